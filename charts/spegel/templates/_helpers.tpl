@@ -63,6 +63,14 @@ app.kubernetes.io/name: {{ include "spegel.name" . }}
 app.kubernetes.io/instance: {{ .Release.Name }}
 {{- end }}
 
+{{/*
+Selector labels of the admission webhook, which differ from the selector labels so that Services of the DaemonSet do not select the webhook
+*/}}
+{{- define "spegel.webhookSelectorLabels" -}}
+app.kubernetes.io/name: {{ include "spegel.name" . }}-webhook
+app.kubernetes.io/instance: {{ .Release.Name }}
+{{- end }}
+
 {{/*
 Create the name of the service account to use
 */}}
@@ -80,3 +88,49 @@ Image reference
 {{- .Values.image.repository }}:{{ .Values.image.tag | default .Chart.AppVersion }}
 {{- end }}
 {{- end }}
+
+{{/*
+Containerd socket and registry config path of the runtime flavor
+*/}}
+{{- define "spegel.runtimePaths" -}}
+{{- if has .Values.spegel.runtimeFlavor (list "k3s" "rke2") }}
+containerdSock: /run/k3s/containerd/containerd.sock
+containerdRegistryConfigPath: {{ printf "/var/lib/rancher/%s/agent/etc/containerd/certs.d" .Values.spegel.runtimeFlavor }}
+{{- else }}
+containerdSock: /run/containerd/containerd.sock
+containerdRegistryConfigPath: /etc/containerd/certs.d
+{{- end }}
+{{- end }}
+
+{{/*
+Containerd socket, the socket of the runtime flavor is used when the default is not changed
+*/}}
+{{- define "spegel.containerdSock" -}}
+{{- if eq .Values.spegel.containerdSock "/run/containerd/containerd.sock" }}
+{{- (include "spegel.runtimePaths" . | fromYaml).containerdSock }}
+{{- else }}
+{{- .Values.spegel.containerdSock }}
+{{- end }}
+{{- end }}
+
+{{/*
+Containerd registry config path, the path of the runtime flavor is used when the default is not changed
+*/}}
+{{- define "spegel.containerdRegistryConfigPath" -}}
+{{- if eq .Values.spegel.containerdRegistryConfigPath "/etc/containerd/certs.d" }}
+{{- (include "spegel.runtimePaths" . | fromYaml).containerdRegistryConfigPath }}
+{{- else }}
+{{- .Values.spegel.containerdRegistryConfigPath }}
+{{- end }}
+{{- end }}
+
+{{/*
+Host IP of the registry formatted for use in addresses, IPv6 addresses are enclosed in brackets
+*/}}
+{{- define "spegel.registryHostIP" -}}
+{{- if contains ":" .Values.service.registry.hostIP }}
+{{- printf "[%s]" .Values.service.registry.hostIP }}
+{{- else }}
+{{- .Values.service.registry.hostIP }}
+{{- end }}
+{{- end }}
@@ -0,0 +1,142 @@
+package allowlist
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// ConfigMapKey is the ConfigMap data key containing the allow list patterns.
+	ConfigMapKey = "allow"
+)
+
+// AllowList decides which images are advertised and mirrored.
+// Images are matched by their registry and repository, for example docker.io/library/nginx.
+// An empty allow list allows all images, images rejected by the filter are never allowed.
+type AllowList struct {
+	mx        sync.RWMutex
+	patterns  []*regexp.Regexp
+	filter    *Filter
+	changedCh chan interface{}
+}
+
+type Option func(*AllowList)
+
+// WithFilter rejects images that are not allowed by the filter regardless of the patterns.
+func WithFilter(filter *Filter) Option {
+	return func(a *AllowList) {
+		a.filter = filter
+	}
+}
+
+func NewAllowList(opts ...Option) *AllowList {
+	a := &AllowList{
+		changedCh: make(chan interface{}, 1),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Parse parses one regular expression per line, empty lines and lines starting with # are ignored.
+// Patterns are anchored so that they have to match the full image name.
+func Parse(s string) ([]*regexp.Regexp, error) {
+	patterns := []*regexp.Regexp{}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", line))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse allow list pattern %s: %w", line, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// Set replaces the patterns and signals a change.
+func (a *AllowList) Set(patterns []*regexp.Regexp) {
+	a.mx.Lock()
+	a.patterns = patterns
+	a.mx.Unlock()
+	select {
+	case a.changedCh <- nil:
+	default:
+	}
+}
+
+// Allowed returns true if the image name is allowed by the filter and matches any of the patterns.
+func (a *AllowList) Allowed(name string) bool {
+	if !a.filter.Allowed(name) {
+		return false
+	}
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	if len(a.patterns) == 0 {
+		return true
+	}
+	for _, re := range a.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Changed returns a channel that receives a value every time the patterns are replaced.
+func (a *AllowList) Changed() <-chan interface{} {
+	return a.changedCh
+}
+
+// Watch keeps the allow list in sync with the ConfigMap until the context is cancelled.
+// Invalid patterns are logged and ignored so that the last valid allow list stays active, deleting the ConfigMap allows all images.
+func Watch(ctx context.Context, cs kubernetes.Interface, namespace, name string, a *AllowList) error {
+	log := logr.FromContextOrDiscard(ctx).WithName("allowlist")
+
+	factory := informers.NewSharedInformerFactoryWithOptions(cs, 0, informers.WithNamespace(namespace), informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+		opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+	}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	update := func(obj interface{}) {
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !ok {
+			return
+		}
+		patterns, err := Parse(cm.Data[ConfigMapKey])
+		if err != nil {
+			log.Error(err, "ignoring invalid allow list", "namespace", namespace, "name", name)
+			return
+		}
+		log.Info("updating allow list", "namespace", namespace, "name", name, "patterns", len(patterns))
+		a.Set(patterns)
+	}
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(oldObj, newObj interface{}) { update(newObj) },
+		DeleteFunc: func(obj interface{}) {
+			log.Info("allow list removed allowing all images", "namespace", namespace, "name", name)
+			a.Set(nil)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	factory.Shutdown()
+	return nil
+}
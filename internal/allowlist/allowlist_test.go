@@ -0,0 +1,107 @@
+package allowlist
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		image    string
+		expected bool
+	}{
+		{
+			name:     "empty allows all",
+			content:  "",
+			image:    "docker.io/library/nginx",
+			expected: true,
+		},
+		{
+			name:     "comments and empty lines ignored",
+			content:  "# comment\n\n",
+			image:    "docker.io/library/nginx",
+			expected: true,
+		},
+		{
+			name:     "matching pattern",
+			content:  "ghcr.io/.+\ndocker\\.io/library/nginx\n",
+			image:    "docker.io/library/nginx",
+			expected: true,
+		},
+		{
+			name:     "pattern is anchored",
+			content:  "docker\\.io/library/nginx",
+			image:    "docker.io/library/nginx-unprivileged",
+			expected: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patterns, err := Parse(tt.content)
+			require.NoError(t, err)
+			a := NewAllowList()
+			a.Set(patterns)
+			require.Equal(t, tt.expected, a.Allowed(tt.image))
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	_, err := Parse("docker.io/(foo\n")
+	require.Error(t, err)
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "allow-list",
+			Namespace: "spegel",
+		},
+		Data: map[string]string{
+			ConfigMapKey: "ghcr.io/.+",
+		},
+	}
+	cs := fake.NewSimpleClientset(cm)
+	a := NewAllowList()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Watch(ctx, cs, "spegel", "allow-list", a)
+	}()
+
+	require.Eventually(t, func() bool {
+		return !a.Allowed("docker.io/library/nginx")
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, a.Allowed("ghcr.io/xenitab/spegel"))
+
+	// Invalid patterns should keep the previous allow list.
+	cm.Data[ConfigMapKey] = "docker.io/(foo"
+	_, err := cs.CoreV1().ConfigMaps("spegel").Update(ctx, cm, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	cm.Data[ConfigMapKey] = "docker\\.io/.+"
+	_, err = cs.CoreV1().ConfigMaps("spegel").Update(ctx, cm, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return a.Allowed("docker.io/library/nginx")
+	}, 5*time.Second, 10*time.Millisecond)
+	require.False(t, a.Allowed("ghcr.io/xenitab/spegel"))
+
+	err = cs.CoreV1().ConfigMaps("spegel").Delete(ctx, "allow-list", metav1.DeleteOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return a.Allowed("ghcr.io/xenitab/spegel")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
@@ -0,0 +1,89 @@
+package allowlist
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RegexPrefix marks a filter pattern as a regular expression instead of a glob.
+const RegexPrefix = "regex:"
+
+// Filter is a static filter of images that are advertised and served to other nodes, independent of which registries are mirrored.
+// Images are matched by their registry and repository in the same way as the allow list.
+type Filter struct {
+	include   []string
+	includeRe []*regexp.Regexp
+	excludeRe []*regexp.Regexp
+}
+
+// NewFilter creates a filter allowing images that match any include pattern and no exclude pattern, all images are included when include is empty.
+// Patterns are globs where * matches any sequence of characters and ? matches a single character, patterns prefixed with regex: are regular expressions.
+func NewFilter(include, exclude []string) (*Filter, error) {
+	f := &Filter{}
+	for _, pattern := range include {
+		expr, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, expr)
+		f.includeRe = append(f.includeRe, regexp.MustCompile(fmt.Sprintf("^(?:%s)$", expr)))
+	}
+	for _, pattern := range exclude {
+		expr, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.excludeRe = append(f.excludeRe, regexp.MustCompile(fmt.Sprintf("^(?:%s)$", expr)))
+	}
+	return f, nil
+}
+
+// compilePattern returns the unanchored regular expression of the pattern.
+func compilePattern(pattern string) (string, error) {
+	expr := ""
+	if strings.HasPrefix(pattern, RegexPrefix) {
+		expr = strings.TrimPrefix(pattern, RegexPrefix)
+	} else {
+		expr = regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+	}
+	if expr == "" {
+		return "", fmt.Errorf("filter pattern cannot be empty")
+	}
+	_, err := regexp.Compile(expr)
+	if err != nil {
+		return "", fmt.Errorf("could not parse filter pattern %s: %w", pattern, err)
+	}
+	return expr, nil
+}
+
+// Include returns the unanchored regular expressions of the include patterns.
+func (f *Filter) Include() []string {
+	if f == nil {
+		return nil
+	}
+	return f.include
+}
+
+// Allowed returns true if the image name is included and not excluded, a nil filter allows all images.
+func (f *Filter) Allowed(name string) bool {
+	if f == nil {
+		return true
+	}
+	for _, re := range f.excludeRe {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(f.includeRe) == 0 {
+		return true
+	}
+	for _, re := range f.includeRe {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package allowlist
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		image    string
+		expected bool
+	}{
+		{
+			name:     "empty allows all",
+			image:    "docker.io/library/nginx",
+			expected: true,
+		},
+		{
+			name:     "glob include",
+			include:  []string{"docker.io/library/*"},
+			image:    "docker.io/library/nginx",
+			expected: true,
+		},
+		{
+			name:     "glob is anchored",
+			include:  []string{"docker.io/library/*"},
+			image:    "mirror.docker.io/library/nginx",
+			expected: false,
+		},
+		{
+			name:     "glob matches literal dots",
+			include:  []string{"docker.io/library/nginx"},
+			image:    "dockerxio/library/nginx",
+			expected: false,
+		},
+		{
+			name:     "regex include",
+			include:  []string{`regex:ghcr\.io/(foo|bar)/.+`},
+			image:    "ghcr.io/bar/app",
+			expected: true,
+		},
+		{
+			name:     "exclude takes precedence",
+			include:  []string{"ghcr.io/*"},
+			exclude:  []string{"ghcr.io/internal/*"},
+			image:    "ghcr.io/internal/secret",
+			expected: false,
+		},
+		{
+			name:     "exclude without include",
+			exclude:  []string{"*/internal/*"},
+			image:    "docker.io/library/nginx",
+			expected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewFilter(tt.include, tt.exclude)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, f.Allowed(tt.image))
+		})
+	}
+}
+
+func TestFilterInvalid(t *testing.T) {
+	_, err := NewFilter([]string{"regex:docker.io/(foo"}, nil)
+	require.Error(t, err)
+	_, err = NewFilter(nil, []string{""})
+	require.Error(t, err)
+}
+
+func TestAllowListFilter(t *testing.T) {
+	f, err := NewFilter(nil, []string{"ghcr.io/internal/*"})
+	require.NoError(t, err)
+	a := NewAllowList(WithFilter(f))
+	require.True(t, a.Allowed("ghcr.io/public/app"))
+	require.False(t, a.Allowed("ghcr.io/internal/app"))
+	a.Set([]*regexp.Regexp{regexp.MustCompile(`^ghcr\.io/.+$`)})
+	require.False(t, a.Allowed("ghcr.io/internal/app"))
+	require.False(t, a.Allowed("docker.io/library/nginx"))
+}
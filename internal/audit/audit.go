@@ -0,0 +1,246 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// Max amount of records waiting to be exported, records are dropped when the buffer is full.
+	recordBufferSize = 1000
+	// Max amount of records sent in a single export request.
+	maxBatchSize = 100
+)
+
+var droppedRecordsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "spegel_audit_records_dropped_total",
+	Help: "Total number of audit records dropped because the export buffer was full.",
+})
+
+// Record describes a single access to the registry.
+type Record struct {
+	Time     time.Time
+	Handler  string
+	Method   string
+	Path     string
+	Registry string
+	Status   int
+	Bytes    int
+	ClientIP string
+	Duration time.Duration
+}
+
+// OTLPExporter sends audit records as OTLP logs over HTTP with JSON encoding.
+// Records are batched and sent at the interval or when a full batch is available.
+type OTLPExporter struct {
+	client   *http.Client
+	endpoint string
+	headers  map[string]string
+	interval time.Duration
+	hostname string
+	recordCh chan Record
+}
+
+func NewOTLPExporter(endpoint string, headers map[string]string, interval time.Duration) (*OTLPExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse otlp endpoint: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("otlp endpoint %s has to contain a scheme and host", endpoint)
+	}
+	// Like the OTLP exporters logs are sent to /v1/logs when only the collector address is set, other paths are used as is.
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/logs"
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &OTLPExporter{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		endpoint: u.String(),
+		headers:  headers,
+		interval: interval,
+		hostname: hostname,
+		recordCh: make(chan Record, recordBufferSize),
+	}, nil
+}
+
+// Export queues the record without blocking the request being handled.
+func (e *OTLPExporter) Export(rec Record) {
+	select {
+	case e.recordCh <- rec:
+	default:
+		droppedRecordsTotal.Inc()
+	}
+}
+
+// Run sends queued records until the context is cancelled, remaining records are sent before returning.
+func (e *OTLPExporter) Run(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx).WithName("audit")
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	batch := []Record{}
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		err := e.send(ctx, batch)
+		if err != nil {
+			log.Error(err, "could not export audit records", "count", len(batch))
+		}
+		batch = []Record{}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			// Context has been cancelled at this point so a new context is created to send the remaining records.
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			for len(e.recordCh) > 0 {
+				batch = append(batch, <-e.recordCh)
+				if len(batch) >= maxBatchSize {
+					flush(shutdownCtx)
+				}
+			}
+			flush(shutdownCtx)
+			return nil
+		case <-ticker.C:
+			flush(ctx)
+		case rec := <-e.recordCh:
+			batch = append(batch, rec)
+			if len(batch) >= maxBatchSize {
+				flush(ctx)
+			}
+		}
+	}
+}
+
+func (e *OTLPExporter) send(ctx context.Context, records []Record) error {
+	b, err := json.Marshal(e.request(records))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("expected otlp endpoint to respond with 200 OK but received: %s", resp.Status)
+	}
+	return nil
+}
+
+// The types below implement the subset of the OTLP JSON encoding required for logs.
+// Integers are encoded as strings as required by the protobuf JSON mapping of 64 bit values.
+
+type exportLogsRequest struct {
+	ResourceLogs []resourceLogs `json:"resourceLogs"`
+}
+
+type resourceLogs struct {
+	Resource  resource    `json:"resource"`
+	ScopeLogs []scopeLogs `json:"scopeLogs"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeLogs struct {
+	Scope      scope       `json:"scope"`
+	LogRecords []logRecord `json:"logRecords"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type logRecord struct {
+	TimeUnixNano   string     `json:"timeUnixNano"`
+	SeverityNumber int        `json:"severityNumber"`
+	SeverityText   string     `json:"severityText"`
+	Body           anyValue   `json:"body"`
+	Attributes     []keyValue `json:"attributes"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func stringValue(v string) anyValue {
+	return anyValue{StringValue: &v}
+}
+
+func intValue(v int64) anyValue {
+	s := strconv.FormatInt(v, 10)
+	return anyValue{IntValue: &s}
+}
+
+func (e *OTLPExporter) request(records []Record) exportLogsRequest {
+	logRecords := []logRecord{}
+	for _, rec := range records {
+		logRecords = append(logRecords, logRecord{
+			TimeUnixNano: strconv.FormatInt(rec.Time.UnixNano(), 10),
+			// Severity number 9 is INFO in the OTLP log data model.
+			SeverityNumber: 9,
+			SeverityText:   "INFO",
+			Body:           stringValue("registry access"),
+			Attributes: []keyValue{
+				{Key: "spegel.handler", Value: stringValue(rec.Handler)},
+				{Key: "spegel.registry", Value: stringValue(rec.Registry)},
+				{Key: "http.request.method", Value: stringValue(rec.Method)},
+				{Key: "url.path", Value: stringValue(rec.Path)},
+				{Key: "http.response.status_code", Value: intValue(int64(rec.Status))},
+				{Key: "http.response.body.size", Value: intValue(int64(rec.Bytes))},
+				{Key: "client.address", Value: stringValue(rec.ClientIP)},
+				{Key: "spegel.duration_ms", Value: intValue(rec.Duration.Milliseconds())},
+			},
+		})
+	}
+	return exportLogsRequest{
+		ResourceLogs: []resourceLogs{
+			{
+				Resource: resource{
+					Attributes: []keyValue{
+						{Key: "service.name", Value: stringValue("spegel")},
+						{Key: "host.name", Value: stringValue(e.hostname)},
+					},
+				},
+				ScopeLogs: []scopeLogs{
+					{
+						Scope:      scope{Name: "github.com/xenitab/spegel/internal/audit"},
+						LogRecords: logRecords,
+					},
+				},
+			},
+		},
+	}
+}
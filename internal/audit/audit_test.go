@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	// Requests are asserted in the test goroutine as require can not be used in the handler goroutine.
+	httpReqCh := make(chan *http.Request, 10)
+	reqCh := make(chan exportLogsRequest, 10)
+	errCh := make(chan error, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := exportLogsRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			errCh <- err
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		httpReqCh <- r
+		reqCh <- req
+	}))
+	defer srv.Close()
+
+	exporter, err := NewOTLPExporter(srv.URL, map[string]string{"Authorization": "Bearer foo"}, time.Hour)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	runErrCh := make(chan error, 1)
+	go func() {
+		runErrCh <- exporter.Run(ctx)
+	}()
+	exporter.Export(Record{
+		Time:     time.Unix(0, 1000),
+		Handler:  "mirror",
+		Method:   http.MethodGet,
+		Path:     "/v2/library/ubuntu/manifests/22.04",
+		Registry: "docker.io",
+		Status:   http.StatusOK,
+		Bytes:    10,
+		ClientIP: "10.0.0.1",
+		Duration: time.Second,
+	})
+	// Records are sent on shutdown even if the interval has not passed.
+	cancel()
+	require.NoError(t, <-runErrCh)
+	require.Empty(t, errCh)
+
+	httpReq := <-httpReqCh
+	require.Equal(t, "/v1/logs", httpReq.URL.Path)
+	require.Equal(t, "application/json", httpReq.Header.Get("Content-Type"))
+	require.Equal(t, "Bearer foo", httpReq.Header.Get("Authorization"))
+	req := <-reqCh
+	require.Len(t, req.ResourceLogs, 1)
+	require.Equal(t, "service.name", req.ResourceLogs[0].Resource.Attributes[0].Key)
+	require.Equal(t, "spegel", *req.ResourceLogs[0].Resource.Attributes[0].Value.StringValue)
+	logRecords := req.ResourceLogs[0].ScopeLogs[0].LogRecords
+	require.Len(t, logRecords, 1)
+	require.Equal(t, "1000", logRecords[0].TimeUnixNano)
+	attrs := map[string]anyValue{}
+	for _, kv := range logRecords[0].Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	require.Equal(t, "mirror", *attrs["spegel.handler"].StringValue)
+	require.Equal(t, "docker.io", *attrs["spegel.registry"].StringValue)
+	require.Equal(t, "200", *attrs["http.response.status_code"].IntValue)
+	require.Equal(t, "1000", *attrs["spegel.duration_ms"].IntValue)
+}
+
+func TestNewOTLPExporterEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		expected string
+	}{
+		{endpoint: "http://localhost:4318", expected: "http://localhost:4318/v1/logs"},
+		{endpoint: "http://localhost:4318/", expected: "http://localhost:4318/v1/logs"},
+		{endpoint: "https://collector.example.com/otlp/v1/logs", expected: "https://collector.example.com/otlp/v1/logs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			exporter, err := NewOTLPExporter(tt.endpoint, nil, time.Second)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, exporter.endpoint)
+		})
+	}
+}
+
+func TestNewOTLPExporterInvalidEndpoint(t *testing.T) {
+	_, err := NewOTLPExporter("localhost:4318", nil, time.Second)
+	require.Error(t, err)
+}
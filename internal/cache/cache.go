@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+type Entry struct {
+	Data      []byte
+	MediaType string
+}
+
+type item struct {
+	key   string
+	entry Entry
+}
+
+// LRU is a least recently used cache bounded by the total size of the cached data.
+type LRU struct {
+	mx      sync.Mutex
+	maxSize int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+}
+
+func NewLRU(maxSize int64) *LRU {
+	return &LRU{
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   map[string]*list.Element{},
+	}
+}
+
+func (l *LRU) Get(key string) (Entry, bool) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	el, ok := l.items[key]
+	if !ok {
+		return Entry{}, false
+	}
+	l.ll.MoveToFront(el)
+	return el.Value.(*item).entry, true
+}
+
+// Add stores the entry evicting the least recently used entries until it fits.
+// Entries larger than the max size are never stored.
+func (l *LRU) Add(key string, entry Entry) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	size := int64(len(entry.Data))
+	if size > l.maxSize {
+		return
+	}
+	if el, ok := l.items[key]; ok {
+		l.size -= int64(len(el.Value.(*item).entry.Data))
+		el.Value.(*item).entry = entry
+		l.size += size
+		l.ll.MoveToFront(el)
+	} else {
+		l.items[key] = l.ll.PushFront(&item{key: key, entry: entry})
+		l.size += size
+	}
+	for l.size > l.maxSize {
+		el := l.ll.Back()
+		it := el.Value.(*item)
+		l.ll.Remove(el)
+		delete(l.items, it.key)
+		l.size -= int64(len(it.entry.Data))
+	}
+}
+
+func (l *LRU) Len() int {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return l.ll.Len()
+}
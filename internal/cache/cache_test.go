@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRU(t *testing.T) {
+	l := NewLRU(10)
+	l.Add("a", Entry{Data: []byte("aaaa")})
+	l.Add("b", Entry{Data: []byte("bbbb"), MediaType: "foo"})
+	require.Equal(t, 2, l.Len())
+
+	// Access a so that b becomes least recently used.
+	_, ok := l.Get("a")
+	require.True(t, ok)
+	l.Add("c", Entry{Data: []byte("cccc")})
+	require.Equal(t, 2, l.Len())
+	_, ok = l.Get("b")
+	require.False(t, ok)
+	_, ok = l.Get("a")
+	require.True(t, ok)
+
+	// Too large entries should not be stored.
+	l.Add("d", Entry{Data: []byte("ddddddddddd")})
+	_, ok = l.Get("d")
+	require.False(t, ok)
+	require.Equal(t, 2, l.Len())
+
+	// Updating an entry should replace its size.
+	l.Add("a", Entry{Data: []byte("a")})
+	entry, ok := l.Get("a")
+	require.True(t, ok)
+	require.Equal(t, []byte("a"), entry.Data)
+	l.Add("e", Entry{Data: []byte("eeeee")})
+	require.Equal(t, 3, l.Len())
+}
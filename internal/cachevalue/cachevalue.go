@@ -0,0 +1,207 @@
+package cachevalue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/xenitab/spegel/internal/allowlist"
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+const (
+	// KeysAnnotation is the number of distinct digests stored on the node.
+	KeysAnnotation = "spegel.dev/keys"
+	// UniqueKeysAnnotation is the number of distinct digests stored on the node that no other node provides.
+	UniqueKeysAnnotation = "spegel.dev/unique-keys"
+	// ScaleDownDisabledAnnotation prevents the cluster autoscaler from removing the node.
+	ScaleDownDisabledAnnotation = "cluster-autoscaler.kubernetes.io/scale-down-disabled"
+	// protectedAnnotation marks that scale down was disabled by Spegel, so that the annotation is never removed when set by someone else.
+	protectedAnnotation = "spegel.dev/scale-down-protected"
+)
+
+// Max amount of keys resolved in parallel when measuring.
+const resolveConcurrency = 8
+
+var cacheKeys = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "spegel_cache_keys",
+		Help: "Number of distinct digests stored on the node when the cache value was last measured.",
+	},
+)
+
+var cacheUniqueKeys = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "spegel_cache_unique_keys",
+		Help: "Number of distinct digests stored on the node that no other node provides, removing the node would make them unavailable from peers.",
+	},
+)
+
+// Value describes how much of the content of the node cannot be pulled from any other node.
+type Value struct {
+	Keys       int
+	UniqueKeys int
+}
+
+// Measure resolves every digest of the allowed images and counts the digests that are not provided by any other node.
+// Digests that cannot be resolved to another node within the timeout are considered unique.
+func Measure(ctx context.Context, ociClient oci.Client, router routing.Router, allowList *allowlist.AllowList, timeout time.Duration) (Value, error) {
+	imgs, err := ociClient.ListImages(ctx)
+	if err != nil {
+		return Value{}, err
+	}
+	keys := []string{}
+	seen := map[string]interface{}{}
+	for _, img := range imgs {
+		if !allowList.Allowed(fmt.Sprintf("%s/%s", img.Registry, img.Repository)) {
+			continue
+		}
+		dgsts, err := ociClient.GetImageDigests(ctx, img)
+		if err != nil {
+			return Value{}, err
+		}
+		for _, dgst := range dgsts {
+			if _, ok := seen[dgst]; ok {
+				continue
+			}
+			seen[dgst] = nil
+			keys = append(keys, dgst)
+		}
+	}
+
+	mx := sync.Mutex{}
+	value := Value{Keys: len(keys)}
+	keyCh := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < resolveConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keyCh {
+				if !hasOtherProvider(ctx, router, key, timeout) {
+					mx.Lock()
+					value.UniqueKeys++
+					mx.Unlock()
+				}
+			}
+		}()
+	}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		keyCh <- key
+	}
+	close(keyCh)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return Value{}, ctx.Err()
+	}
+	return value, nil
+}
+
+func hasOtherProvider(ctx context.Context, router routing.Router, key string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	peerCh, err := router.Resolve(ctx, key, false, 1)
+	if err != nil {
+		return false
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case _, ok := <-peerCh:
+		return ok
+	}
+}
+
+// Annotator sets the cache value as annotations on the node so that it can be used when choosing nodes to remove.
+type Annotator struct {
+	cs                 kubernetes.Interface
+	nodeName           string
+	scaleDownThreshold int
+}
+
+// NewAnnotator creates an annotator for the node, scale down is disabled while the node has at least the threshold of unique keys.
+// The scale down annotation is never managed when the threshold is zero.
+func NewAnnotator(cs kubernetes.Interface, nodeName string, scaleDownThreshold int) *Annotator {
+	return &Annotator{
+		cs:                 cs,
+		nodeName:           nodeName,
+		scaleDownThreshold: scaleDownThreshold,
+	}
+}
+
+// Annotate updates the annotations of the node with the value.
+func (a *Annotator) Annotate(ctx context.Context, value Value) error {
+	node, err := a.cs.CoreV1().Nodes().Get(ctx, a.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	annotations := map[string]interface{}{
+		KeysAnnotation:       strconv.Itoa(value.Keys),
+		UniqueKeysAnnotation: strconv.Itoa(value.UniqueKeys),
+	}
+	if a.scaleDownThreshold > 0 {
+		_, protected := node.Annotations[protectedAnnotation]
+		_, disabled := node.Annotations[ScaleDownDisabledAnnotation]
+		switch {
+		case value.UniqueKeys >= a.scaleDownThreshold && !disabled:
+			annotations[ScaleDownDisabledAnnotation] = "true"
+			annotations[protectedAnnotation] = "true"
+		case value.UniqueKeys < a.scaleDownThreshold && protected:
+			annotations[ScaleDownDisabledAnnotation] = nil
+			annotations[protectedAnnotation] = nil
+		}
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.cs.CoreV1().Nodes().Patch(ctx, a.nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// Run measures the cache value at every interval until the context is cancelled, the node is annotated when the annotator is not nil.
+func Run(ctx context.Context, ociClient oci.Client, router routing.Router, allowList *allowlist.AllowList, interval, timeout time.Duration, annotator *Annotator) {
+	log := logr.FromContextOrDiscard(ctx).WithName("cachevalue")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			value, err := Measure(ctx, ociClient, router, allowList, timeout)
+			if err != nil {
+				log.Error(err, "could not measure cache value")
+				continue
+			}
+			cacheKeys.Set(float64(value.Keys))
+			cacheUniqueKeys.Set(float64(value.UniqueKeys))
+			log.V(5).Info("measured cache value", "keys", value.Keys, "uniqueKeys", value.UniqueKeys)
+			if annotator == nil {
+				continue
+			}
+			err = annotator.Annotate(ctx, value)
+			if err != nil {
+				log.Error(err, "could not annotate node with cache value")
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package cachevalue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/xenitab/spegel/internal/allowlist"
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestMeasure(t *testing.T) {
+	imgs := []oci.Image{}
+	for _, s := range []string{
+		"docker.io/library/ubuntu:22.04@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+		"docker.io/library/ubuntu:latest@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+		"ghcr.io/foo/alpine:3.18@sha256:c5c5fda71656f28e49ac9c5416b3643eaa6a108a8093151d6d1afc39463be786",
+		"ghcr.io/foo/bar:1.0@sha256:44cb2cf712c060f69df7310e99339c1eb51a085446f1bb6d44469acff35b4355",
+	} {
+		img, err := oci.Parse(s, "")
+		require.NoError(t, err)
+		imgs = append(imgs, img)
+	}
+	router := routing.NewMockRouter(map[string][]string{
+		"sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020": {"http://10.0.0.2:5000"},
+	})
+	value, err := Measure(context.Background(), oci.NewMockClient(imgs), router, allowlist.NewAllowList(), 50*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, Value{Keys: 3, UniqueKeys: 2}, value)
+
+	filter, err := allowlist.NewFilter(nil, []string{"ghcr.io/foo/bar"})
+	require.NoError(t, err)
+	value, err = Measure(context.Background(), oci.NewMockClient(imgs), router, allowlist.NewAllowList(allowlist.WithFilter(filter)), 50*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, Value{Keys: 2, UniqueKeys: 1}, value)
+}
+
+func TestAnnotate(t *testing.T) {
+	ctx := context.Background()
+	cs := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "foo"}})
+	a := NewAnnotator(cs, "foo", 10)
+
+	err := a.Annotate(ctx, Value{Keys: 20, UniqueKeys: 10})
+	require.NoError(t, err)
+	node, err := cs.CoreV1().Nodes().Get(ctx, "foo", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "20", node.Annotations[KeysAnnotation])
+	require.Equal(t, "10", node.Annotations[UniqueKeysAnnotation])
+	require.Equal(t, "true", node.Annotations[ScaleDownDisabledAnnotation])
+
+	err = a.Annotate(ctx, Value{Keys: 20, UniqueKeys: 1})
+	require.NoError(t, err)
+	node, err = cs.CoreV1().Nodes().Get(ctx, "foo", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "1", node.Annotations[UniqueKeysAnnotation])
+	require.NotContains(t, node.Annotations, ScaleDownDisabledAnnotation)
+	require.NotContains(t, node.Annotations, protectedAnnotation)
+}
+
+func TestAnnotateKeepsExistingScaleDownDisabled(t *testing.T) {
+	ctx := context.Background()
+	cs := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "foo", Annotations: map[string]string{ScaleDownDisabledAnnotation: "true"}}})
+	a := NewAnnotator(cs, "foo", 10)
+	for _, uniqueKeys := range []int{20, 1} {
+		err := a.Annotate(ctx, Value{Keys: 20, UniqueKeys: uniqueKeys})
+		require.NoError(t, err)
+		node, err := cs.CoreV1().Nodes().Get(ctx, "foo", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "true", node.Annotations[ScaleDownDisabledAnnotation])
+		require.NotContains(t, node.Annotations, protectedAnnotation)
+	}
+}
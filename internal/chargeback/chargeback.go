@@ -0,0 +1,259 @@
+package chargeback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// OtherRepository aggregates the bytes of repositories once the max amount of repositories within an hour has been reached.
+	OtherRepository = "_other"
+	// UnassignedTeam is the team of repositories that do not match any team mapping.
+	UnassignedTeam = "unassigned"
+)
+
+// Record is the amount of bytes served for a repository within an hour.
+type Record struct {
+	Hour       time.Time `json:"hour"`
+	Repository string    `json:"repository"`
+	Team       string    `json:"team,omitempty"`
+	Bytes      int64     `json:"bytes"`
+}
+
+// Ledger aggregates the bytes served to peers per repository and hour, and persists them to a file so that they survive restarts.
+// Memory and file size are bounded by the retention and the max amount of repositories tracked per hour.
+type Ledger struct {
+	mx              sync.Mutex
+	path            string
+	retention       time.Duration
+	maxRepositories int
+	teams           map[string]string
+	hours           map[time.Time]map[string]int64
+	dirty           bool
+}
+
+// NewLedger creates a ledger persisted to the path, records already persisted to the path are loaded.
+func NewLedger(path string, retention time.Duration, maxRepositories int) (*Ledger, error) {
+	if retention < time.Hour {
+		return nil, fmt.Errorf("chargeback retention has to be at least one hour")
+	}
+	if maxRepositories < 1 {
+		return nil, fmt.Errorf("chargeback max repositories has to be larger than zero")
+	}
+	l := &Ledger{
+		path:            path,
+		retention:       retention,
+		maxRepositories: maxRepositories,
+		teams:           map[string]string{},
+		hours:           map[time.Time]map[string]int64{},
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	records := []Record{}
+	err = json.Unmarshal(b, &records)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse chargeback records %s: %w", path, err)
+	}
+	// Records are restored as is, as the max amount of repositories was already applied when they were added.
+	for _, record := range records {
+		hour := record.Hour.UTC().Truncate(time.Hour)
+		if _, ok := l.hours[hour]; !ok {
+			l.hours[hour] = map[string]int64{}
+		}
+		l.hours[hour][record.Repository] += record.Bytes
+	}
+	l.prune(time.Now())
+	l.dirty = false
+	return l, nil
+}
+
+// SetTeams replaces the mapping of repositories to teams. Keys are repositories including the registry,
+// or a prefix of path components, and the longest matching key is used. Records are mapped when read,
+// so changes to the mapping also apply to bytes served before the change.
+func (l *Ledger) SetTeams(teams map[string]string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.teams = map[string]string{}
+	for k, v := range teams {
+		l.teams[strings.TrimSuffix(k, "/")] = v
+	}
+}
+
+// Add records the bytes served for the repository in the current hour.
+func (l *Ledger) Add(repository string, n int64) {
+	if n <= 0 {
+		return
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.add(time.Now(), repository, n)
+}
+
+func (l *Ledger) add(t time.Time, repository string, n int64) {
+	hour := t.UTC().Truncate(time.Hour)
+	repositories, ok := l.hours[hour]
+	if !ok {
+		repositories = map[string]int64{}
+		l.hours[hour] = repositories
+	}
+	if _, ok := repositories[repository]; !ok && len(repositories) >= l.maxRepositories {
+		repository = OtherRepository
+	}
+	repositories[repository] += n
+	l.dirty = true
+}
+
+// Records returns the records of the hours within the range sorted by hour and repository, a zero time does not limit the range.
+func (l *Ledger) Records(since, until time.Time) []Record {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	records := []Record{}
+	for hour, repositories := range l.hours {
+		if !since.IsZero() && hour.Before(since.UTC().Truncate(time.Hour)) {
+			continue
+		}
+		if !until.IsZero() && !hour.Before(until) {
+			continue
+		}
+		for repository, n := range repositories {
+			records = append(records, Record{Hour: hour, Repository: repository, Team: l.team(repository), Bytes: n})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].Hour.Equal(records[j].Hour) {
+			return records[i].Hour.Before(records[j].Hour)
+		}
+		return records[i].Repository < records[j].Repository
+	})
+	return records
+}
+
+func (l *Ledger) team(repository string) string {
+	for p := repository; p != ""; {
+		if team, ok := l.teams[p]; ok {
+			return team
+		}
+		i := strings.LastIndex(p, "/")
+		if i == -1 {
+			break
+		}
+		p = p[:i]
+	}
+	return UnassignedTeam
+}
+
+func (l *Ledger) prune(now time.Time) {
+	for hour := range l.hours {
+		if now.Sub(hour) <= l.retention {
+			continue
+		}
+		delete(l.hours, hour)
+		l.dirty = true
+	}
+}
+
+// Save removes hours older than the retention and writes the records to the file if they have changed.
+// The file is replaced atomically so that a crash never leaves a partially written file.
+func (l *Ledger) Save() error {
+	l.mx.Lock()
+	l.prune(time.Now())
+	if !l.dirty {
+		l.mx.Unlock()
+		return nil
+	}
+	l.dirty = false
+	l.mx.Unlock()
+	records := l.Records(time.Time{}, time.Time{})
+	for i := range records {
+		records[i].Team = ""
+	}
+	err := l.write(records)
+	if err != nil {
+		l.mx.Lock()
+		l.dirty = true
+		l.mx.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (l *Ledger) write(records []Record) error {
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), l.path)
+}
+
+// Run saves the records at every interval until the context is cancelled, when the records are saved a last time.
+func (l *Ledger) Run(ctx context.Context, interval time.Duration) {
+	log := logr.FromContextOrDiscard(ctx).WithName("chargeback")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			err := l.Save()
+			if err != nil {
+				log.Error(err, "could not save chargeback records")
+			}
+			return
+		case <-ticker.C:
+			err := l.Save()
+			if err != nil {
+				log.Error(err, "could not save chargeback records")
+			}
+		}
+	}
+}
+
+// ServeHTTP returns the records as JSON, optionally limited to the hours within the RFC 3339 since and until query parameters.
+func (l *Ledger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	times := []time.Time{}
+	for _, k := range []string{"since", "until"} {
+		v := req.URL.Query().Get(k)
+		if v == "" {
+			times = append(times, time.Time{})
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not parse %s: %v", k, err), http.StatusBadRequest)
+			return
+		}
+		times = append(times, t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	//nolint:errcheck // ignore
+	json.NewEncoder(w).Encode(l.Records(times[0], times[1]))
+}
@@ -0,0 +1,112 @@
+package chargeback
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLedger(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "chargeback.json")
+	l, err := NewLedger(p, 24*time.Hour, 2)
+	require.NoError(t, err)
+	l.SetTeams(map[string]string{
+		"ghcr.io/xenitab/":       "platform",
+		"ghcr.io/xenitab/spegel": "spegel",
+		"docker.io":              "public",
+	})
+
+	l.Add("ghcr.io/xenitab/spegel", 10)
+	l.Add("ghcr.io/xenitab/spegel", 5)
+	l.Add("ghcr.io/xenitab/foo", 1)
+	l.Add("docker.io/library/ubuntu", 2)
+	l.Add("quay.io/foo", 0)
+	hour := time.Now().UTC().Truncate(time.Hour)
+	// Hours older than the retention are pruned when saved.
+	l.add(hour.Add(-48*time.Hour), "ghcr.io/xenitab/spegel", 100)
+
+	records := l.Records(hour, time.Time{})
+	expected := []Record{
+		{Hour: hour, Repository: OtherRepository, Team: UnassignedTeam, Bytes: 2},
+		{Hour: hour, Repository: "ghcr.io/xenitab/foo", Team: "platform", Bytes: 1},
+		{Hour: hour, Repository: "ghcr.io/xenitab/spegel", Team: "spegel", Bytes: 15},
+	}
+	require.Equal(t, expected, records)
+	require.Len(t, l.Records(time.Time{}, time.Time{}), 4)
+	require.Len(t, l.Records(time.Time{}, hour.Add(-47*time.Hour)), 1)
+
+	err = l.Save()
+	require.NoError(t, err)
+	b, err := os.ReadFile(p)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "team")
+
+	// Persisted records are loaded and mapped with the current teams.
+	l, err = NewLedger(p, 24*time.Hour, 2)
+	require.NoError(t, err)
+	l.SetTeams(map[string]string{"ghcr.io": "all"})
+	records = l.Records(time.Time{}, time.Time{})
+	require.Len(t, records, 3)
+	for _, record := range records {
+		if record.Repository == OtherRepository {
+			require.Equal(t, UnassignedTeam, record.Team)
+			continue
+		}
+		require.Equal(t, "all", record.Team)
+	}
+}
+
+func TestNewLedgerValidation(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "chargeback.json")
+	_, err := NewLedger(p, time.Minute, 1)
+	require.EqualError(t, err, "chargeback retention has to be at least one hour")
+	_, err = NewLedger(p, time.Hour, 0)
+	require.EqualError(t, err, "chargeback max repositories has to be larger than zero")
+	err = os.WriteFile(p, []byte("foo"), 0o644)
+	require.NoError(t, err)
+	_, err = NewLedger(p, time.Hour, 1)
+	require.Error(t, err)
+}
+
+func TestRun(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "chargeback.json")
+	l, err := NewLedger(p, time.Hour, 1)
+	require.NoError(t, err)
+	l.Add("docker.io/library/ubuntu", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.Run(ctx, time.Hour)
+	_, err = os.Stat(p)
+	require.NoError(t, err)
+}
+
+func TestServeHTTP(t *testing.T) {
+	l, err := NewLedger(filepath.Join(t.TempDir(), "chargeback.json"), time.Hour, 10)
+	require.NoError(t, err)
+	l.Add("docker.io/library/ubuntu", 1)
+
+	rw := httptest.NewRecorder()
+	l.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/chargeback", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+	records := []Record{}
+	err = json.Unmarshal(rw.Body.Bytes(), &records)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, UnassignedTeam, records[0].Team)
+
+	rw = httptest.NewRecorder()
+	l.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/chargeback?until=2000-01-01T00:00:00Z", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, "[]\n", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	l.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/chargeback?since=foo", nil))
+	require.Equal(t, http.StatusBadRequest, rw.Code)
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Config contains the options that can be set through a configuration file.
+// Fields that are not set in the file keep the value given by flags.
+type Config struct {
+	Registries             []string          `json:"registries,omitempty"`
+	MirrorRegistries       []string          `json:"mirrorRegistries,omitempty"`
+	ResolveTags            *bool             `json:"resolveTags,omitempty"`
+	RegistryResolveTags    map[string]bool   `json:"registryResolveTags,omitempty"`
+	RegistryServers        map[string]string `json:"registryServers,omitempty"`
+	ResolveLatestTag       *bool             `json:"resolveLatestTag,omitempty"`
+	MirrorResolveRetries   *int              `json:"mirrorResolveRetries,omitempty"`
+	MirrorResolveTimeout   *metav1.Duration  `json:"mirrorResolveTimeout,omitempty"`
+	RouterKeySchemas       []string          `json:"routerKeySchemas,omitempty"`
+	ChargebackTeams        map[string]string `json:"chargebackTeams,omitempty"`
+	ContainerdImageFilters []string          `json:"containerdImageFilters,omitempty"`
+}
+
+// Load reads and parses the configuration file at the path.
+func Load(p string) (Config, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return Config{}, err
+	}
+	return Parse(b)
+}
+
+func Parse(b []byte) (Config, error) {
+	cfg := Config{}
+	err := yaml.UnmarshalStrict(b, &cfg)
+	if err != nil {
+		return Config{}, fmt.Errorf("could not parse configuration: %w", err)
+	}
+	_, err = ParseURLs(cfg.Registries)
+	if err != nil {
+		return Config{}, err
+	}
+	_, err = ParseURLs(cfg.MirrorRegistries)
+	if err != nil {
+		return Config{}, err
+	}
+	if cfg.MirrorResolveRetries != nil && *cfg.MirrorResolveRetries < 1 {
+		return Config{}, fmt.Errorf("mirror resolve retries has to be larger than zero")
+	}
+	if cfg.MirrorResolveTimeout != nil && cfg.MirrorResolveTimeout.Duration <= 0 {
+		return Config{}, fmt.Errorf("mirror resolve timeout has to be larger than zero")
+	}
+	return cfg, nil
+}
+
+func ParseURLs(urls []string) ([]url.URL, error) {
+	parsed := []url.URL{}
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse registry url %s: %w", s, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("registry url %s has to contain a scheme and host", s)
+		}
+		parsed = append(parsed, *u)
+	}
+	return parsed, nil
+}
+
+// Watch calls the function with the new configuration every time the file at the path changes until the context is cancelled.
+// The parent directory is watched as a mounted ConfigMap is updated by swapping a symlink rather than writing to the file.
+// Invalid configuration is logged and ignored so that the last valid configuration stays active.
+// Receiving SIGHUP reloads the configuration even if the file has not changed.
+func Watch(ctx context.Context, p string, fn func(Config)) error {
+	log := logr.FromContextOrDiscard(ctx).WithName("config")
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	err = watcher.Add(filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+	last, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+	for {
+		force := false
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			log.Error(err, "configuration watcher error")
+			continue
+		case <-watcher.Events:
+		case <-hupCh:
+			force = true
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			log.Error(err, "could not read configuration", "path", p)
+			continue
+		}
+		if !force && string(b) == string(last) {
+			continue
+		}
+		last = b
+		cfg, err := Parse(b)
+		if err != nil {
+			log.Error(err, "ignoring invalid configuration", "path", p)
+			continue
+		}
+		log.Info("reloading configuration", "path", p)
+		fn(cfg)
+	}
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		expectedError bool
+		expected      func(t *testing.T, cfg Config)
+	}{
+		{
+			name: "all fields",
+			content: `registries:
+  - https://docker.io
+  - https://ghcr.io
+mirrorRegistries:
+  - http://127.0.0.1:5000
+resolveTags: false
+registryResolveTags:
+  internal.corp: true
+registryServers:
+  registry.corp: https://corp.jfrog.io
+resolveLatestTag: false
+mirrorResolveRetries: 5
+mirrorResolveTimeout: 2s
+routerKeySchemas:
+  - v1
+chargebackTeams:
+  ghcr.io/xenitab: platform
+containerdImageFilters:
+  - labels."ci.scratch"!=true
+`,
+			expected: func(t *testing.T, cfg Config) {
+				require.Equal(t, []string{"https://docker.io", "https://ghcr.io"}, cfg.Registries)
+				require.Equal(t, []string{"http://127.0.0.1:5000"}, cfg.MirrorRegistries)
+				require.False(t, *cfg.ResolveTags)
+				require.Equal(t, map[string]bool{"internal.corp": true}, cfg.RegistryResolveTags)
+				require.Equal(t, map[string]string{"registry.corp": "https://corp.jfrog.io"}, cfg.RegistryServers)
+				require.False(t, *cfg.ResolveLatestTag)
+				require.Equal(t, 5, *cfg.MirrorResolveRetries)
+				require.Equal(t, 2*time.Second, cfg.MirrorResolveTimeout.Duration)
+				require.Equal(t, []string{"v1"}, cfg.RouterKeySchemas)
+				require.Equal(t, map[string]string{"ghcr.io/xenitab": "platform"}, cfg.ChargebackTeams)
+				require.Equal(t, []string{`labels."ci.scratch"!=true`}, cfg.ContainerdImageFilters)
+			},
+		},
+		{
+			name:    "unset fields",
+			content: "resolveLatestTag: true\n",
+			expected: func(t *testing.T, cfg Config) {
+				require.Empty(t, cfg.Registries)
+				require.Nil(t, cfg.ResolveTags)
+				require.Nil(t, cfg.MirrorResolveTimeout)
+				require.True(t, *cfg.ResolveLatestTag)
+			},
+		},
+		{
+			name:          "unknown field",
+			content:       "foo: bar\n",
+			expectedError: true,
+		},
+		{
+			name:          "registry without scheme",
+			content:       "registries:\n  - docker.io\n",
+			expectedError: true,
+		},
+		{
+			name:          "zero retries",
+			content:       "mirrorResolveRetries: 0\n",
+			expectedError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Parse([]byte(tt.content))
+			if tt.expectedError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			tt.expected(t, cfg)
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, p, "resolveLatestTag: true\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfgCh := make(chan Config)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Watch(ctx, p, func(cfg Config) {
+			select {
+			case <-ctx.Done():
+			case cfgCh <- cfg:
+			}
+		})
+	}()
+
+	// Invalid configuration should be ignored until a valid file is written.
+	require.Eventually(t, func() bool {
+		writeConfig(t, p, "mirrorResolveRetries: 0\n")
+		writeConfig(t, p, "resolveLatestTag: false\n")
+		select {
+		case cfg := <-cfgCh:
+			require.False(t, *cfg.ResolveLatestTag)
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// SIGHUP should reload the configuration even if the file has not changed.
+	err := syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	require.NoError(t, err)
+	select {
+	case cfg := <-cfgCh:
+		require.False(t, *cfg.ResolveLatestTag)
+	case <-time.After(5 * time.Second):
+		t.Fatal("configuration was not reloaded on SIGHUP")
+	}
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+// writeConfig replaces the file atomically in the same way as a mounted ConfigMap is updated.
+func writeConfig(t *testing.T, p, content string) {
+	t.Helper()
+	tmp := p + ".tmp"
+	err := os.WriteFile(tmp, []byte(content), 0644)
+	require.NoError(t, err)
+	err = os.Rename(tmp, p)
+	require.NoError(t, err)
+}
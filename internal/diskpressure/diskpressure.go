@@ -0,0 +1,157 @@
+package diskpressure
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var diskPressure = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "spegel_disk_pressure",
+	Help: "Set to 1 while disk pressure is detected by the source, serving to peers is paused while any source detects pressure.",
+}, []string{"source"})
+
+var diskUsageRatio = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "spegel_disk_usage_ratio",
+	Help: "Ratio of used space of the volume of the content store when it was last checked.",
+})
+
+const (
+	sourceUsage     = "usage"
+	sourceCondition = "condition"
+)
+
+// Detector tracks if the node is under disk pressure, either because the usage of the content store volume
+// is above a threshold or because Kubernetes reports the DiskPressure condition for the node.
+type Detector struct {
+	mx        sync.RWMutex
+	sources   map[string]bool
+	changedCh chan interface{}
+}
+
+func NewDetector() *Detector {
+	return &Detector{
+		sources:   map[string]bool{},
+		changedCh: make(chan interface{}, 1),
+	}
+}
+
+// Pressured returns true if any source detects disk pressure, a nil detector is never pressured.
+func (d *Detector) Pressured() bool {
+	if d == nil {
+		return false
+	}
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+	return d.pressured()
+}
+
+func (d *Detector) pressured() bool {
+	for _, pressured := range d.sources {
+		if pressured {
+			return true
+		}
+	}
+	return false
+}
+
+// Changed returns a channel that receives a value every time the detector switches between pressured and not pressured.
+// The channel of a nil detector never receives a value.
+func (d *Detector) Changed() <-chan interface{} {
+	if d == nil {
+		return nil
+	}
+	return d.changedCh
+}
+
+// Set updates the pressure detected by the source and returns true if the overall pressure changed.
+func (d *Detector) Set(source string, pressured bool) bool {
+	if pressured {
+		diskPressure.WithLabelValues(source).Set(1)
+	} else {
+		diskPressure.WithLabelValues(source).Set(0)
+	}
+	d.mx.Lock()
+	before := d.pressured()
+	d.sources[source] = pressured
+	changed := before != d.pressured()
+	d.mx.Unlock()
+	if !changed {
+		return false
+	}
+	select {
+	case d.changedCh <- nil:
+	default:
+	}
+	return true
+}
+
+// Run checks for disk pressure at every interval until the context is cancelled. The usage of the volume at the path
+// is compared with the threshold when the path is set, and the node condition is checked when the clientset is set.
+// Errors are logged and keep the last known state of the source.
+func (d *Detector) Run(ctx context.Context, interval time.Duration, path string, threshold float64, cs kubernetes.Interface, nodeName string) {
+	log := logr.FromContextOrDiscard(ctx).WithName("diskpressure")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if path != "" {
+			usage, err := volumeUsage(path)
+			if err != nil {
+				log.Error(err, "could not get volume usage", "path", path)
+			} else {
+				diskUsageRatio.Set(usage)
+				if d.Set(sourceUsage, usage >= threshold) {
+					log.Info("disk pressure changed", "source", sourceUsage, "pressured", d.Pressured(), "usage", usage, "threshold", threshold)
+				}
+			}
+		}
+		if cs != nil {
+			pressured, err := nodeDiskPressure(ctx, cs, nodeName)
+			if err != nil {
+				log.Error(err, "could not get node disk pressure condition", "node", nodeName)
+			} else if d.Set(sourceCondition, pressured) {
+				log.Info("disk pressure changed", "source", sourceCondition, "pressured", d.Pressured())
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// volumeUsage returns the ratio of used space of the volume at the path, including space reserved for the root user.
+func volumeUsage(path string) (float64, error) {
+	stat := syscall.Statfs_t{}
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	if stat.Blocks == 0 {
+		return 0, fmt.Errorf("volume at %s reports zero blocks", path)
+	}
+	return float64(stat.Blocks-stat.Bavail) / float64(stat.Blocks), nil
+}
+
+func nodeDiskPressure(ctx context.Context, cs kubernetes.Interface, nodeName string) (bool, error) {
+	node, err := cs.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeDiskPressure {
+			return cond.Status == corev1.ConditionTrue, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,74 @@
+package diskpressure
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDetector(t *testing.T) {
+	var nilDetector *Detector
+	require.False(t, nilDetector.Pressured())
+	require.Nil(t, nilDetector.Changed())
+
+	d := NewDetector()
+	require.False(t, d.Pressured())
+	require.False(t, d.Set(sourceUsage, false))
+	require.True(t, d.Set(sourceUsage, true))
+	require.True(t, d.Pressured())
+	<-d.Changed()
+
+	// Pressure only clears once no source detects pressure.
+	require.False(t, d.Set(sourceCondition, true))
+	require.False(t, d.Set(sourceUsage, false))
+	require.True(t, d.Pressured())
+	require.True(t, d.Set(sourceCondition, false))
+	require.False(t, d.Pressured())
+	<-d.Changed()
+}
+
+func TestRun(t *testing.T) {
+	cs := fake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node"},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse},
+				{Type: corev1.NodeDiskPressure, Status: corev1.ConditionTrue},
+			},
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Checks are run once before waiting for the interval.
+	d := NewDetector()
+	d.Run(ctx, time.Hour, t.TempDir(), 1, cs, "node")
+	require.True(t, d.Pressured())
+	require.False(t, d.sources[sourceUsage])
+
+	d = NewDetector()
+	d.Run(ctx, time.Hour, t.TempDir(), 0, nil, "")
+	require.True(t, d.Pressured())
+	require.True(t, d.sources[sourceUsage])
+
+	// Errors keep the last known state.
+	d = NewDetector()
+	d.Run(ctx, time.Hour, "/does/not/exist", 0, cs, "missing")
+	require.False(t, d.Pressured())
+	require.Empty(t, d.sources)
+}
+
+func TestVolumeUsage(t *testing.T) {
+	usage, err := volumeUsage(t.TempDir())
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, usage, 0.0)
+	require.LessOrEqual(t, usage, 1.0)
+
+	_, err = volumeUsage("/does/not/exist")
+	require.Error(t, err)
+}
@@ -0,0 +1,142 @@
+package handoff
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+// State is written by a pod that is shutting down and imported by the pod replacing it on the same node,
+// so that the replacing pod keeps the peer identity and advertises the keys before it has listed all images.
+type State struct {
+	Timestamp time.Time `json:"timestamp"`
+	// PrivateKey is the marshaled private key of the peer identity.
+	PrivateKey []byte   `json:"privateKey"`
+	Keys       []string `json:"keys"`
+}
+
+// Save writes the state to the path, only readable by the owner as it contains the private key of the peer identity.
+// The file is replaced atomically so that a pod killed while writing never leaves a partially written file.
+func Save(path string, state State) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Load reads the state from the path and removes the file, so that the state is only imported once.
+// It returns false if there is no state or if the state is older than the max age, as the peer identity
+// may have been replaced and the keys may have expired since.
+func Load(path string, maxAge time.Duration) (State, bool, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return State{}, false, nil
+	}
+	if err != nil {
+		return State{}, false, err
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return State{}, false, err
+	}
+	state := State{}
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return State{}, false, fmt.Errorf("could not parse handoff state %s: %w", path, err)
+	}
+	if time.Since(state.Timestamp) > maxAge {
+		return State{}, false, nil
+	}
+	return state, true, nil
+}
+
+// Recorder is a router that records the keys advertised within the key TTL, which are the keys that peers can still resolve to the node.
+type Recorder struct {
+	routing.Router
+	mx         sync.Mutex
+	keyTTL     time.Duration
+	advertised map[string]time.Time
+}
+
+func NewRecorder(router routing.Router, keyTTL time.Duration) *Recorder {
+	return &Recorder{
+		Router:     router,
+		keyTTL:     keyTTL,
+		advertised: map[string]time.Time{},
+	}
+}
+
+// Advertise records the keys that were advertised, keys that failed are not recorded.
+func (r *Recorder) Advertise(ctx context.Context, keys []string) error {
+	err := r.Router.Advertise(ctx, keys)
+	failed := routing.FailedKeys(err)
+	if err != nil && len(failed) == 0 {
+		return err
+	}
+	skip := map[string]interface{}{}
+	for _, key := range failed {
+		skip[key] = nil
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		if _, ok := skip[key]; ok {
+			continue
+		}
+		r.advertised[key] = now
+	}
+	return err
+}
+
+func (r *Recorder) Withdraw(ctx context.Context, keys []string) error {
+	err := r.Router.Withdraw(ctx, keys)
+	if err != nil {
+		return err
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, key := range keys {
+		delete(r.advertised, key)
+	}
+	return nil
+}
+
+// Keys returns the sorted keys advertised within the key TTL, expired keys are forgotten.
+func (r *Recorder) Keys() []string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	keys := []string{}
+	for key, t := range r.advertised {
+		if time.Since(t) > r.keyTTL {
+			delete(r.advertised, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
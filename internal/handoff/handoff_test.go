@@ -0,0 +1,74 @@
+package handoff
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "handoff.json")
+	state, ok, err := Load(p, time.Minute)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Empty(t, state.Keys)
+
+	expected := State{
+		Timestamp:  time.Now(),
+		PrivateKey: []byte("foo"),
+		Keys:       []string{"bar", "baz"},
+	}
+	err = Save(p, expected)
+	require.NoError(t, err)
+	fi, err := os.Stat(p)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	state, ok, err = Load(p, time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, expected.Timestamp.Equal(state.Timestamp))
+	require.Equal(t, expected.PrivateKey, state.PrivateKey)
+	require.Equal(t, expected.Keys, state.Keys)
+
+	// State is only imported once.
+	_, err = os.Stat(p)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, ok, err = Load(p, time.Minute)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	err = Save(p, State{Timestamp: time.Now().Add(-2 * time.Minute), Keys: []string{"foo"}})
+	require.NoError(t, err)
+	_, ok, err = Load(p, time.Minute)
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, err = os.Stat(p)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	err = os.WriteFile(p, []byte("foo"), 0600)
+	require.NoError(t, err)
+	_, _, err = Load(p, time.Minute)
+	require.Error(t, err)
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder(routing.NewMockRouter(map[string][]string{}), time.Minute)
+	err := r.Advertise(context.Background(), []string{"foo", "bar", "baz"})
+	require.NoError(t, err)
+	err = r.Withdraw(context.Background(), []string{"baz"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"bar", "foo"}, r.Keys())
+
+	// Keys not advertised again within the key TTL have expired.
+	r.mx.Lock()
+	r.advertised["foo"] = time.Now().Add(-2 * time.Minute)
+	r.mx.Unlock()
+	require.Equal(t, []string{"bar"}, r.Keys())
+	require.NotContains(t, r.advertised, "foo")
+}
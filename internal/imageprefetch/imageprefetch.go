@@ -0,0 +1,321 @@
+package imageprefetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/xenitab/spegel/internal/oci"
+)
+
+// GroupVersionResource of the ImagePrefetch custom resource.
+var GroupVersionResource = schema.GroupVersionResource{Group: "spegel.dev", Version: "v1alpha1", Resource: "imageprefetches"}
+
+// Max amount of times pulling the images of a prefetch is retried before the node reports it as failed.
+const maxRetries = 5
+
+const (
+	PhasePulling   = "Pulling"
+	PhaseSucceeded = "Succeeded"
+	PhaseFailed    = "Failed"
+)
+
+// ImagePrefetch lists images that are pulled by all nodes matching the node selector ahead of a rollout.
+type ImagePrefetch struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              Spec   `json:"spec"`
+	Status            Status `json:"status,omitempty"`
+}
+
+type Spec struct {
+	// Images are references containing a tag or digest.
+	Images []string `json:"images"`
+	// NodeSelector selects the nodes that pull the images, all nodes pull the images when not set.
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+}
+
+// Status is keyed by node name so that every node can patch its own status without conflicting with other nodes.
+type Status struct {
+	Nodes map[string]NodeStatus `json:"nodes,omitempty"`
+}
+
+type NodeStatus struct {
+	ObservedGeneration int64       `json:"observedGeneration"`
+	Phase              string      `json:"phase"`
+	PulledImages       int         `json:"pulledImages"`
+	FailedImages       []string    `json:"failedImages,omitempty"`
+	Message            string      `json:"message,omitempty"`
+	LastUpdateTime     metav1.Time `json:"lastUpdateTime"`
+}
+
+// Puller pulls images into the local image store.
+type Puller interface {
+	Pull(ctx context.Context, ref string) error
+}
+
+// Controller pulls the images of ImagePrefetch resources selecting the node and reports the result in the status.
+// Images are pulled with the node mirror configuration, so content already pulled by other nodes is fetched from peers.
+type Controller struct {
+	dc       dynamic.Interface
+	cs       kubernetes.Interface
+	puller   Puller
+	nodeName string
+	queue    workqueue.RateLimitingInterface
+}
+
+func NewController(dc dynamic.Interface, cs kubernetes.Interface, puller Puller, nodeName string) *Controller {
+	return &Controller{
+		dc:       dc,
+		cs:       cs,
+		puller:   puller,
+		nodeName: nodeName,
+		queue:    workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+}
+
+// Run watches ImagePrefetch resources in all namespaces and processes them one at a time until the context is cancelled.
+// All resources are processed again when the labels of the node change, as node selectors may select the node after the change.
+func (c *Controller) Run(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx).WithName("imageprefetch")
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(c.dc, 0)
+	informer := factory.ForResource(GroupVersionResource)
+	enqueue := func(obj interface{}) {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			log.Error(err, "could not get key of image prefetch")
+			return
+		}
+		c.queue.Add(key)
+	}
+	_, err := informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		// Status updates do not change the generation and are ignored, as they would bypass the rate limit of retries.
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldMeta, err := meta.Accessor(oldObj)
+			if err != nil {
+				return
+			}
+			newMeta, err := meta.Accessor(newObj)
+			if err != nil {
+				return
+			}
+			if oldMeta.GetGeneration() == newMeta.GetGeneration() {
+				return
+			}
+			enqueue(newObj)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	nodeFactory := informers.NewSharedInformerFactoryWithOptions(c.cs, 0, informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+		opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", c.nodeName).String()
+	}))
+	nodeInformer := nodeFactory.Core().V1().Nodes().Informer()
+	_, err = nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, ok := oldObj.(*corev1.Node)
+			if !ok {
+				return
+			}
+			newNode, ok := newObj.(*corev1.Node)
+			if !ok {
+				return
+			}
+			if labels.Equals(oldNode.Labels, newNode.Labels) {
+				return
+			}
+			objs, err := informer.Lister().List(labels.Everything())
+			if err != nil {
+				log.Error(err, "could not list image prefetches")
+				return
+			}
+			log.Info("node labels changed, evaluating image prefetches again", "count", len(objs))
+			for _, obj := range objs {
+				enqueue(obj)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	nodeFactory.Start(ctx.Done())
+	defer nodeFactory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced, nodeInformer.HasSynced) {
+		return fmt.Errorf("could not sync image prefetch cache")
+	}
+	go func() {
+		<-ctx.Done()
+		c.queue.ShutDown()
+	}()
+	for c.processNext(ctx, log, informer.Lister()) {
+	}
+	return nil
+}
+
+func (c *Controller) processNext(ctx context.Context, log logr.Logger, lister cache.GenericLister) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+	key, ok := item.(string)
+	if !ok {
+		c.queue.Forget(item)
+		return true
+	}
+	obj, err := lister.Get(key)
+	if err != nil {
+		// The resource has been deleted.
+		c.queue.Forget(item)
+		return true
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		c.queue.Forget(item)
+		return true
+	}
+	prefetch := ImagePrefetch{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &prefetch)
+	if err != nil {
+		log.Error(err, "could not parse image prefetch", "key", key)
+		c.queue.Forget(item)
+		return true
+	}
+	retry, err := c.sync(ctx, prefetch, c.queue.NumRequeues(item))
+	if err != nil {
+		log.Error(err, "could not prefetch images", "key", key)
+	}
+	if retry {
+		c.queue.AddRateLimited(item)
+		return true
+	}
+	c.queue.Forget(item)
+	return true
+}
+
+// sync pulls the images of the prefetch if it selects the node and the current generation has not been completed.
+// It returns true if pulling failed and should be retried.
+func (c *Controller) sync(ctx context.Context, prefetch ImagePrefetch, requeues int) (bool, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("namespace", prefetch.Namespace, "name", prefetch.Name)
+	if status, ok := prefetch.Status.Nodes[c.nodeName]; ok && status.ObservedGeneration == prefetch.Generation && status.Phase != PhasePulling {
+		return false, nil
+	}
+	selected, err := c.selectsNode(ctx, prefetch.Spec.NodeSelector)
+	if err != nil {
+		return true, err
+	}
+	if !selected {
+		return false, nil
+	}
+
+	err = ValidateImages(prefetch.Spec.Images)
+	if err != nil {
+		return false, c.patchStatus(ctx, prefetch, NodeStatus{Phase: PhaseFailed, Message: err.Error()})
+	}
+	if requeues == 0 {
+		err = c.patchStatus(ctx, prefetch, NodeStatus{Phase: PhasePulling})
+		if err != nil {
+			return true, err
+		}
+	}
+	log.Info("prefetching images", "images", len(prefetch.Spec.Images))
+	failed := []string{}
+	errs := []string{}
+	for _, ref := range prefetch.Spec.Images {
+		err := c.puller.Pull(ctx, ref)
+		if err != nil {
+			failed = append(failed, ref)
+			errs = append(errs, err.Error())
+		}
+	}
+	status := NodeStatus{
+		Phase:        PhaseSucceeded,
+		PulledImages: len(prefetch.Spec.Images) - len(failed),
+		FailedImages: failed,
+	}
+	retry := false
+	if len(failed) > 0 {
+		status.Message = strings.Join(errs, "; ")
+		status.Phase = PhaseFailed
+		if requeues < maxRetries {
+			status.Phase = PhasePulling
+			retry = true
+		}
+	}
+	err = c.patchStatus(ctx, prefetch, status)
+	if err != nil {
+		return true, err
+	}
+	log.Info("prefetched images", "phase", status.Phase, "pulled", status.PulledImages, "failed", len(failed))
+	return retry, nil
+}
+
+func (c *Controller) selectsNode(ctx context.Context, nodeSelector *metav1.LabelSelector) (bool, error) {
+	if nodeSelector == nil {
+		return true, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(nodeSelector)
+	if err != nil {
+		return false, err
+	}
+	node, err := c.cs.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(node.Labels)), nil
+}
+
+// patchStatus merges the status of the node into the status, leaving the status of other nodes unchanged.
+func (c *Controller) patchStatus(ctx context.Context, prefetch ImagePrefetch, status NodeStatus) error {
+	status.ObservedGeneration = prefetch.Generation
+	status.LastUpdateTime = metav1.NewTime(time.Now())
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"nodes": map[string]interface{}{
+				c.nodeName: status,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.dc.Resource(GroupVersionResource).Namespace(prefetch.Namespace).Patch(ctx, prefetch.Name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	return err
+}
+
+// ValidateImages checks that all images are references containing a tag or digest.
+func ValidateImages(images []string) error {
+	for _, ref := range images {
+		_, _, tag, dgst, err := oci.ParseReference(ref)
+		if err != nil {
+			return fmt.Errorf("invalid image reference %s: %w", ref, err)
+		}
+		if tag == "" && dgst == "" {
+			return fmt.Errorf("image reference %s needs to contain a tag or digest", ref)
+		}
+	}
+	return nil
+}
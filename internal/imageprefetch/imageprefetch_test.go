@@ -0,0 +1,198 @@
+package imageprefetch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type mockPuller struct {
+	mx      sync.Mutex
+	failing map[string]interface{}
+	pulled  []string
+}
+
+func (m *mockPuller) Pull(ctx context.Context, ref string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if _, ok := m.failing[ref]; ok {
+		return fmt.Errorf("could not pull %s", ref)
+	}
+	m.pulled = append(m.pulled, ref)
+	return nil
+}
+
+func (m *mockPuller) Pulled() []string {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return append([]string{}, m.pulled...)
+}
+
+func newPrefetch(t *testing.T, images []string, nodeSelector *metav1.LabelSelector) ImagePrefetch {
+	t.Helper()
+	return ImagePrefetch{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: GroupVersionResource.GroupVersion().String(),
+			Kind:       "ImagePrefetch",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:  "default",
+			Name:       "foo",
+			Generation: 1,
+		},
+		Spec: Spec{
+			Images:       images,
+			NodeSelector: nodeSelector,
+		},
+	}
+}
+
+func newController(t *testing.T, prefetch ImagePrefetch, puller Puller) *Controller {
+	t.Helper()
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&prefetch)
+	require.NoError(t, err)
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{GroupVersionResource: "ImagePrefetchList"})
+	_, err = dc.Resource(GroupVersionResource).Namespace(prefetch.Namespace).Create(context.Background(), &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	cs := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a", Labels: map[string]string{"pool": "gpu"}}})
+	return NewController(dc, cs, puller, "node-a")
+}
+
+func getNodeStatus(t *testing.T, c *Controller) NodeStatus {
+	t.Helper()
+	u, err := c.dc.Resource(GroupVersionResource).Namespace("default").Get(context.Background(), "foo", metav1.GetOptions{})
+	require.NoError(t, err)
+	prefetch := ImagePrefetch{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &prefetch)
+	require.NoError(t, err)
+	return prefetch.Status.Nodes["node-a"]
+}
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	images := []string{"docker.io/library/ubuntu:22.04", "ghcr.io/foo/bar@sha256:44cb2cf712c060f69df7310e99339c1eb51a085446f1bb6d44469acff35b4355"}
+	prefetch := newPrefetch(t, images, &metav1.LabelSelector{MatchLabels: map[string]string{"pool": "gpu"}})
+	puller := &mockPuller{}
+	c := newController(t, prefetch, puller)
+
+	retry, err := c.sync(ctx, prefetch, 0)
+	require.NoError(t, err)
+	require.False(t, retry)
+	require.Equal(t, images, puller.pulled)
+	status := getNodeStatus(t, c)
+	require.Equal(t, PhaseSucceeded, status.Phase)
+	require.Equal(t, 2, status.PulledImages)
+	require.Equal(t, int64(1), status.ObservedGeneration)
+
+	// Completed generations are not pulled again.
+	prefetch.Status.Nodes = map[string]NodeStatus{"node-a": status}
+	retry, err = c.sync(ctx, prefetch, 0)
+	require.NoError(t, err)
+	require.False(t, retry)
+	require.Len(t, puller.pulled, 2)
+}
+
+func TestSyncNodeSelectorMismatch(t *testing.T) {
+	prefetch := newPrefetch(t, []string{"docker.io/library/ubuntu:22.04"}, &metav1.LabelSelector{MatchLabels: map[string]string{"pool": "cpu"}})
+	puller := &mockPuller{}
+	c := newController(t, prefetch, puller)
+
+	retry, err := c.sync(context.Background(), prefetch, 0)
+	require.NoError(t, err)
+	require.False(t, retry)
+	require.Empty(t, puller.pulled)
+	require.Equal(t, NodeStatus{}, getNodeStatus(t, c))
+}
+
+func TestSyncRetry(t *testing.T) {
+	ctx := context.Background()
+	prefetch := newPrefetch(t, []string{"docker.io/library/ubuntu:22.04", "docker.io/library/alpine:3.18"}, nil)
+	puller := &mockPuller{failing: map[string]interface{}{"docker.io/library/alpine:3.18": nil}}
+	c := newController(t, prefetch, puller)
+
+	retry, err := c.sync(ctx, prefetch, 0)
+	require.NoError(t, err)
+	require.True(t, retry)
+	status := getNodeStatus(t, c)
+	require.Equal(t, PhasePulling, status.Phase)
+	require.Equal(t, 1, status.PulledImages)
+	require.Equal(t, []string{"docker.io/library/alpine:3.18"}, status.FailedImages)
+
+	retry, err = c.sync(ctx, prefetch, maxRetries)
+	require.NoError(t, err)
+	require.False(t, retry)
+	status = getNodeStatus(t, c)
+	require.Equal(t, PhaseFailed, status.Phase)
+	require.Equal(t, "could not pull docker.io/library/alpine:3.18", status.Message)
+}
+
+func TestSyncInvalidImages(t *testing.T) {
+	prefetch := newPrefetch(t, []string{"docker.io/library/ubuntu"}, nil)
+	puller := &mockPuller{}
+	c := newController(t, prefetch, puller)
+
+	retry, err := c.sync(context.Background(), prefetch, 0)
+	require.NoError(t, err)
+	require.False(t, retry)
+	require.Empty(t, puller.pulled)
+	status := getNodeStatus(t, c)
+	require.Equal(t, PhaseFailed, status.Phase)
+	require.Equal(t, "image reference docker.io/library/ubuntu needs to contain a tag or digest", status.Message)
+}
+
+func TestRunNodeLabelsChanged(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	images := []string{"docker.io/library/ubuntu:22.04"}
+	prefetch := newPrefetch(t, images, &metav1.LabelSelector{MatchLabels: map[string]string{"pool": "cpu"}})
+	puller := &mockPuller{}
+	c := newController(t, prefetch, puller)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Run(ctx)
+	}()
+
+	// Wait for the node selector to be evaluated before the node labels change.
+	cs := c.cs.(*fake.Clientset)
+	require.Eventually(t, func() bool {
+		for _, action := range cs.Actions() {
+			if action.GetVerb() == "get" && action.GetResource().Resource == "nodes" {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Empty(t, puller.Pulled())
+
+	// The prefetch is evaluated again once the node is selected by the node selector.
+	node, err := cs.CoreV1().Nodes().Get(ctx, "node-a", metav1.GetOptions{})
+	require.NoError(t, err)
+	node.Labels["pool"] = "cpu"
+	_, err = cs.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(puller.Pulled()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, images, puller.Pulled())
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+func TestValidateImages(t *testing.T) {
+	err := ValidateImages([]string{"docker.io/library/ubuntu:22.04", "ghcr.io/foo/bar@sha256:44cb2cf712c060f69df7310e99339c1eb51a085446f1bb6d44469acff35b4355"})
+	require.NoError(t, err)
+	err = ValidateImages([]string{"docker.io/library/ubuntu"})
+	require.EqualError(t, err, "image reference docker.io/library/ubuntu needs to contain a tag or digest")
+}
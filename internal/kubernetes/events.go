@@ -0,0 +1,97 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Component reported as the source of events.
+const eventComponent = "spegel"
+
+const (
+	ReasonMirrorConfigurationFailed = "MirrorConfigurationFailed"
+	ReasonContainerdVerifyFailed    = "ContainerdVerifyFailed"
+)
+
+// EventRecorder emits events on the node and the pod that Spegel runs in, so that misconfigured nodes are visible
+// with kubectl get events instead of only in the logs of the pod. Events are created synchronously as failures are
+// usually followed by the process exiting, which would drop events that are still queued.
+type EventRecorder struct {
+	cs      kubernetes.Interface
+	host    string
+	objects []corev1.ObjectReference
+}
+
+// NewEventRecorder returns a recorder emitting events on the node and the pod, either is skipped when its name is empty.
+func NewEventRecorder(cs kubernetes.Interface, nodeName, podNamespace, podName string) *EventRecorder {
+	objects := []corev1.ObjectReference{}
+	if nodeName != "" {
+		// Events of nodes are created in the default namespace with the name as UID, which is what kubectl describe node looks for.
+		objects = append(objects, corev1.ObjectReference{
+			Kind:      "Node",
+			Name:      nodeName,
+			UID:       types.UID(nodeName),
+			Namespace: metav1.NamespaceDefault,
+		})
+	}
+	if podName != "" {
+		objects = append(objects, corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Name:       podName,
+			Namespace:  podNamespace,
+		})
+	}
+	return &EventRecorder{
+		cs:      cs,
+		host:    nodeName,
+		objects: objects,
+	}
+}
+
+// Warning emits a warning event with the reason and message on all objects, a nil recorder does nothing.
+func (r *EventRecorder) Warning(ctx context.Context, reason, message string) error {
+	if r == nil {
+		return nil
+	}
+	errs := []error{}
+	for _, obj := range r.objects {
+		err := r.create(ctx, obj, corev1.EventTypeWarning, reason, message)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not create event for %s %s: %w", obj.Kind, obj.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *EventRecorder) create(ctx context.Context, obj corev1.ObjectReference, eventType, reason, message string) error {
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: obj.Name + ".",
+			Namespace:    obj.Namespace,
+		},
+		InvolvedObject: obj,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source: corev1.EventSource{
+			Component: eventComponent,
+			Host:      r.host,
+		},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		ReportingController: eventComponent,
+		ReportingInstance:   r.host,
+	}
+	_, err := r.cs.CoreV1().Events(obj.Namespace).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
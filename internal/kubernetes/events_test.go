@@ -0,0 +1,60 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestEventRecorder(t *testing.T) {
+	var nilRecorder *EventRecorder
+	require.NoError(t, nilRecorder.Warning(context.TODO(), ReasonMirrorConfigurationFailed, "foo"))
+
+	cs := fake.NewSimpleClientset()
+	recorder := NewEventRecorder(cs, "node-a", "spegel", "spegel-abc")
+	err := recorder.Warning(context.TODO(), ReasonMirrorConfigurationFailed, "could not write mirror configuration")
+	require.NoError(t, err)
+
+	nodeEvents, err := cs.CoreV1().Events(metav1.NamespaceDefault).List(context.TODO(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, nodeEvents.Items, 1)
+	event := nodeEvents.Items[0]
+	require.Equal(t, "Node", event.InvolvedObject.Kind)
+	require.Equal(t, "node-a", event.InvolvedObject.Name)
+	require.Equal(t, "node-a", string(event.InvolvedObject.UID))
+	require.Equal(t, corev1.EventTypeWarning, event.Type)
+	require.Equal(t, ReasonMirrorConfigurationFailed, event.Reason)
+	require.Equal(t, "could not write mirror configuration", event.Message)
+	require.Equal(t, "spegel", event.Source.Component)
+	require.Equal(t, "node-a", event.Source.Host)
+
+	podEvents, err := cs.CoreV1().Events("spegel").List(context.TODO(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, podEvents.Items, 1)
+	require.Equal(t, "Pod", podEvents.Items[0].InvolvedObject.Kind)
+	require.Equal(t, "spegel-abc", podEvents.Items[0].InvolvedObject.Name)
+
+	// Objects without a name are skipped.
+	cs = fake.NewSimpleClientset()
+	recorder = NewEventRecorder(cs, "", "spegel", "spegel-abc")
+	err = recorder.Warning(context.TODO(), ReasonContainerdVerifyFailed, "foo")
+	require.NoError(t, err)
+	nodeEvents, err = cs.CoreV1().Events(metav1.NamespaceDefault).List(context.TODO(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Empty(t, nodeEvents.Items)
+
+	cs = fake.NewSimpleClientset()
+	cs.PrependReactor("create", "events", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("forbidden")
+	})
+	recorder = NewEventRecorder(cs, "node-a", "spegel", "spegel-abc")
+	err = recorder.Warning(context.TODO(), ReasonContainerdVerifyFailed, "foo")
+	require.EqualError(t, err, "could not create event for Node node-a: forbidden\ncould not create event for Pod spegel-abc: forbidden")
+}
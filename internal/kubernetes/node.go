@@ -0,0 +1,42 @@
+package kubernetes
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Taints added to nodes that are about to be removed by the cluster autoscaler and Karpenter.
+var removalTaints = []string{
+	"ToBeDeletedByClusterAutoscaler",
+	"karpenter.sh/disruption",
+}
+
+// NodeLeaving returns true if the node is cordoned, deleted or tainted for removal, in which case no pod
+// will replace a pod that is shutting down on the node.
+func NodeLeaving(ctx context.Context, cs kubernetes.Interface, nodeName string) (bool, error) {
+	node, err := cs.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	if node.Spec.Unschedulable || node.DeletionTimestamp != nil {
+		return true, nil
+	}
+	for _, taint := range node.Spec.Taints {
+		if isRemovalTaint(taint) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func isRemovalTaint(taint corev1.Taint) bool {
+	for _, key := range removalTaints {
+		if taint.Key == key {
+			return true
+		}
+	}
+	return false
+}
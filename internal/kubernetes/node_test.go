@@ -0,0 +1,57 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNodeLeaving(t *testing.T) {
+	now := metav1.Now()
+	tests := []struct {
+		name     string
+		node     *corev1.Node
+		expected bool
+	}{
+		{
+			name:     "schedulable",
+			node:     &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}},
+			expected: false,
+		},
+		{
+			name:     "cordoned",
+			node:     &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}, Spec: corev1.NodeSpec{Unschedulable: true}},
+			expected: true,
+		},
+		{
+			name:     "deleted",
+			node:     &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", DeletionTimestamp: &now, Finalizers: []string{"foo"}}},
+			expected: true,
+		},
+		{
+			name:     "scaled down",
+			node:     &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}, Spec: corev1.NodeSpec{Taints: []corev1.Taint{{Key: "ToBeDeletedByClusterAutoscaler", Effect: corev1.TaintEffectNoSchedule}}}},
+			expected: true,
+		},
+		{
+			name:     "other taint",
+			node:     &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}, Spec: corev1.NodeSpec{Taints: []corev1.Taint{{Key: "foo", Effect: corev1.TaintEffectNoSchedule}}}},
+			expected: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := fake.NewSimpleClientset(tt.node)
+			leaving, err := NodeLeaving(context.TODO(), cs, "node")
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, leaving)
+		})
+	}
+
+	_, err := NodeLeaving(context.TODO(), fake.NewSimpleClientset(), "missing")
+	require.Error(t, err)
+}
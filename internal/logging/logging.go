@@ -0,0 +1,118 @@
+package logging
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/exp/slog"
+)
+
+type Backend string
+
+const (
+	BackendZap  Backend = "zap"
+	BackendSlog Backend = "slog"
+)
+
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	FormatText Format = "text"
+)
+
+// New creates a logger writing to the writer with the backend and format.
+// The level is read for every log call which means that it can be changed while running. Verbosity V(n) of the logger maps to the slog level -n.
+func New(backend Backend, format Format, w io.Writer, level *slog.LevelVar) (logr.Logger, error) {
+	switch backend {
+	case BackendZap:
+		var encoder zapcore.Encoder
+		switch format {
+		case FormatJSON:
+			encoder = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+		case FormatText:
+			encoder = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+		default:
+			return logr.Logger{}, fmt.Errorf("unknown log format %s", format)
+		}
+		core := zapcore.NewCore(encoder, zapcore.AddSync(w), zapLevel{level: level})
+		// Sampling matches the production configuration which was used before the backend was configurable.
+		core = zapcore.NewSamplerWithOptions(core, time.Second, 100, 100)
+		zapLog := zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
+		return zapr.NewLogger(zapLog), nil
+	case BackendSlog:
+		opts := &slog.HandlerOptions{Level: level}
+		var handler slog.Handler
+		switch format {
+		case FormatJSON:
+			handler = slog.NewJSONHandler(w, opts)
+		case FormatText:
+			handler = slog.NewTextHandler(w, opts)
+		default:
+			return logr.Logger{}, fmt.Errorf("unknown log format %s", format)
+		}
+		return FromSlogHandler(handler), nil
+	default:
+		return logr.Logger{}, fmt.Errorf("unknown log backend %s", backend)
+	}
+}
+
+// zapLevel enables zap levels based on the slog level.
+type zapLevel struct {
+	level *slog.LevelVar
+}
+
+func (z zapLevel) Enabled(l zapcore.Level) bool {
+	var sl slog.Level
+	switch {
+	case l >= zapcore.ErrorLevel:
+		sl = slog.LevelError
+	case l == zapcore.WarnLevel:
+		sl = slog.LevelWarn
+	default:
+		// Zapr maps verbosity V(n) to the zap level -n.
+		sl = slog.Level(l)
+	}
+	return sl >= z.level.Level()
+}
+
+// LevelHandler returns the current level on GET requests and sets it to the level in the request body on PUT requests.
+// Levels are written as slog levels, for example INFO or DEBUG-1 for verbosity V(5).
+// PUT requests have to present the token as bearer token, the level cannot be changed when the token is empty.
+func LevelHandler(level *slog.LevelVar, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			auth := req.Header.Get("Authorization")
+			reqToken := strings.TrimPrefix(auth, "Bearer ")
+			if token == "" || reqToken == auth || subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) != 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			b, err := io.ReadAll(req.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = level.UnmarshalText([]byte(strings.TrimSpace(string(b))))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		//nolint:errcheck // ignore
+		w.Write([]byte(level.Level().String()))
+	})
+}
@@ -0,0 +1,121 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+func TestNew(t *testing.T) {
+	for _, backend := range []Backend{BackendZap, BackendSlog} {
+		t.Run(string(backend), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			level := &slog.LevelVar{}
+			log, err := New(backend, FormatJSON, buf, level)
+			require.NoError(t, err)
+
+			log.WithName("registry").WithValues("foo", "bar").Info("hello")
+			log.V(5).Info("hidden")
+			level.Set(slog.Level(-5))
+			log.V(5).Info("visible")
+			log.Error(errors.New("failed"), "oops")
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			require.Len(t, lines, 3)
+			entry := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+			require.Equal(t, "hello", entry["msg"])
+			require.Equal(t, "bar", entry["foo"])
+			require.Equal(t, "registry", entry["logger"])
+			require.Contains(t, lines[1], "visible")
+			entry = map[string]interface{}{}
+			require.NoError(t, json.Unmarshal([]byte(lines[2]), &entry))
+			require.Equal(t, "failed", entry["error"])
+		})
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := New("foo", FormatJSON, &bytes.Buffer{}, &slog.LevelVar{})
+	require.EqualError(t, err, "unknown log backend foo")
+	_, err = New(BackendSlog, "foo", &bytes.Buffer{}, &slog.LevelVar{})
+	require.EqualError(t, err, "unknown log format foo")
+}
+
+func TestToSlog(t *testing.T) {
+	for _, backend := range []Backend{BackendZap, BackendSlog} {
+		t.Run(string(backend), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			log, err := New(backend, FormatJSON, buf, &slog.LevelVar{})
+			require.NoError(t, err)
+
+			slogLog := ToSlog(log.WithName("state").WithValues("foo", "bar"))
+			slogLog.WithGroup("req").Info("hello", "path", "/v2")
+			slogLog.Debug("hidden")
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			require.Len(t, lines, 1)
+			entry := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+			require.Equal(t, "hello", entry["msg"])
+			require.Equal(t, "bar", entry["foo"])
+			require.Equal(t, "state", entry["logger"])
+			if backend == BackendSlog {
+				require.Equal(t, map[string]interface{}{"path": "/v2"}, entry["req"])
+			} else {
+				require.Equal(t, "/v2", entry["req.path"])
+			}
+		})
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	level := &slog.LevelVar{}
+	handler := LevelHandler(level, "token")
+	putRequest := func(body, auth string) *http.Request {
+		req := httptest.NewRequest(http.MethodPut, "/debug/log-level", strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		return req
+	}
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/debug/log-level", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, "INFO", rw.Body.String())
+
+	for _, auth := range []string{"", "token", "Bearer foo"} {
+		rw = httptest.NewRecorder()
+		handler.ServeHTTP(rw, putRequest("DEBUG", auth))
+		require.Equal(t, http.StatusUnauthorized, rw.Code)
+		require.Equal(t, slog.LevelInfo, level.Level())
+	}
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, putRequest("DEBUG-1\n", "Bearer token"))
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, slog.Level(-5), level.Level())
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, putRequest("foo", "Bearer token"))
+	require.Equal(t, http.StatusBadRequest, rw.Code)
+	require.Equal(t, slog.Level(-5), level.Level())
+
+	// The level cannot be changed without a token.
+	rw = httptest.NewRecorder()
+	LevelHandler(level, "").ServeHTTP(rw, putRequest("INFO", "Bearer "))
+	require.Equal(t, http.StatusUnauthorized, rw.Code)
+	require.Equal(t, slog.Level(-5), level.Level())
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/debug/log-level", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+}
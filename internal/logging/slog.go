@@ -0,0 +1,150 @@
+package logging
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/exp/slog"
+)
+
+// FromSlogHandler returns a logger writing to the slog handler.
+func FromSlogHandler(handler slog.Handler) logr.Logger {
+	return logr.New(&slogSink{handler: handler})
+}
+
+// ToSlog returns a slog logger writing to the same output as the logger, including values and names already added to it.
+// Loggers using the slog backend write straight to the slog handler while other backends are written to through the logger.
+func ToSlog(log logr.Logger) *slog.Logger {
+	if sink, ok := log.GetSink().(*slogSink); ok {
+		handler := sink.handler
+		if sink.name != "" {
+			handler = handler.WithAttrs([]slog.Attr{slog.String(loggerKey, sink.name)})
+		}
+		return slog.New(handler)
+	}
+	return slog.New(&logrHandler{log: log})
+}
+
+const (
+	loggerKey = "logger"
+	errorKey  = "error"
+)
+
+// slogSink implements logr.LogSink with a slog handler.
+type slogSink struct {
+	handler slog.Handler
+	name    string
+}
+
+func (s *slogSink) Init(info logr.RuntimeInfo) {}
+
+func (s *slogSink) Enabled(level int) bool {
+	return s.handler.Enabled(context.Background(), slog.Level(-level))
+}
+
+func (s *slogSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	s.handle(slog.Level(-level), msg, nil, keysAndValues)
+}
+
+func (s *slogSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	s.handle(slog.LevelError, msg, err, keysAndValues)
+}
+
+func (s *slogSink) handle(level slog.Level, msg string, err error, keysAndValues []interface{}) {
+	r := slog.NewRecord(time.Now(), level, msg, 0)
+	if s.name != "" {
+		r.AddAttrs(slog.String(loggerKey, s.name))
+	}
+	if err != nil {
+		r.AddAttrs(slog.Any(errorKey, err))
+	}
+	r.Add(keysAndValues...)
+	//nolint:errcheck // ignore
+	s.handler.Handle(context.Background(), r)
+}
+
+func (s *slogSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	r := slog.NewRecord(time.Time{}, 0, "", 0)
+	r.Add(keysAndValues...)
+	attrs := []slog.Attr{}
+	r.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+	return &slogSink{handler: s.handler.WithAttrs(attrs), name: s.name}
+}
+
+func (s *slogSink) WithName(name string) logr.LogSink {
+	if s.name != "" {
+		name = s.name + "." + name
+	}
+	return &slogSink{handler: s.handler, name: name}
+}
+
+// logrHandler implements slog.Handler with a logger for backends that do not support slog.
+type logrHandler struct {
+	log    logr.Logger
+	groups []string
+}
+
+func (h *logrHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if level >= slog.LevelError {
+		return h.log.GetSink() != nil
+	}
+	return h.log.V(verbosity(level)).Enabled()
+}
+
+func (h *logrHandler) Handle(_ context.Context, r slog.Record) error {
+	kvs := []interface{}{}
+	var err error
+	r.Attrs(func(attr slog.Attr) bool {
+		if r.Level >= slog.LevelError && attr.Key == errorKey && len(h.groups) == 0 {
+			if e, ok := attr.Value.Any().(error); ok {
+				err = e
+				return true
+			}
+		}
+		kvs = append(kvs, h.key(attr.Key), attr.Value.Resolve().Any())
+		return true
+	})
+	if r.Level >= slog.LevelError {
+		h.log.Error(err, r.Message, kvs...)
+		return nil
+	}
+	h.log.V(verbosity(r.Level)).Info(r.Message, kvs...)
+	return nil
+}
+
+func (h *logrHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	kvs := []interface{}{}
+	for _, attr := range attrs {
+		kvs = append(kvs, h.key(attr.Key), attr.Value.Resolve().Any())
+	}
+	return &logrHandler{log: h.log.WithValues(kvs...), groups: h.groups}
+}
+
+func (h *logrHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	groups := append([]string{}, h.groups...)
+	return &logrHandler{log: h.log, groups: append(groups, name)}
+}
+
+// key prefixes the key with the groups as logr does not support nested values.
+func (h *logrHandler) key(key string) string {
+	if len(h.groups) == 0 {
+		return key
+	}
+	return strings.Join(h.groups, ".") + "." + key
+}
+
+// verbosity converts the slog level to a logr verbosity, levels above info are logged at verbosity zero.
+func verbosity(level slog.Level) int {
+	if level >= slog.LevelInfo {
+		return 0
+	}
+	return int(-level)
+}
@@ -0,0 +1,63 @@
+// Package metrics defines the metric families of served bytes, advertised images and keys, image events, Containerd connectivity and resolve durations.
+// Metrics that only concern a single feature are defined next to the feature. Families are registered with the default registerer
+// and are only served on the metrics address, never by the registry.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Registry metrics.
+var (
+	// ServedBytesTotal is the amount of bytes written in responses to registry requests.
+	ServedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "spegel_served_bytes_total",
+		Help: "Total number of bytes served by the registry, by registry of the request and handler.",
+	}, []string{"registry", "handler"})
+)
+
+// Routing metrics.
+var (
+	// RouterResolveDuration is observed once per resolve, when the first peer is found or the lookup ends.
+	RouterResolveDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "spegel_router_resolve_duration_seconds",
+		Help:    "Duration until the first peer was found for a key, or until the lookup ended when no peer was found.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"result"})
+)
+
+// State metrics.
+var (
+	// AdvertisedImages is the amount of images advertised per registry.
+	AdvertisedImages = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "spegel_advertised_images",
+		Help: "Number of images advertised to be availible.",
+	}, []string{"registry"})
+	// AdvertisedKeys is the amount of keys advertised per registry, keys shared by images are counted for each image.
+	AdvertisedKeys = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "spegel_advertised_keys",
+		Help: "Number of keys advertised to be availible.",
+	}, []string{"registry"})
+	// AdvertisedUniqueKeys is the amount of distinct keys advertised.
+	AdvertisedUniqueKeys = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "spegel_advertised_unique_keys",
+		Help: "Number of distinct keys advertised, keys shared by multiple images are only counted once.",
+	})
+	// ImageEventLag is the delay between Containerd publishing an image event and the image being advertised.
+	ImageEventLag = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "spegel_image_event_lag_seconds",
+		Help:    "Duration from when an image event was published until the image was advertised.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+	// ContainerdConnected reports if Containerd could be reached when it was last verified or subscribed to.
+	ContainerdConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "spegel_containerd_connected",
+		Help: "One if Containerd was reachable when last verified or subscribed to, zero otherwise.",
+	})
+	// MirrorConfigurationStatus reports if Containerd is configured to read the mirror configuration written by Spegel.
+	MirrorConfigurationStatus = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "spegel_mirror_configuration_status",
+		Help: "One if the Containerd registry config path matches the path mirror configuration is written to, zero otherwise.",
+	})
+)
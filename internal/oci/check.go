@@ -0,0 +1,121 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+
+	"github.com/spf13/afero"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+type FindingSeverity string
+
+const (
+	FindingSeverityError   FindingSeverity = "error"
+	FindingSeverityWarning FindingSeverity = "warning"
+)
+
+// Finding is a problem with the Containerd configuration together with how to resolve it.
+type Finding struct {
+	Severity FindingSeverity
+	Message  string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s", f.Severity, f.Message)
+}
+
+// Check connects to Containerd and returns findings for configuration that prevents images from being mirrored.
+// Mirror configuration written to the file system is checked for each of the registries.
+func (c *Containerd) Check(ctx context.Context, fs afero.Fs, registries []url.URL) ([]Finding, error) {
+	ok, err := c.client.IsServing(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("could not reach Containerd service")
+	}
+	resp, err := c.runtimeClient.Status(ctx, &runtimeapi.StatusRequest{Verbose: true})
+	if err != nil {
+		return nil, err
+	}
+	findings, err := checkStatusResponse(resp, c.registryConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	mirrorFindings, err := checkMirrorConfiguration(fs, c.registryConfigPath, registries)
+	if err != nil {
+		return nil, err
+	}
+	return append(findings, mirrorFindings...), nil
+}
+
+func checkStatusResponse(resp *runtimeapi.StatusResponse, configPath string) ([]Finding, error) {
+	str, ok := resp.Info["config"]
+	if !ok {
+		return nil, fmt.Errorf("could not get config data from info response")
+	}
+	cfg := &struct {
+		Containerd struct {
+			DiscardUnpackedLayers bool `json:"discardUnpackedLayers"`
+		} `json:"containerd"`
+	}{}
+	err := json.Unmarshal([]byte(str), cfg)
+	if err != nil {
+		return nil, err
+	}
+	findings := []Finding{}
+	err = verifyStatusResponse(resp, configPath)
+	if err != nil {
+		findings = append(findings, Finding{
+			Severity: FindingSeverityError,
+			Message:  fmt.Sprintf(`%v, set config_path = "%s" in the [plugins."io.containerd.grpc.v1.cri".registry] section of the Containerd configuration and restart Containerd`, err, configPath),
+		})
+	}
+	if cfg.Containerd.DiscardUnpackedLayers {
+		findings = append(findings, Finding{
+			Severity: FindingSeverityError,
+			Message:  `Containerd discards layers after unpacking which means that they cannot be served to peers, set discard_unpacked_layers = false in the [plugins."io.containerd.grpc.v1.cri".containerd] section of the Containerd configuration and restart Containerd`,
+		})
+	}
+	return findings, nil
+}
+
+func checkMirrorConfiguration(fs afero.Fs, configPath string, registries []url.URL) ([]Finding, error) {
+	findings := []Finding{}
+	for _, registry := range registries {
+		p := path.Join(configPath, registry.Host)
+		ok, err := afero.Exists(fs, path.Join(p, "hosts.toml"))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			findings = append(findings, Finding{
+				Severity: FindingSeverityError,
+				Message:  fmt.Sprintf("mirror configuration for registry %s is missing at %s, run the configuration subcommand to write it", registry.String(), p),
+			})
+			continue
+		}
+		managed, modified, err := isSpegelManaged(fs, p)
+		if err != nil {
+			return nil, err
+		}
+		if !managed {
+			findings = append(findings, Finding{
+				Severity: FindingSeverityWarning,
+				Message:  fmt.Sprintf("mirror configuration for registry %s at %s is not generated by Spegel, images from the registry may not be mirrored", registry.String(), p),
+			})
+			continue
+		}
+		if modified {
+			findings = append(findings, Finding{
+				Severity: FindingSeverityWarning,
+				Message:  fmt.Sprintf("mirror configuration for registry %s at %s has been modified after it was generated by Spegel, changes are overwritten on the next run", registry.String(), p),
+			})
+		}
+	}
+	return findings, nil
+}
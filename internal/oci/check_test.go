@@ -0,0 +1,87 @@
+package oci
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestCheckStatusResponse(t *testing.T) {
+	tests := []struct {
+		name               string
+		config             string
+		expectedSeverities []FindingSeverity
+	}{
+		{
+			name:               "valid configuration",
+			config:             `{"registry": {"configPath": "/etc/containerd/certs.d"}, "containerd": {"discardUnpackedLayers": false}}`,
+			expectedSeverities: []FindingSeverity{},
+		},
+		{
+			name:               "missing config path",
+			config:             `{"registry": {"configPath": ""}, "containerd": {"discardUnpackedLayers": false}}`,
+			expectedSeverities: []FindingSeverity{FindingSeverityError},
+		},
+		{
+			name:               "discard unpacked layers",
+			config:             `{"registry": {"configPath": "/etc/containerd/certs.d"}, "containerd": {"discardUnpackedLayers": true}}`,
+			expectedSeverities: []FindingSeverity{FindingSeverityError},
+		},
+		{
+			name:               "all errors",
+			config:             `{"registry": {"configPath": "/var/lib/containerd/certs.d"}, "containerd": {"discardUnpackedLayers": true}}`,
+			expectedSeverities: []FindingSeverity{FindingSeverityError, FindingSeverityError},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &runtimeapi.StatusResponse{Info: map[string]string{"config": tt.config}}
+			findings, err := checkStatusResponse(resp, "/etc/containerd/certs.d")
+			require.NoError(t, err)
+			severities := []FindingSeverity{}
+			for _, f := range findings {
+				severities = append(severities, f.Severity)
+			}
+			require.Equal(t, tt.expectedSeverities, severities)
+		})
+	}
+
+	_, err := checkStatusResponse(&runtimeapi.StatusResponse{}, "/etc/containerd/certs.d")
+	require.Error(t, err)
+}
+
+func TestCheckMirrorConfiguration(t *testing.T) {
+	configPath := "/etc/containerd/certs.d"
+	fs := afero.NewMemMapFs()
+	registries := []url.URL{}
+	for _, s := range []string{"https://docker.io", "https://ghcr.io", "https://quay.io", "https://gcr.io"} {
+		u, err := url.Parse(s)
+		require.NoError(t, err)
+		registries = append(registries, *u)
+	}
+	mirrors := []url.URL{{Scheme: "http", Host: "127.0.0.1:5000"}}
+	err := AddMirrorConfiguration(context.TODO(), fs, configPath, registries[:3], mirrors, ResolveTags{Default: true}, nil)
+	require.NoError(t, err)
+	err = afero.WriteFile(fs, configPath+"/ghcr.io/hosts.toml", []byte("server = \"https://ghcr.io\"\n"), 0644)
+	require.NoError(t, err)
+	b, err := afero.ReadFile(fs, configPath+"/quay.io/hosts.toml")
+	require.NoError(t, err)
+	err = afero.WriteFile(fs, configPath+"/quay.io/hosts.toml", append(b, []byte("# modified\n")...), 0644)
+	require.NoError(t, err)
+
+	findings, err := checkMirrorConfiguration(fs, configPath, registries)
+	require.NoError(t, err)
+	require.Len(t, findings, 3)
+	require.Equal(t, FindingSeverityWarning, findings[0].Severity)
+	require.Contains(t, findings[0].Message, "ghcr.io")
+	require.Contains(t, findings[0].Message, "not generated by Spegel")
+	require.Equal(t, FindingSeverityWarning, findings[1].Severity)
+	require.Contains(t, findings[1].Message, "quay.io")
+	require.Contains(t, findings[1].Message, "modified")
+	require.Equal(t, FindingSeverityError, findings[2].Severity)
+	require.Contains(t, findings[2].Message, "gcr.io")
+}
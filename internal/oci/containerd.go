@@ -11,224 +11,778 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/containerd/containerd"
 	eventtypes "github.com/containerd/containerd/api/events"
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/filters"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/typeurl/v2"
 	"github.com/go-logr/logr"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pelletier/go-toml/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/spf13/afero"
-	"github.com/xenitab/pkg/channels"
+	"golang.org/x/sync/errgroup"
 	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+
+	"github.com/xenitab/spegel/internal/metrics"
 )
 
 const (
 	backupDir = "_backup"
+	// Directory used by Containerd for registries without their own host configuration.
+	defaultHostsDir = "_default"
+	// Amount of image events that can be queued before the event subscription blocks.
+	eventBufferSize = 100
+	// Max amount of concurrent content reads when walking image manifests.
+	walkParallelism = 4
+	// Max depth of nested indexes when walking image manifests.
+	maxWalkDepth = 8
+	// Max amount of decoded indexes and manifests kept in memory, shared base images result in the same documents being walked.
+	documentCacheSize = 1000
+	// Marker written at the top of hosts.toml files generated by Spegel.
+	hostsMarker = "# Generated by Spegel, changes will be overwritten."
+	// Checksum of the content written after the header, used to detect changes made by others.
+	hostsChecksumPrefix = "# Checksum: "
+	// MediaTypeArtifactManifest is the artifact manifest which was dropped from the OCI image spec before its release,
+	// artifacts pushed by older versions of ORAS still use it.
+	MediaTypeArtifactManifest = "application/vnd.oci.artifact.manifest.v1+json"
 )
 
+// ArtifactManifest references the blobs of an artifact, it does not have a config.
+type ArtifactManifest struct {
+	MediaType    string               `json:"mediaType"`
+	ArtifactType string               `json:"artifactType,omitempty"`
+	Blobs        []ocispec.Descriptor `json:"blobs,omitempty"`
+	Subject      *ocispec.Descriptor  `json:"subject,omitempty"`
+}
+
+var containerdCallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "spegel_containerd_calls_total",
+	Help: "Total number of calls made to Containerd.",
+}, []string{"method"})
+
+var containerdCallErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "spegel_containerd_call_errors_total",
+	Help: "Total number of calls made to Containerd that failed, not found errors are not counted as they are expected.",
+}, []string{"method"})
+
+var containerdCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "spegel_containerd_call_duration_seconds",
+	Help:    "Duration of calls made to Containerd, blob readers are only measured until they are opened.",
+	Buckets: prometheus.ExponentialBuckets(0.0005, 4, 10),
+}, []string{"method"})
+
+// observeContainerdCall records the call of the method, it is deferred with the named error result of the method
+// so that latency of Containerd can be told apart from latency of resolving peers.
+func observeContainerdCall(method string, start time.Time, err *error) {
+	containerdCallsTotal.WithLabelValues(method).Inc()
+	containerdCallDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if *err != nil && !errdefs.IsNotFound(*err) {
+		containerdCallErrorsTotal.WithLabelValues(method).Inc()
+	}
+}
+
 type Containerd struct {
 	client             *containerd.Client
 	platform           platforms.MatchComparer
+	mx                 sync.RWMutex
 	listFilter         string
-	eventFilter        string
+	eventFilters       []string
+	include            []string
+	imageFilters       []string
+	filterCh           chan interface{}
 	runtimeClient      runtimeapi.RuntimeServiceClient
+	imageClient        runtimeapi.ImageServiceClient
 	registryConfigPath string
+	minLayerSize       int64
+	contentPath        string
+	configTemplatePath string
+	skipForeignLayers  bool
+	documentCache      *lru.Cache
+	namespaces         []string
+}
+
+type ContainerdOption func(*Containerd)
+
+// WithMinLayerSize excludes layers smaller than the size from image digests, manifests and configs are always included.
+func WithMinLayerSize(size int64) ContainerdOption {
+	return func(c *Containerd) {
+		c.minLayerSize = size
+	}
+}
+
+// WithSkipNonDistributableLayers excludes non-distributable layers from image digests, for example Windows base layers.
+// The license of these layers only allows distribution from the origin, so they should not be served by mirrors.
+func WithSkipNonDistributableLayers() ContainerdOption {
+	return func(c *Containerd) {
+		c.skipForeignLayers = true
+	}
+}
+
+// WithContentPath reads blobs directly from the content store directory instead of through the Containerd API.
+// Serving blobs as files allows the kernel to copy the content to the connection with sendfile.
+func WithContentPath(p string) ContainerdOption {
+	return func(c *Containerd) {
+		c.contentPath = p
+	}
+}
+
+// WithIncludeFilter only lists and watches images whose registry and repository match any of the regular expressions.
+func WithIncludeFilter(include []string) ContainerdOption {
+	return func(c *Containerd) {
+		c.include = include
+	}
+}
+
+// WithImageFilters only lists and watches images matching all of the Containerd filter selectors, for example
+// labels."ci.scratch"!=true. Selectors have to be validated with ValidateImageFilter.
+func WithImageFilters(imageFilters []string) ContainerdOption {
+	return func(c *Containerd) {
+		c.imageFilters = imageFilters
+	}
+}
+
+// WithNamespaces lists images in all of the namespaces, and looks up content in the namespaces in order until it is found.
+// Images with the same name in multiple namespaces are only listed for the first namespace.
+func WithNamespaces(nss []string) ContainerdOption {
+	return func(c *Containerd) {
+		c.namespaces = nss
+	}
 }
 
-func NewContainerd(sock, namespace, registryConfigPath string, registries []url.URL) (*Containerd, error) {
+func NewContainerd(sock, namespace, registryConfigPath string, registries []url.URL, opts ...ContainerdOption) (*Containerd, error) {
 	client, err := containerd.New(sock, containerd.WithDefaultNamespace(namespace))
 	if err != nil {
 		return nil, fmt.Errorf("could not create containerd client: %w", err)
 	}
-	listFilter, eventFilter := createFilters(registries)
 	runtimeClient := runtimeapi.NewRuntimeServiceClient(client.Conn())
-	return &Containerd{
+	imageClient := runtimeapi.NewImageServiceClient(client.Conn())
+	documentCache, err := lru.New(documentCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	c := &Containerd{
 		client:             client,
 		platform:           platforms.Default(),
-		listFilter:         listFilter,
-		eventFilter:        eventFilter,
+		filterCh:           make(chan interface{}),
 		runtimeClient:      runtimeClient,
+		imageClient:        imageClient,
 		registryConfigPath: registryConfigPath,
-	}, nil
+		documentCache:      documentCache,
+		namespaces:         []string{namespace},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	listFilter, eventFilter := createFilters(registries, c.include)
+	c.listFilter, c.eventFilters = applyImageFilters(listFilter, eventFilter, c.imageFilters)
+	return c, nil
 }
 
-func (c *Containerd) Verify(ctx context.Context) error {
-	ok, err := c.client.IsServing(ctx)
+func (c *Containerd) Verify(ctx context.Context) (err error) {
+	defer observeContainerdCall("verify", time.Now(), &err)
+	err = c.Ping(ctx)
 	if err != nil {
 		return err
 	}
-	if !ok {
-		return fmt.Errorf("could not reach Containerd service")
-	}
 	resp, err := c.runtimeClient.Status(ctx, &runtimeapi.StatusRequest{Verbose: true})
 	if err != nil {
 		return err
 	}
 	err = verifyStatusResponse(resp, c.registryConfigPath)
 	if err != nil {
+		metrics.MirrorConfigurationStatus.Set(0)
+		if c.configTemplatePath != "" {
+			return fmt.Errorf("%w, the Containerd configuration is generated from the template %s which has to set the registry config_path", err, c.configTemplatePath)
+		}
+		return err
+	}
+	if c.contentPath != "" {
+		err = verifyContentPath(c.contentPath)
+		if err != nil {
+			return err
+		}
+	}
+	metrics.MirrorConfigurationStatus.Set(1)
+	return nil
+}
+
+// Ping returns an error if the Containerd service cannot be reached.
+func (c *Containerd) Ping(ctx context.Context) error {
+	ok, err := c.client.IsServing(ctx)
+	if err != nil {
+		metrics.ContainerdConnected.Set(0)
 		return err
 	}
+	if !ok {
+		metrics.ContainerdConnected.Set(0)
+		return fmt.Errorf("could not reach Containerd service")
+	}
+	metrics.ContainerdConnected.Set(1)
 	return nil
 }
 
+// verifyContentPath checks that the path is a content store directory, as blobs missing from the directory
+// silently fall back to the Containerd API which would hide a wrongly mounted path.
+func verifyContentPath(contentPath string) error {
+	fi, err := os.Stat(filepath.Join(contentPath, "blobs"))
+	if err != nil {
+		return fmt.Errorf("could not find blobs in content path %s: %w", contentPath, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("content path %s is not a Containerd content store", contentPath)
+	}
+	return nil
+}
+
+// verifyStatusResponse checks that the registry config path of the CRI plugin contains the config path.
+// The layout of the status info differs between Containerd 1.x, Containerd 2.x and distributions such as k3s and rke2
+// which template their own configuration, so the registry configuration is searched for in all info values and nested objects.
 func verifyStatusResponse(resp *runtimeapi.StatusResponse, configPath string) error {
-	str, ok := resp.Info["config"]
+	_, ok := resp.Info["config"]
 	if !ok {
 		return fmt.Errorf("could not get config data from info response")
 	}
-	cfg := &struct {
-		Registry struct {
-			ConfigPath string `json:"configPath"`
-		} `json:"registry"`
-	}{}
-	err := json.Unmarshal([]byte(str), cfg)
-	if err != nil {
-		return err
+	// The CRI config is checked before any other info values.
+	keys := []string{"config"}
+	for k := range resp.Info {
+		if k != "config" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys[1:])
+	infoConfigPath := ""
+	for _, k := range keys {
+		var v interface{}
+		err := json.Unmarshal([]byte(resp.Info[k]), &v)
+		if err != nil {
+			if k == "config" {
+				return err
+			}
+			continue
+		}
+		infoConfigPath = findRegistryConfigPath(v)
+		if infoConfigPath != "" {
+			break
+		}
 	}
-	if cfg.Registry.ConfigPath == "" {
+	if infoConfigPath == "" {
 		return fmt.Errorf("Containerd registry config path needs to be set for mirror configuration to take effect")
 	}
-	paths := filepath.SplitList(cfg.Registry.ConfigPath)
+	paths := filepath.SplitList(infoConfigPath)
 	for _, path := range paths {
-		if path != configPath {
+		if filepath.Clean(path) != filepath.Clean(configPath) {
 			continue
 		}
 		return nil
 	}
-	return fmt.Errorf("Containerd registry config path is %s but needs to contain path %s for mirror configuration to take effect", cfg.Registry.ConfigPath, configPath)
+	return fmt.Errorf("Containerd registry config path is %s but needs to contain path %s for mirror configuration to take effect", infoConfigPath, configPath)
+}
+
+// findRegistryConfigPath returns the first non empty config path of a registry object in the decoded JSON value.
+// Both the camel case field names of the CRI status and the snake case names of the TOML configuration are matched.
+func findRegistryConfigPath(v interface{}) string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if registry, ok := m["registry"].(map[string]interface{}); ok {
+		for _, k := range []string{"configPath", "config_path", "ConfigPath"} {
+			if p, ok := registry[k].(string); ok && p != "" {
+				return p
+			}
+		}
+	}
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if p := findRegistryConfigPath(m[k]); p != "" {
+			return p
+		}
+	}
+	return ""
+}
+
+// SetRegistries replaces the registries that images are filtered by, active subscriptions are restarted with the new filter
+// and send a resync event so that images are listed with the new filter.
+func (c *Containerd) SetRegistries(registries []url.URL) {
+	listFilter, eventFilter := createFilters(registries, c.include)
+	listFilter, eventFilters := applyImageFilters(listFilter, eventFilter, c.imageFilters)
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.listFilter = listFilter
+	c.eventFilters = eventFilters
+	close(c.filterCh)
+	c.filterCh = make(chan interface{})
+}
+
+func (c *Containerd) filters() (string, []string, <-chan interface{}) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.listFilter, c.eventFilters, c.filterCh
 }
 
-func (c *Containerd) Subscribe(ctx context.Context) (<-chan Image, <-chan error) {
-	imgCh := make(chan Image)
+func (c *Containerd) Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan error) {
+	// Events are buffered so that the amount of events waiting to be processed can be observed.
+	imgCh := make(chan ImageEvent, eventBufferSize)
 	errCh := make(chan error)
-	envelopeCh, cErrCh := c.client.EventService().Subscribe(ctx, c.eventFilter)
 	go func() {
-		for envelope := range envelopeCh {
-			imageName, err := getEventImage(envelope.Event)
+		for {
+			_, eventFilters, filterCh := c.filters()
+			subCtx, cancel := context.WithCancel(ctx)
+			envelopeCh, cErrCh := c.client.EventService().Subscribe(subCtx, eventFilters...)
+			err := c.forwardEvents(ctx, envelopeCh, cErrCh, filterCh, imgCh)
+			cancel()
 			if err != nil {
-				errCh <- err
+				select {
+				case <-ctx.Done():
+				case errCh <- err:
+				}
 				return
 			}
-			cImg, err := c.client.GetImage(ctx, imageName)
-			if err != nil {
-				errCh <- err
+			if ctx.Err() != nil {
 				return
 			}
-			img, err := Parse(cImg.Name(), cImg.Target().Digest)
-			if err != nil {
-				errCh <- err
+			// The filter has changed, images of added registries were never sent as events and have to be listed.
+			select {
+			case <-ctx.Done():
 				return
+			case imgCh <- ImageEvent{Type: ResyncEvent, Timestamp: time.Now()}:
 			}
-			imgCh <- img
 		}
 	}()
-	return imgCh, channels.Merge(errCh, cErrCh)
+	return imgCh, errCh
 }
 
-func (c *Containerd) ListImages(ctx context.Context) ([]Image, error) {
-	cImgs, err := c.client.ListImages(ctx, c.listFilter)
+// forwardEvents sends images from the event subscription until the context is cancelled or the filter changes.
+func (c *Containerd) forwardEvents(ctx context.Context, envelopeCh <-chan *events.Envelope, cErrCh <-chan error, filterCh <-chan interface{}, imgCh chan<- ImageEvent) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-filterCh:
+			return nil
+		case err := <-cErrCh:
+			metrics.ContainerdConnected.Set(0)
+			return err
+		case envelope := <-envelopeCh:
+			// Events are published for all namespaces, images in other namespaces cannot be looked up.
+			if !c.hasNamespace(envelope.Namespace) {
+				continue
+			}
+			imageName, eventType, err := getEventImage(envelope.Event)
+			if err != nil {
+				return err
+			}
+			var img Image
+			if eventType == DeleteEvent {
+				img, err = parseDeletedImage(imageName)
+			} else {
+				img, err = c.getEventImage(namespaces.WithNamespace(ctx, envelope.Namespace), imageName)
+			}
+			if err != nil {
+				return err
+			}
+			img.Namespace = envelope.Namespace
+			select {
+			case <-ctx.Done():
+				return nil
+			case imgCh <- ImageEvent{Image: img, Type: eventType, Timestamp: envelope.Timestamp}:
+			}
+		}
+	}
+}
+
+func (c *Containerd) getEventImage(ctx context.Context, name string) (Image, error) {
+	cImg, err := c.client.GetImage(ctx, name)
 	if err != nil {
-		return nil, err
+		return Image{}, err
+	}
+	return Parse(cImg.Name(), cImg.Target().Digest)
+}
+
+// parseDeletedImage returns the image without a digest, as the target of a deleted image cannot be looked up.
+func parseDeletedImage(name string) (Image, error) {
+	registry, repository, tag, dgst, err := ParseReference(name)
+	if err != nil {
+		return Image{}, err
+	}
+	return Image{Name: name, Registry: registry, Repository: repository, Tag: tag, Digest: dgst}, nil
+}
+
+func (c *Containerd) ListImages(ctx context.Context) (_ []Image, err error) {
+	defer observeContainerdCall("list_images", time.Now(), &err)
+	listFilter, _, _ := c.filters()
+	nss := c.namespaces
+	if len(nss) == 0 {
+		nss = []string{""}
 	}
 	imgs := []Image{}
-	for _, cImg := range cImgs {
-		img, err := Parse(cImg.Name(), cImg.Target().Digest)
+	seen := map[string]interface{}{}
+	for _, ns := range nss {
+		nsCtx := ctx
+		if ns != "" {
+			nsCtx = namespaces.WithNamespace(ctx, ns)
+		}
+		cImgs, err := c.client.ListImages(nsCtx, listFilter)
 		if err != nil {
 			return nil, err
 		}
-		imgs = append(imgs, img)
+		// Images with the same name in different namespaces are listed separately as they can reference different content.
+		for _, cImg := range cImgs {
+			key := fmt.Sprintf("%s/%s", ns, cImg.Name())
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = nil
+			img, err := Parse(cImg.Name(), cImg.Target().Digest)
+			if err != nil {
+				return nil, err
+			}
+			img.UpdatedAt = cImg.Metadata().UpdatedAt
+			img.Namespace = ns
+			imgs = append(imgs, img)
+		}
 	}
 	return imgs, nil
 }
 
-func (c *Containerd) GetImageDigests(ctx context.Context, img Image) ([]string, error) {
-	cImg, err := c.client.ImageService().Get(ctx, img.Name)
+// inNamespaces calls the function with the context of each namespace in order until the function finds what it looks for.
+func (c *Containerd) inNamespaces(ctx context.Context, fn func(context.Context) error) error {
+	if len(c.namespaces) == 0 {
+		return fn(ctx)
+	}
+	var err error
+	for _, ns := range c.namespaces {
+		err = fn(namespaces.WithNamespace(ctx, ns))
+		if !errdefs.IsNotFound(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// hasNamespace returns true if images in the namespace are listed, all namespaces are listed when none are set.
+func (c *Containerd) hasNamespace(ns string) bool {
+	if len(c.namespaces) == 0 {
+		return true
+	}
+	for _, v := range c.namespaces {
+		if v == ns {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Containerd) GetImageDigests(ctx context.Context, img Image) (_ []string, err error) {
+	defer observeContainerdCall("get_image_digests", time.Now(), &err)
+	// Content referenced by the image is walked in the namespace that the image is found in.
+	var cImg images.Image
+	if img.Namespace != "" {
+		ctx = namespaces.WithNamespace(ctx, img.Namespace)
+		cImg, err = c.client.ImageService().Get(ctx, img.Name)
+	} else {
+		err = c.inNamespaces(ctx, func(nsCtx context.Context) error {
+			var err error
+			cImg, err = c.client.ImageService().Get(nsCtx, img.Name)
+			if err == nil {
+				ctx = nsCtx
+			}
+			return err
+		})
+	}
 	if err != nil {
 		return nil, err
 	}
-	keys := []string{}
-	err = images.Walk(ctx, images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
-		keys = append(keys, desc.Digest.String())
-		b, err := content.ReadBlob(ctx, c.client.ContentStore(), desc)
+	// Limits the amount of concurrent reads from the content store.
+	sem := make(chan interface{}, walkParallelism)
+	keys, err := c.walkImageDigests(ctx, sem, cImg.Target, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk image manifests: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no image digests found")
+	}
+	return keys, nil
+}
+
+// walkImageDigests returns the digests referenced by the descriptor in depth first order.
+// Only the best matching platform of an index is walked, the blobs of a manifest are looked up concurrently.
+func (c *Containerd) walkImageDigests(ctx context.Context, sem chan interface{}, desc ocispec.Descriptor, depth int) ([]string, error) {
+	// Nested indexes are valid but a corrupt index could reference itself.
+	if depth > maxWalkDepth {
+		return nil, fmt.Errorf("manifest walk exceeded max depth of %d at digest: %v", maxWalkDepth, desc.Digest)
+	}
+	keys := []string{desc.Digest.String()}
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		idx, err := readDocument[ocispec.Index](ctx, c, sem, desc)
 		if err != nil {
 			return nil, err
 		}
-		switch desc.MediaType {
-		case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
-			var idx ocispec.Index
-			if err := json.Unmarshal(b, &idx); err != nil {
-				return nil, err
+		var descs []ocispec.Descriptor
+		for _, m := range idx.Manifests {
+			if m.Platform != nil && !c.platform.Match(*m.Platform) {
+				continue
 			}
-			var descs []ocispec.Descriptor
-			for _, m := range idx.Manifests {
-				if !c.platform.Match(*m.Platform) {
-					continue
-				}
-				descs = append(descs, m)
+			descs = append(descs, m)
+		}
+		if len(descs) == 0 {
+			return nil, fmt.Errorf("could not find platform architecture in manifest: %v", desc.Digest)
+		}
+		// Platform matching is a bit weird in that multiple platforms can match.
+		// There is however a "best" match that should be used.
+		// This logic is used by Containerd to determine which layer to pull so we should use the same logic.
+		sort.SliceStable(descs, func(i, j int) bool {
+			if descs[i].Platform == nil {
+				return false
 			}
-			if len(descs) == 0 {
-				return nil, fmt.Errorf("could not find platform architecture in manifest: %v", desc.Digest)
+			if descs[j].Platform == nil {
+				return true
 			}
-			// Platform matching is a bit weird in that multiple platforms can match.
-			// There is however a "best" match that should be used.
-			// This logic is used by Containerd to determine which layer to pull so we should use the same logic.
-			sort.SliceStable(descs, func(i, j int) bool {
-				if descs[i].Platform == nil {
-					return false
-				}
-				if descs[j].Platform == nil {
-					return true
-				}
-				return c.platform.Less(*descs[i].Platform, *descs[j].Platform)
-			})
-			return []ocispec.Descriptor{descs[0]}, nil
-		case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
-			var manifest ocispec.Manifest
-			if err := json.Unmarshal(b, &manifest); err != nil {
-				return nil, err
+			return c.platform.Less(*descs[i].Platform, *descs[j].Platform)
+		})
+		childKeys, err := c.walkImageDigests(ctx, sem, descs[0], depth+1)
+		// A missing child manifest is skipped so that the parent is still advertised.
+		if errdefs.IsNotFound(err) {
+			logr.FromContextOrDiscard(ctx).V(4).Info("skipping manifest missing from content store", "digest", descs[0].Digest.String(), "parent", desc.Digest.String())
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return append(keys, childKeys...), nil
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+		// Artifacts such as Helm charts are image manifests with their own config and layer media types, or the empty config.
+		manifest, err := readDocument[ocispec.Manifest](ctx, c, sem, desc)
+		if err != nil {
+			return nil, err
+		}
+		blobKeys, err := c.existingBlobs(ctx, sem, desc, &manifest.Config, manifest.Layers)
+		if err != nil {
+			return nil, err
+		}
+		return append(keys, blobKeys...), nil
+	case MediaTypeArtifactManifest:
+		manifest, err := readDocument[ArtifactManifest](ctx, c, sem, desc)
+		if err != nil {
+			return nil, err
+		}
+		blobKeys, err := c.existingBlobs(ctx, sem, desc, nil, manifest.Blobs)
+		if err != nil {
+			return nil, err
+		}
+		return append(keys, blobKeys...), nil
+	default:
+		return nil, fmt.Errorf("unexpected media type %v for digest: %v", desc.MediaType, desc.Digest)
+	}
+}
+
+// isNonDistributable returns true for non-distributable and foreign layers.
+// Docker foreign layers are not always marked with a media type but reference the URLs that they are fetched from.
+func isNonDistributable(desc ocispec.Descriptor) bool {
+	return images.IsNonDistributable(desc.MediaType) || len(desc.URLs) > 0
+}
+
+// existingBlobs returns the digests of the config, when set, and the layers of the manifest that are advertised.
+func (c *Containerd) existingBlobs(ctx context.Context, sem chan interface{}, desc ocispec.Descriptor, config *ocispec.Descriptor, layers []ocispec.Descriptor) ([]string, error) {
+	blobs := []ocispec.Descriptor{}
+	if config != nil {
+		blobs = append(blobs, *config)
+	}
+	// Layers are advertised by digest, so compressed layers are handled the same way independent of gzip or zstd compression.
+	// OCIcrypt encrypted layers are opaque to Spegel and are advertised and served as is, they are only decrypted by the runtime.
+	for _, layer := range layers {
+		if layer.Size < c.minLayerSize {
+			continue
+		}
+		if c.skipForeignLayers && isNonDistributable(layer) {
+			continue
+		}
+		blobs = append(blobs, layer)
+	}
+	// Blobs may have been removed by garbage collection, only the blobs that still exist are advertised
+	// so that the node keeps serving the content that it has. Lookups run concurrently, bounded by the semaphore.
+	found := make([]bool, len(blobs))
+	g, gCtx := errgroup.WithContext(ctx)
+	for i, blob := range blobs {
+		i, blob := i, blob
+		g.Go(func() error {
+			ok, err := c.contentExists(gCtx, sem, blob.Digest)
+			if err != nil {
+				return err
 			}
-			keys = append(keys, manifest.Config.Digest.String())
-			for _, layer := range manifest.Layers {
-				keys = append(keys, layer.Digest.String())
+			found[i] = ok
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for i, blob := range blobs {
+		if !found[i] {
+			logr.FromContextOrDiscard(ctx).V(4).Info("skipping digest missing from content store", "digest", blob.Digest.String(), "manifest", desc.Digest.String())
+			continue
+		}
+		keys = append(keys, blob.Digest.String())
+	}
+	return keys, nil
+}
+
+// readDocument decodes the content of the descriptor, decoded documents are cached by digest as content is immutable.
+func readDocument[T any](ctx context.Context, c *Containerd, sem chan interface{}, desc ocispec.Descriptor) (T, error) {
+	var doc T
+	if c.documentCache != nil {
+		if v, ok := c.documentCache.Get(desc.Digest); ok {
+			if cached, ok := v.(T); ok {
+				return cached, nil
 			}
-			return nil, nil
-		default:
-			return nil, fmt.Errorf("unexpected media type %v for digest: %v", desc.MediaType, desc.Digest)
 		}
-	}), cImg.Target)
+	}
+	select {
+	case <-ctx.Done():
+		return doc, ctx.Err()
+	case sem <- nil:
+	}
+	b, err := content.ReadBlob(ctx, c.client.ContentStore(), desc)
+	<-sem
 	if err != nil {
-		return nil, fmt.Errorf("failed to walk image manifests: %w", err)
+		return doc, err
 	}
-	if len(keys) == 0 {
-		return nil, fmt.Errorf("no image digests found")
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return doc, err
 	}
-	return keys, nil
+	if c.documentCache != nil {
+		c.documentCache.Add(desc.Digest, doc)
+	}
+	return doc, nil
+}
+
+// contentExists returns true if the content store contains the digest.
+func (c *Containerd) contentExists(ctx context.Context, sem chan interface{}, dgst digest.Digest) (bool, error) {
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case sem <- nil:
+	}
+	_, err := c.client.ContentStore().Info(ctx, dgst)
+	<-sem
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ListTags returns the sorted tags of images stored with the name, which is expected to contain both registry and repository.
+func (c *Containerd) ListTags(ctx context.Context, name string) (_ []string, err error) {
+	defer observeContainerdCall("list_tags", time.Now(), &err)
+	nss := c.namespaces
+	if len(nss) == 0 {
+		nss = []string{""}
+	}
+	cImgs := []images.Image{}
+	for _, ns := range nss {
+		nsCtx := ctx
+		if ns != "" {
+			nsCtx = namespaces.WithNamespace(ctx, ns)
+		}
+		nsImgs, err := c.client.ImageService().List(nsCtx, fmt.Sprintf(`name~="^%s:"`, name))
+		if err != nil {
+			return nil, err
+		}
+		cImgs = append(cImgs, nsImgs...)
+	}
+	return tagsForName(cImgs, name), nil
+}
+
+func tagsForName(cImgs []images.Image, name string) []string {
+	seen := map[string]interface{}{}
+	tags := []string{}
+	for _, cImg := range cImgs {
+		img, err := Parse(cImg.Name, cImg.Target.Digest)
+		if err != nil {
+			continue
+		}
+		if img.Tag == "" {
+			continue
+		}
+		if fmt.Sprintf("%s/%s", img.Registry, img.Repository) != name {
+			continue
+		}
+		if _, ok := seen[img.Tag]; ok {
+			continue
+		}
+		seen[img.Tag] = nil
+		tags = append(tags, img.Tag)
+	}
+	sort.Strings(tags)
+	return tags
 }
 
-func (c *Containerd) Resolve(ctx context.Context, ref string) (digest.Digest, error) {
-	cImg, err := c.client.GetImage(ctx, ref)
+func (c *Containerd) Resolve(ctx context.Context, ref string) (_ digest.Digest, err error) {
+	defer observeContainerdCall("resolve", time.Now(), &err)
+	var dgst digest.Digest
+	err = c.inNamespaces(ctx, func(ctx context.Context) error {
+		cImg, err := c.client.GetImage(ctx, ref)
+		if err != nil {
+			return err
+		}
+		dgst = cImg.Target().Digest
+		return nil
+	})
 	if err != nil {
 		return "", err
 	}
-	return cImg.Target().Digest, nil
+	return dgst, nil
 }
 
-func (c *Containerd) GetSize(ctx context.Context, dgst digest.Digest) (int64, error) {
-	info, err := c.client.ContentStore().Info(ctx, dgst)
+func (c *Containerd) GetSize(ctx context.Context, dgst digest.Digest) (_ int64, err error) {
+	defer observeContainerdCall("get_size", time.Now(), &err)
+	var info content.Info
+	err = c.inNamespaces(ctx, func(ctx context.Context) error {
+		var err error
+		info, err = c.client.ContentStore().Info(ctx, dgst)
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
 	return info.Size, nil
 }
 
-func (c *Containerd) GetBlob(ctx context.Context, dgst digest.Digest) ([]byte, string, error) {
-	b, err := content.ReadBlob(ctx, c.client.ContentStore(), ocispec.Descriptor{Digest: dgst})
+func (c *Containerd) GetBlob(ctx context.Context, dgst digest.Digest) (_ []byte, _ string, err error) {
+	defer observeContainerdCall("get_blob", time.Now(), &err)
+	var b []byte
+	err = c.inNamespaces(ctx, func(nsCtx context.Context) error {
+		var err error
+		b, err = content.ReadBlob(nsCtx, c.client.ContentStore(), ocispec.Descriptor{Digest: dgst})
+		if err == nil {
+			ctx = nsCtx
+		}
+		return err
+	})
 	if err != nil {
 		return nil, "", err
 	}
@@ -247,19 +801,81 @@ func (c *Containerd) GetBlob(ctx context.Context, dgst digest.Digest) ([]byte, s
 	return b, mt, nil
 }
 
-func (c *Containerd) WriteBlob(ctx context.Context, dst io.Writer, dgst digest.Digest) error {
-	ra, err := c.client.ContentStore().ReaderAt(ctx, ocispec.Descriptor{Digest: dgst})
+// GetImageConfig returns the image config referenced by the manifest digest.
+// Index digests are resolved to the manifest matching the platform in the same way as when walking image digests.
+func (c *Containerd) GetImageConfig(ctx context.Context, dgst digest.Digest) (_ []byte, _ string, err error) {
+	defer observeContainerdCall("get_image_config", time.Now(), &err)
+	_, mediaType, err := c.GetBlob(ctx, dgst)
 	if err != nil {
+		return nil, "", err
+	}
+	var b []byte
+	var desc ocispec.Descriptor
+	err = c.inNamespaces(ctx, func(ctx context.Context) error {
+		var err error
+		desc, err = images.Config(ctx, c.client.ContentStore(), ocispec.Descriptor{MediaType: mediaType, Digest: dgst}, c.platform)
+		if err != nil {
+			return err
+		}
+		b, err = content.ReadBlob(ctx, c.client.ContentStore(), desc)
 		return err
+	})
+	if err != nil {
+		return nil, "", err
 	}
-	defer ra.Close()
-	_, err = io.Copy(dst, content.NewReader(ra))
+	return b, desc.MediaType, nil
+}
+
+// Pull pulls the image through the CRI image service so that it is available to the kubelet.
+// The pull uses the mirror configuration of the node which means that content is fetched from peers when available.
+func (c *Containerd) Pull(ctx context.Context, ref string) (err error) {
+	defer observeContainerdCall("pull", time.Now(), &err)
+	_, err = c.imageClient.PullImage(ctx, &runtimeapi.PullImageRequest{Image: &runtimeapi.ImageSpec{Image: ref}})
 	if err != nil {
-		return err
+		return fmt.Errorf("could not pull image %s: %w", ref, err)
 	}
 	return nil
 }
 
+func (c *Containerd) GetBlobReader(ctx context.Context, dgst digest.Digest) (_ io.ReadSeekCloser, err error) {
+	defer observeContainerdCall("get_blob_reader", time.Now(), &err)
+	if c.contentPath != "" {
+		f, err := openContentFile(c.contentPath, dgst)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	var ra content.ReaderAt
+	err = c.inNamespaces(ctx, func(ctx context.Context) error {
+		var err error
+		ra, err = c.client.ContentStore().ReaderAt(ctx, ocispec.Descriptor{Digest: dgst})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &readSeekCloser{
+		ReadSeeker: io.NewSectionReader(ra, 0, ra.Size()),
+		Closer:     ra,
+	}, nil
+}
+
+// openContentFile opens the blob in the content store directory, which stores blobs by algorithm and encoded digest.
+func openContentFile(contentPath string, dgst digest.Digest) (*os.File, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(contentPath, "blobs", dgst.Algorithm().String(), dgst.Encoded()))
+}
+
+type readSeekCloser struct {
+	io.ReadSeeker
+	io.Closer
+}
+
 // lookupMediaType will resolve the media type for a digest without looking at the content.
 // Only use this as a fallback method as it is a lot slower than reading it from the file.
 // TODO: A cache would be helpful to speed up lookups for the same digets.
@@ -335,33 +951,97 @@ func getContentFilter(labels map[string]string) (string, error) {
 	return "", fmt.Errorf("could not find distribution label to create content filter")
 }
 
-func getEventImage(e typeurl.Any) (string, error) {
+func getEventImage(e typeurl.Any) (string, EventType, error) {
 	evt, err := typeurl.UnmarshalAny(e)
 	if err != nil {
-		return "", fmt.Errorf("failed to unmarshalany: %w", err)
+		return "", "", fmt.Errorf("failed to unmarshalany: %w", err)
 	}
 	switch e := evt.(type) {
 	case *eventtypes.ImageCreate:
-		return e.Name, nil
+		return e.Name, CreateEvent, nil
 	case *eventtypes.ImageUpdate:
-		return e.Name, nil
+		return e.Name, UpdateEvent, nil
+	case *eventtypes.ImageDelete:
+		return e.Name, DeleteEvent, nil
 	default:
-		return "", errors.New("unsupported event")
+		return "", "", errors.New("unsupported event")
 	}
 }
 
-func createFilters(registries []url.URL) (string, string) {
-	registryHosts := []string{}
-	for _, registry := range registries {
-		registryHosts = append(registryHosts, registry.Host)
+// createFilters returns filters matching images from the registries, all images with a registry are matched when registries is empty.
+// Images also have to match any of the include regular expressions when set, which are matched against the name without tag or digest.
+func createFilters(registries []url.URL, include []string) (string, string) {
+	listFilter := `name~="^.+/"`
+	eventFilter := `topic~="/images/create|/images/update|/images/delete",event.name~="^.+/"`
+	if len(registries) > 0 {
+		registryHosts := []string{}
+		for _, registry := range registries {
+			registryHosts = append(registryHosts, registry.Host)
+		}
+		listFilter = fmt.Sprintf(`name~="%s"`, strings.Join(registryHosts, "|"))
+		eventFilter = fmt.Sprintf(`topic~="/images/create|/images/update|/images/delete",event.name~="%s"`, strings.Join(registryHosts, "|"))
+	}
+	if len(include) > 0 {
+		exprs := []string{}
+		for _, expr := range include {
+			exprs = append(exprs, fmt.Sprintf("(?:%s)", expr))
+		}
+		expr := strconv.Quote(fmt.Sprintf("^(?:%s)[:@]", strings.Join(exprs, "|")))
+		listFilter = fmt.Sprintf("%s,name~=%s", listFilter, expr)
+		eventFilter = fmt.Sprintf("%s,event.name~=%s", eventFilter, expr)
 	}
-	listFilter := fmt.Sprintf(`name~="%s"`, strings.Join(registryHosts, "|"))
-	eventFilter := fmt.Sprintf(`topic~="/images/create|/images/update",event.name~="%s"`, strings.Join(registryHosts, "|"))
 	return listFilter, eventFilter
 }
 
+// ValidateImageFilter returns an error if the filter is not a single Containerd filter selector of the image name or labels.
+func ValidateImageFilter(filter string) error {
+	field := filter
+	if i := strings.IndexAny(filter, "=!~"); i >= 0 {
+		field = filter[:i]
+	}
+	if field != "name" && !strings.HasPrefix(field, "labels.") {
+		return fmt.Errorf("image filter %s has to select the name or labels of images", filter)
+	}
+	quoted := false
+	for i := 0; i < len(filter); i++ {
+		switch filter[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				return fmt.Errorf("image filter %s has to be a single selector", filter)
+			}
+		}
+	}
+	_, err := filters.Parse(filter)
+	if err != nil {
+		return fmt.Errorf("could not parse image filter %s: %w", filter, err)
+	}
+	return nil
+}
+
+// applyImageFilters adds the image filter selectors to the list and event filters. Delete events do not carry image labels,
+// so they are subscribed to with a separate filter without the image filters, which are ORed by Containerd.
+func applyImageFilters(listFilter, eventFilter string, imageFilters []string) (string, []string) {
+	if len(imageFilters) == 0 {
+		return listFilter, []string{eventFilter}
+	}
+	eventImageFilters := []string{}
+	for _, imageFilter := range imageFilters {
+		eventImageFilters = append(eventImageFilters, "event."+imageFilter)
+	}
+	listFilter = fmt.Sprintf("%s,%s", listFilter, strings.Join(imageFilters, ","))
+	eventFilters := []string{
+		fmt.Sprintf(`%s,topic~="/images/create|/images/update",%s`, eventFilter, strings.Join(eventImageFilters, ",")),
+		fmt.Sprintf(`%s,topic=="/images/delete"`, eventFilter),
+	}
+	return listFilter, eventFilters
+}
+
 type hostFile struct {
-	Server      string                `toml:"server"`
+	Server      string                `toml:"server,omitempty"`
 	HostConfigs map[string]hostConfig `toml:"host"`
 }
 
@@ -372,12 +1052,110 @@ type hostConfig struct {
 // Refer to containerd registry configuration documentation for mor information about required configuration.
 // https://github.com/containerd/containerd/blob/main/docs/cri/config.md#registry-configuration
 // https://github.com/containerd/containerd/blob/main/docs/hosts.md#registry-configuration---examples
-func AddMirrorConfiguration(ctx context.Context, fs afero.Fs, configPath string, registryURLs, mirrorURLs []url.URL, resolveTags bool) error {
+// Registry servers are keyed by registry host and replace the upstream server of the registry, which is the registry URL by default.
+func AddMirrorConfiguration(ctx context.Context, fs afero.Fs, configPath string, registryURLs, mirrorURLs []url.URL, resolveTags ResolveTags, registryServers map[string]string) error {
 	log := logr.FromContextOrDiscard(ctx)
 
 	if err := validate(registryURLs); err != nil {
 		return err
 	}
+	if err := validateRegistryServers(registryServers); err != nil {
+		return err
+	}
+
+	err := prepareConfigPath(ctx, fs, configPath, isSpegelManaged)
+	if err != nil {
+		return err
+	}
+
+	// Write mirror configuration
+	for _, registryURL := range registryURLs {
+		capabilities := []string{"pull"}
+		if resolveTags.Enabled(registryURL.Host) {
+			capabilities = append(capabilities, "resolve")
+		}
+		server := registryServer(registryURL, registryServers)
+		hostConfigs := map[string]hostConfig{}
+		for _, u := range mirrorURLs {
+			hostConfigs[u.String()] = hostConfig{Capabilities: capabilities}
+		}
+		cfg := hostFile{
+			Server:      server,
+			HostConfigs: hostConfigs,
+		}
+		b, err := toml.Marshal(&cfg)
+		if err != nil {
+			return err
+		}
+		b = addManagedHeader(b)
+		fp := path.Join(configPath, registryURL.Host, "hosts.toml")
+		err = fs.MkdirAll(path.Dir(fp), 0755)
+		if err != nil {
+			return err
+		}
+		err = afero.WriteFile(fs, fp, b, 0644)
+		if err != nil {
+			return err
+		}
+		log.Info("added containerd mirror configuration", "registry", registryURL.String(), "path", fp)
+	}
+	return nil
+}
+
+// Docker Hub needs a default server as docker.io is just an alias.
+var defaultRegistryServers = map[string]string{
+	"docker.io": "https://registry-1.docker.io",
+}
+
+// registryServer returns the server of the registry, servers set for the registry host take precedence over the defaults.
+func registryServer(registryURL url.URL, registryServers map[string]string) string {
+	if server, ok := registryServers[registryURL.Host]; ok {
+		return server
+	}
+	if server, ok := defaultRegistryServers[registryURL.Host]; ok && registryURL.Scheme == "https" {
+		return server
+	}
+	return registryURL.String()
+}
+
+// AddDefaultMirrorConfiguration writes default host configuration which mirrors all registries that do not have their own configuration.
+// It should be called after AddMirrorConfiguration as existing configuration is not backed up.
+func AddDefaultMirrorConfiguration(ctx context.Context, fs afero.Fs, configPath string, mirrorURLs []url.URL, resolveTags ResolveTags) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	capabilities := []string{"pull"}
+	if resolveTags.Default {
+		capabilities = append(capabilities, "resolve")
+	}
+	hostConfigs := map[string]hostConfig{}
+	for _, u := range mirrorURLs {
+		hostConfigs[u.String()] = hostConfig{Capabilities: capabilities}
+	}
+	// Server is not set so that Containerd falls back to the registry host of the request.
+	cfg := hostFile{
+		HostConfigs: hostConfigs,
+	}
+	b, err := toml.Marshal(&cfg)
+	if err != nil {
+		return err
+	}
+	b = addManagedHeader(b)
+	fp := path.Join(configPath, defaultHostsDir, "hosts.toml")
+	err = fs.MkdirAll(path.Dir(fp), 0755)
+	if err != nil {
+		return err
+	}
+	err = afero.WriteFile(fs, fp, b, 0644)
+	if err != nil {
+		return err
+	}
+	log.Info("added containerd default mirror configuration", "path", fp)
+	return nil
+}
+
+// prepareConfigPath backs up existing configuration not generated by Spegel and removes everything else from the config path.
+func prepareConfigPath(ctx context.Context, fs afero.Fs, configPath string, isManaged func(afero.Fs, string) (bool, bool, error)) error {
+	log := logr.FromContextOrDiscard(ctx)
 
 	// Create config path dir if it does not exist
 	ok, err := afero.DirExists(fs, configPath)
@@ -398,20 +1176,30 @@ func AddMirrorConfiguration(ctx context.Context, fs afero.Fs, configPath string,
 		if err != nil {
 			return err
 		}
-		if len(files) > 0 {
+		for _, fi := range files {
+			oldPath := path.Join(configPath, fi.Name())
+			// Configuration generated by Spegel, for example with a different port, should be replaced and not backed up.
+			// Generated configuration that has been modified since is backed up as it is no longer owned by Spegel.
+			managed, modified, err := isManaged(fs, oldPath)
+			if err != nil {
+				return err
+			}
+			if managed && !modified {
+				continue
+			}
+			if modified {
+				log.Info("generated mirror configuration has been modified", "path", oldPath)
+			}
 			err = fs.MkdirAll(backupDirPath, 0755)
 			if err != nil {
 				return err
 			}
-			for _, fi := range files {
-				oldPath := path.Join(configPath, fi.Name())
-				newPath := path.Join(backupDirPath, fi.Name())
-				err := fs.Rename(oldPath, newPath)
-				if err != nil {
-					return err
-				}
-				log.Info("backing up Containerd host configuration", "path", oldPath)
+			newPath := path.Join(backupDirPath, fi.Name())
+			err = fs.Rename(oldPath, newPath)
+			if err != nil {
+				return err
 			}
+			log.Info("backing up mirror configuration", "path", oldPath)
 		}
 	}
 
@@ -430,42 +1218,134 @@ func AddMirrorConfiguration(ctx context.Context, fs afero.Fs, configPath string,
 			return err
 		}
 	}
+	return nil
+}
 
-	// Write mirror configuration
-	capabilities := []string{"pull"}
-	if resolveTags {
-		capabilities = append(capabilities, "resolve")
+// CleanupMirrorConfiguration removes mirror configuration generated by Spegel and restores the backed up configuration.
+// Generated configuration that has been modified is kept as it is no longer owned by Spegel.
+func CleanupMirrorConfiguration(ctx context.Context, fs afero.Fs, configPath string) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	ok, err := afero.DirExists(fs, configPath)
+	if err != nil {
+		return err
 	}
-	for _, registryURL := range registryURLs {
-		// Need a special case for Docker Hub as docker.io is just an alias.
-		server := registryURL.String()
-		if registryURL.String() == "https://docker.io" {
-			server = "https://registry-1.docker.io"
+	if !ok {
+		return nil
+	}
+	files, err := afero.ReadDir(fs, configPath)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if fi.Name() == backupDir {
+			continue
 		}
-		hostConfigs := map[string]hostConfig{}
-		for _, u := range mirrorURLs {
-			hostConfigs[u.String()] = hostConfig{Capabilities: capabilities}
+		filePath := path.Join(configPath, fi.Name())
+		managed, modified, err := isSpegelManaged(fs, filePath)
+		if err != nil {
+			return err
 		}
-		cfg := hostFile{
-			Server:      server,
-			HostConfigs: hostConfigs,
+		if !managed {
+			managed, modified, err = isSpegelManagedFile(fs, filePath)
+			if err != nil {
+				return err
+			}
 		}
-		b, err := toml.Marshal(&cfg)
+		if !managed || modified {
+			continue
+		}
+		err = fs.RemoveAll(filePath)
 		if err != nil {
 			return err
 		}
-		fp := path.Join(configPath, registryURL.Host, "hosts.toml")
-		err = fs.MkdirAll(path.Dir(fp), 0755)
+		log.Info("removed generated mirror configuration", "path", filePath)
+	}
+
+	backupDirPath := path.Join(configPath, backupDir)
+	ok, err = afero.DirExists(fs, backupDirPath)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	files, err = afero.ReadDir(fs, backupDirPath)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		newPath := path.Join(configPath, fi.Name())
+		exists, err := afero.Exists(fs, newPath)
 		if err != nil {
 			return err
 		}
-		err = afero.WriteFile(fs, fp, b, 0644)
+		if exists {
+			log.Info("skipping restore of backed up mirror configuration as path already exists", "path", newPath)
+			continue
+		}
+		err = fs.Rename(path.Join(backupDirPath, fi.Name()), newPath)
 		if err != nil {
 			return err
 		}
-		log.Info("added containerd mirror configuration", "registry", registryURL.String(), "path", fp)
+		log.Info("restored backed up mirror configuration", "path", newPath)
 	}
-	return nil
+	files, err = afero.ReadDir(fs, backupDirPath)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return nil
+	}
+	return fs.Remove(backupDirPath)
+}
+
+// isSpegelManaged returns true if the path is a registry directory only containing a hosts file generated by Spegel.
+// Modified is true if the content of a generated file does not match its checksum.
+func isSpegelManaged(fs afero.Fs, p string) (bool, bool, error) {
+	ok, err := afero.IsDir(fs, p)
+	if err != nil {
+		return false, false, err
+	}
+	if !ok {
+		return false, false, nil
+	}
+	files, err := afero.ReadDir(fs, p)
+	if err != nil {
+		return false, false, err
+	}
+	if len(files) != 1 || files[0].Name() != "hosts.toml" {
+		return false, false, nil
+	}
+	b, err := afero.ReadFile(fs, path.Join(p, "hosts.toml"))
+	if err != nil {
+		return false, false, err
+	}
+	managed, modified := parseManagedHeader(b)
+	return managed, modified, nil
+}
+
+func addManagedHeader(b []byte) []byte {
+	header := fmt.Sprintf("%s\n%s%s\n", hostsMarker, hostsChecksumPrefix, digest.FromBytes(b).String())
+	return append([]byte(header), b...)
+}
+
+// parseManagedHeader returns if the content was generated by Spegel and if it has been modified since.
+func parseManagedHeader(b []byte) (bool, bool) {
+	marker, rest, _ := strings.Cut(string(b), "\n")
+	if marker != hostsMarker {
+		return false, false
+	}
+	checksumLine, content, _ := strings.Cut(rest, "\n")
+	// Files generated before the checksum was added only have the marker, they are replaced without a backup as before.
+	if !strings.HasPrefix(checksumLine, hostsChecksumPrefix) {
+		return true, false
+	}
+	dgst := digest.Digest(strings.TrimPrefix(checksumLine, hostsChecksumPrefix))
+	if dgst != digest.FromString(content) {
+		return true, true
+	}
+	return true, false
 }
 
 func validate(urls []url.URL) error {
@@ -486,3 +1366,22 @@ func validate(urls []url.URL) error {
 	}
 	return errors.Join(errs...)
 }
+
+// validateRegistryServers checks that servers are URLs, unlike registry URLs they may have a path for registries served below a path.
+func validateRegistryServers(registryServers map[string]string) error {
+	errs := []error{}
+	for host, server := range registryServers {
+		u, err := url.Parse(server)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid server of registry %s: %w", host, err))
+			continue
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			errs = append(errs, fmt.Errorf("invalid server of registry %s scheme must be http or https: %s", host, server))
+		}
+		if u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid server of registry %s host has to be set: %s", host, server))
+		}
+	}
+	return errors.Join(errs...)
+}
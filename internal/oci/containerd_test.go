@@ -1,20 +1,37 @@
 package oci
 
+//go:generate go run ./fixturegen --output testdata/images ghcr.io/xenitab/spegel:v0.0.8
+
 import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	iofs "io/fs"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/containerd/containerd"
+	eventtypes "github.com/containerd/containerd/api/events"
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/filters"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/typeurl/v2"
+	lru "github.com/hashicorp/golang-lru"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
@@ -74,20 +91,86 @@ func TestVerifyStatusResponse(t *testing.T) {
 	}
 }
 
+func TestVerifyStatusResponseSchemas(t *testing.T) {
+	tests := []struct {
+		name           string
+		info           map[string]string
+		expectedErrMsg string
+	}{
+		{
+			name: "missing config",
+			info: map[string]string{
+				"status": "{}",
+			},
+			expectedErrMsg: "could not get config data from info response",
+		},
+		{
+			name: "containerd 2 nested plugin config",
+			info: map[string]string{
+				"config": `{"containerd": {"defaultRuntimeName": "runc"}, "plugins": {"io.containerd.cri.v1.images": {"registry": {"config_path": "/etc/containerd/certs.d"}}}}`,
+			},
+		},
+		{
+			name: "containerd 2 separate image config",
+			info: map[string]string{
+				"config":            `{"containerd": {"defaultRuntimeName": "runc"}}`,
+				"imageConfig":       `{"registry": {"configPath": "/etc/containerd/certs.d/"}}`,
+				"lastCNILoadStatus": "OK",
+			},
+		},
+		{
+			name: "k3s config path",
+			info: map[string]string{
+				"config": `{"registry": {"configPath": "/var/lib/rancher/k3s/agent/etc/containerd/certs.d"}}`,
+			},
+			expectedErrMsg: "Containerd registry config path is /var/lib/rancher/k3s/agent/etc/containerd/certs.d but needs to contain path /etc/containerd/certs.d for mirror configuration to take effect",
+		},
+		{
+			name: "no registry config",
+			info: map[string]string{
+				"config": `{"containerd": {"defaultRuntimeName": "runc"}}`,
+			},
+			expectedErrMsg: "Containerd registry config path needs to be set for mirror configuration to take effect",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &runtimeapi.StatusResponse{Info: tt.info}
+			err := verifyStatusResponse(resp, "/etc/containerd/certs.d")
+			if tt.expectedErrMsg != "" {
+				require.EqualError(t, err, tt.expectedErrMsg)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestObserveContainerdCall(t *testing.T) {
+	calls := testutil.ToFloat64(containerdCallsTotal.WithLabelValues("test"))
+	errs := testutil.ToFloat64(containerdCallErrorsTotal.WithLabelValues("test"))
+	for _, err := range []error{nil, fmt.Errorf("wrapped: %w", errdefs.ErrNotFound), fmt.Errorf("unavailable")} {
+		observeContainerdCall("test", time.Now(), &err)
+	}
+	require.Equal(t, calls+3, testutil.ToFloat64(containerdCallsTotal.WithLabelValues("test")))
+	require.Equal(t, errs+1, testutil.ToFloat64(containerdCallErrorsTotal.WithLabelValues("test")))
+}
+
 func TestGetImageDigests(t *testing.T) {
 	tests := []struct {
 		platformStr  string
 		imageName    string
 		imageDigest  string
+		minLayerSize int64
 		expectedKeys []string
 	}{
 		{
 			platformStr: "linux/amd64",
 			imageName:   "ghcr.io/xenitab/spegel:v0.0.8-with-media-type",
-			imageDigest: "sha256:e80e36564e9617f684eb5972bf86dc9e9e761216e0d40ff78ca07741ec70725a",
+			imageDigest: "sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f",
 			expectedKeys: []string{
-				"sha256:e80e36564e9617f684eb5972bf86dc9e9e761216e0d40ff78ca07741ec70725a",
-				"sha256:44cb2cf712c060f69df7310e99339c1eb51a085446f1bb6d44469acff35b4355",
+				"sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f",
+				"sha256:54ef6e0dbcb4df880ef14f83e6377ac7946c96937af8c761d352dd3b7a42e470",
 				"sha256:d715ba0d85ee7d37da627d0679652680ed2cb23dde6120f25143a0b8079ee47e",
 				"sha256:a7ca0d9ba68fdce7e15bc0952d3e898e970548ca24d57698725836c039086639",
 				"sha256:fe5ca62666f04366c8e7f605aa82997d71320183e99962fa76b3209fdfbb8b58",
@@ -105,10 +188,10 @@ func TestGetImageDigests(t *testing.T) {
 		{
 			platformStr: "linux/amd64",
 			imageName:   "ghcr.io/xenitab/spegel:v0.0.8-without-media-type",
-			imageDigest: "sha256:e80e36564e9617f684eb5972bf86dc9e9e761216e0d40ff78ca07741ec70725a",
+			imageDigest: "sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f",
 			expectedKeys: []string{
-				"sha256:e2db0e6787216c5abfc42ea8ec82812e41782f3bc6e3b5221d5ef9c800e6c507",
-				"sha256:44cb2cf712c060f69df7310e99339c1eb51a085446f1bb6d44469acff35b4355",
+				"sha256:5289f1044e6e25e0222f150b46fd12560e481e3c98ad42ad8bdc409d65a742b2",
+				"sha256:54ef6e0dbcb4df880ef14f83e6377ac7946c96937af8c761d352dd3b7a42e470",
 				"sha256:d715ba0d85ee7d37da627d0679652680ed2cb23dde6120f25143a0b8079ee47e",
 				"sha256:a7ca0d9ba68fdce7e15bc0952d3e898e970548ca24d57698725836c039086639",
 				"sha256:fe5ca62666f04366c8e7f605aa82997d71320183e99962fa76b3209fdfbb8b58",
@@ -126,10 +209,10 @@ func TestGetImageDigests(t *testing.T) {
 		{
 			platformStr: "linux/arm64",
 			imageName:   "ghcr.io/xenitab/spegel:v0.0.8-with-media-type",
-			imageDigest: "sha256:e80e36564e9617f684eb5972bf86dc9e9e761216e0d40ff78ca07741ec70725a",
+			imageDigest: "sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f",
 			expectedKeys: []string{
-				"sha256:e80e36564e9617f684eb5972bf86dc9e9e761216e0d40ff78ca07741ec70725a",
-				"sha256:dce623533c59af554b85f859e91fc1cbb7f574e873c82f36b9ea05a09feb0b53",
+				"sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f",
+				"sha256:c3f2f37cfa454e8df8bac579492e71d07b0aad00877bb4c862f2c6efcd6b28ac",
 				"sha256:c73129c9fb699b620aac2df472196ed41797fd0f5a90e1942bfbf19849c4a1c9",
 				"sha256:0b41f743fd4d78cb50ba86dd3b951b51458744109e1f5063a76bc5a792c3d8e7",
 				"sha256:fe5ca62666f04366c8e7f605aa82997d71320183e99962fa76b3209fdfbb8b58",
@@ -147,10 +230,10 @@ func TestGetImageDigests(t *testing.T) {
 		{
 			platformStr: "linux/arm",
 			imageName:   "ghcr.io/xenitab/spegel:v0.0.8-with-media-type",
-			imageDigest: "sha256:e80e36564e9617f684eb5972bf86dc9e9e761216e0d40ff78ca07741ec70725a",
+			imageDigest: "sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f",
 			expectedKeys: []string{
-				"sha256:e80e36564e9617f684eb5972bf86dc9e9e761216e0d40ff78ca07741ec70725a",
-				"sha256:0ad7c556c55464fa44d4c41e5236715e015b0266daced62140fb5c6b983c946b",
+				"sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f",
+				"sha256:e0ab4a4c2a233914baa83725422e7879abb6f771ac8ead8458fbc310016b6687",
 				"sha256:1079836371d57a148a0afa5abfe00bd91825c869fcc6574a418f4371d53cab4c",
 				"sha256:b437b30b8b4cc4e02865517b5ca9b66501752012a028e605da1c98beb0ed9f50",
 				"sha256:fe5ca62666f04366c8e7f605aa82997d71320183e99962fa76b3209fdfbb8b58",
@@ -165,29 +248,29 @@ func TestGetImageDigests(t *testing.T) {
 				"sha256:4f4fb700ef54461cfa02571ae0db9a0dc1e0cdb5577484a6d75e68dc38e8acc1",
 			},
 		},
+		{
+			platformStr:  "linux/amd64",
+			imageName:    "ghcr.io/xenitab/spegel:v0.0.8-with-media-type",
+			imageDigest:  "sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f",
+			minLayerSize: 1024 * 1024 * 1024,
+			expectedKeys: []string{
+				"sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f",
+				"sha256:54ef6e0dbcb4df880ef14f83e6377ac7946c96937af8c761d352dd3b7a42e470",
+				"sha256:d715ba0d85ee7d37da627d0679652680ed2cb23dde6120f25143a0b8079ee47e",
+			},
+		},
 	}
 
 	cs := &mockContentStore{
-		data: map[string]string{
-			// Index with media type
-			"sha256:e80e36564e9617f684eb5972bf86dc9e9e761216e0d40ff78ca07741ec70725a": `{ "mediaType": "application/vnd.oci.image.index.v1+json", "schemaVersion": 2, "manifests": [ { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:44cb2cf712c060f69df7310e99339c1eb51a085446f1bb6d44469acff35b4355", "size": 2372, "platform": { "architecture": "amd64", "os": "linux" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:0ad7c556c55464fa44d4c41e5236715e015b0266daced62140fb5c6b983c946b", "size": 2372, "platform": { "architecture": "arm", "os": "linux", "variant": "v7" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:dce623533c59af554b85f859e91fc1cbb7f574e873c82f36b9ea05a09feb0b53", "size": 2372, "platform": { "architecture": "arm64", "os": "linux" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:73af5483f4d2d636275dcef14d5443ff96d7347a0720ca5a73a32c73855c4aac", "size": 566, "annotations": { "vnd.docker.reference.digest": "sha256:44cb2cf712c060f69df7310e99339c1eb51a085446f1bb6d44469acff35b4355", "vnd.docker.reference.type": "attestation-manifest" }, "platform": { "architecture": "unknown", "os": "unknown" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:36e11bf470af256febbdfad9d803e60b7290b0268218952991b392be9e8153bd", "size": 566, "annotations": { "vnd.docker.reference.digest": "sha256:0ad7c556c55464fa44d4c41e5236715e015b0266daced62140fb5c6b983c946b", "vnd.docker.reference.type": "attestation-manifest" }, "platform": { "architecture": "unknown", "os": "unknown" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:42d1c43f2285e8e3d39f80b8eed8e4c5c28b8011c942b5413ecc6a0050600609", "size": 566, "annotations": { "vnd.docker.reference.digest": "sha256:dce623533c59af554b85f859e91fc1cbb7f574e873c82f36b9ea05a09feb0b53", "vnd.docker.reference.type": "attestation-manifest" }, "platform": { "architecture": "unknown", "os": "unknown" } } ] }`,
-			// Index without media type
-			"sha256:e2db0e6787216c5abfc42ea8ec82812e41782f3bc6e3b5221d5ef9c800e6c507": `{ "schemaVersion": 2, "manifests": [ { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:44cb2cf712c060f69df7310e99339c1eb51a085446f1bb6d44469acff35b4355", "size": 2372, "platform": { "architecture": "amd64", "os": "linux" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:0ad7c556c55464fa44d4c41e5236715e015b0266daced62140fb5c6b983c946b", "size": 2372, "platform": { "architecture": "arm", "os": "linux", "variant": "v7" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:dce623533c59af554b85f859e91fc1cbb7f574e873c82f36b9ea05a09feb0b53", "size": 2372, "platform": { "architecture": "arm64", "os": "linux" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:73af5483f4d2d636275dcef14d5443ff96d7347a0720ca5a73a32c73855c4aac", "size": 566, "annotations": { "vnd.docker.reference.digest": "sha256:44cb2cf712c060f69df7310e99339c1eb51a085446f1bb6d44469acff35b4355", "vnd.docker.reference.type": "attestation-manifest" }, "platform": { "architecture": "unknown", "os": "unknown" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:36e11bf470af256febbdfad9d803e60b7290b0268218952991b392be9e8153bd", "size": 566, "annotations": { "vnd.docker.reference.digest": "sha256:0ad7c556c55464fa44d4c41e5236715e015b0266daced62140fb5c6b983c946b", "vnd.docker.reference.type": "attestation-manifest" }, "platform": { "architecture": "unknown", "os": "unknown" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:42d1c43f2285e8e3d39f80b8eed8e4c5c28b8011c942b5413ecc6a0050600609", "size": 566, "annotations": { "vnd.docker.reference.digest": "sha256:dce623533c59af554b85f859e91fc1cbb7f574e873c82f36b9ea05a09feb0b53", "vnd.docker.reference.type": "attestation-manifest" }, "platform": { "architecture": "unknown", "os": "unknown" } } ] }`,
-			// AMD64
-			"sha256:44cb2cf712c060f69df7310e99339c1eb51a085446f1bb6d44469acff35b4355": `{ "mediaType": "application/vnd.oci.image.manifest.v1+json", "schemaVersion": 2, "config": { "mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:d715ba0d85ee7d37da627d0679652680ed2cb23dde6120f25143a0b8079ee47e", "size": 2842 }, "layers": [ { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:a7ca0d9ba68fdce7e15bc0952d3e898e970548ca24d57698725836c039086639", "size": 103732 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:fe5ca62666f04366c8e7f605aa82997d71320183e99962fa76b3209fdfbb8b58", "size": 21202 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:b02a7525f878e61fc1ef8a7405a2cc17f866e8de222c1c98fd6681aff6e509db", "size": 716491 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:fcb6f6d2c9986d9cd6a2ea3cc2936e5fc613e09f1af9042329011e43057f3265", "size": 317 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:e8c73c638ae9ec5ad70c49df7e484040d889cca6b4a9af056579c3d058ea93f0", "size": 198 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:1e3d9b7d145208fa8fa3ee1c9612d0adaac7255f1bbc9ddea7e461e0b317805c", "size": 113 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:4aa0ea1413d37a58615488592a0b827ea4b2e48fa5a77cf707d0e35f025e613f", "size": 385 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:7c881f9ab25e0d86562a123b5fb56aebf8aa0ddd7d48ef602faf8d1e7cf43d8c", "size": 355 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:5627a970d25e752d971a501ec7e35d0d6fdcd4a3ce9e958715a686853024794a", "size": 130562 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:76f3a495ffdc00c612747ba0c59fc56d0a2610d2785e80e9edddbf214c2709ef", "size": 36529876 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:4f4fb700ef54461cfa02571ae0db9a0dc1e0cdb5577484a6d75e68dc38e8acc1", "size": 32 } ] }`,
-			// ARM64
-			"sha256:dce623533c59af554b85f859e91fc1cbb7f574e873c82f36b9ea05a09feb0b53": `{ "mediaType": "application/vnd.oci.image.manifest.v1+json", "schemaVersion": 2, "config": { "mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:c73129c9fb699b620aac2df472196ed41797fd0f5a90e1942bfbf19849c4a1c9", "size": 2842 }, "layers": [ { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:0b41f743fd4d78cb50ba86dd3b951b51458744109e1f5063a76bc5a792c3d8e7", "size": 103732 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:fe5ca62666f04366c8e7f605aa82997d71320183e99962fa76b3209fdfbb8b58", "size": 21202 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:b02a7525f878e61fc1ef8a7405a2cc17f866e8de222c1c98fd6681aff6e509db", "size": 716491 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:fcb6f6d2c9986d9cd6a2ea3cc2936e5fc613e09f1af9042329011e43057f3265", "size": 317 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:e8c73c638ae9ec5ad70c49df7e484040d889cca6b4a9af056579c3d058ea93f0", "size": 198 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:1e3d9b7d145208fa8fa3ee1c9612d0adaac7255f1bbc9ddea7e461e0b317805c", "size": 113 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:4aa0ea1413d37a58615488592a0b827ea4b2e48fa5a77cf707d0e35f025e613f", "size": 385 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:7c881f9ab25e0d86562a123b5fb56aebf8aa0ddd7d48ef602faf8d1e7cf43d8c", "size": 355 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:5627a970d25e752d971a501ec7e35d0d6fdcd4a3ce9e958715a686853024794a", "size": 130562 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:0dc769edeab7d9f622b9703579f6c89298a4cf45a84af1908e26fffca55341e1", "size": 34168923 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:4f4fb700ef54461cfa02571ae0db9a0dc1e0cdb5577484a6d75e68dc38e8acc1", "size": 32 } ] }`,
-			// ARM
-			"sha256:0ad7c556c55464fa44d4c41e5236715e015b0266daced62140fb5c6b983c946b": `{ "mediaType": "application/vnd.oci.image.manifest.v1+json", "schemaVersion": 2, "config": { "mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:1079836371d57a148a0afa5abfe00bd91825c869fcc6574a418f4371d53cab4c", "size": 2855 }, "layers": [ { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:b437b30b8b4cc4e02865517b5ca9b66501752012a028e605da1c98beb0ed9f50", "size": 103732 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:fe5ca62666f04366c8e7f605aa82997d71320183e99962fa76b3209fdfbb8b58", "size": 21202 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:b02a7525f878e61fc1ef8a7405a2cc17f866e8de222c1c98fd6681aff6e509db", "size": 716491 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:fcb6f6d2c9986d9cd6a2ea3cc2936e5fc613e09f1af9042329011e43057f3265", "size": 317 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:e8c73c638ae9ec5ad70c49df7e484040d889cca6b4a9af056579c3d058ea93f0", "size": 198 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:1e3d9b7d145208fa8fa3ee1c9612d0adaac7255f1bbc9ddea7e461e0b317805c", "size": 113 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:4aa0ea1413d37a58615488592a0b827ea4b2e48fa5a77cf707d0e35f025e613f", "size": 385 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:7c881f9ab25e0d86562a123b5fb56aebf8aa0ddd7d48ef602faf8d1e7cf43d8c", "size": 355 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:5627a970d25e752d971a501ec7e35d0d6fdcd4a3ce9e958715a686853024794a", "size": 130562 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:01d28554416aa05390e2827a653a1289a2a549e46cc78d65915a75377c6008ba", "size": 34318536 }, { "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:4f4fb700ef54461cfa02571ae0db9a0dc1e0cdb5577484a6d75e68dc38e8acc1", "size": 32 } ] }`,
-		},
+		data: readFixtures(t),
 	}
 	is := &mockImageStore{
 		data: map[string]images.Image{
 			"ghcr.io/xenitab/spegel:v0.0.8-with-media-type": {
-				Target: ocispec.Descriptor{MediaType: "application/vnd.oci.image.index.v1+json", Digest: digest.Digest("sha256:e80e36564e9617f684eb5972bf86dc9e9e761216e0d40ff78ca07741ec70725a")},
+				Target: ocispec.Descriptor{MediaType: "application/vnd.oci.image.index.v1+json", Digest: digest.Digest("sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f")},
 			},
 			"ghcr.io/xenitab/spegel:v0.0.8-without-media-type": {
-				Target: ocispec.Descriptor{MediaType: "application/vnd.oci.image.index.v1+json", Digest: digest.Digest("sha256:e2db0e6787216c5abfc42ea8ec82812e41782f3bc6e3b5221d5ef9c800e6c507")},
+				Target: ocispec.Descriptor{MediaType: "application/vnd.oci.image.index.v1+json", Digest: digest.Digest("sha256:5289f1044e6e25e0222f150b46fd12560e481e3c98ad42ad8bdc409d65a742b2")},
 			},
 		},
 	}
@@ -195,10 +278,11 @@ func TestGetImageDigests(t *testing.T) {
 	require.NoError(t, err)
 
 	for _, tt := range tests {
-		t.Run(strings.Join([]string{tt.platformStr, tt.imageName}, "-"), func(t *testing.T) {
+		t.Run(strings.Join([]string{tt.platformStr, tt.imageName, strconv.FormatInt(tt.minLayerSize, 10)}, "-"), func(t *testing.T) {
 			c := Containerd{
-				client:   client,
-				platform: platforms.Only(platforms.MustParse(tt.platformStr)),
+				client:       client,
+				platform:     platforms.Only(platforms.MustParse(tt.platformStr)),
+				minLayerSize: tt.minLayerSize,
 			}
 			img := Image{
 				Name:   tt.imageName,
@@ -213,15 +297,12 @@ func TestGetImageDigests(t *testing.T) {
 
 func TestGetImageDigestsNoPlatform(t *testing.T) {
 	cs := &mockContentStore{
-		data: map[string]string{
-			// Index
-			"sha256:e80e36564e9617f684eb5972bf86dc9e9e761216e0d40ff78ca07741ec70725a": `{ "mediaType": "application/vnd.oci.image.index.v1+json", "schemaVersion": 2, "manifests": [ { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:44cb2cf712c060f69df7310e99339c1eb51a085446f1bb6d44469acff35b4355", "size": 2372, "platform": { "architecture": "amd64", "os": "linux" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:0ad7c556c55464fa44d4c41e5236715e015b0266daced62140fb5c6b983c946b", "size": 2372, "platform": { "architecture": "arm", "os": "linux", "variant": "v7" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:dce623533c59af554b85f859e91fc1cbb7f574e873c82f36b9ea05a09feb0b53", "size": 2372, "platform": { "architecture": "arm64", "os": "linux" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:73af5483f4d2d636275dcef14d5443ff96d7347a0720ca5a73a32c73855c4aac", "size": 566, "annotations": { "vnd.docker.reference.digest": "sha256:44cb2cf712c060f69df7310e99339c1eb51a085446f1bb6d44469acff35b4355", "vnd.docker.reference.type": "attestation-manifest" }, "platform": { "architecture": "unknown", "os": "unknown" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:36e11bf470af256febbdfad9d803e60b7290b0268218952991b392be9e8153bd", "size": 566, "annotations": { "vnd.docker.reference.digest": "sha256:0ad7c556c55464fa44d4c41e5236715e015b0266daced62140fb5c6b983c946b", "vnd.docker.reference.type": "attestation-manifest" }, "platform": { "architecture": "unknown", "os": "unknown" } }, { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:42d1c43f2285e8e3d39f80b8eed8e4c5c28b8011c942b5413ecc6a0050600609", "size": 566, "annotations": { "vnd.docker.reference.digest": "sha256:dce623533c59af554b85f859e91fc1cbb7f574e873c82f36b9ea05a09feb0b53", "vnd.docker.reference.type": "attestation-manifest" }, "platform": { "architecture": "unknown", "os": "unknown" } } ] }`,
-		},
+		data: readFixtures(t),
 	}
 	is := &mockImageStore{
 		data: map[string]images.Image{
 			"ghcr.io/xenitab/spegel:v0.0.8": {
-				Target: ocispec.Descriptor{MediaType: "application/vnd.oci.image.index.v1+json", Digest: digest.Digest("sha256:e80e36564e9617f684eb5972bf86dc9e9e761216e0d40ff78ca07741ec70725a")},
+				Target: ocispec.Descriptor{MediaType: "application/vnd.oci.image.index.v1+json", Digest: digest.Digest("sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f")},
 			},
 		},
 	}
@@ -233,16 +314,342 @@ func TestGetImageDigestsNoPlatform(t *testing.T) {
 	}
 	img := Image{
 		Name:   "ghcr.io/xenitab/spegel:v0.0.8",
-		Digest: digest.Digest("sha256:e80e36564e9617f684eb5972bf86dc9e9e761216e0d40ff78ca07741ec70725a"),
+		Digest: digest.Digest("sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f"),
 	}
 	_, err = c.GetImageDigests(context.TODO(), img)
-	require.EqualError(t, err, "failed to walk image manifests: could not find platform architecture in manifest: sha256:e80e36564e9617f684eb5972bf86dc9e9e761216e0d40ff78ca07741ec70725a")
+	require.EqualError(t, err, "failed to walk image manifests: could not find platform architecture in manifest: sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f")
+}
+
+func TestGetImageDigestsNonDistributable(t *testing.T) {
+	manifestDgst := digest.FromString("manifest")
+	configDgst := digest.FromString("config")
+	zstdDgst := digest.FromString("zstd")
+	nonDistributableDgst := digest.FromString("non-distributable")
+	foreignDgst := digest.FromString("foreign")
+	cs := &mockContentStore{
+		data: map[string]string{
+			manifestDgst.String(): fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","schemaVersion":2,"config":{"digest":"%s"},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+zstd","digest":"%s","size":1},{"mediaType":"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd","digest":"%s","size":1},{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","digest":"%s","size":1,"urls":["https://mcr.microsoft.com/v2/windows/servercore/blobs/%s"]}]}`, configDgst, zstdDgst, nonDistributableDgst, foreignDgst, foreignDgst),
+		},
+	}
+	is := &mockImageStore{
+		data: map[string]images.Image{
+			"mcr.microsoft.com/windows/servercore:ltsc2022": {
+				Target: ocispec.Descriptor{MediaType: "application/vnd.oci.image.manifest.v1+json", Digest: manifestDgst},
+			},
+		},
+	}
+	client, err := containerd.New("", containerd.WithServices(containerd.WithImageStore(is), containerd.WithContentStore(cs)))
+	require.NoError(t, err)
+	img := Image{Name: "mcr.microsoft.com/windows/servercore:ltsc2022", Digest: manifestDgst}
+
+	c := Containerd{client: client}
+	keys, err := c.GetImageDigests(context.TODO(), img)
+	require.NoError(t, err)
+	require.Equal(t, []string{manifestDgst.String(), configDgst.String(), zstdDgst.String(), nonDistributableDgst.String(), foreignDgst.String()}, keys)
+
+	c = Containerd{client: client, skipForeignLayers: true}
+	keys, err = c.GetImageDigests(context.TODO(), img)
+	require.NoError(t, err)
+	require.Equal(t, []string{manifestDgst.String(), configDgst.String(), zstdDgst.String()}, keys)
+}
+
+func TestGetImageDigestsEncrypted(t *testing.T) {
+	manifestDgst := digest.FromString("manifest")
+	configDgst := digest.FromString("config")
+	gzipDgst := digest.FromString("gzip-encrypted")
+	zstdDgst := digest.FromString("zstd-encrypted")
+	nonDistributableDgst := digest.FromString("non-distributable-encrypted")
+	cs := &mockContentStore{
+		data: map[string]string{
+			manifestDgst.String(): fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","schemaVersion":2,"config":{"digest":"%s"},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip+encrypted","digest":"%s","size":1,"annotations":{"org.opencontainers.image.enc.keys.jwe":"e30="}},{"mediaType":"application/vnd.oci.image.layer.v1.tar+zstd+encrypted","digest":"%s","size":1},{"mediaType":"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip+encrypted","digest":"%s","size":1}]}`, configDgst, gzipDgst, zstdDgst, nonDistributableDgst),
+		},
+	}
+	is := &mockImageStore{
+		data: map[string]images.Image{
+			"ghcr.io/foo/encrypted:1.0": {
+				Target: ocispec.Descriptor{MediaType: "application/vnd.oci.image.manifest.v1+json", Digest: manifestDgst},
+			},
+		},
+	}
+	client, err := containerd.New("", containerd.WithServices(containerd.WithImageStore(is), containerd.WithContentStore(cs)))
+	require.NoError(t, err)
+	img := Image{Name: "ghcr.io/foo/encrypted:1.0", Digest: manifestDgst}
+
+	c := Containerd{client: client}
+	keys, err := c.GetImageDigests(context.TODO(), img)
+	require.NoError(t, err)
+	require.Equal(t, []string{manifestDgst.String(), configDgst.String(), gzipDgst.String(), zstdDgst.String(), nonDistributableDgst.String()}, keys)
+
+	// Encrypted non-distributable layers are still non-distributable.
+	c = Containerd{client: client, skipForeignLayers: true}
+	keys, err = c.GetImageDigests(context.TODO(), img)
+	require.NoError(t, err)
+	require.Equal(t, []string{manifestDgst.String(), configDgst.String(), gzipDgst.String(), zstdDgst.String()}, keys)
+}
+
+func TestGetImageDigestsArtifacts(t *testing.T) {
+	chartManifestDgst := digest.FromString("chart-manifest")
+	chartConfigDgst := digest.FromString("chart-config")
+	chartDgst := digest.FromString("chart")
+	orasManifestDgst := digest.FromString("oras-manifest")
+	orasBlobDgst := digest.FromString("oras-blob")
+	artifactManifestDgst := digest.FromString("artifact-manifest")
+	artifactBlobDgst := digest.FromString("artifact-blob")
+	cs := &mockContentStore{
+		data: map[string]string{
+			// Helm does not set the media type of chart manifests.
+			chartManifestDgst.String():                  fmt.Sprintf(`{"schemaVersion":2,"config":{"mediaType":"application/vnd.cncf.helm.config.v1+json","digest":"%s","size":1},"layers":[{"mediaType":"application/vnd.cncf.helm.chart.content.v1.tar+gzip","digest":"%s","size":1}]}`, chartConfigDgst, chartDgst),
+			orasManifestDgst.String():                   fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/vnd.example+type","config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"%s","size":2,"data":"e30="},"layers":[{"mediaType":"application/vnd.example.file","digest":"%s","size":1}]}`, ocispec.DescriptorEmptyJSON.Digest, orasBlobDgst),
+			artifactManifestDgst.String():               fmt.Sprintf(`{"mediaType":"application/vnd.oci.artifact.manifest.v1+json","artifactType":"application/vnd.example+type","blobs":[{"mediaType":"application/vnd.example.file","digest":"%s","size":1}]}`, artifactBlobDgst),
+			chartConfigDgst.String():                    "",
+			chartDgst.String():                          "",
+			orasBlobDgst.String():                       "",
+			artifactBlobDgst.String():                   "",
+			ocispec.DescriptorEmptyJSON.Digest.String(): "{}",
+		},
+	}
+	is := &mockImageStore{
+		data: map[string]images.Image{
+			"ghcr.io/stefanprodan/charts/podinfo:6.5.4": {
+				Target: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: chartManifestDgst},
+			},
+			"ghcr.io/foo/oras:1.0": {
+				Target: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: orasManifestDgst},
+			},
+			"ghcr.io/foo/artifact:1.0": {
+				Target: ocispec.Descriptor{MediaType: MediaTypeArtifactManifest, Digest: artifactManifestDgst},
+			},
+		},
+	}
+	client, err := containerd.New("", containerd.WithServices(containerd.WithImageStore(is), containerd.WithContentStore(cs)))
+	require.NoError(t, err)
+	c := Containerd{client: client}
+
+	tests := []struct {
+		name         string
+		image        string
+		expectedKeys []string
+	}{
+		{
+			name:         "helm chart",
+			image:        "ghcr.io/stefanprodan/charts/podinfo:6.5.4",
+			expectedKeys: []string{chartManifestDgst.String(), chartConfigDgst.String(), chartDgst.String()},
+		},
+		{
+			name:         "oras artifact with empty config",
+			image:        "ghcr.io/foo/oras:1.0",
+			expectedKeys: []string{orasManifestDgst.String(), ocispec.DescriptorEmptyJSON.Digest.String(), orasBlobDgst.String()},
+		},
+		{
+			name:         "artifact manifest",
+			image:        "ghcr.io/foo/artifact:1.0",
+			expectedKeys: []string{artifactManifestDgst.String(), artifactBlobDgst.String()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := c.GetImageDigests(context.TODO(), Image{Name: tt.image})
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedKeys, keys)
+		})
+	}
+}
+
+func TestGetImageDigestsMissingContent(t *testing.T) {
+	indexDgst := digest.FromString("index")
+	amdManifestDgst := digest.FromString("amd64-manifest")
+	armManifestDgst := digest.FromString("arm64-manifest")
+	configDgst := digest.FromString("config")
+	firstLayerDgst := digest.FromString("first-layer")
+	secondLayerDgst := digest.FromString("second-layer")
+	cs := &mockContentStore{
+		data: map[string]string{
+			indexDgst.String():       fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.index.v1+json","schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"%s","platform":{"architecture":"amd64","os":"linux"}},{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"%s","platform":{"architecture":"arm64","os":"linux"}}]}`, amdManifestDgst, armManifestDgst),
+			amdManifestDgst.String(): fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","schemaVersion":2,"config":{"digest":"%s"},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"%s","size":1},{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"%s","size":1}]}`, configDgst, firstLayerDgst, secondLayerDgst),
+		},
+		missing: map[string]interface{}{
+			firstLayerDgst.String():  nil,
+			armManifestDgst.String(): nil,
+		},
+	}
+	is := &mockImageStore{
+		data: map[string]images.Image{
+			"ghcr.io/foo/bar:1.0": {
+				Target: ocispec.Descriptor{MediaType: "application/vnd.oci.image.index.v1+json", Digest: indexDgst},
+			},
+		},
+	}
+	client, err := containerd.New("", containerd.WithServices(containerd.WithImageStore(is), containerd.WithContentStore(cs)))
+	require.NoError(t, err)
+	img := Image{Name: "ghcr.io/foo/bar:1.0", Digest: indexDgst}
+
+	// Layers removed by garbage collection are not advertised.
+	c := Containerd{client: client, platform: platforms.Only(platforms.MustParse("linux/amd64"))}
+	keys, err := c.GetImageDigests(context.TODO(), img)
+	require.NoError(t, err)
+	require.Equal(t, []string{indexDgst.String(), amdManifestDgst.String(), configDgst.String(), secondLayerDgst.String()}, keys)
+
+	// A removed platform manifest still advertises the index.
+	c = Containerd{client: client, platform: platforms.Only(platforms.MustParse("linux/arm64"))}
+	keys, err = c.GetImageDigests(context.TODO(), img)
+	require.NoError(t, err)
+	require.Equal(t, []string{indexDgst.String()}, keys)
+
+	// The image can not be walked when the target is removed.
+	delete(cs.data, indexDgst.String())
+	_, err = c.GetImageDigests(context.TODO(), img)
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+}
+
+func TestGetImageDigestsDocumentCache(t *testing.T) {
+	indexDgst := digest.FromString("index")
+	manifestDgst := digest.FromString("manifest")
+	configDgst := digest.FromString("config")
+	layerDgst := digest.FromString("layer")
+	cs := &mockContentStore{
+		data: map[string]string{
+			indexDgst.String():    fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.index.v1+json","schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"%s","size":1,"platform":{"architecture":"amd64","os":"linux"}}]}`, manifestDgst),
+			manifestDgst.String(): fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","schemaVersion":2,"config":{"digest":"%s"},"layers":[{"digest":"%s","size":1}]}`, configDgst, layerDgst),
+		},
+	}
+	is := &mockImageStore{
+		data: map[string]images.Image{
+			"ghcr.io/xenitab/spegel:v0.0.1": {
+				Target: ocispec.Descriptor{MediaType: "application/vnd.oci.image.index.v1+json", Digest: indexDgst},
+			},
+		},
+	}
+	client, err := containerd.New("", containerd.WithServices(containerd.WithImageStore(is), containerd.WithContentStore(cs)))
+	require.NoError(t, err)
+	documentCache, err := lru.New(10)
+	require.NoError(t, err)
+	c := Containerd{
+		client:        client,
+		platform:      platforms.Only(platforms.MustParse("linux/amd64")),
+		documentCache: documentCache,
+	}
+	img := Image{Name: "ghcr.io/xenitab/spegel:v0.0.1", Digest: indexDgst}
+	expectedKeys := []string{indexDgst.String(), manifestDgst.String(), configDgst.String(), layerDgst.String()}
+	keys, err := c.GetImageDigests(context.TODO(), img)
+	require.NoError(t, err)
+	require.Equal(t, expectedKeys, keys)
+
+	// Documents should be read from the cache once they have been decoded.
+	cs.data = map[string]string{}
+	keys, err = c.GetImageDigests(context.TODO(), img)
+	require.NoError(t, err)
+	require.Equal(t, expectedKeys, keys)
+	require.Equal(t, 2, documentCache.Len())
+}
+
+func TestNamespaces(t *testing.T) {
+	k8sDgst := digest.FromString("k8s")
+	defaultDgst := digest.FromString("default")
+	is := &mockNamespacedImageStore{
+		data: map[string]map[string]images.Image{
+			"k8s.io": {
+				"ghcr.io/xenitab/spegel:v0.0.1": {Name: "ghcr.io/xenitab/spegel:v0.0.1", Target: ocispec.Descriptor{Digest: k8sDgst}},
+			},
+			"default": {
+				"ghcr.io/xenitab/spegel:v0.0.1":  {Name: "ghcr.io/xenitab/spegel:v0.0.1", Target: ocispec.Descriptor{Digest: defaultDgst}},
+				"docker.io/library/local:latest": {Name: "docker.io/library/local:latest", Target: ocispec.Descriptor{Digest: defaultDgst}},
+			},
+			"other": {
+				"docker.io/library/other:latest": {Name: "docker.io/library/other:latest", Target: ocispec.Descriptor{Digest: defaultDgst}},
+			},
+		},
+	}
+	client, err := containerd.New("", containerd.WithServices(containerd.WithImageStore(is)))
+	require.NoError(t, err)
+	c := Containerd{client: client}
+	WithNamespaces([]string{"k8s.io", "default"})(&c)
+
+	require.True(t, c.hasNamespace("default"))
+	require.False(t, c.hasNamespace("other"))
+
+	// Images with the same name in different namespaces are both listed.
+	imgs, err := c.ListImages(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, imgs, 3)
+	require.Equal(t, "k8s.io", imgs[0].Namespace)
+	require.Equal(t, k8sDgst, imgs[0].Digest)
+	require.Equal(t, "default", imgs[1].Namespace)
+	require.Equal(t, "docker.io/library/local:latest", imgs[1].Name)
+	require.Equal(t, "default", imgs[2].Namespace)
+	require.Equal(t, "ghcr.io/xenitab/spegel:v0.0.1", imgs[2].Name)
+	require.Equal(t, defaultDgst, imgs[2].Digest)
+
+	dgst, err := c.Resolve(context.TODO(), "ghcr.io/xenitab/spegel:v0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, k8sDgst, dgst)
+	dgst, err = c.Resolve(context.TODO(), "docker.io/library/local:latest")
+	require.NoError(t, err)
+	require.Equal(t, defaultDgst, dgst)
+	_, err = c.Resolve(context.TODO(), "docker.io/library/other:latest")
+	require.True(t, errdefs.IsNotFound(err))
+}
+
+func TestWalkImageDigestsMaxDepth(t *testing.T) {
+	indexDgst := digest.FromString("index")
+	cs := &mockContentStore{
+		data: map[string]string{
+			indexDgst.String(): fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.index.v1+json","schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.index.v1+json","digest":"%s","size":1}]}`, indexDgst),
+		},
+	}
+	client, err := containerd.New("", containerd.WithServices(containerd.WithContentStore(cs)))
+	require.NoError(t, err)
+	c := Containerd{
+		client:   client,
+		platform: platforms.Only(platforms.MustParse("linux/amd64")),
+	}
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: indexDgst}
+	_, err = c.walkImageDigests(context.TODO(), make(chan interface{}, walkParallelism), desc, 0)
+	require.EqualError(t, err, fmt.Sprintf("manifest walk exceeded max depth of 8 at digest: %s", indexDgst))
+}
+
+// FuzzWalkImageDigests walks the fuzzed document as both an index and a manifest.
+// The document is stored at a fixed digest so that it is able to reference itself.
+func FuzzWalkImageDigests(f *testing.F) {
+	dgst := digest.FromString("fuzz")
+	for _, v := range readFixtures(f) {
+		f.Add(v)
+	}
+	f.Add(fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.index.v1+json","schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"%s","size":1}]}`, dgst))
+	f.Fuzz(func(t *testing.T, doc string) {
+		fixtures := readFixtures(t)
+		fixtures[dgst.String()] = doc
+		client, err := containerd.New("", containerd.WithServices(containerd.WithContentStore(&mockContentStore{data: fixtures})))
+		require.NoError(t, err)
+		c := Containerd{
+			client:   client,
+			platform: platforms.Only(platforms.MustParse("linux/amd64")),
+		}
+		for _, mediaType := range []string{ocispec.MediaTypeImageIndex, ocispec.MediaTypeImageManifest} {
+			desc := ocispec.Descriptor{MediaType: mediaType, Digest: dgst}
+			//nolint:errcheck // ignore
+			c.walkImageDigests(context.TODO(), make(chan interface{}, walkParallelism), desc, 0)
+		}
+	})
+}
+
+func TestTagsForName(t *testing.T) {
+	dgst := digest.Digest("sha256:9749e23b7c1f5759069e5424aa8ba94416f8f2c89ef02e96ec7d078577b7f89f")
+	cImgs := []images.Image{
+		{Name: "ghcr.io/xenitab/spegel:v0.0.9", Target: ocispec.Descriptor{Digest: dgst}},
+		{Name: "ghcr.io/xenitab/spegel:v0.0.8", Target: ocispec.Descriptor{Digest: dgst}},
+		{Name: "ghcr.io/xenitab/spegel@" + dgst.String(), Target: ocispec.Descriptor{Digest: dgst}},
+		{Name: "ghcr.io/xenitab/spegel-foo:v0.0.1", Target: ocispec.Descriptor{Digest: dgst}},
+		{Name: "docker.io/xenitab/spegel:v0.0.1", Target: ocispec.Descriptor{Digest: dgst}},
+	}
+	tags := tagsForName(cImgs, "ghcr.io/xenitab/spegel")
+	require.Equal(t, []string{"v0.0.8", "v0.0.9"}, tags)
 }
 
 func TestCreateFilter(t *testing.T) {
 	tests := []struct {
 		name                string
 		registries          []string
+		include             []string
 		expectedListFilter  string
 		expectedEventFilter string
 	}{
@@ -250,21 +657,125 @@ func TestCreateFilter(t *testing.T) {
 			name:                "only registries",
 			registries:          []string{"https://docker.io", "https://gcr.io"},
 			expectedListFilter:  `name~="docker.io|gcr.io"`,
-			expectedEventFilter: `topic~="/images/create|/images/update",event.name~="docker.io|gcr.io"`,
+			expectedEventFilter: `topic~="/images/create|/images/update|/images/delete",event.name~="docker.io|gcr.io"`,
 		},
 		{
 			name:                "additional image filtes",
 			registries:          []string{"https://docker.io", "https://gcr.io"},
 			expectedListFilter:  `name~="docker.io|gcr.io"`,
-			expectedEventFilter: `topic~="/images/create|/images/update",event.name~="docker.io|gcr.io"`,
+			expectedEventFilter: `topic~="/images/create|/images/update|/images/delete",event.name~="docker.io|gcr.io"`,
+		},
+		{
+			name:                "all registries",
+			registries:          []string{},
+			expectedListFilter:  `name~="^.+/"`,
+			expectedEventFilter: `topic~="/images/create|/images/update|/images/delete",event.name~="^.+/"`,
+		},
+		{
+			name:                "include patterns",
+			registries:          []string{"https://docker.io"},
+			include:             []string{`docker\.io/library/.*`, "ghcr.io|quay.io"},
+			expectedListFilter:  `name~="docker.io",name~="^(?:(?:docker\\.io/library/.*)|(?:ghcr.io|quay.io))[:@]"`,
+			expectedEventFilter: `topic~="/images/create|/images/update|/images/delete",event.name~="docker.io",event.name~="^(?:(?:docker\\.io/library/.*)|(?:ghcr.io|quay.io))[:@]"`,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			listFilter, eventFilter := createFilters(stringListToUrlList(t, tt.registries))
+			listFilter, eventFilter := createFilters(stringListToUrlList(t, tt.registries), tt.include)
 			require.Equal(t, listFilter, tt.expectedListFilter)
 			require.Equal(t, eventFilter, tt.expectedEventFilter)
+			_, err := filters.ParseAll(listFilter)
+			require.NoError(t, err)
+			_, err = filters.ParseAll(eventFilter)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestCreateFilterInclude(t *testing.T) {
+	listFilter, _ := createFilters(nil, []string{`docker\.io/library/.*`})
+	filter, err := filters.ParseAll(listFilter)
+	require.NoError(t, err)
+	for name, expected := range map[string]bool{
+		"docker.io/library/nginx:1.25":      true,
+		"docker.io/library/nginx@sha256:ab": true,
+		"docker.io/internal/nginx:1.25":     false,
+		"dockerxio/library/nginx:1.25":      false,
+	} {
+		adaptor := filters.AdapterFunc(func(fieldpath []string) (string, bool) {
+			return name, true
+		})
+		require.Equal(t, expected, filter.Match(adaptor), name)
+	}
+}
+
+func TestValidateImageFilter(t *testing.T) {
+	for _, f := range []string{`name~="^docker.io/"`, `labels."ci.scratch"!=true`, `labels.team==platform`, "labels.keep"} {
+		require.NoError(t, ValidateImageFilter(f), f)
+	}
+	for _, f := range []string{`topic=="/images/create"`, `name~="foo",labels.bar==baz`, `labels."ci.scratch"!=`, ""} {
+		require.Error(t, ValidateImageFilter(f), f)
+	}
+}
+
+func TestApplyImageFilters(t *testing.T) {
+	listFilter, eventFilter := createFilters(stringListToUrlList(t, []string{"https://docker.io"}), nil)
+	listFilter, eventFilters := applyImageFilters(listFilter, eventFilter, nil)
+	require.Equal(t, `name~="docker.io"`, listFilter)
+	require.Equal(t, []string{eventFilter}, eventFilters)
+
+	listFilter, eventFilter = createFilters(stringListToUrlList(t, []string{"https://docker.io"}), nil)
+	listFilter, eventFilters = applyImageFilters(listFilter, eventFilter, []string{`labels."ci.scratch"!=true`})
+	require.Equal(t, `name~="docker.io",labels."ci.scratch"!=true`, listFilter)
+	_, err := filters.ParseAll(listFilter)
+	require.NoError(t, err)
+	filter, err := filters.ParseAll(eventFilters...)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		topic    string
+		event    interface{}
+		expected bool
+	}{
+		{
+			name:     "create without label",
+			topic:    "/images/create",
+			event:    &eventtypes.ImageCreate{Name: "docker.io/library/nginx:1.25"},
+			expected: true,
+		},
+		{
+			name:     "create with excluded label",
+			topic:    "/images/create",
+			event:    &eventtypes.ImageCreate{Name: "docker.io/library/nginx:1.25", Labels: map[string]string{"ci.scratch": "true"}},
+			expected: false,
+		},
+		{
+			name:     "update with excluded label",
+			topic:    "/images/update",
+			event:    &eventtypes.ImageUpdate{Name: "docker.io/library/nginx:1.25", Labels: map[string]string{"ci.scratch": "true"}},
+			expected: false,
+		},
+		{
+			name:     "delete",
+			topic:    "/images/delete",
+			event:    &eventtypes.ImageDelete{Name: "docker.io/library/nginx:1.25"},
+			expected: true,
+		},
+		{
+			name:     "delete from other registry",
+			topic:    "/images/delete",
+			event:    &eventtypes.ImageDelete{Name: "ghcr.io/xenitab/spegel:v0.0.8"},
+			expected: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := typeurl.MarshalAny(tt.event)
+			require.NoError(t, err)
+			envelope := &events.Envelope{Topic: tt.topic, Event: a}
+			require.Equal(t, tt.expected, filter.Match(envelope))
 		})
 	}
 }
@@ -280,6 +791,7 @@ func TestMirrorConfiguration(t *testing.T) {
 		createConfigPathDir bool
 		existingFiles       map[string]string
 		expectedFiles       map[string]string
+		expectNoBackup      bool
 	}{
 		{
 			name:        "multiple mirros",
@@ -287,7 +799,7 @@ func TestMirrorConfiguration(t *testing.T) {
 			registries:  stringListToUrlList(t, []string{"http://foo.bar:5000"}),
 			mirrors:     stringListToUrlList(t, []string{"http://127.0.0.1:5000", "http://127.0.0.1:5001"}),
 			expectedFiles: map[string]string{
-				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": `server = 'http://foo.bar:5000'
+				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": managedHostsFile(t, `server = 'http://foo.bar:5000'
 
 [host]
 [host.'http://127.0.0.1:5000']
@@ -295,7 +807,24 @@ capabilities = ['pull', 'resolve']
 
 [host.'http://127.0.0.1:5001']
 capabilities = ['pull', 'resolve']
-`,
+`),
+			},
+		},
+		{
+			name:        "IPv6 mirrors",
+			resolveTags: true,
+			registries:  stringListToUrlList(t, []string{"http://[fd00::10]:5000"}),
+			mirrors:     stringListToUrlList(t, []string{"http://[::1]:30020", "http://[fd00::1]:30021"}),
+			expectedFiles: map[string]string{
+				"/etc/containerd/certs.d/[fd00::10]:5000/hosts.toml": managedHostsFile(t, `server = 'http://[fd00::10]:5000'
+
+[host]
+[host.'http://[::1]:30020']
+capabilities = ['pull', 'resolve']
+
+[host.'http://[fd00::1]:30021']
+capabilities = ['pull', 'resolve']
+`),
 			},
 		},
 		{
@@ -304,18 +833,18 @@ capabilities = ['pull', 'resolve']
 			registries:  stringListToUrlList(t, []string{"https://docker.io", "http://foo.bar:5000"}),
 			mirrors:     stringListToUrlList(t, []string{"http://127.0.0.1:5000"}),
 			expectedFiles: map[string]string{
-				"/etc/containerd/certs.d/docker.io/hosts.toml": `server = 'https://registry-1.docker.io'
+				"/etc/containerd/certs.d/docker.io/hosts.toml": managedHostsFile(t, `server = 'https://registry-1.docker.io'
 
 [host]
 [host.'http://127.0.0.1:5000']
 capabilities = ['pull']
-`,
-				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": `server = 'http://foo.bar:5000'
+`),
+				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": managedHostsFile(t, `server = 'http://foo.bar:5000'
 
 [host]
 [host.'http://127.0.0.1:5000']
 capabilities = ['pull']
-`,
+`),
 			},
 		},
 		{
@@ -325,18 +854,18 @@ capabilities = ['pull']
 			mirrors:             stringListToUrlList(t, []string{"http://127.0.0.1:5000"}),
 			createConfigPathDir: false,
 			expectedFiles: map[string]string{
-				"/etc/containerd/certs.d/docker.io/hosts.toml": `server = 'https://registry-1.docker.io'
+				"/etc/containerd/certs.d/docker.io/hosts.toml": managedHostsFile(t, `server = 'https://registry-1.docker.io'
 
 [host]
 [host.'http://127.0.0.1:5000']
 capabilities = ['pull', 'resolve']
-`,
-				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": `server = 'http://foo.bar:5000'
+`),
+				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": managedHostsFile(t, `server = 'http://foo.bar:5000'
 
 [host]
 [host.'http://127.0.0.1:5000']
 capabilities = ['pull', 'resolve']
-`,
+`),
 			},
 		},
 		{
@@ -346,18 +875,18 @@ capabilities = ['pull', 'resolve']
 			mirrors:             stringListToUrlList(t, []string{"http://127.0.0.1:5000"}),
 			createConfigPathDir: true,
 			expectedFiles: map[string]string{
-				"/etc/containerd/certs.d/docker.io/hosts.toml": `server = 'https://registry-1.docker.io'
+				"/etc/containerd/certs.d/docker.io/hosts.toml": managedHostsFile(t, `server = 'https://registry-1.docker.io'
 
 [host]
 [host.'http://127.0.0.1:5000']
 capabilities = ['pull', 'resolve']
-`,
-				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": `server = 'http://foo.bar:5000'
+`),
+				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": managedHostsFile(t, `server = 'http://foo.bar:5000'
 
 [host]
 [host.'http://127.0.0.1:5000']
 capabilities = ['pull', 'resolve']
-`,
+`),
 			},
 		},
 		{
@@ -373,18 +902,61 @@ capabilities = ['pull', 'resolve']
 			expectedFiles: map[string]string{
 				"/etc/containerd/certs.d/_backup/docker.io/hosts.toml": "Hello World",
 				"/etc/containerd/certs.d/_backup/ghcr.io/hosts.toml":   "Foo Bar",
-				"/etc/containerd/certs.d/docker.io/hosts.toml": `server = 'https://registry-1.docker.io'
+				"/etc/containerd/certs.d/docker.io/hosts.toml": managedHostsFile(t, `server = 'https://registry-1.docker.io'
 
 [host]
 [host.'http://127.0.0.1:5000']
 capabilities = ['pull', 'resolve']
-`,
-				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": `server = 'http://foo.bar:5000'
+`),
+				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": managedHostsFile(t, `server = 'http://foo.bar:5000'
 
 [host]
 [host.'http://127.0.0.1:5000']
 capabilities = ['pull', 'resolve']
-`,
+`),
+			},
+		},
+		{
+			name:                "config path directory contains configuration generated by spegel",
+			resolveTags:         true,
+			registries:          stringListToUrlList(t, []string{"http://foo.bar:5000"}),
+			mirrors:             stringListToUrlList(t, []string{"http://127.0.0.1:5001"}),
+			createConfigPathDir: true,
+			existingFiles: map[string]string{
+				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": managedHostsFile(t, `server = 'http://foo.bar:5000'
+
+[host]
+[host.'http://127.0.0.1:5000']
+capabilities = ['pull', 'resolve']
+`),
+			},
+			expectedFiles: map[string]string{
+				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": managedHostsFile(t, `server = 'http://foo.bar:5000'
+
+[host]
+[host.'http://127.0.0.1:5001']
+capabilities = ['pull', 'resolve']
+`),
+			},
+			expectNoBackup: true,
+		},
+		{
+			name:                "config path directory contains modified configuration generated by spegel",
+			resolveTags:         true,
+			registries:          stringListToUrlList(t, []string{"http://foo.bar:5000"}),
+			mirrors:             stringListToUrlList(t, []string{"http://127.0.0.1:5000"}),
+			createConfigPathDir: true,
+			existingFiles: map[string]string{
+				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": "# Generated by Spegel, changes will be overwritten.\n# Checksum: sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\nserver = 'http://foo.bar:5000'\n",
+			},
+			expectedFiles: map[string]string{
+				"/etc/containerd/certs.d/_backup/foo.bar:5000/hosts.toml": "# Generated by Spegel, changes will be overwritten.\n# Checksum: sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\nserver = 'http://foo.bar:5000'\n",
+				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": managedHostsFile(t, `server = 'http://foo.bar:5000'
+
+[host]
+[host.'http://127.0.0.1:5000']
+capabilities = ['pull', 'resolve']
+`),
 			},
 		},
 		{
@@ -402,18 +974,18 @@ capabilities = ['pull', 'resolve']
 			expectedFiles: map[string]string{
 				"/etc/containerd/certs.d/_backup/docker.io/hosts.toml": "Hello World",
 				"/etc/containerd/certs.d/_backup/ghcr.io/hosts.toml":   "Foo Bar",
-				"/etc/containerd/certs.d/docker.io/hosts.toml": `server = 'https://registry-1.docker.io'
+				"/etc/containerd/certs.d/docker.io/hosts.toml": managedHostsFile(t, `server = 'https://registry-1.docker.io'
 
 [host]
 [host.'http://127.0.0.1:5000']
 capabilities = ['pull', 'resolve']
-`,
-				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": `server = 'http://foo.bar:5000'
+`),
+				"/etc/containerd/certs.d/foo.bar:5000/hosts.toml": managedHostsFile(t, `server = 'http://foo.bar:5000'
 
 [host]
 [host.'http://127.0.0.1:5000']
 capabilities = ['pull', 'resolve']
-`,
+`),
 			},
 		},
 	}
@@ -428,9 +1000,9 @@ capabilities = ['pull', 'resolve']
 				err := afero.WriteFile(fs, k, []byte(v), 0644)
 				require.NoError(t, err)
 			}
-			err := AddMirrorConfiguration(context.TODO(), fs, registryConfigPath, tt.registries, tt.mirrors, tt.resolveTags)
+			err := AddMirrorConfiguration(context.TODO(), fs, registryConfigPath, tt.registries, tt.mirrors, ResolveTags{Default: tt.resolveTags}, nil)
 			require.NoError(t, err)
-			if len(tt.existingFiles) == 0 {
+			if len(tt.existingFiles) == 0 || tt.expectNoBackup {
 				ok, err := afero.DirExists(fs, "/etc/containerd/certs.d/_backup")
 				require.NoError(t, err)
 				require.False(t, ok)
@@ -451,27 +1023,207 @@ capabilities = ['pull', 'resolve']
 	}
 }
 
+func TestDefaultMirrorConfiguration(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	configPath := "/etc/containerd/certs.d"
+	registries := stringListToUrlList(t, []string{"https://docker.io"})
+	mirrors := stringListToUrlList(t, []string{"http://127.0.0.1:5000"})
+	err := AddMirrorConfiguration(context.TODO(), fs, configPath, registries, mirrors, ResolveTags{Default: true}, nil)
+	require.NoError(t, err)
+	err = AddDefaultMirrorConfiguration(context.TODO(), fs, configPath, mirrors, ResolveTags{Default: true})
+	require.NoError(t, err)
+
+	b, err := afero.ReadFile(fs, "/etc/containerd/certs.d/_default/hosts.toml")
+	require.NoError(t, err)
+	expected := managedHostsFile(t, `[host]
+[host.'http://127.0.0.1:5000']
+capabilities = ['pull', 'resolve']
+`)
+	require.Equal(t, expected, string(b))
+	ok, err := afero.Exists(fs, "/etc/containerd/certs.d/docker.io/hosts.toml")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Default configuration should be replaced and not backed up on the next run.
+	err = AddMirrorConfiguration(context.TODO(), fs, configPath, registries, mirrors, ResolveTags{Default: true}, nil)
+	require.NoError(t, err)
+	ok, err = afero.DirExists(fs, "/etc/containerd/certs.d/_backup")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestParseManagedHeader(t *testing.T) {
+	content := "server = 'https://docker.io'\n"
+	tests := []struct {
+		name             string
+		content          string
+		expectedManaged  bool
+		expectedModified bool
+	}{
+		{
+			name:             "not generated by Spegel",
+			content:          content,
+			expectedManaged:  false,
+			expectedModified: false,
+		},
+		{
+			name:             "generated by Spegel",
+			content:          string(addManagedHeader([]byte(content))),
+			expectedManaged:  true,
+			expectedModified: false,
+		},
+		{
+			name:             "modified after generation",
+			content:          string(addManagedHeader([]byte(content))) + "[host]\n",
+			expectedManaged:  true,
+			expectedModified: true,
+		},
+		{
+			name:             "modified checksum",
+			content:          hostsMarker + "\n" + hostsChecksumPrefix + "sha256:foo\n" + content,
+			expectedManaged:  true,
+			expectedModified: true,
+		},
+		{
+			name:             "legacy marker without checksum",
+			content:          hostsMarker + "\n" + content,
+			expectedManaged:  true,
+			expectedModified: false,
+		},
+		{
+			name:             "legacy marker only",
+			content:          hostsMarker,
+			expectedManaged:  true,
+			expectedModified: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			managed, modified := parseManagedHeader([]byte(tt.content))
+			require.Equal(t, tt.expectedManaged, managed)
+			require.Equal(t, tt.expectedModified, modified)
+		})
+	}
+}
+
 func TestMirrorConfigurationInvalidMirrorURL(t *testing.T) {
 	fs := afero.NewMemMapFs()
 	mirrors := stringListToUrlList(t, []string{"http://127.0.0.1:5000"})
 
 	registries := stringListToUrlList(t, []string{"ftp://docker.io"})
-	err := AddMirrorConfiguration(context.TODO(), fs, "/etc/containerd/certs.d", registries, mirrors, true)
+	err := AddMirrorConfiguration(context.TODO(), fs, "/etc/containerd/certs.d", registries, mirrors, ResolveTags{Default: true}, nil)
 	require.EqualError(t, err, "invalid registry url scheme must be http or https: ftp://docker.io")
 
 	registries = stringListToUrlList(t, []string{"https://docker.io/foo/bar"})
-	err = AddMirrorConfiguration(context.TODO(), fs, "/etc/containerd/certs.d", registries, mirrors, true)
+	err = AddMirrorConfiguration(context.TODO(), fs, "/etc/containerd/certs.d", registries, mirrors, ResolveTags{Default: true}, nil)
 	require.EqualError(t, err, "invalid registry url path has to be empty: https://docker.io/foo/bar")
 
 	registries = stringListToUrlList(t, []string{"https://docker.io?foo=bar"})
-	err = AddMirrorConfiguration(context.TODO(), fs, "/etc/containerd/certs.d", registries, mirrors, true)
+	err = AddMirrorConfiguration(context.TODO(), fs, "/etc/containerd/certs.d", registries, mirrors, ResolveTags{Default: true}, nil)
 	require.EqualError(t, err, "invalid registry url query has to be empty: https://docker.io?foo=bar")
 
 	registries = stringListToUrlList(t, []string{"https://foo@docker.io"})
-	err = AddMirrorConfiguration(context.TODO(), fs, "/etc/containerd/certs.d", registries, mirrors, true)
+	err = AddMirrorConfiguration(context.TODO(), fs, "/etc/containerd/certs.d", registries, mirrors, ResolveTags{Default: true}, nil)
 	require.EqualError(t, err, "invalid registry url user has to be empty: https://foo@docker.io")
 }
 
+func TestCleanupMirrorConfiguration(t *testing.T) {
+	tests := []struct {
+		name          string
+		configPath    string
+		add           func(ctx context.Context, fs afero.Fs, configPath string, registryURLs, mirrorURLs []url.URL, resolveTags ResolveTags, registryServers map[string]string) error
+		existingFiles map[string]string
+		expectedFiles map[string]string
+	}{
+		{
+			name:       "containerd",
+			configPath: "/etc/containerd/certs.d",
+			add:        AddMirrorConfiguration,
+			existingFiles: map[string]string{
+				"/etc/containerd/certs.d/docker.io/hosts.toml": "hello = 'world'",
+				"/etc/containerd/certs.d/ghcr.io/hosts.toml":   "foo = 'bar'",
+			},
+			expectedFiles: map[string]string{
+				"/etc/containerd/certs.d/docker.io/hosts.toml": "hello = 'world'",
+				"/etc/containerd/certs.d/ghcr.io/hosts.toml":   "foo = 'bar'",
+			},
+		},
+		{
+			name:       "registries conf",
+			configPath: "/etc/containers/registries.conf.d",
+			add:        AddRegistriesConfConfiguration,
+			existingFiles: map[string]string{
+				"/etc/containers/registries.conf.d/000-shortnames.conf": "[aliases]",
+			},
+			expectedFiles: map[string]string{
+				"/etc/containers/registries.conf.d/000-shortnames.conf": "[aliases]",
+			},
+		},
+		{
+			name:          "without existing configuration",
+			configPath:    "/etc/containerd/certs.d",
+			add:           AddMirrorConfiguration,
+			existingFiles: map[string]string{},
+			expectedFiles: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			for k, v := range tt.existingFiles {
+				err := afero.WriteFile(fs, k, []byte(v), 0644)
+				require.NoError(t, err)
+			}
+			registries := stringListToUrlList(t, []string{"https://docker.io", "https://ghcr.io", "https://quay.io"})
+			mirrors := stringListToUrlList(t, []string{"http://127.0.0.1:5000"})
+			err := tt.add(context.TODO(), fs, tt.configPath, registries, mirrors, ResolveTags{Default: true}, nil)
+			require.NoError(t, err)
+			err = CleanupMirrorConfiguration(context.TODO(), fs, tt.configPath)
+			require.NoError(t, err)
+
+			ok, err := afero.DirExists(fs, path.Join(tt.configPath, backupDir))
+			require.NoError(t, err)
+			require.False(t, ok)
+			files := map[string]string{}
+			err = afero.Walk(fs, tt.configPath, func(path string, fi iofs.FileInfo, _ error) error {
+				if fi.IsDir() {
+					return nil
+				}
+				b, err := afero.ReadFile(fs, path)
+				require.NoError(t, err)
+				files[path] = string(b)
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedFiles, files)
+		})
+	}
+}
+
+func TestCleanupMirrorConfigurationKeepsModified(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	configPath := "/etc/containerd/certs.d"
+	modified := strings.Replace(managedHostsFile(t, "server = 'https://registry-1.docker.io'"), "registry-1.", "", 1)
+	err := afero.WriteFile(fs, "/etc/containerd/certs.d/docker.io/hosts.toml", []byte(modified), 0644)
+	require.NoError(t, err)
+	err = afero.WriteFile(fs, "/etc/containerd/certs.d/quay.io/hosts.toml", []byte(managedHostsFile(t, "server = 'https://quay.io'")), 0644)
+	require.NoError(t, err)
+
+	err = CleanupMirrorConfiguration(context.TODO(), fs, configPath)
+	require.NoError(t, err)
+	b, err := afero.ReadFile(fs, "/etc/containerd/certs.d/docker.io/hosts.toml")
+	require.NoError(t, err)
+	require.Equal(t, modified, string(b))
+	ok, err := afero.DirExists(fs, "/etc/containerd/certs.d/quay.io")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func managedHostsFile(t *testing.T, content string) string {
+	t.Helper()
+	return string(addManagedHeader([]byte(content)))
+}
+
 func stringListToUrlList(t *testing.T, list []string) []url.URL {
 	t.Helper()
 	urls := []url.URL{}
@@ -491,12 +1243,56 @@ func (r *readerAt) Close() error {
 	return nil
 }
 
+// readFixtures returns the documents in testdata/images and testdata/handmade keyed by digest.
+// Documents that do not exist in any registry, like the index without a media type, belong in testdata/handmade.
+func readFixtures(t testing.TB) map[string]string {
+	t.Helper()
+	data := map[string]string{}
+	for _, dir := range []string{filepath.Join("testdata", "images"), filepath.Join("testdata", "handmade")} {
+		readFixtureDir(t, dir, data)
+	}
+	return data
+}
+
+func readFixtureDir(t testing.TB, dir string, data map[string]string) {
+	t.Helper()
+	err := filepath.WalkDir(dir, func(p string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		alg, encoded := filepath.Split(rel)
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(filepath.Clean(alg)), encoded)
+		if dgst.Algorithm().FromBytes(b) != dgst {
+			return fmt.Errorf("fixture %s does not match its digest", p)
+		}
+		data[dgst.String()] = string(b)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
 type mockContentStore struct {
 	data map[string]string
+	// missing are blobs that have been removed, all other blobs exist even when they have no data.
+	missing map[string]interface{}
 }
 
-func (*mockContentStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
-	panic("not implemented")
+func (m *mockContentStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	if _, ok := m.missing[dgst.String()]; ok {
+		return content.Info{}, fmt.Errorf("content %s: %w", dgst, errdefs.ErrNotFound)
+	}
+	return content.Info{Digest: dgst}, nil
 }
 
 func (*mockContentStore) Walk(ctx context.Context, fn content.WalkFunc, filters ...string) error {
@@ -510,7 +1306,7 @@ func (*mockContentStore) Delete(ctx context.Context, dgst digest.Digest) error {
 func (m *mockContentStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
 	s, ok := m.data[desc.Digest.String()]
 	if !ok {
-		return nil, fmt.Errorf("digest not found: %s", desc.Digest.String())
+		return nil, fmt.Errorf("digest not found %s: %w", desc.Digest.String(), errdefs.ErrNotFound)
 	}
 	return &readerAt{*bytes.NewReader([]byte(s))}, nil
 }
@@ -563,3 +1359,118 @@ func (*mockImageStore) Update(ctx context.Context, image images.Image, fieldpath
 func (*mockImageStore) Delete(ctx context.Context, name string, opts ...images.DeleteOpt) error {
 	return nil
 }
+
+// mockNamespacedImageStore stores images per namespace, names of listed images are returned in order.
+type mockNamespacedImageStore struct {
+	mockImageStore
+	data map[string]map[string]images.Image
+}
+
+func (m *mockNamespacedImageStore) Get(ctx context.Context, name string) (images.Image, error) {
+	ns, _ := namespaces.Namespace(ctx)
+	img, ok := m.data[ns][name]
+	if !ok {
+		return images.Image{}, fmt.Errorf("image %s in namespace %s: %w", name, ns, errdefs.ErrNotFound)
+	}
+	return img, nil
+}
+
+func (m *mockNamespacedImageStore) List(ctx context.Context, filters ...string) ([]images.Image, error) {
+	ns, _ := namespaces.Namespace(ctx)
+	names := []string{}
+	for name := range m.data[ns] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	imgs := []images.Image{}
+	for _, name := range names {
+		imgs = append(imgs, m.data[ns][name])
+	}
+	return imgs, nil
+}
+
+func TestOpenContentFile(t *testing.T) {
+	contentPath := t.TempDir()
+	content := []byte("hello world")
+	dgst := digest.FromBytes(content)
+	err := os.MkdirAll(filepath.Join(contentPath, "blobs", "sha256"), 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(contentPath, "blobs", "sha256", dgst.Encoded()), content, 0644)
+	require.NoError(t, err)
+
+	f, err := openContentFile(contentPath, dgst)
+	require.NoError(t, err)
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+
+	_, err = openContentFile(contentPath, digest.FromString("foo"))
+	require.True(t, os.IsNotExist(err))
+	_, err = openContentFile(contentPath, digest.Digest("sha256:../../etc/passwd"))
+	require.Error(t, err)
+}
+
+func TestVerifyContentPath(t *testing.T) {
+	contentPath := t.TempDir()
+	err := verifyContentPath(contentPath)
+	require.Error(t, err)
+	err = os.WriteFile(filepath.Join(contentPath, "blobs"), []byte("foo"), 0644)
+	require.NoError(t, err)
+	err = verifyContentPath(contentPath)
+	require.EqualError(t, err, fmt.Sprintf("content path %s is not a Containerd content store", contentPath))
+
+	contentPath = t.TempDir()
+	err = os.MkdirAll(filepath.Join(contentPath, "blobs", "sha256"), 0755)
+	require.NoError(t, err)
+	err = verifyContentPath(contentPath)
+	require.NoError(t, err)
+}
+
+func TestMirrorConfigurationRegistryResolveTags(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	configPath := "/etc/containerd/certs.d"
+	registries := stringListToUrlList(t, []string{"https://docker.io", "https://internal.corp"})
+	mirrors := stringListToUrlList(t, []string{"http://127.0.0.1:5000"})
+	resolveTags := ResolveTags{Default: false, Overrides: map[string]bool{"internal.corp": true}}
+	err := AddMirrorConfiguration(context.TODO(), fs, configPath, registries, mirrors, resolveTags, nil)
+	require.NoError(t, err)
+
+	b, err := afero.ReadFile(fs, path.Join(configPath, "docker.io", "hosts.toml"))
+	require.NoError(t, err)
+	require.Contains(t, string(b), "capabilities = ['pull']\n")
+	b, err = afero.ReadFile(fs, path.Join(configPath, "internal.corp", "hosts.toml"))
+	require.NoError(t, err)
+	require.Contains(t, string(b), "capabilities = ['pull', 'resolve']\n")
+}
+
+func TestMirrorConfigurationRegistryServers(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	configPath := "/etc/containerd/certs.d"
+	registries := stringListToUrlList(t, []string{"https://docker.io", "https://registry.corp", "https://ghcr.io"})
+	mirrors := stringListToUrlList(t, []string{"http://127.0.0.1:5000"})
+	registryServers := map[string]string{"registry.corp": "https://corp.jfrog.io/artifactory/api/docker/virtual"}
+	err := AddMirrorConfiguration(context.TODO(), fs, configPath, registries, mirrors, ResolveTags{Default: true}, registryServers)
+	require.NoError(t, err)
+
+	expected := map[string]string{
+		"docker.io":     "server = 'https://registry-1.docker.io'\n",
+		"registry.corp": "server = 'https://corp.jfrog.io/artifactory/api/docker/virtual'\n",
+		"ghcr.io":       "server = 'https://ghcr.io'\n",
+	}
+	for host, server := range expected {
+		b, err := afero.ReadFile(fs, path.Join(configPath, host, "hosts.toml"))
+		require.NoError(t, err)
+		require.Contains(t, string(b), server)
+	}
+
+	// Servers override the default of Docker Hub.
+	err = AddMirrorConfiguration(context.TODO(), fs, configPath, registries[:1], mirrors, ResolveTags{Default: true}, map[string]string{"docker.io": "https://mirror.corp"})
+	require.NoError(t, err)
+	b, err := afero.ReadFile(fs, path.Join(configPath, "docker.io", "hosts.toml"))
+	require.NoError(t, err)
+	require.Contains(t, string(b), "server = 'https://mirror.corp'\n")
+
+	err = AddMirrorConfiguration(context.TODO(), fs, configPath, registries, mirrors, ResolveTags{Default: true}, map[string]string{"registry.corp": "corp.jfrog.io"})
+	require.EqualError(t, err, "invalid server of registry registry.corp scheme must be http or https: corp.jfrog.io\ninvalid server of registry registry.corp host has to be set: corp.jfrog.io")
+}
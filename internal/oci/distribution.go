@@ -12,12 +12,14 @@ type ReferenceType string
 const (
 	ReferenceTypeManifest = "Manifest"
 	ReferenceTypeBlob     = "Blob"
+	ReferenceTypeTagsList = "TagsList"
 )
 
 // Package is used to parse components from requests which comform with the OCI distribution spec.
 // https://github.com/opencontainers/distribution-spec/blob/main/spec.md
 // /v2/<name>/manifests/<reference>
 // /v2/<name>/blobs/<reference>
+// /v2/<name>/tags/list
 
 var (
 	nameRegex           = regexp.MustCompile(`([a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*)`)
@@ -25,10 +27,19 @@ var (
 	manifestRegexTag    = regexp.MustCompile(`/v2/` + nameRegex.String() + `/manifests/` + tagRegex.String() + `$`)
 	manifestRegexDigest = regexp.MustCompile(`/v2/` + nameRegex.String() + `/manifests/(.*)`)
 	blobsRegexDigest    = regexp.MustCompile(`/v2/` + nameRegex.String() + `/blobs/(.*)`)
+	tagsListRegex       = regexp.MustCompile(`/v2/` + nameRegex.String() + `/tags/list$`)
 )
 
 func ParsePathComponents(registry, path string) (string, digest.Digest, ReferenceType, error) {
-	comps := manifestRegexTag.FindStringSubmatch(path)
+	comps := tagsListRegex.FindStringSubmatch(path)
+	if len(comps) == 5 {
+		if registry == "" {
+			return "", "", "", fmt.Errorf("registry parameter needs to be set for tag list references")
+		}
+		ref := fmt.Sprintf("%s/%s", registry, comps[1])
+		return ref, "", ReferenceTypeTagsList, nil
+	}
+	comps = manifestRegexTag.FindStringSubmatch(path)
 	if len(comps) == 6 {
 		if registry == "" {
 			return "", "", "", fmt.Errorf("registry parameter needs to be set for tag references")
@@ -38,11 +49,19 @@ func ParsePathComponents(registry, path string) (string, digest.Digest, Referenc
 	}
 	comps = manifestRegexDigest.FindStringSubmatch(path)
 	if len(comps) == 6 {
-		return "", digest.Digest(comps[5]), ReferenceTypeManifest, nil
+		dgst, err := digest.Parse(comps[5])
+		if err != nil {
+			return "", "", "", err
+		}
+		return "", dgst, ReferenceTypeManifest, nil
 	}
 	comps = blobsRegexDigest.FindStringSubmatch(path)
 	if len(comps) == 6 {
-		return "", digest.Digest(comps[5]), ReferenceTypeBlob, nil
+		dgst, err := digest.Parse(comps[5])
+		if err != nil {
+			return "", "", "", err
+		}
+		return "", dgst, ReferenceTypeBlob, nil
 	}
 	return "", "", "", fmt.Errorf("distribution path could not be parsed")
 }
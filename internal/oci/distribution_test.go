@@ -32,6 +32,38 @@ func TestParsePathComponents(t *testing.T) {
 			expectedDgst:    digest.Digest("sha256:295c7be079025306c4f1d65997fcf7adb411c88f139ad1d34b537164aa060369"),
 			expectedRefType: ReferenceTypeBlob,
 		},
+		{
+			name:            "helm chart tag",
+			registry:        "ghcr.io",
+			path:            "/v2/stefanprodan/charts/podinfo/manifests/6.5.4",
+			expectedRef:     "ghcr.io/stefanprodan/charts/podinfo:6.5.4",
+			expectedDgst:    "",
+			expectedRefType: ReferenceTypeManifest,
+		},
+		{
+			name:            "helm chart tag with build metadata",
+			registry:        "ghcr.io",
+			path:            "/v2/stefanprodan/charts/podinfo/manifests/6.5.4_build.1",
+			expectedRef:     "ghcr.io/stefanprodan/charts/podinfo:6.5.4_build.1",
+			expectedDgst:    "",
+			expectedRefType: ReferenceTypeManifest,
+		},
+		{
+			name:            "artifact manifest digest",
+			registry:        "ghcr.io",
+			path:            "/v2/xenitab/spegel/manifests/sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+			expectedRef:     "",
+			expectedDgst:    digest.Digest("sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"),
+			expectedRefType: ReferenceTypeManifest,
+		},
+		{
+			name:            "valid tags list",
+			registry:        "ghcr.io",
+			path:            "/v2/xenitab/spegel/tags/list",
+			expectedRef:     "ghcr.io/xenitab/spegel",
+			expectedDgst:    "",
+			expectedRefType: ReferenceTypeTagsList,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -53,3 +85,27 @@ func TestParsePathComponentsMissingRegistry(t *testing.T) {
 	_, _, _, err := ParsePathComponents("", "/v2/xenitab/spegel/manifests/v0.0.1")
 	require.EqualError(t, err, "registry parameter needs to be set for tag references")
 }
+
+func TestParsePathComponentsInvalidDigest(t *testing.T) {
+	_, _, _, err := ParsePathComponents("example.com", "/v2/xenitab/spegel/blobs/sha256:foo")
+	require.EqualError(t, err, "invalid checksum digest length")
+}
+
+func FuzzParsePathComponents(f *testing.F) {
+	f.Add("example.com", "/v2/foo/bar/manifests/hello-world")
+	f.Add("docker.io", "/v2/library/nginx/blobs/sha256:295c7be079025306c4f1d65997fcf7adb411c88f139ad1d34b537164aa060369")
+	f.Add("ghcr.io", "/v2/xenitab/spegel/tags/list")
+	f.Add("", "/v2/xenitab/spegel/manifests/sha256:295c7be079025306c4f1d65997fcf7adb411c88f139ad1d34b537164aa060369")
+	f.Fuzz(func(t *testing.T, registry, path string) {
+		ref, dgst, refType, err := ParsePathComponents(registry, path)
+		if err != nil {
+			return
+		}
+		require.NotEmpty(t, refType)
+		if dgst == "" {
+			require.NotEmpty(t, ref)
+			return
+		}
+		require.NoError(t, dgst.Validate())
+	})
+}
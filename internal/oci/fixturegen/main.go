@@ -0,0 +1,117 @@
+// fixturegen snapshots manifests and indexes of images from live registries
+// into test fixtures used by the oci package tests. Each document is written
+// as is to a file named by its digest so that the fixtures can be served by
+// a mock content store.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/alexflint/go-arg"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type Arguments struct {
+	Output string   `arg:"--output" default:"testdata/images" help:"Directory where fixtures are written."`
+	Config bool     `arg:"--config" default:"false" help:"When true image configs are written in addition to manifests and indexes."`
+	Refs   []string `arg:"positional,required" help:"Image references to snapshot."`
+}
+
+func main() {
+	args := &Arguments{}
+	arg.MustParse(args)
+	if err := run(context.Background(), args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args *Arguments) error {
+	resolver := docker.NewResolver(docker.ResolverOptions{})
+	for _, ref := range args.Refs {
+		name, desc, err := resolver.Resolve(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("could not resolve %s: %w", ref, err)
+		}
+		fetcher, err := resolver.Fetcher(ctx, name)
+		if err != nil {
+			return err
+		}
+		err = snapshot(ctx, fetcher, desc, args.Output, args.Config)
+		if err != nil {
+			return fmt.Errorf("could not snapshot %s: %w", ref, err)
+		}
+		fmt.Printf("%s %s\n", ref, desc.Digest)
+	}
+	return nil
+}
+
+func snapshot(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, output string, config bool) error {
+	b, err := fetch(ctx, fetcher, desc)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(output, desc.Digest.Algorithm().String())
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, desc.Digest.Encoded()), b, 0o644)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case images.IsIndexType(desc.MediaType):
+		var idx ocispec.Index
+		if err := json.Unmarshal(b, &idx); err != nil {
+			return err
+		}
+		for _, m := range idx.Manifests {
+			if err := snapshot(ctx, fetcher, m, output, config); err != nil {
+				return err
+			}
+		}
+	case images.IsManifestType(desc.MediaType):
+		if !config {
+			return nil
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return err
+		}
+		return snapshot(ctx, fetcher, manifest.Config, output, config)
+	}
+	return nil
+}
+
+func fetch(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) ([]byte, error) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	verifier := desc.Digest.Verifier()
+	if _, err := verifier.Write(b); err != nil {
+		return nil, err
+	}
+	if !verifier.Verified() {
+		return nil, fmt.Errorf("content does not match digest %s", desc.Digest)
+	}
+	return b, nil
+}
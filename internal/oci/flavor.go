@@ -0,0 +1,60 @@
+package oci
+
+import (
+	"fmt"
+)
+
+// RuntimeFlavor is the distribution that Containerd is run by, which decides the default socket and paths.
+type RuntimeFlavor string
+
+const (
+	RuntimeFlavorStandard RuntimeFlavor = "standard"
+	RuntimeFlavorK3s      RuntimeFlavor = "k3s"
+	RuntimeFlavorRKE2     RuntimeFlavor = "rke2"
+)
+
+// RuntimePaths are the Containerd socket, namespace and paths of a runtime flavor.
+type RuntimePaths struct {
+	Sock               string
+	Namespace          string
+	RegistryConfigPath string
+	// ConfigTemplatePath is the template that the Containerd configuration is generated from, empty when the configuration is not templated.
+	ConfigTemplatePath string
+}
+
+var runtimePaths = map[RuntimeFlavor]RuntimePaths{
+	RuntimeFlavorStandard: {
+		Sock:               "/run/containerd/containerd.sock",
+		Namespace:          "k8s.io",
+		RegistryConfigPath: "/etc/containerd/certs.d",
+	},
+	RuntimeFlavorK3s: {
+		Sock:               "/run/k3s/containerd/containerd.sock",
+		Namespace:          "k8s.io",
+		RegistryConfigPath: "/var/lib/rancher/k3s/agent/etc/containerd/certs.d",
+		ConfigTemplatePath: "/var/lib/rancher/k3s/agent/etc/containerd/config.toml.tmpl",
+	},
+	RuntimeFlavorRKE2: {
+		Sock:               "/run/k3s/containerd/containerd.sock",
+		Namespace:          "k8s.io",
+		RegistryConfigPath: "/var/lib/rancher/rke2/agent/etc/containerd/certs.d",
+		ConfigTemplatePath: "/var/lib/rancher/rke2/agent/etc/containerd/config.toml.tmpl",
+	},
+}
+
+// GetRuntimePaths returns the paths of the runtime flavor.
+func GetRuntimePaths(flavor RuntimeFlavor) (RuntimePaths, error) {
+	paths, ok := runtimePaths[flavor]
+	if !ok {
+		return RuntimePaths{}, fmt.Errorf("unknown runtime flavor %s", flavor)
+	}
+	return paths, nil
+}
+
+// WithConfigTemplatePath adds the template path to verification errors, as changes to a templated configuration
+// have to be made to the template to not be overwritten when the runtime restarts.
+func WithConfigTemplatePath(p string) ContainerdOption {
+	return func(c *Containerd) {
+		c.configTemplatePath = p
+	}
+}
@@ -0,0 +1,23 @@
+package oci
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRuntimePaths(t *testing.T) {
+	paths, err := GetRuntimePaths(RuntimeFlavorStandard)
+	require.NoError(t, err)
+	require.Equal(t, "/run/containerd/containerd.sock", paths.Sock)
+	require.Empty(t, paths.ConfigTemplatePath)
+
+	paths, err = GetRuntimePaths(RuntimeFlavorRKE2)
+	require.NoError(t, err)
+	require.Equal(t, "/run/k3s/containerd/containerd.sock", paths.Sock)
+	require.Equal(t, "/var/lib/rancher/rke2/agent/etc/containerd/certs.d", paths.RegistryConfigPath)
+	require.Equal(t, "/var/lib/rancher/rke2/agent/etc/containerd/config.toml.tmpl", paths.ConfigTemplatePath)
+
+	_, err = GetRuntimePaths(RuntimeFlavor("foo"))
+	require.EqualError(t, err, "unknown runtime flavor foo")
+}
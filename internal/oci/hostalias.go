@@ -0,0 +1,88 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/spf13/afero"
+)
+
+const (
+	hostAliasMarker = "# managed by spegel"
+)
+
+// AddHostAlias writes an entry to the hosts file resolving the hostname to the ip.
+// Entries previously written by Spegel are replaced so the file does not grow on every run.
+func AddHostAlias(ctx context.Context, fs afero.Fs, hostsPath, hostname, ip string) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid host alias ip: %s", ip)
+	}
+	b, err := afero.ReadFile(fs, hostsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasSuffix(line, hostAliasMarker) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	// Keep a single trailing newline before appending the entry.
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	lines = append(lines, fmt.Sprintf("%s %s %s", ip, hostname, hostAliasMarker), "")
+	err = afero.WriteFile(fs, hostsPath, []byte(strings.Join(lines, "\n")), 0644)
+	if err != nil {
+		return err
+	}
+	log.Info("added host alias", "hostname", hostname, "ip", ip, "path", hostsPath)
+	return nil
+}
+
+// ReplaceLoopbackHost replaces the host of mirror URLs pointing at the loopback address with the hostname, keeping the port.
+// The port is always written, as the default port of the scheme is used when the mirror URL does not set one.
+func ReplaceLoopbackHost(mirrorURLs []url.URL, hostname string) []url.URL {
+	urls := []url.URL{}
+	for _, u := range mirrorURLs {
+		ip := net.ParseIP(u.Hostname())
+		if ip == nil || !ip.IsLoopback() {
+			urls = append(urls, u)
+			continue
+		}
+		u.Host = net.JoinHostPort(hostname, mirrorPort(u))
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// mirrorPort returns the port of the mirror URL, falling back to the default port of the scheme.
+func mirrorPort(u url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// LoopbackIP returns the loopback address of the first mirror URL pointing at a loopback address, so that the host alias
+// resolves to ::1 in IPv6 only clusters. The IPv4 loopback address is returned when no mirror points at a loopback address.
+func LoopbackIP(mirrorURLs []url.URL) string {
+	for _, u := range mirrorURLs {
+		ip := net.ParseIP(u.Hostname())
+		if ip != nil && ip.IsLoopback() {
+			return ip.String()
+		}
+	}
+	return "127.0.0.1"
+}
@@ -0,0 +1,50 @@
+package oci
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddHostAlias(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	err := afero.WriteFile(fs, "/etc/hosts", []byte("127.0.0.1 localhost\n"), 0644)
+	require.NoError(t, err)
+
+	// Running multiple times should not add duplicate entries.
+	for i := 0; i < 2; i++ {
+		err = AddHostAlias(context.TODO(), fs, "/etc/hosts", "spegel.localhost", "127.0.0.1")
+		require.NoError(t, err)
+	}
+	b, err := afero.ReadFile(fs, "/etc/hosts")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1 localhost\n127.0.0.1 spegel.localhost # managed by spegel\n", string(b))
+
+	err = AddHostAlias(context.TODO(), fs, "/etc/hosts", "spegel.localhost", "foo")
+	require.EqualError(t, err, "invalid host alias ip: foo")
+}
+
+func TestReplaceLoopbackHost(t *testing.T) {
+	mirrors := stringListToUrlList(t, []string{"http://127.0.0.1:30020", "http://127.0.0.1:30021", "https://example.com"})
+	urls := ReplaceLoopbackHost(mirrors, "spegel.localhost")
+	expected := stringListToUrlList(t, []string{"http://spegel.localhost:30020", "http://spegel.localhost:30021", "https://example.com"})
+	require.Equal(t, expected, urls)
+
+	mirrors = stringListToUrlList(t, []string{"http://[::1]:30020"})
+	urls = ReplaceLoopbackHost(mirrors, "spegel.localhost")
+	expected = stringListToUrlList(t, []string{"http://spegel.localhost:30020"})
+	require.Equal(t, expected, urls)
+
+	mirrors = stringListToUrlList(t, []string{"http://127.0.0.1", "https://127.0.0.1"})
+	urls = ReplaceLoopbackHost(mirrors, "spegel.localhost")
+	expected = stringListToUrlList(t, []string{"http://spegel.localhost:80", "https://spegel.localhost:443"})
+	require.Equal(t, expected, urls)
+}
+
+func TestLoopbackIP(t *testing.T) {
+	require.Equal(t, "127.0.0.1", LoopbackIP(stringListToUrlList(t, []string{"https://example.com", "http://127.0.0.1:30020"})))
+	require.Equal(t, "::1", LoopbackIP(stringListToUrlList(t, []string{"http://[::1]:30020", "http://[::1]:30021"})))
+	require.Equal(t, "127.0.0.1", LoopbackIP(stringListToUrlList(t, []string{"https://example.com"})))
+}
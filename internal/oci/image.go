@@ -5,6 +5,7 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"time"
 
 	digest "github.com/opencontainers/go-digest"
 )
@@ -15,6 +16,10 @@ type Image struct {
 	Repository string
 	Tag        string
 	Digest     digest.Digest
+	// UpdatedAt is when the image was last pulled or updated, it is only set for listed images.
+	UpdatedAt time.Time
+	// Namespace is the Containerd namespace of the image, it is only set for listed images and images of events.
+	Namespace string
 }
 
 func NewImage(name, registry, repository, tag string, dgst digest.Digest) (Image, error) {
@@ -65,18 +70,38 @@ func (i Image) TagName() (string, bool) {
 var splitRe = regexp.MustCompile(`[:@]`)
 
 func Parse(s string, extraDgst digest.Digest) (Image, error) {
+	registry, repository, tag, dgst, err := ParseReference(s)
+	if err != nil {
+		return Image{}, err
+	}
+	if dgst == "" {
+		dgst = extraDgst
+	}
+	if extraDgst != "" && dgst != extraDgst {
+		return Image{}, fmt.Errorf("invalid digest set does not match parsed digest: %v %v", s, dgst)
+	}
+	img, err := NewImage(s, registry, repository, tag, dgst)
+	if err != nil {
+		return Image{}, err
+	}
+	return img, nil
+}
+
+// ParseReference splits an image reference into registry, repository, tag and digest.
+// Tag and digest are empty when not present in the reference.
+func ParseReference(s string) (string, string, string, digest.Digest, error) {
 	if strings.Contains(s, "://") {
-		return Image{}, fmt.Errorf("invalid reference")
+		return "", "", "", "", fmt.Errorf("invalid reference")
 	}
 	u, err := url.Parse("dummy://" + s)
 	if err != nil {
-		return Image{}, err
+		return "", "", "", "", err
 	}
 	if u.Scheme != "dummy" {
-		return Image{}, fmt.Errorf("invalid reference")
+		return "", "", "", "", fmt.Errorf("invalid reference")
 	}
 	if u.Host == "" {
-		return Image{}, fmt.Errorf("hostname required")
+		return "", "", "", "", fmt.Errorf("hostname required")
 	}
 	var object string
 	if idx := splitRe.FindStringIndex(u.Path); idx != nil {
@@ -91,18 +116,7 @@ func Parse(s string, extraDgst digest.Digest) (Image, error) {
 	tag, dgst := splitObject(object)
 	tag, _, _ = strings.Cut(tag, "@")
 	repository := strings.TrimPrefix(u.Path, "/")
-
-	if dgst == "" {
-		dgst = extraDgst
-	}
-	if extraDgst != "" && dgst != extraDgst {
-		return Image{}, fmt.Errorf("invalid digest set does not match parsed digest: %v %v", s, dgst)
-	}
-	img, err := NewImage(s, u.Host, repository, tag, dgst)
-	if err != nil {
-		return Image{}, err
-	}
-	return img, nil
+	return u.Host, repository, tag, dgst, nil
 }
 
 func splitObject(obj string) (tag string, dgst digest.Digest) {
@@ -0,0 +1,116 @@
+package oci
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+)
+
+// ImportLayout imports the images of the OCI image layout directory into Containerd.
+// Blobs are verified against their digest and only written if they do not already exist, and existing images are updated,
+// so importing the same layout again is a no-op. Images are named by the containerd image name annotation or by a
+// reference name annotation containing a full image reference, as a tag alone cannot be mapped to a registry.
+func (c *Containerd) ImportLayout(ctx context.Context, dir string) (err error) {
+	defer observeContainerdCall("import_layout", time.Now(), &err)
+	log := logr.FromContextOrDiscard(ctx)
+
+	_, err = os.Stat(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return fmt.Errorf("could not find OCI image layout index: %w", err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarDirectory(pw, dir))
+	}()
+	defer pr.Close()
+	imgs, err := c.client.Import(ctx, pr, containerd.WithImageRefTranslator(fullReferenceName), containerd.WithImportPlatform(c.platform))
+	if err != nil {
+		return fmt.Errorf("could not import OCI image layout %s: %w", dir, err)
+	}
+	for _, img := range imgs {
+		log.Info("imported image from OCI image layout", "image", img.Name, "digest", img.Target.Digest.String())
+	}
+	return nil
+}
+
+// fullReferenceName returns the normalized reference name, or an empty string if it is not a full image reference.
+func fullReferenceName(name string) string {
+	if !strings.ContainsAny(name, "/:@") {
+		return ""
+	}
+	ref, err := docker.ParseDockerRef(name)
+	if err != nil {
+		return ""
+	}
+	return ref.String()
+}
+
+// tarDirectory writes the regular files of the directory as a tar stream with paths relative to the directory.
+// Containerd stores imported blobs by the digest of their content, so blobs are verified against their path
+// to fail instead of importing images that reference missing content.
+func tarDirectory(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(p string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		comps := strings.Split(hdr.Name, "/")
+		if len(comps) != 3 || comps[0] != "blobs" {
+			_, err = io.Copy(tw, f)
+			return err
+		}
+		dgst, err := digest.Parse(fmt.Sprintf("%s:%s", comps[1], comps[2]))
+		if err != nil {
+			return err
+		}
+		verifier := dgst.Verifier()
+		_, err = io.Copy(io.MultiWriter(tw, verifier), f)
+		if err != nil {
+			return err
+		}
+		if !verifier.Verified() {
+			return fmt.Errorf("content of blob %s does not match digest", hdr.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,73 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarDirectoryImport(t *testing.T) {
+	dir := t.TempDir()
+	writeBlob := func(b []byte, mediaType string) ocispec.Descriptor {
+		dgst := digest.FromBytes(b)
+		err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0o755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(dir, "blobs", "sha256", dgst.Encoded()), b, 0o644)
+		require.NoError(t, err)
+		return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(b))}
+	}
+	config := writeBlob([]byte(`{"architecture":"amd64","os":"linux"}`), ocispec.MediaTypeImageConfig)
+	b, err := json.Marshal(ocispec.Manifest{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageManifest, Config: config, Layers: []ocispec.Descriptor{}})
+	require.NoError(t, err)
+	manifest := writeBlob(b, ocispec.MediaTypeImageManifest)
+	manifest.Annotations = map[string]string{ocispec.AnnotationRefName: "docker.io/library/foo:1.0"}
+	b, err = json.Marshal(ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{manifest}})
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "index.json"), b, 0o644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0o644)
+	require.NoError(t, err)
+
+	importDir := func(store content.Store) (ocispec.Descriptor, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(tarDirectory(pw, dir))
+		}()
+		defer pr.Close()
+		return archive.ImportIndex(context.Background(), store, pr)
+	}
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	_, err = importDir(store)
+	require.NoError(t, err)
+	// Importing again does not fail on existing content.
+	_, err = importDir(store)
+	require.NoError(t, err)
+	_, err = store.Info(context.Background(), config.Digest)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "blobs", "sha256", config.Digest.Encoded()), []byte(`{"architecture":"arm64","os":"linux"}`), 0o644)
+	require.NoError(t, err)
+	store, err = local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	_, err = importDir(store)
+	require.Error(t, err)
+}
+
+func TestFullReferenceName(t *testing.T) {
+	require.Equal(t, "docker.io/library/foo:1.0", fullReferenceName("foo:1.0"))
+	require.Equal(t, "ghcr.io/xenitab/spegel:v0.0.8", fullReferenceName("ghcr.io/xenitab/spegel:v0.0.8"))
+	require.Equal(t, "", fullReferenceName("1.0"))
+	require.Equal(t, "", fullReferenceName("Foo:1.0"))
+}
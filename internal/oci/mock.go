@@ -1,7 +1,9 @@
 package oci
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
 
 	"github.com/opencontainers/go-digest"
@@ -21,7 +23,7 @@ func (m *MockClient) Verify(ctx context.Context) error {
 	return nil
 }
 
-func (m *MockClient) Subscribe(ctx context.Context) (<-chan Image, <-chan error) {
+func (m *MockClient) Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan error) {
 	return nil, nil
 }
 
@@ -33,6 +35,20 @@ func (m *MockClient) GetImageDigests(ctx context.Context, img Image) ([]string,
 	return []string{img.Digest.String()}, nil
 }
 
+func (m *MockClient) ListTags(ctx context.Context, name string) ([]string, error) {
+	tags := []string{}
+	for _, img := range m.images {
+		if img.Tag == "" {
+			continue
+		}
+		if fmt.Sprintf("%s/%s", img.Registry, img.Repository) != name {
+			continue
+		}
+		tags = append(tags, img.Tag)
+	}
+	return tags, nil
+}
+
 func (m *MockClient) Resolve(ctx context.Context, ref string) (digest.Digest, error) {
 	return "", nil
 }
@@ -41,10 +57,21 @@ func (m *MockClient) GetSize(ctx context.Context, dgst digest.Digest) (int64, er
 	return 0, nil
 }
 
-func (m *MockClient) WriteBlob(ctx context.Context, dst io.Writer, dgst digest.Digest) error {
-	return nil
+func (m *MockClient) GetBlobReader(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	return &readSeekCloser{
+		ReadSeeker: bytes.NewReader(nil),
+		Closer:     io.NopCloser(nil),
+	}, nil
 }
 
 func (m *MockClient) GetBlob(ctx context.Context, dgst digest.Digest) ([]byte, string, error) {
 	return nil, "", nil
 }
+
+func (m *MockClient) GetImageConfig(ctx context.Context, dgst digest.Digest) ([]byte, string, error) {
+	return nil, "", nil
+}
+
+func (m *MockClient) Pull(ctx context.Context, ref string) error {
+	return nil
+}
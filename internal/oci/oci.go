@@ -3,6 +3,7 @@ package oci
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 )
@@ -11,13 +12,50 @@ type UnknownDocument struct {
 	MediaType string `json:"mediaType,omitempty"`
 }
 
+// EventType is the kind of change to an image.
+type EventType string
+
+const (
+	CreateEvent EventType = "CREATE"
+	UpdateEvent EventType = "UPDATE"
+	DeleteEvent EventType = "DELETE"
+	// ResyncEvent is sent when the images that are listed have changed, for example when the registries are replaced.
+	ResyncEvent EventType = "RESYNC"
+)
+
+// ImageEvent is an image that has been created, updated or deleted at the timestamp of the event.
+// The digest of the image is not set for delete events as the image no longer exists, and no image is set for resync events.
+type ImageEvent struct {
+	Image     Image
+	Type      EventType
+	Timestamp time.Time
+}
+
+// ResolveTags decides per registry if tags are resolved through mirrors.
+// Registries are identified by host, registries without an override use the default.
+type ResolveTags struct {
+	Default   bool
+	Overrides map[string]bool
+}
+
+// Enabled returns true if tags of the registry host should be resolved through mirrors.
+func (r ResolveTags) Enabled(registry string) bool {
+	if v, ok := r.Overrides[registry]; ok {
+		return v
+	}
+	return r.Default
+}
+
 type Client interface {
 	Verify(ctx context.Context) error
-	Subscribe(ctx context.Context) (<-chan Image, <-chan error)
+	Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan error)
 	ListImages(ctx context.Context) ([]Image, error)
 	GetImageDigests(ctx context.Context, img Image) ([]string, error)
+	ListTags(ctx context.Context, name string) ([]string, error)
 	Resolve(ctx context.Context, ref string) (digest.Digest, error)
 	GetSize(ctx context.Context, dgst digest.Digest) (int64, error)
-	WriteBlob(ctx context.Context, dst io.Writer, dgst digest.Digest) error
+	GetBlobReader(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error)
 	GetBlob(ctx context.Context, dgst digest.Digest) ([]byte, string, error)
+	GetImageConfig(ctx context.Context, dgst digest.Digest) ([]byte, string, error)
+	Pull(ctx context.Context, ref string) error
 }
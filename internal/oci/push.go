@@ -0,0 +1,165 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Duration that pushed content is kept without being referenced by an image, so that blobs and child manifests
+// pushed before the manifest referencing them are not garbage collected.
+const pushLeaseExpiration = time.Hour
+
+var (
+	// ErrBlobUnknown is returned when a pushed manifest references content that does not exist.
+	ErrBlobUnknown = errors.New("blob unknown")
+	// ErrManifestInvalid is returned when a pushed manifest cannot be parsed.
+	ErrManifestInvalid = errors.New("manifest invalid")
+)
+
+// WriteUpload appends the content to the upload and returns the size of the upload.
+// Uploads are Containerd ingests which means that they survive restarts and are resumed at the offset written so far.
+func (c *Containerd) WriteUpload(ctx context.Context, id string, r io.Reader) (_ int64, err error) {
+	defer observeContainerdCall("write_upload", time.Now(), &err)
+	ctx, err = c.withPushLease(ctx)
+	if err != nil {
+		return 0, err
+	}
+	cw, err := content.OpenWriter(ctx, c.client.ContentStore(), content.WithRef(uploadRef(id)))
+	if err != nil {
+		return 0, err
+	}
+	defer cw.Close()
+	_, err = io.Copy(cw, r)
+	if err != nil {
+		return 0, err
+	}
+	status, err := cw.Status()
+	if err != nil {
+		return 0, err
+	}
+	return status.Offset, nil
+}
+
+// CommitUpload appends the remaining content to the upload and commits it to the content store if it matches the digest.
+func (c *Containerd) CommitUpload(ctx context.Context, id string, r io.Reader, dgst digest.Digest) (err error) {
+	defer observeContainerdCall("commit_upload", time.Now(), &err)
+	ctx, err = c.withPushLease(ctx)
+	if err != nil {
+		return err
+	}
+	cw, err := content.OpenWriter(ctx, c.client.ContentStore(), content.WithRef(uploadRef(id)))
+	if err != nil {
+		return err
+	}
+	defer cw.Close()
+	_, err = io.Copy(cw, r)
+	if err != nil {
+		return err
+	}
+	err = cw.Commit(ctx, 0, dgst)
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// PutManifest writes the manifest to the content store and points the image at it when the name is set.
+// Content referenced by the manifest has to exist, and is labeled so that it is kept as long as the manifest is kept.
+func (c *Containerd) PutManifest(ctx context.Context, name, mediaType string, b []byte) (_ digest.Digest, err error) {
+	defer observeContainerdCall("put_manifest", time.Now(), &err)
+	dgst := digest.FromBytes(b)
+	children, err := manifestChildren(mediaType, b)
+	if err != nil {
+		return "", err
+	}
+	labels := map[string]string{}
+	for i, child := range children {
+		// Foreign layers are pulled from their URLs and are never pushed.
+		if len(child.URLs) > 0 {
+			continue
+		}
+		_, err := c.client.ContentStore().Info(ctx, child.Digest)
+		if errdefs.IsNotFound(err) {
+			return "", fmt.Errorf("%w: %s", ErrBlobUnknown, child.Digest)
+		}
+		if err != nil {
+			return "", err
+		}
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.%d", i)] = child.Digest.String()
+	}
+	ctx, err = c.withPushLease(ctx)
+	if err != nil {
+		return "", err
+	}
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(b))}
+	err = content.WriteBlob(ctx, c.client.ContentStore(), uploadRef(dgst.String()), bytes.NewReader(b), desc, content.WithLabels(labels))
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return dgst, nil
+	}
+	img := images.Image{Name: name, Target: desc}
+	_, err = c.client.ImageService().Update(ctx, img, "target")
+	if errdefs.IsNotFound(err) {
+		_, err = c.client.ImageService().Create(ctx, img)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not update image %s: %w", name, err)
+	}
+	return dgst, nil
+}
+
+// withPushLease adds a lease to the context which expires on its own, it is never deleted as content has to outlive the request.
+func (c *Containerd) withPushLease(ctx context.Context) (context.Context, error) {
+	l, err := c.client.LeasesService().Create(ctx, leases.WithRandomID(), leases.WithExpiration(pushLeaseExpiration))
+	if err != nil {
+		return nil, err
+	}
+	return leases.WithLease(ctx, l.ID), nil
+}
+
+// manifestChildren returns the descriptors referenced by the manifest or index.
+func manifestChildren(mediaType string, b []byte) ([]ocispec.Descriptor, error) {
+	switch mediaType {
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+		var manifest ocispec.Manifest
+		err := json.Unmarshal(b, &manifest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrManifestInvalid, err)
+		}
+		return append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...), nil
+	case MediaTypeArtifactManifest:
+		var manifest ArtifactManifest
+		err := json.Unmarshal(b, &manifest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrManifestInvalid, err)
+		}
+		return manifest.Blobs, nil
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		var idx ocispec.Index
+		err := json.Unmarshal(b, &idx)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrManifestInvalid, err)
+		}
+		return idx.Manifests, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported media type %s", ErrManifestInvalid, mediaType)
+	}
+}
+
+func uploadRef(id string) string {
+	return fmt.Sprintf("spegel-push-%s", id)
+}
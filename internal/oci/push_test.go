@@ -0,0 +1,44 @@
+package oci
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestChildren(t *testing.T) {
+	config := digest.FromString("config")
+	layer := digest.FromString("layer")
+	manifest := []byte(`{"schemaVersion":2,"config":{"digest":"` + config.String() + `"},"layers":[{"digest":"` + layer.String() + `"}]}`)
+	for _, mediaType := range []string{ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest} {
+		children, err := manifestChildren(mediaType, manifest)
+		require.NoError(t, err)
+		require.Len(t, children, 2)
+		require.Equal(t, config, children[0].Digest)
+		require.Equal(t, layer, children[1].Digest)
+	}
+
+	child := digest.FromString("child")
+	index := []byte(`{"schemaVersion":2,"manifests":[{"digest":"` + child.String() + `"}]}`)
+	for _, mediaType := range []string{ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList} {
+		children, err := manifestChildren(mediaType, index)
+		require.NoError(t, err)
+		require.Len(t, children, 1)
+		require.Equal(t, child, children[0].Digest)
+	}
+
+	blob := digest.FromString("blob")
+	artifact := []byte(`{"mediaType":"` + MediaTypeArtifactManifest + `","artifactType":"application/vnd.example+type","blobs":[{"digest":"` + blob.String() + `"}]}`)
+	children, err := manifestChildren(MediaTypeArtifactManifest, artifact)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	require.Equal(t, blob, children[0].Digest)
+
+	_, err = manifestChildren(ocispec.MediaTypeImageManifest, []byte("foo"))
+	require.ErrorIs(t, err, ErrManifestInvalid)
+	_, err = manifestChildren("text/plain", manifest)
+	require.ErrorIs(t, err, ErrManifestInvalid)
+}
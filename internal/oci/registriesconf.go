@@ -0,0 +1,144 @@
+package oci
+
+import (
+	"context"
+	"net/url"
+	"path"
+
+	"github.com/go-logr/logr"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/spf13/afero"
+)
+
+const registriesConfFile = "spegel.conf"
+
+type registriesConf struct {
+	Registries []registriesConfRegistry `toml:"registry"`
+}
+
+type registriesConfRegistry struct {
+	Prefix   string                 `toml:"prefix"`
+	Location string                 `toml:"location"`
+	Mirrors  []registriesConfMirror `toml:"mirror"`
+}
+
+type registriesConfMirror struct {
+	Location       string `toml:"location"`
+	Insecure       bool   `toml:"insecure,omitempty"`
+	PullFromMirror string `toml:"pull-from-mirror"`
+}
+
+// AddRegistriesConfConfiguration writes a registries.conf drop-in file used by CRI-O and Podman with the mirrors for each registry.
+// Drop-in files are merged, so only the Spegel drop-in file is written and other files such as short name aliases are left as is.
+// An existing Spegel drop-in file that was not generated by Spegel, or that has been modified, is backed up.
+// Tag requests from CRI-O do not include the ns query parameter, so they are not served by Spegel and fall back to the origin registry.
+// Registry servers replace the location of the registry, Docker Hub does not need a default as it is resolved by CRI-O and Podman.
+func AddRegistriesConfConfiguration(ctx context.Context, fs afero.Fs, configPath string, registryURLs, mirrorURLs []url.URL, resolveTags ResolveTags, registryServers map[string]string) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	if err := validate(registryURLs); err != nil {
+		return err
+	}
+	if err := validateRegistryServers(registryServers); err != nil {
+		return err
+	}
+
+	err := fs.MkdirAll(configPath, 0755)
+	if err != nil {
+		return err
+	}
+	fp := path.Join(configPath, registriesConfFile)
+	err = backupRegistriesConfFile(ctx, fs, configPath, fp)
+	if err != nil {
+		return err
+	}
+
+	cfg := registriesConf{}
+	for _, registryURL := range registryURLs {
+		pullFromMirror := "digest-only"
+		if resolveTags.Enabled(registryURL.Host) {
+			pullFromMirror = "all"
+		}
+		mirrors := []registriesConfMirror{}
+		for _, u := range mirrorURLs {
+			mirrors = append(mirrors, registriesConfMirror{
+				Location:       u.Host,
+				Insecure:       u.Scheme == "http",
+				PullFromMirror: pullFromMirror,
+			})
+		}
+		location := registryURL.Host
+		if server, ok := registryServers[registryURL.Host]; ok {
+			u, err := url.Parse(server)
+			if err != nil {
+				return err
+			}
+			location = path.Join(u.Host, u.Path)
+		}
+		cfg.Registries = append(cfg.Registries, registriesConfRegistry{
+			Prefix:   registryURL.Host,
+			Location: location,
+			Mirrors:  mirrors,
+		})
+	}
+	b, err := toml.Marshal(&cfg)
+	if err != nil {
+		return err
+	}
+	b = addManagedHeader(b)
+	err = afero.WriteFile(fs, fp, b, 0644)
+	if err != nil {
+		return err
+	}
+	log.Info("added registries.conf mirror configuration", "path", fp)
+	return nil
+}
+
+// backupRegistriesConfFile moves the drop-in file to the backup directory unless it has been generated by Spegel and not modified.
+// The first backup is kept so that the configuration from before Spegel was installed can be restored.
+func backupRegistriesConfFile(ctx context.Context, fs afero.Fs, configPath, fp string) error {
+	ok, err := afero.Exists(fs, fp)
+	if err != nil || !ok {
+		return err
+	}
+	managed, modified, err := isSpegelManagedFile(fs, fp)
+	if err != nil {
+		return err
+	}
+	if managed && !modified {
+		return nil
+	}
+	backupDirPath := path.Join(configPath, backupDir)
+	backupPath := path.Join(backupDirPath, registriesConfFile)
+	ok, err = afero.Exists(fs, backupPath)
+	if err != nil || ok {
+		return err
+	}
+	err = fs.MkdirAll(backupDirPath, 0755)
+	if err != nil {
+		return err
+	}
+	err = fs.Rename(fp, backupPath)
+	if err != nil {
+		return err
+	}
+	logr.FromContextOrDiscard(ctx).Info("backing up mirror configuration", "path", fp)
+	return nil
+}
+
+// isSpegelManagedFile returns true if the path is a file generated by Spegel.
+func isSpegelManagedFile(fs afero.Fs, p string) (bool, bool, error) {
+	ok, err := afero.IsDir(fs, p)
+	if err != nil {
+		return false, false, err
+	}
+	if ok {
+		return false, false, nil
+	}
+	b, err := afero.ReadFile(fs, p)
+	if err != nil {
+		return false, false, err
+	}
+	managed, modified := parseManagedHeader(b)
+	return managed, modified, nil
+}
@@ -0,0 +1,175 @@
+package oci
+
+import (
+	"context"
+	iofs "io/fs"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistriesConfConfiguration(t *testing.T) {
+	configPath := "/etc/containers/registries.conf.d"
+
+	tests := []struct {
+		name            string
+		resolveTags     bool
+		registries      []string
+		mirrors         []string
+		registryServers map[string]string
+		existingFiles   map[string]string
+		expectedFiles   map[string]string
+		expectNoBackup  bool
+	}{
+		{
+			name:        "multiple registries and mirrors",
+			resolveTags: true,
+			registries:  []string{"https://docker.io", "http://foo.bar:5000"},
+			mirrors:     []string{"http://127.0.0.1:5000", "https://example.com"},
+			expectedFiles: map[string]string{
+				"/etc/containers/registries.conf.d/spegel.conf": managedHostsFile(t, `[[registry]]
+prefix = 'docker.io'
+location = 'docker.io'
+
+[[registry.mirror]]
+location = '127.0.0.1:5000'
+insecure = true
+pull-from-mirror = 'all'
+
+[[registry.mirror]]
+location = 'example.com'
+pull-from-mirror = 'all'
+
+[[registry]]
+prefix = 'foo.bar:5000'
+location = 'foo.bar:5000'
+
+[[registry.mirror]]
+location = '127.0.0.1:5000'
+insecure = true
+pull-from-mirror = 'all'
+
+[[registry.mirror]]
+location = 'example.com'
+pull-from-mirror = 'all'
+`),
+			},
+		},
+		{
+			name:        "without resolve tags and existing drop-in",
+			resolveTags: false,
+			registries:  []string{"https://docker.io"},
+			mirrors:     []string{"http://127.0.0.1:5000"},
+			existingFiles: map[string]string{
+				"/etc/containers/registries.conf.d/000-shortnames.conf": "[aliases]",
+			},
+			expectedFiles: map[string]string{
+				"/etc/containers/registries.conf.d/000-shortnames.conf": "[aliases]",
+				"/etc/containers/registries.conf.d/spegel.conf": managedHostsFile(t, `[[registry]]
+prefix = 'docker.io'
+location = 'docker.io'
+
+[[registry.mirror]]
+location = '127.0.0.1:5000'
+insecure = true
+pull-from-mirror = 'digest-only'
+`),
+			},
+			expectNoBackup: true,
+		},
+		{
+			name:        "existing drop-in not generated by Spegel",
+			resolveTags: false,
+			registries:  []string{"https://docker.io"},
+			mirrors:     []string{"http://127.0.0.1:5000"},
+			existingFiles: map[string]string{
+				"/etc/containers/registries.conf.d/spegel.conf": "[[registry]]",
+			},
+			expectedFiles: map[string]string{
+				"/etc/containers/registries.conf.d/_backup/spegel.conf": "[[registry]]",
+				"/etc/containers/registries.conf.d/spegel.conf": managedHostsFile(t, `[[registry]]
+prefix = 'docker.io'
+location = 'docker.io'
+
+[[registry.mirror]]
+location = '127.0.0.1:5000'
+insecure = true
+pull-from-mirror = 'digest-only'
+`),
+			},
+		},
+		{
+			name:        "replace generated configuration",
+			resolveTags: true,
+			registries:  []string{"https://docker.io"},
+			mirrors:     []string{"http://127.0.0.1:5001"},
+			existingFiles: map[string]string{
+				"/etc/containers/registries.conf.d/spegel.conf": managedHostsFile(t, `[[registry]]
+prefix = 'docker.io'
+location = 'docker.io'
+`),
+			},
+			expectedFiles: map[string]string{
+				"/etc/containers/registries.conf.d/spegel.conf": managedHostsFile(t, `[[registry]]
+prefix = 'docker.io'
+location = 'docker.io'
+
+[[registry.mirror]]
+location = '127.0.0.1:5001'
+insecure = true
+pull-from-mirror = 'all'
+`),
+			},
+			expectNoBackup: true,
+		},
+		{
+			name:            "registry servers",
+			resolveTags:     true,
+			registries:      []string{"https://registry.corp"},
+			mirrors:         []string{"http://127.0.0.1:5000"},
+			registryServers: map[string]string{"registry.corp": "https://corp.jfrog.io/artifactory/api/docker/virtual"},
+			expectedFiles: map[string]string{
+				"/etc/containers/registries.conf.d/spegel.conf": managedHostsFile(t, `[[registry]]
+prefix = 'registry.corp'
+location = 'corp.jfrog.io/artifactory/api/docker/virtual'
+
+[[registry.mirror]]
+location = '127.0.0.1:5000'
+insecure = true
+pull-from-mirror = 'all'
+`),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			for k, v := range tt.existingFiles {
+				err := afero.WriteFile(fs, k, []byte(v), 0644)
+				require.NoError(t, err)
+			}
+			registries := stringListToUrlList(t, tt.registries)
+			mirrors := stringListToUrlList(t, tt.mirrors)
+			err := AddRegistriesConfConfiguration(context.TODO(), fs, configPath, registries, mirrors, ResolveTags{Default: tt.resolveTags}, tt.registryServers)
+			require.NoError(t, err)
+			if len(tt.existingFiles) == 0 || tt.expectNoBackup {
+				ok, err := afero.DirExists(fs, "/etc/containers/registries.conf.d/_backup")
+				require.NoError(t, err)
+				require.False(t, ok)
+			}
+			err = afero.Walk(fs, configPath, func(path string, fi iofs.FileInfo, _ error) error {
+				if fi.IsDir() {
+					return nil
+				}
+				expectedContent, ok := tt.expectedFiles[path]
+				require.True(t, ok, path)
+				b, err := afero.ReadFile(fs, path)
+				require.NoError(t, err)
+				require.Equal(t, expectedContent, string(b))
+				return nil
+			})
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var accessLogSkippedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "spegel_access_log_skipped_total",
+	Help: "Total number of successful requests not logged because of access log sampling.",
+})
+
+// WithAccessLogSampling only logs the fraction of successful requests, failed requests are always logged.
+// Sampling is bypassed while verbosity 5 is enabled, so that the log level can be raised to debug specific pulls.
+func WithAccessLogSampling(rate float64) Option {
+	return func(r *Registry) {
+		r.accessLogSampleRate = rate
+	}
+}
+
+// accessLogHandler logs a structured record of every request after it has been served. Values added by handlers
+// with withLogValues, such as the digest and the peer that served a mirrored request, are included in the record.
+func (r *Registry) accessLogHandler(log logr.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.URL.Path == "/healthz" {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		c.Next()
+		latency := time.Since(start)
+
+		status := c.Writer.Status()
+		failed := status < 200 || status >= 300
+		//nolint:gosec // sampling does not have to be secure
+		if !failed && !log.V(5).Enabled() && rand.Float64() >= r.accessLogSampleRate {
+			accessLogSkippedTotal.Inc()
+			return
+		}
+		size := c.Writer.Size()
+		if size < 0 {
+			size = 0
+		}
+		kvs := []interface{}{"path", c.Request.URL.Path, "status", status, "method", c.Request.Method, "latency", latency, "ip", c.ClientIP(), "bytes", size}
+		if handler := c.GetString("handler"); handler != "" {
+			kvs = append(kvs, "handler", handler)
+			if handler == "mirror" {
+				cache := "hit"
+				if status != http.StatusOK {
+					cache = "miss"
+				}
+				kvs = append(kvs, "cache", cache)
+			}
+		}
+		if ns := c.Query("ns"); ns != "" {
+			kvs = append(kvs, "ns", ns)
+		}
+		if v, ok := c.Get(logValuesContextKey); ok {
+			kvs = append(kvs, v.([]interface{})...)
+		}
+		if !failed {
+			log.Info("", kvs...)
+			return
+		}
+		errs := []error{}
+		for _, e := range c.Errors {
+			errs = append(errs, e.Err)
+		}
+		log.Error(errors.Join(errs...), "", kvs...)
+	}
+}
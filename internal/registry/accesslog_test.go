@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr/funcr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLog(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleRate float64
+		verbosity  int
+		path       string
+		expected   []string
+	}{
+		{
+			name:       "all requests logged",
+			sampleRate: 1,
+			path:       "/ok",
+			expected:   []string{`"path"="/ok" "status"=200 "method"="GET"`, `"bytes"=3 "handler"="mirror" "cache"="hit" "ns"="docker.io" "digest"="sha256:foo" "peer"="http://10.0.0.1:5000"`},
+		},
+		{
+			name:       "successful request not sampled",
+			sampleRate: 0,
+			path:       "/ok",
+			expected:   []string{},
+		},
+		{
+			name:       "failed request always logged",
+			sampleRate: 0,
+			path:       "/fail",
+			expected:   []string{`"error"="not found"`, `"handler"="mirror" "cache"="miss"`},
+		},
+		{
+			name:       "sampling bypassed when debugging",
+			sampleRate: 0,
+			verbosity:  5,
+			path:       "/ok",
+			expected:   []string{`"path"="/ok"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := []string{}
+			log := funcr.New(func(prefix, args string) {
+				lines = append(lines, args)
+			}, funcr.Options{Verbosity: tt.verbosity})
+			reg := &Registry{}
+			WithAccessLogSampling(tt.sampleRate)(reg)
+
+			gin.SetMode(gin.TestMode)
+			engine := gin.New()
+			engine.Use(reg.accessLogHandler(log))
+			engine.GET("/ok", func(c *gin.Context) {
+				c.Set("handler", "mirror")
+				withLogValues(c, "digest", "sha256:foo")
+				withLogValues(c, "peer", "http://10.0.0.1:5000")
+				c.String(http.StatusOK, "foo")
+			})
+			engine.GET("/fail", func(c *gin.Context) {
+				c.Set("handler", "mirror")
+				//nolint:errcheck // ignore
+				c.AbortWithError(http.StatusNotFound, errors.New("not found"))
+			})
+			engine.GET("/healthz", func(c *gin.Context) {})
+
+			skipped := testutil.ToFloat64(accessLogSkippedTotal)
+			rw := httptest.NewRecorder()
+			engine.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path+"?ns=docker.io", nil))
+			rw = httptest.NewRecorder()
+			engine.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/healthz", nil))
+
+			if len(tt.expected) == 0 {
+				require.Empty(t, lines)
+				require.Equal(t, skipped+1, testutil.ToFloat64(accessLogSkippedTotal))
+				return
+			}
+			require.Len(t, lines, 1)
+			for _, expected := range tt.expected {
+				require.Contains(t, lines[0], expected)
+			}
+		})
+	}
+}
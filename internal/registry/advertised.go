@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/xenitab/spegel/internal/oci"
+)
+
+type AdvertisedImage struct {
+	Name   string `json:"name"`
+	Tag    string `json:"tag,omitempty"`
+	Digest string `json:"digest"`
+}
+
+func (i AdvertisedImage) String() string {
+	if i.Tag == "" {
+		return fmt.Sprintf("%s@%s", i.Name, i.Digest)
+	}
+	return fmt.Sprintf("%s:%s@%s", i.Name, i.Tag, i.Digest)
+}
+
+// Advertised contains the images and digests that the node advertises to peers.
+type Advertised struct {
+	Images  []AdvertisedImage `json:"images,omitempty"`
+	Digests []string          `json:"digests,omitempty"`
+}
+
+// advertisedKeys is an image in the local store together with the keys advertised for it.
+type advertisedKeys struct {
+	img   oci.Image
+	tag   string
+	dgsts []string
+}
+
+// listAdvertised lists the images in the local store and their keys in the same way as the state tracker advertises them,
+// which means that the result reflects the current state. Nothing is advertised while the node is under disk pressure.
+func (r *Registry) listAdvertised(ctx context.Context) ([]advertisedKeys, error) {
+	if r.diskPressure.Pressured() {
+		return []advertisedKeys{}, nil
+	}
+	imgs, err := r.ociClient.ListImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, _, resolveLatestTag := r.resolveSettings()
+	result := []advertisedKeys{}
+	digestKeys := map[string][]string{}
+	for _, img := range imgs {
+		if r.allowList != nil && !r.allowList.Allowed(fmt.Sprintf("%s/%s", img.Registry, img.Repository)) {
+			continue
+		}
+		dgsts, ok := digestKeys[img.Digest.String()]
+		if !ok {
+			dgsts, err = r.ociClient.GetImageDigests(ctx, img)
+			if err != nil {
+				return nil, err
+			}
+			digestKeys[img.Digest.String()] = dgsts
+		}
+		keys := advertisedKeys{img: img, dgsts: dgsts}
+		if r.resolveTags.Enabled(img.Registry) && !(!resolveLatestTag && img.IsLatestTag()) {
+			keys.tag = img.Tag
+		}
+		result = append(result, keys)
+	}
+	return result, nil
+}
+
+// advertisedHandler lists the images and digests in the local store that are advertised to peers.
+func (r *Registry) advertisedHandler(c *gin.Context) {
+	c.Set("handler", "advertised")
+	advertised, err := r.listAdvertised(c)
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	result := Advertised{
+		Images:  []AdvertisedImage{},
+		Digests: []string{},
+	}
+	seenImages := map[string]interface{}{}
+	seen := map[string]interface{}{}
+	for _, keys := range advertised {
+		name := fmt.Sprintf("%s/%s", keys.img.Registry, keys.img.Repository)
+		advImg := AdvertisedImage{Name: name, Tag: keys.tag, Digest: keys.img.Digest.String()}
+		// Images with the same name and content in multiple namespaces are only listed once.
+		if _, ok := seenImages[advImg.String()]; !ok {
+			seenImages[advImg.String()] = nil
+			result.Images = append(result.Images, advImg)
+		}
+		for _, dgst := range keys.dgsts {
+			if _, ok := seen[dgst]; ok {
+				continue
+			}
+			seen[dgst] = nil
+			result.Digests = append(result.Digests, dgst)
+		}
+	}
+	sort.Slice(result.Images, func(i, j int) bool {
+		return result.Images[i].String() < result.Images[j].String()
+	})
+	sort.Strings(result.Digests)
+	c.JSON(http.StatusOK, result)
+}
+
+// GetAdvertised fetches the advertised images and digests from the registry running at the address.
+func GetAdvertised(ctx context.Context, addr string) (Advertised, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return Advertised{}, err
+	}
+	u.Path = "/internal/advertised"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return Advertised{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Advertised{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Advertised{}, fmt.Errorf("expected registry to respond with 200 OK but received: %s", resp.Status)
+	}
+	advertised := Advertised{}
+	err = json.NewDecoder(resp.Body).Decode(&advertised)
+	if err != nil {
+		return Advertised{}, err
+	}
+	return advertised, nil
+}
@@ -0,0 +1,51 @@
+package registry
+
+import (
+	"context"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/allowlist"
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestAdvertised(t *testing.T) {
+	ubuntuDgst := digest.Digest("sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020")
+	alpineDgst := digest.Digest("sha256:c5c5fda71656f28e49ac9c5416b3643eaa6a108a8093151d6d1afc39463be786")
+	imgs := []oci.Image{}
+	for _, s := range []string{
+		"docker.io/library/ubuntu:22.04@" + ubuntuDgst.String(),
+		"docker.io/library/ubuntu:latest@" + ubuntuDgst.String(),
+		"ghcr.io/foo/alpine:3.18@" + alpineDgst.String(),
+	} {
+		img, err := oci.Parse(s, "")
+		require.NoError(t, err)
+		imgs = append(imgs, img)
+	}
+	// The same image in another namespace is only listed once.
+	dup := imgs[0]
+	dup.Namespace = "default"
+	imgs = append(imgs, dup)
+	allowList := allowlist.NewAllowList()
+	allowList.Set([]*regexp.Regexp{regexp.MustCompile(`^docker\.io/.*$`)})
+	reg := NewRegistry(oci.NewMockClient(imgs), routing.NewMockRouter(map[string][]string{}), "", 3, time.Second, false, WithAllowList(allowList))
+	srv := httptest.NewServer(reg.Server("", logr.Discard()).Handler)
+	defer srv.Close()
+
+	advertised, err := GetAdvertised(context.Background(), srv.URL)
+	require.NoError(t, err)
+	expectedImages := []AdvertisedImage{
+		{Name: "docker.io/library/ubuntu", Tag: "22.04", Digest: ubuntuDgst.String()},
+		{Name: "docker.io/library/ubuntu", Digest: ubuntuDgst.String()},
+	}
+	require.Equal(t, expectedImages, advertised.Images)
+	require.Equal(t, []string{ubuntuDgst.String()}, advertised.Digests)
+	require.Equal(t, "docker.io/library/ubuntu:22.04@"+ubuntuDgst.String(), advertised.Images[0].String())
+}
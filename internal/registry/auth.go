@@ -0,0 +1,215 @@
+package registry
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var authFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "spegel_auth_failures_total",
+	Help: "Total number of external requests rejected because of a missing or invalid bearer token.",
+})
+
+// TokenVerifier verifies bearer tokens presented by external requests.
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) error
+}
+
+// TokenSource returns the bearer token sent with requests to mirrors.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// WithBearerAuth requires requests from clients that are not local to present a bearer token accepted by the verifier.
+// Clients are local when they connect from a loopback address or from within the local CIDRs, the request host is not trusted.
+// Requests to mirrors present a token from the source, which means that all peers have to be configured in the same way.
+func WithBearerAuth(verifier TokenVerifier, source TokenSource) Option {
+	return func(r *Registry) {
+		r.tokenVerifier = verifier
+		r.tokenSource = source
+	}
+}
+
+// verifyBearerToken verifies the bearer token of the request unless the client is local.
+func (r *Registry) verifyBearerToken(c *gin.Context) error {
+	if r.tokenVerifier == nil || r.isLocalClient(c) {
+		return nil
+	}
+	auth := c.GetHeader("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || token == "" {
+		return fmt.Errorf("bearer token is required for external requests")
+	}
+	return r.tokenVerifier.Verify(c, token)
+}
+
+// bearerAuthHandler aborts requests that fail bearer token verification.
+func (r *Registry) bearerAuthHandler(c *gin.Context) {
+	if err := r.verifyBearerToken(c); err != nil {
+		authFailuresTotal.Inc()
+		c.Header("WWW-Authenticate", `Bearer realm="spegel"`)
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusUnauthorized, err)
+		return
+	}
+}
+
+// authTransport sets the bearer token from the source on all requests.
+type authTransport struct {
+	http.RoundTripper
+	source TokenSource
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.source.Token(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("could not get bearer token: %w", err)
+	}
+	// Request has to be cloned as round trippers should not modify the request.
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// SharedSecretAuth creates and verifies tokens derived from a secret shared by all nodes.
+// Tokens contain an expiry signed with the secret so that the secret itself is never sent over the network.
+type SharedSecretAuth struct {
+	secret   []byte
+	validity time.Duration
+	now      func() time.Time
+}
+
+func NewSharedSecretAuth(secret []byte) (*SharedSecretAuth, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("shared secret cannot be empty")
+	}
+	return &SharedSecretAuth{
+		secret:   secret,
+		validity: 5 * time.Minute,
+		now:      time.Now,
+	}, nil
+}
+
+// LoadSharedSecretAuth reads the shared secret from the file, surrounding whitespace is ignored.
+func LoadSharedSecretAuth(p string) (*SharedSecretAuth, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return NewSharedSecretAuth([]byte(strings.TrimSpace(string(b))))
+}
+
+func (a *SharedSecretAuth) Token(ctx context.Context) (string, error) {
+	expiry := strconv.FormatInt(a.now().Add(a.validity).Unix(), 10)
+	return expiry + "." + a.sign(expiry), nil
+}
+
+func (a *SharedSecretAuth) Verify(ctx context.Context, token string) error {
+	expiry, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return fmt.Errorf("invalid token format")
+	}
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(a.sign(expiry))) != 1 {
+		return fmt.Errorf("invalid token signature")
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid token expiry: %w", err)
+	}
+	if a.now().After(time.Unix(unix, 0)) {
+		return fmt.Errorf("token has expired")
+	}
+	// Tokens with long expiry are rejected as they would stay valid after the secret is rotated.
+	if time.Unix(unix, 0).After(a.now().Add(2 * a.validity)) {
+		return fmt.Errorf("token expiry is too far in the future")
+	}
+	return nil
+}
+
+func (a *SharedSecretAuth) sign(expiry string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(expiry))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// FileTokenSource reads the token from a file for every request, as projected ServiceAccount tokens are rotated by the kubelet.
+type FileTokenSource struct {
+	path string
+}
+
+func NewFileTokenSource(p string) *FileTokenSource {
+	return &FileTokenSource{path: p}
+}
+
+func (s *FileTokenSource) Token(ctx context.Context) (string, error) {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// TokenReviewVerifier verifies Kubernetes ServiceAccount tokens with the TokenReview API.
+// Successful reviews are cached for a short duration to not create a review for every request.
+type TokenReviewVerifier struct {
+	cs        kubernetes.Interface
+	audiences []string
+	cache     *lru.Cache
+	cacheTTL  time.Duration
+}
+
+func NewTokenReviewVerifier(cs kubernetes.Interface, audiences []string) (*TokenReviewVerifier, error) {
+	cache, err := lru.New(1000)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenReviewVerifier{
+		cs:        cs,
+		audiences: audiences,
+		cache:     cache,
+		cacheTTL:  time.Minute,
+	}, nil
+}
+
+func (v *TokenReviewVerifier) Verify(ctx context.Context, token string) error {
+	key := sha256.Sum256([]byte(token))
+	if expiry, ok := v.cache.Get(key); ok && time.Now().Before(expiry.(time.Time)) {
+		return nil
+	}
+	review := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: v.audiences,
+		},
+	}
+	review, err := v.cs.AuthenticationV1().TokenReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("could not review token: %w", err)
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return errors.New(review.Status.Error)
+		}
+		return fmt.Errorf("token is not authenticated")
+	}
+	v.cache.Add(key, time.Now().Add(v.cacheTTL))
+	return nil
+}
@@ -0,0 +1,216 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestSharedSecretAuth(t *testing.T) {
+	auth, err := NewSharedSecretAuth([]byte("foo"))
+	require.NoError(t, err)
+	other, err := NewSharedSecretAuth([]byte("bar"))
+	require.NoError(t, err)
+
+	token, err := auth.Token(context.TODO())
+	require.NoError(t, err)
+	require.NoError(t, auth.Verify(context.TODO(), token))
+	require.EqualError(t, other.Verify(context.TODO(), token), "invalid token signature")
+	require.EqualError(t, auth.Verify(context.TODO(), "foo"), "invalid token format")
+
+	now := time.Now()
+	auth.now = func() time.Time { return now.Add(-10 * time.Minute) }
+	token, err = auth.Token(context.TODO())
+	require.NoError(t, err)
+	auth.now = time.Now
+	require.EqualError(t, auth.Verify(context.TODO(), token), "token has expired")
+
+	auth.now = func() time.Time { return now.Add(time.Hour) }
+	token, err = auth.Token(context.TODO())
+	require.NoError(t, err)
+	auth.now = time.Now
+	require.EqualError(t, auth.Verify(context.TODO(), token), "token expiry is too far in the future")
+
+	_, err = NewSharedSecretAuth(nil)
+	require.EqualError(t, err, "shared secret cannot be empty")
+}
+
+func TestFileTokenSource(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(p, []byte("foo\n"), 0600)
+	require.NoError(t, err)
+	token, err := NewFileTokenSource(p).Token(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, "foo", token)
+}
+
+func TestTokenReviewVerifier(t *testing.T) {
+	reviews := 0
+	cs := fake.NewSimpleClientset()
+	cs.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		require.Equal(t, []string{"spegel"}, review.Spec.Audiences)
+		if review.Spec.Token == "valid" {
+			review.Status.Authenticated = true
+		} else {
+			review.Status.Error = "invalid bearer token"
+		}
+		return true, review, nil
+	})
+	verifier, err := NewTokenReviewVerifier(cs, []string{"spegel"})
+	require.NoError(t, err)
+
+	require.NoError(t, verifier.Verify(context.TODO(), "valid"))
+	require.NoError(t, verifier.Verify(context.TODO(), "valid"))
+	require.Equal(t, 1, reviews)
+	require.EqualError(t, verifier.Verify(context.TODO(), "invalid"), "invalid bearer token")
+	require.Equal(t, 2, reviews)
+}
+
+func TestBearerAuth(t *testing.T) {
+	auth, err := NewSharedSecretAuth([]byte("foo"))
+	require.NoError(t, err)
+	token, err := auth.Token(context.TODO())
+	require.NoError(t, err)
+
+	cidrs, err := ParseCIDRs([]string{"192.168.1.10"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		opts          []Option
+		host          string
+		remoteAddr    string
+		authorization string
+		expected      int
+	}{
+		{
+			name:       "loopback request without token",
+			host:       "127.0.0.1:30020",
+			remoteAddr: "127.0.0.1:1234",
+			expected:   http.StatusOK,
+		},
+		{
+			name:       "local cidr request without token",
+			opts:       []Option{WithLocalCIDRs(cidrs)},
+			host:       "10.0.0.5:30020",
+			remoteAddr: "192.168.1.10:1234",
+			expected:   http.StatusOK,
+		},
+		{
+			name:       "external request without token",
+			host:       "10.0.0.5:30020",
+			remoteAddr: "10.0.0.6:1234",
+			expected:   http.StatusUnauthorized,
+		},
+		{
+			name:       "external request with spoofed local host",
+			host:       "127.0.0.1:30020",
+			remoteAddr: "10.0.0.6:1234",
+			expected:   http.StatusUnauthorized,
+		},
+		{
+			name:       "external request with spoofed local host and local cidrs",
+			opts:       []Option{WithLocalCIDRs(cidrs)},
+			host:       "127.0.0.1:30020",
+			remoteAddr: "10.0.0.6:1234",
+			expected:   http.StatusUnauthorized,
+		},
+		{
+			name:          "external request with invalid token",
+			host:          "10.0.0.5:30020",
+			remoteAddr:    "10.0.0.6:1234",
+			authorization: "Bearer foo",
+			expected:      http.StatusUnauthorized,
+		},
+		{
+			name:          "external request with valid token",
+			host:          "10.0.0.5:30020",
+			remoteAddr:    "10.0.0.6:1234",
+			authorization: "Bearer " + token,
+			expected:      http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithBearerAuth(auth, auth)}, tt.opts...)
+			reg := NewRegistry(nil, routing.NewMockRouter(nil), "127.0.0.1:30020", 3, 5*time.Second, false, opts...)
+			rw := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rw)
+			c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/v2/", nil)
+			c.Request.Host = tt.host
+			c.Request.RemoteAddr = tt.remoteAddr
+			if tt.authorization != "" {
+				c.Request.Header.Set("Authorization", tt.authorization)
+			}
+			reg.registryHandler(c)
+			require.Equal(t, tt.expected, rw.Code)
+			if tt.expected == http.StatusUnauthorized {
+				require.Equal(t, `Bearer realm="spegel"`, rw.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestInternalEndpointsAuth(t *testing.T) {
+	auth, err := NewSharedSecretAuth([]byte("foo"))
+	require.NoError(t, err)
+	token, err := auth.Token(context.TODO())
+	require.NoError(t, err)
+	reg := NewRegistry(oci.NewMockClient(nil), routing.NewMockRouter(map[string][]string{}), "127.0.0.1:30020", 3, 5*time.Second, false, WithBearerAuth(auth, auth))
+	handler := reg.Server("", logr.Discard()).Handler
+
+	for _, p := range []string{"/internal/resolve?ref=" + digest.FromString("foo").String(), "/internal/advertised"} {
+		t.Run(p, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://10.0.0.5:30020"+p, nil)
+			req.RemoteAddr = "10.0.0.6:1234"
+			handler.ServeHTTP(rw, req)
+			require.Equal(t, http.StatusUnauthorized, rw.Code)
+			require.Equal(t, `Bearer realm="spegel"`, rw.Header().Get("WWW-Authenticate"))
+
+			rw = httptest.NewRecorder()
+			req.Header.Set("Authorization", "Bearer "+token)
+			handler.ServeHTTP(rw, req)
+			require.NotEqual(t, http.StatusUnauthorized, rw.Code)
+		})
+	}
+}
+
+func TestAuthTransport(t *testing.T) {
+	auth, err := NewSharedSecretAuth([]byte("foo"))
+	require.NoError(t, err)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		require.NoError(t, auth.Verify(r.Context(), token))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	reg := NewRegistry(nil, routing.NewMockRouter(nil), "", 3, 5*time.Second, false, WithBearerAuth(auth, auth))
+	req, err := http.NewRequestWithContext(context.TODO(), http.MethodGet, svr.URL, nil)
+	require.NoError(t, err)
+	resp, err := reg.client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, req.Header.Get("Authorization"))
+}
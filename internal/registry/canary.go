@@ -0,0 +1,113 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+// Every instance serves the same tiny synthetic blob which allows peers to pull it
+// from each other independently of any images being present on the node.
+var (
+	canaryBlob   = []byte("spegel-canary")
+	canaryDigest = digest.FromBytes(canaryBlob)
+)
+
+const (
+	// Max amount of peers resolved for the canary, that the peer pulled from is picked from at random.
+	maxCanaryPeers = 20
+	// Duration that more peers are waited for after the first peer has been found.
+	canaryResolveWindow = 100 * time.Millisecond
+)
+
+var canaryRequestsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "spegel_canary_requests_total",
+		Help: "Total number of synthetic canary pulls from peers.",
+	},
+	[]string{"result"},
+)
+
+var canaryDuration = promauto.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "spegel_canary_duration_seconds",
+		Help:    "End to end latency of successful synthetic canary pulls from peers.",
+		Buckets: prometheus.DefBuckets,
+	},
+)
+
+// RunCanary periodically pulls the canary blob from a random peer until the context is cancelled.
+// Pulls use the same client as mirrored requests, so they are sent with the same transport settings and credentials.
+func (r *Registry) RunCanary(ctx context.Context, interval, timeout time.Duration) {
+	log := logr.FromContextOrDiscard(ctx).WithName("canary")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Advertise on every run to keep the key from expiring.
+			err := r.router.Advertise(ctx, []string{canaryDigest.String()})
+			if err != nil {
+				log.Error(err, "could not advertise canary key")
+				continue
+			}
+			start := time.Now()
+			err = pullCanary(ctx, r.client, r.router, timeout)
+			if err != nil {
+				log.Error(err, "canary pull failed")
+				canaryRequestsTotal.WithLabelValues("failure").Inc()
+				continue
+			}
+			canaryRequestsTotal.WithLabelValues("success").Inc()
+			canaryDuration.Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+func pullCanary(ctx context.Context, client *http.Client, router routing.Router, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// A random peer is picked so that every peer is pulled from over time, instead of the peer that is resolved first.
+	mirrors, err := routing.ResolveMirrors(ctx, router, canaryDigest.String(), false, maxCanaryPeers, canaryResolveWindow)
+	if err != nil {
+		return err
+	}
+	if len(mirrors) == 0 {
+		return fmt.Errorf("could not resolve peer for canary")
+	}
+	mirror := mirrors[rand.Intn(len(mirrors))]
+	req, err := newMirrorRequest(ctx, http.MethodGet, mirror, &url.URL{Path: fmt.Sprintf("/v2/spegel/canary/blobs/%s", canaryDigest.String())})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	observePeerClockSkew(logr.FromContextOrDiscard(ctx), mirror, resp.Header, time.Now())
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("expected canary peer %s to respond with 200 OK but received: %s", mirror, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if digest.FromBytes(b) != canaryDigest {
+		return fmt.Errorf("canary blob from peer %s does not match digest", mirror)
+	}
+	return nil
+}
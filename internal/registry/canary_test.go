@@ -0,0 +1,94 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestPullCanary(t *testing.T) {
+	reg := NewRegistry(nil, routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false)
+	srv := httptest.NewServer(reg.Server("", logr.Discard()).Handler)
+	defer srv.Close()
+
+	router := routing.NewMockRouter(map[string][]string{canaryDigest.String(): {srv.URL}})
+	err := pullCanary(context.TODO(), &http.Client{}, router, 5*time.Second)
+	require.NoError(t, err)
+
+	// Peers are picked at random, so every peer is eventually pulled from.
+	var mx sync.Mutex
+	pulled := map[string]interface{}{}
+	peers := []string{}
+	for i := 0; i < 3; i++ {
+		peerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mx.Lock()
+			pulled[req.Host] = nil
+			mx.Unlock()
+			reg.Server("", logr.Discard()).Handler.ServeHTTP(w, req)
+		}))
+		defer peerSrv.Close()
+		peers = append(peers, peerSrv.URL)
+	}
+	router = routing.NewMockRouter(map[string][]string{canaryDigest.String(): peers})
+	require.Eventually(t, func() bool {
+		err := pullCanary(context.TODO(), &http.Client{}, router, 5*time.Second)
+		require.NoError(t, err)
+		mx.Lock()
+		defer mx.Unlock()
+		return len(pulled) == len(peers)
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestPullCanaryNoPeers(t *testing.T) {
+	router := routing.NewMockRouter(map[string][]string{})
+	err := pullCanary(context.TODO(), &http.Client{}, router, 100*time.Millisecond)
+	require.EqualError(t, err, "could not resolve peer for canary")
+}
+
+// canaryRouter keeps resolving the canary to the peer, as the mock router resolves advertised keys to localhost.
+type canaryRouter struct {
+	*routing.MockRouter
+}
+
+func (canaryRouter) Advertise(ctx context.Context, keys []string) error {
+	return nil
+}
+
+func TestRunCanary(t *testing.T) {
+	auth, err := NewSharedSecretAuth([]byte("foo"))
+	require.NoError(t, err)
+	// Requests from loopback addresses are not required to present a token, so the peer verifies it on its own.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if auth.Verify(r.Context(), token) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		//nolint:errcheck // ignore
+		w.Write(canaryBlob)
+	}))
+	defer srv.Close()
+
+	// Pulls use the client of the registry which presents the bearer token to the peer.
+	router := canaryRouter{routing.NewMockRouter(map[string][]string{canaryDigest.String(): {srv.URL}})}
+	reg := NewRegistry(nil, router, "", 3, 5*time.Second, false, WithBearerAuth(auth, auth))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successes := testutil.ToFloat64(canaryRequestsTotal.WithLabelValues("success"))
+	failures := testutil.ToFloat64(canaryRequestsTotal.WithLabelValues("failure"))
+	go reg.RunCanary(ctx, 10*time.Millisecond, 5*time.Second)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(canaryRequestsTotal.WithLabelValues("success")) > successes
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, failures, testutil.ToFloat64(canaryRequestsTotal.WithLabelValues("failure")))
+}
@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var servingCapacityActiveTransfers = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "spegel_serving_capacity_active_transfers",
+	Help: "Number of blob transfers currently served to peers.",
+})
+
+var servingCapacityRejectedTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "spegel_serving_capacity_rejected_requests_total",
+		Help: "Total number of blob requests rejected because the serving capacity of the node was exceeded.",
+	},
+	[]string{"reason"},
+)
+
+// Clients are asked to retry after the bandwidth window, as transfers and bandwidth are both expected to free up within seconds.
+const capacityRetryAfter = time.Second
+
+// capacity limits the blob transfers served concurrently and the bandwidth used to serve them.
+// The bandwidth is estimated with a sliding window over the bytes written in the current and previous second.
+type capacity struct {
+	mx                sync.Mutex
+	maxTransfers      int
+	maxBytesPerSecond int64
+	transfers         int
+	windowStart       time.Time
+	current           int64
+	previous          int64
+}
+
+func newCapacity(maxTransfers int, maxBytesPerSecond int64) *capacity {
+	return &capacity{
+		maxTransfers:      maxTransfers,
+		maxBytesPerSecond: maxBytesPerSecond,
+		windowStart:       time.Now(),
+	}
+}
+
+// acquire reserves a transfer, it returns false and the reason if the capacity is exceeded.
+// Reserved transfers have to be released once they are done.
+func (c *capacity) acquire() (bool, string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.maxTransfers > 0 && c.transfers >= c.maxTransfers {
+		return false, "transfers"
+	}
+	if c.maxBytesPerSecond > 0 && c.rate() >= float64(c.maxBytesPerSecond) {
+		return false, "bandwidth"
+	}
+	c.transfers++
+	servingCapacityActiveTransfers.Inc()
+	return true, ""
+}
+
+func (c *capacity) release() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.transfers--
+	servingCapacityActiveTransfers.Dec()
+}
+
+func (c *capacity) add(n int64) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.roll()
+	c.current += n
+}
+
+// rate returns the estimated bytes per second, weighting the previous window by the part of it that is still within the last second.
+func (c *capacity) rate() float64 {
+	c.roll()
+	elapsed := float64(time.Since(c.windowStart)) / float64(time.Second)
+	return float64(c.previous)*(1-elapsed) + float64(c.current)
+}
+
+func (c *capacity) roll() {
+	elapsed := time.Since(c.windowStart)
+	if elapsed < time.Second {
+		return
+	}
+	// The previous window is only kept if it ended less than a second ago.
+	if elapsed < 2*time.Second {
+		c.previous = c.current
+	} else {
+		c.previous = 0
+	}
+	c.current = 0
+	c.windowStart = c.windowStart.Add(elapsed.Truncate(time.Second))
+}
+
+// capacityWriter adds written bytes to the capacity as they are written, so that long transfers count towards the bandwidth while in progress.
+type capacityWriter struct {
+	gin.ResponseWriter
+	capacity *capacity
+}
+
+func (w *capacityWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.capacity.add(int64(n))
+	return n, err
+}
@@ -0,0 +1,102 @@
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestCapacityTransfers(t *testing.T) {
+	c := newCapacity(2, 0)
+
+	ok, _ := c.acquire()
+	require.True(t, ok)
+	ok, _ = c.acquire()
+	require.True(t, ok)
+	ok, reason := c.acquire()
+	require.False(t, ok)
+	require.Equal(t, "transfers", reason)
+
+	c.release()
+	ok, _ = c.acquire()
+	require.True(t, ok)
+}
+
+func TestCapacityBandwidth(t *testing.T) {
+	c := newCapacity(0, 100)
+
+	ok, _ := c.acquire()
+	require.True(t, ok)
+	c.add(100)
+	ok, reason := c.acquire()
+	require.False(t, ok)
+	require.Equal(t, "bandwidth", reason)
+
+	// The estimated rate drops as the window slides past the bytes written.
+	c.windowStart = c.windowStart.Add(-2 * time.Second)
+	ok, _ = c.acquire()
+	require.True(t, ok)
+}
+
+func TestCapacityRate(t *testing.T) {
+	c := newCapacity(0, 0)
+	c.add(100)
+	c.windowStart = time.Now().Add(-1500 * time.Millisecond)
+	rate := c.rate()
+	require.InDelta(t, 50, rate, 5)
+	c.add(20)
+	require.InDelta(t, 70, c.rate(), 5)
+}
+
+func TestServingCapacityHandler(t *testing.T) {
+	reg := NewRegistry(oci.NewMockClient(nil), routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, WithServingCapacity(1, 0))
+	reg.capacity.transfers = 1
+	srv := reg.Server("", logr.Discard())
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{
+			name:           "blob rejected",
+			method:         http.MethodGet,
+			path:           "/v2/library/ubuntu/blobs/sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+			expectedStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:           "blob head not limited",
+			method:         http.MethodHead,
+			path:           "/v2/library/ubuntu/blobs/sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "manifest not limited",
+			method:         http.MethodGet,
+			path:           "/v2/library/ubuntu/manifests/sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "http://example.com"+tt.path+"?ns=docker.io", nil)
+			req.Header.Set(MirroredHeaderKey, "true")
+			srv.Handler.ServeHTTP(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus == http.StatusTooManyRequests {
+				require.Equal(t, "1", resp.Header.Get("Retry-After"))
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+// Time to wait for additional mirrors after the first one has been resolved.
+const chunkResolveWindow = 100 * time.Millisecond
+
+type chunkResult struct {
+	b   []byte
+	err error
+}
+
+type chunk struct {
+	start    int64
+	end      int64
+	resultCh chan chunkResult
+}
+
+// handleChunkedMirror fetches disjoint byte ranges of a blob from multiple mirrors in parallel and writes them to the client in order.
+// It falls back to proxying from a single mirror when the blob is small or only one mirror is found.
+func (r *Registry) handleChunkedMirror(c *gin.Context, key string) {
+	c.Set("handler", "mirror")
+
+	log := requestLogger(c)
+
+	resolveCtx, cancel := context.WithTimeout(c, r.resolveTimeoutFor(oci.ReferenceTypeBlob))
+	defer cancel()
+	resolveCtx = logr.NewContext(resolveCtx, log)
+	isExternal := r.isExternalRequest(c)
+	mirrors, err := routing.ResolveMirrors(resolveCtx, r.router, key, isExternal, r.chunkParallelism, chunkResolveWindow)
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if len(mirrors) < 2 {
+		r.handleMirror(c, key, oci.ReferenceTypeBlob)
+		return
+	}
+	header, size, err := headMirrors(c, r.client, mirrors, c.Request.URL)
+	if err != nil || size <= r.chunkSize {
+		r.handleMirror(c, key, oci.ReferenceTypeBlob)
+		return
+	}
+
+	chunks := []*chunk{}
+	for start := int64(0); start < size; start += r.chunkSize {
+		end := start + r.chunkSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		chunks = append(chunks, &chunk{start: start, end: end, resultCh: make(chan chunkResult, 1)})
+	}
+
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+	// Limits the amount of chunks in flight, which also limits the amount of chunks kept in memory.
+	sem := make(chan interface{}, r.chunkParallelism)
+	go func() {
+		for i, ch := range chunks {
+			select {
+			case <-ctx.Done():
+				return
+			case sem <- nil:
+			}
+			go func(i int, ch *chunk) {
+				b, err := fetchChunk(ctx, r.client, mirrors, i, c.Request.URL, ch.start, ch.end, r.transferTimeout)
+				ch.resultCh <- chunkResult{b: b, err: err}
+			}(i, ch)
+		}
+	}()
+
+	for _, k := range []string{"Content-Type", "Docker-Content-Digest"} {
+		if v := header.Get(k); v != "" {
+			c.Header(k, v)
+		}
+	}
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Status(http.StatusOK)
+	result := "exhausted"
+	defer func() {
+		mirrorPeersTried.Observe(float64(len(mirrors)))
+		mirrorResolveResultsTotal.WithLabelValues(result).Inc()
+	}()
+	for _, ch := range chunks {
+		res := <-ch.resultCh
+		<-sem
+		if res.err != nil {
+			log.Error(res.err, "chunked mirror transfer failed", "offset", ch.start)
+			c.Abort()
+			return
+		}
+		_, err := c.Writer.Write(res.b)
+		if err != nil {
+			log.Error(err, "could not write chunk", "offset", ch.start)
+			c.Abort()
+			return
+		}
+	}
+	result = "hit"
+	log.V(5).Info("mirrored request in chunks", "path", c.Request.URL.Path, "mirrors", len(mirrors), "chunks", len(chunks))
+}
+
+// headMirrors returns the response header and size of the blob from the first mirror that responds.
+func headMirrors(ctx context.Context, client *http.Client, mirrors []string, u *url.URL) (http.Header, int64, error) {
+	for _, mirror := range mirrors {
+		req, err := newMirrorRequest(ctx, http.MethodHead, mirror, u)
+		if err != nil {
+			return nil, 0, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+			continue
+		}
+		return resp.Header, resp.ContentLength, nil
+	}
+	return nil, 0, fmt.Errorf("could not get blob size from any mirror")
+}
+
+// fetchChunk fetches the byte range starting with the mirror of the same index as the chunk, trying the other mirrors on failure.
+// The transfer timeout bounds the fetch of the range from each mirror.
+func fetchChunk(ctx context.Context, client *http.Client, mirrors []string, idx int, u *url.URL, start, end int64, transferTimeout time.Duration) ([]byte, error) {
+	errs := []error{}
+	for i := 0; i < len(mirrors); i++ {
+		mirror := mirrors[(idx+i)%len(mirrors)]
+		b, err := fetchRange(ctx, client, mirror, u, start, end, transferTimeout)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("could not fetch chunk %d-%d from any mirror: %v", start, end, errs)
+}
+
+func fetchRange(ctx context.Context, client *http.Client, mirror string, u *url.URL, start, end int64, transferTimeout time.Duration) ([]byte, error) {
+	ctx, cancel := withTransferTimeout(ctx, transferTimeout)
+	defer cancel()
+	req, err := newMirrorRequest(ctx, http.MethodGet, mirror, u)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("expected mirror %s to respond with 206 Partial Content but received: %s", mirror, resp.Status)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, end-start+1))
+	_, err = io.Copy(buf, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) != end-start+1 {
+		return nil, fmt.Errorf("expected mirror %s to respond with %d bytes but received %d", mirror, end-start+1, buf.Len())
+	}
+	return buf.Bytes(), nil
+}
+
+func newMirrorRequest(ctx context.Context, method, mirror string, u *url.URL) (*http.Request, error) {
+	mirrorURL, err := url.Parse(mirror)
+	if err != nil {
+		return nil, err
+	}
+	mirrorURL.Path = u.Path
+	mirrorURL.RawQuery = u.RawQuery
+	req, err := http.NewRequestWithContext(ctx, method, mirrorURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(MirroredHeaderKey, "true")
+	hops, _ := ctx.Value(hopsContextKey).(int)
+	req.Header.Set(HopsHeaderKey, strconv.Itoa(hops+1))
+	return req, nil
+}
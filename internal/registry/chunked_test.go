@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestChunkedMirrorHandler(t *testing.T) {
+	content := []byte("hello world, this is a chunked blob")
+	rangeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", "sha256:foo")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	firstSvr := httptest.NewServer(rangeHandler)
+	defer firstSvr.Close()
+	secondSvr := httptest.NewServer(rangeHandler)
+	defer secondSvr.Close()
+	badSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer badSvr.Close()
+
+	router := routing.NewMockRouter(map[string][]string{
+		"chunked": {firstSvr.URL, badSvr.URL, secondSvr.URL},
+	})
+	reg := NewRegistry(nil, router, "", 3, 5*time.Second, false, WithChunkedFetch(4, 3))
+
+	rw := CreateTestResponseRecorder()
+	c, _ := gin.CreateTestContext(rw)
+	c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/v2/foo/blobs/chunked", nil)
+	reg.handleChunkedMirror(c, "chunked")
+
+	resp := rw.Result()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, string(content), string(b))
+	require.Equal(t, "sha256:foo", resp.Header.Get("Docker-Content-Digest"))
+}
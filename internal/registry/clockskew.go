@@ -0,0 +1,48 @@
+package registry
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Skew between the local clock and a peer clock above which a warning is logged.
+// Provider records are expired by the wall clock of the node storing them, so large skew causes keys to expire early or late.
+const maxPeerClockSkew = 30 * time.Second
+
+var peerClockSkew = promauto.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "spegel_peer_clock_skew_seconds",
+		Help:    "Absolute difference between the local clock and the Date header of peer responses.",
+		Buckets: []float64{1, 5, 15, 30, 60, 300, 900},
+	},
+)
+
+// observePeerClockSkew compares the Date header of a peer response with the local clock.
+func observePeerClockSkew(log logr.Logger, mirror string, header http.Header, now time.Time) {
+	skew, ok := clockSkew(header, now)
+	if !ok {
+		return
+	}
+	peerClockSkew.Observe(skew.Seconds())
+	if skew > maxPeerClockSkew {
+		log.Info("clock skew detected between local node and peer, provider records may expire early or late", "peer", mirror, "skew", skew.String())
+	}
+}
+
+// clockSkew returns the absolute difference between the Date header and the time.
+// The Date header has a resolution of one second which is accounted for.
+func clockSkew(header http.Header, now time.Time) (time.Duration, bool) {
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+	skew := now.Truncate(time.Second).Sub(date)
+	if skew < 0 {
+		skew = -skew
+	}
+	return skew, true
+}
@@ -0,0 +1,52 @@
+package registry
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClockSkew(t *testing.T) {
+	now := time.Date(2023, 9, 1, 12, 0, 0, 500, time.UTC)
+	tests := []struct {
+		name     string
+		date     string
+		expected time.Duration
+		ok       bool
+	}{
+		{
+			name:     "no skew",
+			date:     now.Format(http.TimeFormat),
+			expected: 0,
+			ok:       true,
+		},
+		{
+			name:     "peer ahead",
+			date:     now.Add(time.Minute).Format(http.TimeFormat),
+			expected: time.Minute,
+			ok:       true,
+		},
+		{
+			name:     "peer behind",
+			date:     now.Add(-45 * time.Second).Format(http.TimeFormat),
+			expected: 45 * time.Second,
+			ok:       true,
+		},
+		{
+			name: "missing date",
+			date: "",
+			ok:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("Date", tt.date)
+			skew, ok := clockSkew(header, now)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.expected, skew)
+		})
+	}
+}
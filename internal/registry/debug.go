@@ -0,0 +1,174 @@
+package registry
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/xenitab/spegel/internal/oci"
+)
+
+type debugKey struct {
+	Key    string   `json:"key"`
+	Images []string `json:"images"`
+}
+
+type debugPeer struct {
+	Peer     string `json:"peer"`
+	Status   int    `json:"status,omitempty"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+type debugResolveResult struct {
+	Key      string      `json:"key"`
+	Duration string      `json:"duration"`
+	Error    string      `json:"error,omitempty"`
+	Peers    []debugPeer `json:"peers"`
+}
+
+// WithDebug enables endpoints used to diagnose missed mirror requests, requests have to authenticate with the bearer token.
+func WithDebug(token string) Option {
+	return func(r *Registry) {
+		r.debugToken = token
+	}
+}
+
+// hasBearerToken returns true if the request presents the token as a bearer token.
+func hasBearerToken(c *gin.Context, token string) bool {
+	auth := c.GetHeader("Authorization")
+	reqToken := strings.TrimPrefix(auth, "Bearer ")
+	return reqToken != auth && subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) == 1
+}
+
+func (r *Registry) debugAuthHandler(c *gin.Context) {
+	if !hasBearerToken(c, r.debugToken) {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+}
+
+// debugKeysHandler lists the keys advertised by the node together with the images they are advertised for.
+func (r *Registry) debugKeysHandler(c *gin.Context) {
+	c.Set("handler", "debug_keys")
+	advertised, err := r.listAdvertised(c)
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	// Images with the same name in multiple namespaces are only listed once per key.
+	sources := map[string]map[string]interface{}{}
+	addSource := func(key, name string) {
+		if _, ok := sources[key]; !ok {
+			sources[key] = map[string]interface{}{}
+		}
+		sources[key][name] = nil
+	}
+	for _, keys := range advertised {
+		if tagRef, ok := keys.img.TagName(); ok && keys.tag != "" {
+			addSource(tagRef, keys.img.Name)
+		}
+		for _, dgst := range keys.dgsts {
+			addSource(dgst, keys.img.Name)
+		}
+	}
+	keys := []debugKey{}
+	for key, names := range sources {
+		images := []string{}
+		for name := range names {
+			images = append(images, name)
+		}
+		sort.Strings(images)
+		keys = append(keys, debugKey{Key: key, Images: images})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Key < keys[j].Key
+	})
+	c.JSON(http.StatusOK, keys)
+}
+
+// debugResolveHandler resolves the key of an image reference and requests the content from every resolved peer
+// in the same way as a mirrored request, showing which peers are found and which of them actually serve the content.
+// The digest query parameter resolves a blob of the image instead of the manifest.
+func (r *Registry) debugResolveHandler(c *gin.Context) {
+	c.Set("handler", "debug_resolve")
+	log := requestLogger(c)
+
+	ref := c.Query("ref")
+	registry, repository, tag, dgst, err := oci.ParseReference(ref)
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	key := fmt.Sprintf("%s/%s:%s", registry, repository, tag)
+	p := fmt.Sprintf("/v2/%s/manifests/%s", repository, tag)
+	if dgst != "" {
+		key = dgst.String()
+		p = fmt.Sprintf("/v2/%s/manifests/%s", repository, dgst)
+	}
+	if v := c.Query("digest"); v != "" {
+		blobDgst, err := digest.Parse(v)
+		if err != nil {
+			//nolint:errcheck // ignore
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		key = blobDgst.String()
+		p = fmt.Sprintf("/v2/%s/blobs/%s", repository, blobDgst)
+	} else if tag == "" && dgst == "" {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("reference needs to contain a tag or digest"))
+		return
+	}
+	ctx := logr.NewContext(c, log)
+
+	res := r.resolveKey(ctx, key)
+	result := debugResolveResult{
+		Key:      res.Key,
+		Duration: res.Duration,
+		Error:    res.Error,
+		Peers:    []debugPeer{},
+	}
+	u := &url.URL{
+		Path:     p,
+		RawQuery: url.Values{"ns": []string{registry}}.Encode(),
+	}
+	_, resolveTimeout, _ := r.resolveSettings()
+	for _, peer := range res.Peers {
+		result.Peers = append(result.Peers, r.probePeer(ctx, peer, u, resolveTimeout))
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// probePeer requests the headers of the content from the peer without following it to other peers.
+func (r *Registry) probePeer(ctx context.Context, peer string, u *url.URL, timeout time.Duration) debugPeer {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	result := debugPeer{Peer: peer}
+	req, err := newMirrorRequest(ctx, http.MethodHead, peer, u)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp, err := r.client.Do(req)
+	result.Duration = time.Since(start).String()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+	result.Status = resp.StatusCode
+	return result
+}
@@ -0,0 +1,131 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/diskpressure"
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestDebugKeysHandler(t *testing.T) {
+	imgs := []oci.Image{}
+	for _, ref := range []string{
+		"docker.io/library/ubuntu:22.04@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+		"docker.io/library/ubuntu:jammy@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+		"docker.io/library/alpine:latest@sha256:25fad2a32ad1f6f510e528448ae1ec69a28ef81916a004d3629874104f8a7f70",
+	} {
+		img, err := oci.Parse(ref, "")
+		require.NoError(t, err)
+		imgs = append(imgs, img)
+	}
+	img, err := oci.Parse("ghcr.io/xenitab/spegel:v0.0.20@sha256:c5c5fda71656f28e49ac9c5416b3643eaa6a108a8093151d6d1afc39463be786", "")
+	require.NoError(t, err)
+	imgs = append(imgs, img)
+	pressure := diskpressure.NewDetector()
+	resolveTags := oci.ResolveTags{Default: true, Overrides: map[string]bool{"ghcr.io": false}}
+	reg := NewRegistry(oci.NewMockClient(imgs), routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, WithDebug("secret"), WithResolveTags(resolveTags), WithDiskPressure(pressure))
+	srv := reg.Server("", logr.Discard())
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/debug/keys", nil)
+	srv.Handler.ServeHTTP(rw, req)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	rw = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer secret")
+	srv.Handler.ServeHTTP(rw, req)
+	resp = rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	keys := []debugKey{}
+	err = json.NewDecoder(resp.Body).Decode(&keys)
+	require.NoError(t, err)
+	expected := []debugKey{
+		{Key: "docker.io/library/ubuntu:22.04", Images: []string{imgs[0].Name}},
+		{Key: "docker.io/library/ubuntu:jammy", Images: []string{imgs[1].Name}},
+		{Key: "sha256:25fad2a32ad1f6f510e528448ae1ec69a28ef81916a004d3629874104f8a7f70", Images: []string{imgs[2].Name}},
+		{Key: "sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020", Images: []string{imgs[0].Name, imgs[1].Name}},
+		{Key: "sha256:c5c5fda71656f28e49ac9c5416b3643eaa6a108a8093151d6d1afc39463be786", Images: []string{imgs[3].Name}},
+	}
+	require.Equal(t, expected, keys)
+
+	// Nothing is advertised while the node is under disk pressure.
+	pressure.Set("usage", true)
+	rw = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rw, req)
+	resp = rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	keys = []debugKey{}
+	err = json.NewDecoder(resp.Body).Decode(&keys)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+}
+
+func TestDebugResolveHandler(t *testing.T) {
+	var mx sync.Mutex
+	paths := []string{}
+	mirrored := []string{}
+	goodSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		paths = append(paths, r.URL.String())
+		mirrored = append(mirrored, r.Header.Get(MirroredHeaderKey))
+		mx.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer goodSvr.Close()
+	badSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer badSvr.Close()
+
+	dgst := "sha256:25fad2a32ad1f6f510e528448ae1ec69a28ef81916a004d3629874104f8a7f70"
+	router := routing.NewMockRouter(map[string][]string{dgst: {goodSvr.URL, badSvr.URL}})
+	reg := NewRegistry(oci.NewMockClient(nil), router, "", 3, 5*time.Second, false, WithDebug("secret"))
+	srv := reg.Server("", logr.Discard())
+
+	for _, target := range []string{
+		"http://example.com/debug/resolve?ref=docker.io/library/alpine@" + dgst,
+		"http://example.com/debug/resolve?ref=docker.io/library/alpine:3.18&digest=" + dgst,
+	} {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		srv.Handler.ServeHTTP(rw, req)
+		resp := rw.Result()
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		result := debugResolveResult{}
+		err := json.NewDecoder(resp.Body).Decode(&result)
+		require.NoError(t, err)
+		require.Equal(t, dgst, result.Key)
+		require.Len(t, result.Peers, 2)
+		require.Equal(t, goodSvr.URL, result.Peers[0].Peer)
+		require.Equal(t, http.StatusOK, result.Peers[0].Status)
+		require.Equal(t, badSvr.URL, result.Peers[1].Peer)
+		require.Equal(t, http.StatusNotFound, result.Peers[1].Status)
+	}
+	mx.Lock()
+	require.Equal(t, []string{"/v2/library/alpine/manifests/" + dgst + "?ns=docker.io", "/v2/library/alpine/blobs/" + dgst + "?ns=docker.io"}, paths)
+	require.Equal(t, []string{"true", "true"}, mirrored)
+	mx.Unlock()
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/debug/resolve?ref=docker.io/library/alpine", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	srv.Handler.ServeHTTP(rw, req)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
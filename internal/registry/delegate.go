@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+)
+
+// DelegatedQueryKey is set on requests redirected to a peer, which serves them from its own content store.
+const DelegatedQueryKey = "delegated"
+
+// WithExternalDelegation redirects external requests to a peer that advertises the content instead of proxying the
+// content through the node. Load from clients outside of the cluster is spread across peers without transferring
+// the content twice. Mirrors have to be reachable by the external clients.
+func WithExternalDelegation() Option {
+	return func(r *Registry) {
+		r.delegateExternal = true
+	}
+}
+
+// isDelegatedRequest returns true if the request has been redirected by a peer.
+func isDelegatedRequest(c *gin.Context) bool {
+	return c.Query(DelegatedQueryKey) == "true"
+}
+
+// delegateMirror redirects the request to the first mirror that is not backing off, and returns the result of the resolve.
+func (r *Registry) delegateMirror(ctx context.Context, c *gin.Context, log logr.Logger, mirrorCh <-chan string) string {
+	resolveRetries, _, _ := r.resolveSettings()
+	for i := 0; i < resolveRetries; i++ {
+		mirror, ok, err := nextMirror(ctx, mirrorCh, r.attemptTimeout)
+		if err != nil || !ok {
+			break
+		}
+		if r.peerScores != nil && r.peerScores.isBackingOff(mirror) {
+			mirrorPeerSkipsTotal.Inc()
+			continue
+		}
+		u, err := url.Parse(mirror)
+		if err != nil {
+			//nolint:errcheck // ignore
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return "miss"
+		}
+		u.Path = c.Request.URL.Path
+		q := c.Request.URL.Query()
+		q.Set(DelegatedQueryKey, "true")
+		u.RawQuery = q.Encode()
+		withLogValues(c, "peer", mirror)
+		log.V(5).Info("delegated external request", "path", c.Request.URL.Path, "url", u.String())
+		c.Redirect(http.StatusTemporaryRedirect, u.String())
+		return "delegated"
+	}
+	//nolint:errcheck // ignore
+	c.AbortWithError(http.StatusNotFound, fmt.Errorf("could not resolve mirror to delegate request to"))
+	return "miss"
+}
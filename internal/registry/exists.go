@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+const (
+	// Max amount of digests checked by a single request.
+	maxExistsDigests = 100
+	// Max amount of peers returned per digest, which should cover the nodes of most clusters.
+	maxExistsPeers = 100
+	// Duration that more peers are waited for after the first peer has been found.
+	existsResolveWindow = 500 * time.Millisecond
+	// Max amount of digests resolved in parallel for a single request.
+	existsParallelism = 10
+)
+
+// ExistsResult reports whether content is available in the cluster and the peers that advertise it.
+type ExistsResult struct {
+	Digest string `json:"digest"`
+	Exists bool   `json:"exists"`
+	// Local is true if the content exists on the node serving the request.
+	Local bool     `json:"local"`
+	Peers []string `json:"peers"`
+	Error string   `json:"error,omitempty"`
+}
+
+// WithExistsAPI enables the endpoint reporting whether digests are available in the cluster and on which peers,
+// so that controllers can make image locality aware decisions. Requests have to authenticate with the bearer token.
+func WithExistsAPI(token string) Option {
+	return func(r *Registry) {
+		r.existsToken = token
+	}
+}
+
+// existsHandler resolves every digest query parameter through the router, without requesting any content from peers.
+func (r *Registry) existsHandler(c *gin.Context) {
+	c.Set("handler", "exists")
+	if !hasBearerToken(c, r.existsToken) {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	values := c.QueryArray("digest")
+	if len(values) == 0 || len(values) > maxExistsDigests {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("between 1 and %d digests have to be set", maxExistsDigests))
+		return
+	}
+	dgsts := []digest.Digest{}
+	for _, v := range values {
+		dgst, err := digest.Parse(v)
+		if err != nil {
+			//nolint:errcheck // ignore
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid digest %s: %w", v, err))
+			return
+		}
+		dgsts = append(dgsts, dgst)
+	}
+
+	results := make([]ExistsResult, len(dgsts))
+	g := errgroup.Group{}
+	g.SetLimit(existsParallelism)
+	for i, dgst := range dgsts {
+		i, dgst := i, dgst
+		g.Go(func() error {
+			results[i] = r.exists(c, dgst)
+			return nil
+		})
+	}
+	//nolint:errcheck // lookups never return errors
+	g.Wait()
+	c.JSON(http.StatusOK, results)
+}
+
+func (r *Registry) exists(ctx context.Context, dgst digest.Digest) ExistsResult {
+	result := ExistsResult{Digest: dgst.String(), Peers: []string{}}
+	if _, err := r.ociClient.GetSize(ctx, dgst); err == nil {
+		result.Local = true
+	}
+	_, resolveTimeout, _ := r.resolveSettings()
+	resolveCtx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	peers, err := routing.ResolveMirrors(resolveCtx, r.router, dgst.String(), true, maxExistsPeers, existsResolveWindow)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if peers != nil {
+		result.Peers = peers
+	}
+	result.Exists = result.Local || len(result.Peers) > 0
+	return result
+}
@@ -0,0 +1,99 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+type localContentClient struct {
+	oci.Client
+	local map[digest.Digest]bool
+}
+
+func (c *localContentClient) GetSize(ctx context.Context, dgst digest.Digest) (int64, error) {
+	if !c.local[dgst] {
+		return 0, errdefs.ErrNotFound
+	}
+	return 1, nil
+}
+
+func TestExistsHandler(t *testing.T) {
+	first := digest.Digest("sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020")
+	second := digest.Digest("sha256:68b8a989a3e08ddbdb3a0077d35c0d0e59c9ecf23d0634584def8bdbb7d6824f")
+	third := digest.Digest("sha256:9430beb291fa7b96997711fc486bc46133c719631aefdbeebe58dd3489217bfe")
+	router := routing.NewMockRouter(map[string][]string{
+		first.String():  {"http://10.0.0.1:5000", "http://10.0.0.2:5000"},
+		second.String(): {"http://10.0.0.3:5000"},
+	})
+	ociClient := &localContentClient{Client: oci.NewMockClient(nil), local: map[digest.Digest]bool{second: true}}
+	reg := NewRegistry(ociClient, router, "", 3, time.Second, false, WithExistsAPI("secret"))
+	srv := reg.Server("", logr.Discard())
+
+	tests := []struct {
+		name           string
+		query          string
+		token          string
+		expectedStatus int
+		expected       []ExistsResult
+	}{
+		{
+			name:           "without token",
+			query:          "digest=" + first.String(),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "without digest",
+			token:          "secret",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid digest",
+			query:          "digest=foo",
+			token:          "secret",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "multiple digests",
+			query:          "digest=" + first.String() + "&digest=" + second.String() + "&digest=" + third.String(),
+			token:          "secret",
+			expectedStatus: http.StatusOK,
+			expected: []ExistsResult{
+				{Digest: first.String(), Exists: true, Peers: []string{"http://10.0.0.1:5000", "http://10.0.0.2:5000"}},
+				{Digest: second.String(), Exists: true, Local: true, Peers: []string{"http://10.0.0.3:5000"}},
+				{Digest: third.String(), Exists: false, Peers: []string{}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/exists?"+tt.query, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			srv.Handler.ServeHTTP(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expected == nil {
+				return
+			}
+			results := []ExistsResult{}
+			err := json.NewDecoder(resp.Body).Decode(&results)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, results)
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// WithHTTP2 mirrors requests to peers over cleartext HTTP/2, multiplexing concurrent requests to the same peer over a single connection.
+// All peers have to run a version of the registry that accepts h2c as prior knowledge is used instead of upgrading connections.
+func WithHTTP2() Option {
+	return func(r *Registry) {
+		r.http2 = true
+	}
+}
+
+func newH2CTransport(dialTimeout, firstByteTimeout time.Duration) http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		// Detects connections to peers that have gone away as all requests to the peer share the connection.
+		ReadIdleTimeout: 30 * time.Second,
+		PingTimeout:     15 * time.Second,
+	}
+	if firstByteTimeout <= 0 {
+		return transport
+	}
+	return &headerTimeoutTransport{RoundTripper: transport, timeout: firstByteTimeout}
+}
+
+// headerTimeoutTransport bounds the time waiting for response headers for transports lacking a response header timeout.
+type headerTimeoutTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *headerTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			//nolint:errcheck // ignore
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, fmt.Errorf("timeout awaiting response headers")
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelReadCloser{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelReadCloser cancels the request context when the response body is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// h2cConns tracks the HTTP/2 connections served by the h2c handler. The handler hijacks the connections from the server,
+// which means that shutting down the server does not wait for them to be drained.
+type h2cConns struct {
+	wg      sync.WaitGroup
+	handler http.Handler
+}
+
+func (h *h2cConns) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// The h2c handler serves the connection until it is closed before returning.
+	if isH2CRequest(req) {
+		h.wg.Add(1)
+		defer h.wg.Done()
+	}
+	h.handler.ServeHTTP(w, req)
+}
+
+func isH2CRequest(req *http.Request) bool {
+	if req.Method == "PRI" && req.URL.Path == "*" {
+		return true
+	}
+	return strings.EqualFold(req.Header.Get("Upgrade"), "h2c")
+}
+
+// Drain waits for HTTP/2 connections to be closed after the server has been shut down. Shutting down the server
+// tells the connections to go away, which closes them once in-flight requests have completed.
+func (r *Registry) Drain(ctx context.Context) error {
+	doneCh := make(chan struct{})
+	go func() {
+		r.h2cConns.wg.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("could not drain HTTP/2 connections: %w", ctx.Err())
+	case <-doneCh:
+		return nil
+	}
+}
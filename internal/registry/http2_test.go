@@ -0,0 +1,150 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestServerH2C(t *testing.T) {
+	router := routing.NewMockRouter(map[string][]string{})
+	reg := NewRegistry(nil, router, "", 3, 5*time.Second, false)
+	srv := httptest.NewServer(reg.Server("", logr.Discard()).Handler)
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(context.TODO(), http.MethodGet, srv.URL+"/healthz", nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, 2, resp.ProtoMajor)
+
+	resp, err = http.Get(srv.URL + "/healthz")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, 1, resp.ProtoMajor)
+}
+
+func TestServerDrainH2C(t *testing.T) {
+	router := routing.NewMockRouter(map[string][]string{})
+	reg := NewRegistry(nil, router, "", 3, 5*time.Second, false)
+	startedCh := make(chan interface{})
+	err := reg.Handle(http.MethodGet, "/slow", func(c *gin.Context) {
+		close(startedCh)
+		time.Sleep(500 * time.Millisecond)
+		c.String(http.StatusOK, "hello world")
+	})
+	require.NoError(t, err)
+	srv := reg.Server("", logr.Discard())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	//nolint:errcheck // ignore
+	go srv.Serve(ln)
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+	}
+	type result struct {
+		body string
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		resp, err := client.Get("http://" + ln.Addr().String() + "/slow")
+		if err != nil {
+			resultCh <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		resultCh <- result{body: string(b), err: err}
+	}()
+	<-startedCh
+
+	// The hijacked connection is not waited for by the server, draining waits until the request has completed.
+	start := time.Now()
+	err = srv.Shutdown(context.TODO())
+	require.NoError(t, err)
+	err = reg.Drain(context.TODO())
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	res := <-resultCh
+	require.NoError(t, res.err)
+	require.Equal(t, "hello world", res.body)
+}
+
+func TestMirrorHandlerHTTP2(t *testing.T) {
+	protos := []int{}
+	svr := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos = append(protos, r.ProtoMajor)
+		//nolint:errcheck // ignore
+		w.Write([]byte("hello world"))
+	}), &http2.Server{}))
+	defer svr.Close()
+
+	router := routing.NewMockRouter(map[string][]string{"key": {svr.URL}})
+	reg := NewRegistry(nil, router, "", 3, 5*time.Second, false, WithHTTP2())
+	for i := 0; i < 2; i++ {
+		rw := CreateTestResponseRecorder()
+		c, _ := gin.CreateTestContext(rw)
+		c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/key", nil)
+		reg.handleMirror(c, "key", oci.ReferenceTypeBlob)
+		resp := rw.Result()
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "hello world", string(b))
+	}
+	require.Equal(t, []int{2, 2}, protos)
+}
+
+func TestHeaderTimeoutTransport(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		//nolint:errcheck // ignore
+		w.Write([]byte("hello world"))
+	}))
+	defer svr.Close()
+
+	client := &http.Client{Transport: &headerTimeoutTransport{RoundTripper: http.DefaultTransport, timeout: 100 * time.Millisecond}}
+	resp, err := client.Get(svr.URL + "/fast")
+	require.NoError(t, err)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, "hello world", string(b))
+
+	//nolint:bodyclose // response is nil on error
+	_, err = client.Get(svr.URL + "/slow")
+	require.Error(t, err)
+}
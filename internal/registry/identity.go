@@ -0,0 +1,122 @@
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+const (
+	// PeerNonceHeaderKey is set by mirroring nodes and is signed by the serving peer together with the request.
+	PeerNonceHeaderKey = "X-Spegel-Peer-Nonce"
+	// PeerIDHeaderKey is the peer ID of the node that signed the response.
+	PeerIDHeaderKey = "X-Spegel-Peer-ID"
+	// PeerSignatureHeaderKey is the base64 encoded signature of the response.
+	PeerSignatureHeaderKey = "X-Spegel-Peer-Signature"
+)
+
+var mirrorIdentityRejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "spegel_mirror_identity_rejected_total",
+	Help: "Total number of mirror responses rejected because they were not signed by the peer that advertised the key.",
+})
+
+// PeerSigner signs data with the identity of the node and verifies data signed by the identity of peers.
+type PeerSigner interface {
+	Sign(b []byte) (string, []byte, error)
+	VerifySignature(peerID string, b, sig []byte) error
+}
+
+// WithPeerIdentity signs responses to requests carrying a nonce with the identity of the node, and rejects responses
+// from mirrors that carry a peer ID but are not signed by that peer. This keeps a node from redirecting requests to
+// addresses of other nodes by advertising keys with them. All peers have to be configured in the same way.
+func WithPeerIdentity(signer PeerSigner) Option {
+	return func(r *Registry) {
+		r.peerSigner = signer
+	}
+}
+
+// peerSignatureData returns the data signed for a request, the nonce keeps signatures from being replayed.
+func peerSignatureData(nonce, method, p string) []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%s", nonce, method, p))
+}
+
+// signResponseHandler signs the response headers before the response is written.
+func (r *Registry) signResponseHandler(c *gin.Context) {
+	nonce := c.GetHeader(PeerNonceHeaderKey)
+	if nonce == "" {
+		return
+	}
+	peerID, sig, err := r.peerSigner.Sign(peerSignatureData(nonce, c.Request.Method, c.Request.URL.Path))
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("could not sign response: %w", err))
+		return
+	}
+	c.Header(PeerIDHeaderKey, peerID)
+	c.Header(PeerSignatureHeaderKey, base64.StdEncoding.EncodeToString(sig))
+}
+
+// identityTransport verifies that responses from mirrors with a peer ID are signed by the peer.
+// Requests to mirrors without a peer ID are sent as is.
+type identityTransport struct {
+	http.RoundTripper
+	signer PeerSigner
+}
+
+func (t *identityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	peerID := req.URL.Fragment
+	if peerID == "" {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	nonce := hex.EncodeToString(b)
+	// Request has to be cloned as round trippers should not modify the request.
+	req = req.Clone(req.Context())
+	req.Header.Set(PeerNonceHeaderKey, nonce)
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyPeerSignature(t.signer, peerID, nonce, req, resp)
+	if err != nil {
+		resp.Body.Close()
+		mirrorIdentityRejectedTotal.Inc()
+		return nil, fmt.Errorf("mirror %s does not match the identity of the advertisement: %w", req.URL.Host, err)
+	}
+	return resp, nil
+}
+
+func verifyPeerSignature(signer PeerSigner, peerID, nonce string, req *http.Request, resp *http.Response) error {
+	if resp.Header.Get(PeerIDHeaderKey) != peerID {
+		return fmt.Errorf("expected peer %s but response was signed by %q", peerID, resp.Header.Get(PeerIDHeaderKey))
+	}
+	sig, err := base64.StdEncoding.DecodeString(resp.Header.Get(PeerSignatureHeaderKey))
+	if err != nil {
+		return fmt.Errorf("could not decode signature: %w", err)
+	}
+	return signer.VerifySignature(peerID, peerSignatureData(nonce, req.Method, req.URL.Path), sig)
+}
+
+// withMirrorPeerID keeps the peer ID of the mirror on proxied requests, as the reverse proxy drops the fragment of the target.
+func withMirrorPeerID(director func(*http.Request), mirror string) func(*http.Request) {
+	peerID, ok := routing.MirrorPeerID(mirror)
+	if !ok {
+		return director
+	}
+	return func(req *http.Request) {
+		director(req)
+		req.URL.Fragment = peerID
+	}
+}
@@ -0,0 +1,140 @@
+package registry
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+type testSigner struct {
+	id   string
+	keys map[string]ed25519.PrivateKey
+}
+
+func newTestSigners(ids ...string) map[string]*testSigner {
+	keys := map[string]ed25519.PrivateKey{}
+	for _, id := range ids {
+		_, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			panic(err)
+		}
+		keys[id] = priv
+	}
+	signers := map[string]*testSigner{}
+	for _, id := range ids {
+		signers[id] = &testSigner{id: id, keys: keys}
+	}
+	return signers
+}
+
+func (s *testSigner) Sign(b []byte) (string, []byte, error) {
+	return s.id, ed25519.Sign(s.keys[s.id], b), nil
+}
+
+func (s *testSigner) VerifySignature(peerID string, b, sig []byte) error {
+	priv, ok := s.keys[peerID]
+	if !ok {
+		return fmt.Errorf("unknown peer %s", peerID)
+	}
+	if !ed25519.Verify(priv.Public().(ed25519.PublicKey), b, sig) {
+		return fmt.Errorf("signature does not match peer %s", peerID)
+	}
+	return nil
+}
+
+func TestIdentityTransport(t *testing.T) {
+	signers := newTestSigners("a", "b")
+	peer := NewRegistry(oci.NewMockClient(nil), routing.NewMockRouter(map[string][]string{}), "", 3, time.Second, false, WithPeerIdentity(signers["a"]))
+	peerSrv := httptest.NewServer(peer.Server("", logr.Discard()).Handler)
+	defer peerSrv.Close()
+	unsignedSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer unsignedSrv.Close()
+
+	tests := []struct {
+		name          string
+		mirror        string
+		expectedError bool
+	}{
+		{
+			name:   "signed by advertised peer",
+			mirror: peerSrv.URL + "#a",
+		},
+		{
+			name:          "signed by other peer",
+			mirror:        peerSrv.URL + "#b",
+			expectedError: true,
+		},
+		{
+			name:          "not signed",
+			mirror:        unsignedSrv.URL + "#a",
+			expectedError: true,
+		},
+		{
+			name:   "without peer ID",
+			mirror: unsignedSrv.URL,
+		},
+	}
+	client := &http.Client{Transport: &identityTransport{RoundTripper: http.DefaultTransport, signer: signers["b"]}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := newMirrorRequest(context.Background(), http.MethodGet, tt.mirror, &url.URL{Path: "/v2/"})
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			if tt.expectedError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestMirrorRejectsUnverifiedIdentity(t *testing.T) {
+	signers := newTestSigners("a", "b")
+	dgst := "sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020"
+	peer := NewRegistry(oci.NewMockClient(nil), routing.NewMockRouter(map[string][]string{}), "", 3, time.Second, false, WithPeerIdentity(signers["a"]))
+	peerSrv := httptest.NewServer(peer.Server("", logr.Discard()).Handler)
+	defer peerSrv.Close()
+
+	tests := []struct {
+		name           string
+		mirrors        []string
+		expectedStatus int
+	}{
+		{
+			name:           "first mirror does not match advertisement",
+			mirrors:        []string{peerSrv.URL + "#b", peerSrv.URL + "#a"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "no mirror matches advertisement",
+			mirrors:        []string{peerSrv.URL + "#b"},
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := routing.NewMockRouter(map[string][]string{dgst: tt.mirrors})
+			reg := NewRegistry(oci.NewMockClient(nil), router, "", 3, time.Second, false, WithPeerIdentity(signers["b"]))
+			srv := reg.Server("", logr.Discard())
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/ubuntu/blobs/"+dgst+"?ns=docker.io", nil)
+			srv.Handler.ServeHTTP(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+		})
+	}
+}
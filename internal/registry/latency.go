@@ -0,0 +1,52 @@
+package registry
+
+import "time"
+
+const (
+	// Latency recorded for a failed attempt when no first byte timeout is set.
+	failedAttemptLatency = 10 * time.Second
+	// Minimum amount of bytes transferred for the throughput of a mirror to be observed, smaller transfers are dominated by latency.
+	minThroughputSize = 64 << 10
+)
+
+// LatencyObserver records the latency and throughput of requests to mirrors, so that the router can rank them.
+type LatencyObserver interface {
+	ObserveLatency(mirror string, d time.Duration)
+	ObserveThroughput(mirror string, bytesPerSecond float64)
+}
+
+// WithLatencyObserver reports the time until the response headers are received from a mirror to the observer,
+// and the throughput of transfers that complete. Failed attempts are reported with a penalty latency.
+func WithLatencyObserver(observer LatencyObserver) Option {
+	return func(r *Registry) {
+		r.latencyObserver = observer
+	}
+}
+
+// observeFailedAttempt records a latency penalty for the mirror, so that failing mirrors are ranked after mirrors that respond.
+// The penalty is the first byte timeout, which is the slowest that a mirror can respond, or the time spent when it is longer.
+func (r *Registry) observeFailedAttempt(mirror string, attemptStart time.Time) {
+	if r.latencyObserver == nil {
+		return
+	}
+	penalty := r.firstByteTimeout
+	if penalty == 0 {
+		penalty = failedAttemptLatency
+	}
+	if elapsed := time.Since(attemptStart); elapsed > penalty {
+		penalty = elapsed
+	}
+	r.latencyObserver.ObserveLatency(mirror, penalty)
+}
+
+// observeThroughput records the throughput of a completed transfer from the mirror.
+func (r *Registry) observeThroughput(mirror string, written int64, transferStart time.Time) {
+	if r.latencyObserver == nil || written < minThroughputSize {
+		return
+	}
+	elapsed := time.Since(transferStart)
+	if elapsed <= 0 {
+		return
+	}
+	r.latencyObserver.ObserveThroughput(mirror, float64(written)/elapsed.Seconds())
+}
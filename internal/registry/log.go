@@ -0,0 +1,42 @@
+package registry
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+)
+
+const (
+	loggerContextKey    = "log.logger"
+	logValuesContextKey = "log.values"
+)
+
+// loggerHandler adds the logger to the context of requests, where it is returned by requestLogger.
+func loggerHandler(log logr.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(loggerContextKey, log)
+	}
+}
+
+// withLogValues adds key value pairs to the logger returned by requestLogger for the rest of the request.
+func withLogValues(c *gin.Context, keysAndValues ...interface{}) {
+	kvs := []interface{}{}
+	if v, ok := c.Get(logValuesContextKey); ok {
+		kvs = v.([]interface{})
+	}
+	c.Set(logValuesContextKey, append(kvs, keysAndValues...))
+}
+
+// requestLogger returns the logger of the request with the handler and values added by handlers while serving the request.
+func requestLogger(c *gin.Context) logr.Logger {
+	log := logr.Discard()
+	if v, ok := c.Get(loggerContextKey); ok {
+		log = v.(logr.Logger)
+	}
+	if handler := c.GetString("handler"); handler != "" {
+		log = log.WithValues("handler", handler)
+	}
+	if v, ok := c.Get(logValuesContextKey); ok {
+		log = log.WithValues(v.([]interface{})...)
+	}
+	return log
+}
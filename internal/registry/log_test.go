@@ -0,0 +1,35 @@
+package registry
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+
+	"github.com/xenitab/spegel/internal/logging"
+)
+
+func TestRequestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log := logging.FromSlogHandler(slog.NewTextHandler(buf, nil))
+	engine := gin.New()
+	engine.Use(loggerHandler(log))
+	engine.GET("/", func(c *gin.Context) {
+		c.Set("handler", "mirror")
+		withLogValues(c, "ref", "docker.io/library/alpine:3.18")
+		withLogValues(c, "digest", "sha256:foo")
+		requestLogger(c).Info("hello")
+		c.Status(http.StatusOK)
+	})
+	rw := httptest.NewRecorder()
+	engine.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	line, _, _ := strings.Cut(buf.String(), "\n")
+	require.Equal(t, `msg=hello handler=mirror ref=docker.io/library/alpine:3.18 digest=sha256:foo`, line[strings.Index(line, "msg="):])
+}
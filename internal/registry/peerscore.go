@@ -0,0 +1,123 @@
+package registry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var mirrorPeerBackoffsTotal = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "spegel_mirror_peer_backoffs_total",
+		Help: "Total number of times a mirror has been temporarily skipped after repeatedly failing.",
+	},
+)
+
+var mirrorPeerSkipsTotal = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "spegel_mirror_peer_skips_total",
+		Help: "Total number of resolved mirrors that were skipped as they are backing off.",
+	},
+)
+
+var mirrorPeersBackingOff = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "spegel_mirror_peers_backing_off",
+		Help: "Number of mirrors currently skipped as they are backing off.",
+	},
+)
+
+type peerScore struct {
+	failures     int
+	backoffUntil time.Time
+}
+
+// peerScores tracks consecutive failures per mirror. Once a mirror has failed the threshold amount of times in a row
+// it is skipped for a backoff which doubles with every further failure, up to the max backoff.
+type peerScores struct {
+	mx         sync.Mutex
+	threshold  int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	scores     map[string]*peerScore
+	now        func() time.Time
+}
+
+func newPeerScores(threshold int, backoff, maxBackoff time.Duration) *peerScores {
+	return &peerScores{
+		threshold:  threshold,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		scores:     map[string]*peerScore{},
+		now:        time.Now,
+	}
+}
+
+// isBackingOff returns true if the mirror should be skipped.
+func (p *peerScores) isBackingOff(mirror string) bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	score, ok := p.scores[mirror]
+	if !ok {
+		return false
+	}
+	return p.now().Before(score.backoffUntil)
+}
+
+// failure records a failed request to the mirror and starts a backoff once the threshold is reached.
+func (p *peerScores) failure(mirror string) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	score, ok := p.scores[mirror]
+	if !ok {
+		score = &peerScore{}
+		p.scores[mirror] = score
+	}
+	score.failures++
+	if score.failures < p.threshold {
+		return
+	}
+	backoff := p.backoff
+	for i := p.threshold; i < score.failures && backoff < p.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.maxBackoff {
+		backoff = p.maxBackoff
+	}
+	score.backoffUntil = p.now().Add(backoff)
+	mirrorPeerBackoffsTotal.Inc()
+	p.updateGauge()
+}
+
+// success resets the failures of the mirror.
+func (p *peerScores) success(mirror string) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if _, ok := p.scores[mirror]; !ok {
+		return
+	}
+	delete(p.scores, mirror)
+	p.updateGauge()
+}
+
+// updateGauge sets the amount of mirrors backing off and forgets mirrors whose backoff has expired
+// without failing again, so that peers that have left do not grow the scores forever.
+func (p *peerScores) updateGauge() {
+	now := p.now()
+	backingOff := 0
+	for mirror, score := range p.scores {
+		if score.failures < p.threshold {
+			continue
+		}
+		if now.Before(score.backoffUntil) {
+			backingOff++
+			continue
+		}
+		if now.Sub(score.backoffUntil) > p.maxBackoff {
+			delete(p.scores, mirror)
+		}
+	}
+	mirrorPeersBackingOff.Set(float64(backingOff))
+}
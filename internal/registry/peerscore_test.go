@@ -0,0 +1,75 @@
+package registry
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestPeerScores(t *testing.T) {
+	now := time.Now()
+	p := newPeerScores(2, time.Second, 3*time.Second)
+	p.now = func() time.Time { return now }
+	mirror := "http://10.0.0.1:5000"
+
+	p.failure(mirror)
+	require.False(t, p.isBackingOff(mirror))
+	p.failure(mirror)
+	require.True(t, p.isBackingOff(mirror))
+	now = now.Add(time.Second)
+	require.False(t, p.isBackingOff(mirror))
+
+	// Backoff doubles with every further failure up to the max backoff.
+	p.failure(mirror)
+	now = now.Add(time.Second)
+	require.True(t, p.isBackingOff(mirror))
+	now = now.Add(time.Second)
+	require.False(t, p.isBackingOff(mirror))
+	p.failure(mirror)
+	now = now.Add(3*time.Second - time.Millisecond)
+	require.True(t, p.isBackingOff(mirror))
+	now = now.Add(time.Millisecond)
+	require.False(t, p.isBackingOff(mirror))
+
+	p.success(mirror)
+	p.failure(mirror)
+	require.False(t, p.isBackingOff(mirror))
+}
+
+func TestMirrorHandlerPeerBackoff(t *testing.T) {
+	badHits := 0
+	badSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badHits++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer badSvr.Close()
+	goodSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//nolint:errcheck // ignore
+		w.Write([]byte("hello world"))
+	}))
+	defer goodSvr.Close()
+
+	router := routing.NewMockRouter(map[string][]string{"key": {badSvr.URL, goodSvr.URL}})
+	reg := NewRegistry(nil, router, "", 2, 5*time.Second, false, WithPeerBackoff(1, time.Minute, time.Minute))
+	for i := 0; i < 3; i++ {
+		rw := CreateTestResponseRecorder()
+		c, _ := gin.CreateTestContext(rw)
+		c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/key", nil)
+		reg.handleMirror(c, "key", oci.ReferenceTypeBlob)
+		resp := rw.Result()
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "hello world", string(b))
+	}
+	require.Equal(t, 1, badHits)
+}
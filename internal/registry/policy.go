@@ -0,0 +1,59 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Policy decides if a registry request is allowed before it is mirrored or served.
+// The request can be modified, for example to rewrite the image name, as it is parsed after all policies have been evaluated.
+type Policy interface {
+	Evaluate(req *http.Request) error
+}
+
+// PolicyFunc is an adapter to use an ordinary function as a policy.
+type PolicyFunc func(req *http.Request) error
+
+func (f PolicyFunc) Evaluate(req *http.Request) error {
+	return f(req)
+}
+
+// PolicyError rejects a request with the status code and response headers.
+// Policy errors of other types reject the request with 403 Forbidden.
+type PolicyError struct {
+	StatusCode int
+	Header     http.Header
+	Err        error
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("request rejected by policy with status %d: %v", e.StatusCode, e.Err)
+}
+
+func (e *PolicyError) Unwrap() error {
+	return e.Err
+}
+
+// WithPolicies adds policies that are evaluated in order for every registry request, the first error rejects the request.
+func WithPolicies(policies ...Policy) Option {
+	return func(r *Registry) {
+		r.policies = append(r.policies, policies...)
+	}
+}
+
+// evaluatePolicies returns the status code and headers of the response if the request is rejected by any of the policies.
+func (r *Registry) evaluatePolicies(req *http.Request) (int, http.Header, error) {
+	for _, policy := range r.policies {
+		err := policy.Evaluate(req)
+		if err == nil {
+			continue
+		}
+		var policyErr *PolicyError
+		if errors.As(err, &policyErr) {
+			return policyErr.StatusCode, policyErr.Header, err
+		}
+		return http.StatusForbidden, nil, err
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,86 @@
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestPolicies(t *testing.T) {
+	dgst := "sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020"
+	pathCh := make(chan string, 1)
+	peerSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pathCh <- r.URL.Path
+	}))
+	defer peerSvr.Close()
+	router := routing.NewMockRouter(map[string][]string{dgst: {peerSvr.URL}})
+
+	auth := PolicyFunc(func(req *http.Request) error {
+		switch req.Header.Get("Authorization") {
+		case "":
+			return &PolicyError{
+				StatusCode: http.StatusUnauthorized,
+				Header:     http.Header{"Www-Authenticate": []string{`Bearer realm="spegel"`}},
+				Err:        errors.New("missing credentials"),
+			}
+		case "Bearer secret":
+			return nil
+		default:
+			return errors.New("invalid credentials")
+		}
+	})
+	rewrite := PolicyFunc(func(req *http.Request) error {
+		req.URL.Path = "/v2/library/alpine/blobs/" + dgst
+		return nil
+	})
+	reg := NewRegistry(nil, router, "", 3, 5*time.Second, false, WithPolicies(auth, rewrite))
+	srv := reg.Server("", logr.Discard())
+
+	tests := []struct {
+		name           string
+		authorization  string
+		expectedStatus int
+		expectedHeader string
+	}{
+		{
+			name:           "missing credentials",
+			expectedStatus: http.StatusUnauthorized,
+			expectedHeader: `Bearer realm="spegel"`,
+		},
+		{
+			name:           "invalid credentials",
+			authorization:  "Bearer foo",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "valid credentials",
+			authorization:  "Bearer secret",
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := CreateTestResponseRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/ubuntu/blobs/"+dgst+"?ns=docker.io", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			srv.Handler.ServeHTTP(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			require.Equal(t, tt.expectedHeader, resp.Header.Get("Www-Authenticate"))
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			require.Equal(t, "/v2/library/alpine/blobs/"+dgst, <-pathCh)
+		})
+	}
+}
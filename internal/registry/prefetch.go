@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/xenitab/spegel/internal/oci"
+)
+
+// Max amount of images pulled in parallel for a single prefetch request.
+const prefetchParallelism = 3
+
+type prefetchRequest struct {
+	Images []string `json:"images"`
+}
+
+type prefetchResult struct {
+	Image string `json:"image"`
+	Error string `json:"error,omitempty"`
+}
+
+// prefetchHandler pulls the requested images into the local store so that nodes can be warmed before a rollout.
+// Images are pulled with the node mirror configuration which means that peers are preferred over the origin registry.
+func (r *Registry) prefetchHandler(c *gin.Context) {
+	c.Set("handler", "prefetch")
+	log := requestLogger(c)
+
+	if !hasBearerToken(c, r.prefetchToken) {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	req := prefetchRequest{}
+	err := c.BindJSON(&req)
+	if err != nil {
+		return
+	}
+	if len(req.Images) == 0 {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("at least one image has to be set"))
+		return
+	}
+	for _, ref := range req.Images {
+		_, _, tag, dgst, err := oci.ParseReference(ref)
+		if err != nil {
+			//nolint:errcheck // ignore
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid image reference %s: %w", ref, err))
+			return
+		}
+		if tag == "" && dgst == "" {
+			//nolint:errcheck // ignore
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("image reference %s needs to contain a tag or digest", ref))
+			return
+		}
+	}
+
+	// The gin context is not safe to use concurrently, pulls use the context of the request instead.
+	ctx := c.Request.Context()
+	results := make([]prefetchResult, len(req.Images))
+	g := errgroup.Group{}
+	g.SetLimit(prefetchParallelism)
+	for i, ref := range req.Images {
+		i, ref := i, ref
+		g.Go(func() error {
+			results[i] = prefetchResult{Image: ref}
+			err := r.ociClient.Pull(ctx, ref)
+			if err != nil {
+				log.Error(err, "could not prefetch image", "image", ref)
+				results[i].Error = err.Error()
+				return nil
+			}
+			log.Info("prefetched image", "image", ref)
+			return nil
+		})
+	}
+	//nolint:errcheck // pulls never return errors
+	g.Wait()
+	for _, res := range results {
+		if res.Error != "" {
+			c.JSON(http.StatusInternalServerError, results)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, results)
+}
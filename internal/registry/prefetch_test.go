@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+type pullClient struct {
+	oci.Client
+	mx     sync.Mutex
+	pulled []string
+}
+
+func (c *pullClient) Pull(ctx context.Context, ref string) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if strings.Contains(ref, "missing") {
+		return fmt.Errorf("not found")
+	}
+	c.pulled = append(c.pulled, ref)
+	return nil
+}
+
+func TestPrefetchHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		token          string
+		body           string
+		expectedStatus int
+		expectedPulled []string
+	}{
+		{
+			name:           "pull images",
+			token:          "secret",
+			body:           `{"images":["docker.io/library/ubuntu:22.04"]}`,
+			expectedStatus: http.StatusOK,
+			expectedPulled: []string{"docker.io/library/ubuntu:22.04"},
+		},
+		{
+			name:           "pull failure",
+			token:          "secret",
+			body:           `{"images":["docker.io/library/ubuntu:22.04","docker.io/library/missing:22.04"]}`,
+			expectedStatus: http.StatusInternalServerError,
+			expectedPulled: []string{"docker.io/library/ubuntu:22.04"},
+		},
+		{
+			name:           "invalid token",
+			token:          "foo",
+			body:           `{"images":["docker.io/library/ubuntu:22.04"]}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "reference without tag",
+			token:          "secret",
+			body:           `{"images":["docker.io/library/ubuntu"]}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "no images",
+			token:          "secret",
+			body:           `{"images":[]}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ociClient := &pullClient{}
+			reg := NewRegistry(ociClient, routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, WithPrefetch("secret"))
+			srv := reg.Server("", logr.Discard())
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/internal/prefetch", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			srv.Handler.ServeHTTP(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			require.Equal(t, tt.expectedPulled, ociClient.pulled)
+			if tt.expectedStatus != http.StatusOK && tt.expectedStatus != http.StatusInternalServerError {
+				return
+			}
+			results := []prefetchResult{}
+			err := json.NewDecoder(resp.Body).Decode(&results)
+			require.NoError(t, err)
+			require.Len(t, results, strings.Count(tt.body, ",")+1)
+		})
+	}
+}
+
+func TestPrefetchHandlerDisabled(t *testing.T) {
+	reg := NewRegistry(&pullClient{}, routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false)
+	srv := reg.Server("", logr.Discard())
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/internal/prefetch", strings.NewReader(`{"images":["docker.io/library/ubuntu:22.04"]}`))
+	srv.Handler.ServeHTTP(rw, req)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
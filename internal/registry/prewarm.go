@@ -0,0 +1,148 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var mirrorConnectionsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "spegel_mirror_connections_total",
+		Help: "Total number of connections used for mirror requests, warm when an idle connection was reused and cold when a new connection was established.",
+	},
+	[]string{"state"},
+)
+
+var prewarmRequestsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "spegel_prewarm_requests_total",
+		Help: "Total number of requests made to keep connections to recently used mirrors warm.",
+	},
+	[]string{"result"},
+)
+
+// withConnectionTrace records if the connection used for the request was reused or newly established.
+func withConnectionTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				mirrorConnectionsTotal.WithLabelValues("warm").Inc()
+				return
+			}
+			mirrorConnectionsTotal.WithLabelValues("cold").Inc()
+		},
+	})
+}
+
+// prewarmer keeps track of the most recently used mirrors, bounded by the pool size.
+type prewarmer struct {
+	mx       sync.Mutex
+	size     int
+	interval time.Duration
+	lastUsed map[string]time.Time
+}
+
+func newPrewarmer(size int, interval time.Duration) *prewarmer {
+	return &prewarmer{
+		size:     size,
+		interval: interval,
+		lastUsed: map[string]time.Time{},
+	}
+}
+
+// touch marks the mirror as used, the least recently used mirror is evicted when the pool is full.
+func (p *prewarmer) touch(mirror string) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.lastUsed[mirror] = time.Now()
+	if len(p.lastUsed) <= p.size {
+		return
+	}
+	oldest := ""
+	for m, t := range p.lastUsed {
+		if oldest == "" || t.Before(p.lastUsed[oldest]) {
+			oldest = m
+		}
+	}
+	delete(p.lastUsed, oldest)
+}
+
+// mirrors returns the mirrors in the pool sorted by when they were last used, most recent first.
+func (p *prewarmer) mirrors() []string {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	mirrors := []string{}
+	for m := range p.lastUsed {
+		mirrors = append(mirrors, m)
+	}
+	sort.Slice(mirrors, func(i, j int) bool {
+		return p.lastUsed[mirrors[i]].After(p.lastUsed[mirrors[j]])
+	})
+	return mirrors
+}
+
+// PrewarmConnections periodically requests the recently used mirrors so that idle connections to them are kept open
+// and the next mirror request does not have to establish a new connection. It blocks until the context is cancelled.
+func (r *Registry) PrewarmConnections(ctx context.Context) {
+	if r.prewarm == nil {
+		return
+	}
+	log := logr.FromContextOrDiscard(ctx).WithName("prewarm")
+	client := &http.Client{Transport: r.transport, Timeout: r.prewarm.interval}
+	ticker := time.NewTicker(r.prewarm.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, mirror := range r.prewarm.mirrors() {
+				err := prewarmMirror(ctx, client, mirror)
+				if err != nil {
+					log.V(5).Info("could not prewarm connection", "mirror", mirror, "error", err.Error())
+					prewarmRequestsTotal.WithLabelValues("failure").Inc()
+					continue
+				}
+				prewarmRequestsTotal.WithLabelValues("success").Inc()
+			}
+		}
+	}
+}
+
+func prewarmMirror(ctx context.Context, client *http.Client, mirror string) error {
+	// Mirrors may carry a peer ID as the fragment, so the path cannot be appended to the mirror.
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return err
+	}
+	u.Path = "/v2/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The body has to be read for the connection to be reused.
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("expected mirror %s to respond with 200 OK but received: %s", mirror, resp.Status)
+	}
+	return nil
+}
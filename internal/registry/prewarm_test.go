@@ -0,0 +1,45 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestPrewarmerTouch(t *testing.T) {
+	p := newPrewarmer(2, time.Second)
+	p.touch("http://10.0.0.1:5000")
+	time.Sleep(time.Millisecond)
+	p.touch("http://10.0.0.2:5000")
+	time.Sleep(time.Millisecond)
+	p.touch("http://10.0.0.1:5000")
+	time.Sleep(time.Millisecond)
+	p.touch("http://10.0.0.3:5000")
+	require.Equal(t, []string{"http://10.0.0.3:5000", "http://10.0.0.1:5000"}, p.mirrors())
+}
+
+func TestPrewarmConnections(t *testing.T) {
+	reqCh := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqCh <- r.URL.Path
+	}))
+	defer srv.Close()
+
+	reg := NewRegistry(nil, routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, WithConnectionPrewarming(2, 10*time.Millisecond))
+	reg.prewarm.touch(srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reg.PrewarmConnections(ctx)
+	select {
+	case p := <-reqCh:
+		require.Equal(t, "/v2/", p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected mirror to be prewarmed")
+	}
+}
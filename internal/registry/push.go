@@ -0,0 +1,229 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/xenitab/spegel/internal/oci"
+)
+
+// Max size of a pushed manifest, which matches the limit of most registries.
+const maxManifestSize = 4 << 20
+
+var uploadRegex = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([a-f0-9]*)$`)
+
+// Pusher writes content pushed to the registry into the local content and image store.
+type Pusher interface {
+	WriteUpload(ctx context.Context, id string, r io.Reader) (int64, error)
+	CommitUpload(ctx context.Context, id string, r io.Reader, dgst digest.Digest) error
+	PutManifest(ctx context.Context, name, mediaType string, b []byte) (digest.Digest, error)
+}
+
+type push struct {
+	pusher   Pusher
+	token    string
+	registry string
+}
+
+// WithPush accepts blob uploads and manifests pushed with the token, either as a bearer token or as the password of basic auth.
+// Pushed images are only named with the registry, so that pushed images cannot replace images of upstream registries.
+// Pushed images are advertised like any other image, so that content pushed once is distributed between nodes by peers.
+func WithPush(pusher Pusher, token, registry string) Option {
+	return func(r *Registry) {
+		r.push = &push{
+			pusher:   pusher,
+			token:    token,
+			registry: registry,
+		}
+	}
+}
+
+// pushHandler handles the OCI distribution push endpoints for blob uploads and manifests.
+func (r *Registry) pushHandler(c *gin.Context) {
+	c.Set("handler", "push")
+	if !r.push.authorized(c) {
+		c.Header("WWW-Authenticate", `Basic realm="spegel"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	registry := r.push.registry
+	if ns := c.Query("ns"); ns != "" && ns != registry {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusForbidden, fmt.Errorf("images can only be pushed to registry %s", registry))
+		return
+	}
+	if comps := uploadRegex.FindStringSubmatch(c.Request.URL.Path); len(comps) == 3 {
+		name, id := comps[1], comps[2]
+		switch {
+		case c.Request.Method == http.MethodPost && id == "":
+			r.handleUploadStart(c, registry, name)
+		case c.Request.Method == http.MethodPatch && id != "":
+			r.handleUploadChunk(c, registry, name, id)
+		case c.Request.Method == http.MethodPut && id != "":
+			r.handleUploadCommit(c, registry, name, id)
+		default:
+			c.Status(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	ref, dgst, refType, err := oci.ParsePathComponents(registry, c.Request.URL.Path)
+	if err != nil || refType != oci.ReferenceTypeManifest {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if c.Request.Method != http.MethodPut {
+		c.Status(http.StatusMethodNotAllowed)
+		return
+	}
+	r.handleManifestPut(c, registry, ref, dgst)
+}
+
+func (p *push) authorized(c *gin.Context) bool {
+	if hasBearerToken(c, p.token) {
+		return true
+	}
+	_, password, ok := c.Request.BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(p.token)) == 1
+}
+
+// handleUploadStart starts an upload, the blob is committed directly when the digest is set or mounted when it already exists.
+func (r *Registry) handleUploadStart(c *gin.Context, registry, name string) {
+	if mount := c.Query("mount"); mount != "" {
+		dgst, err := digest.Parse(mount)
+		if err == nil {
+			if _, err := r.ociClient.GetSize(c, dgst); err == nil {
+				setBlobCreated(c, registry, name, dgst)
+				return
+			}
+		}
+	}
+	id, err := newUploadID()
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if v := c.Query("digest"); v != "" {
+		r.commitUpload(c, registry, name, id, v)
+		return
+	}
+	setUploadAccepted(c, registry, name, id, 0)
+}
+
+func (r *Registry) handleUploadChunk(c *gin.Context, registry, name, id string) {
+	size, err := r.push.pusher.WriteUpload(c, id, c.Request.Body)
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("could not write upload %s: %w", id, err))
+		return
+	}
+	setUploadAccepted(c, registry, name, id, size)
+}
+
+func (r *Registry) handleUploadCommit(c *gin.Context, registry, name, id string) {
+	r.commitUpload(c, registry, name, id, c.Query("digest"))
+}
+
+func (r *Registry) commitUpload(c *gin.Context, registry, name, id, v string) {
+	dgst, err := digest.Parse(v)
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid digest %s: %w", v, err))
+		return
+	}
+	withLogValues(c, "digest", dgst.String())
+	err = r.push.pusher.CommitUpload(c, id, c.Request.Body, dgst)
+	if errdefs.IsFailedPrecondition(err) {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("upload does not match digest %s: %w", dgst, err))
+		return
+	}
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("could not commit upload %s: %w", id, err))
+		return
+	}
+	setBlobCreated(c, registry, name, dgst)
+}
+
+// handleManifestPut writes the manifest, the image is only created when the manifest is pushed by tag.
+func (r *Registry) handleManifestPut(c *gin.Context, registry, ref string, expected digest.Digest) {
+	b, err := io.ReadAll(io.LimitReader(c.Request.Body, maxManifestSize+1))
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if len(b) > maxManifestSize {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusRequestEntityTooLarge, fmt.Errorf("manifest exceeds the max size of %d bytes", maxManifestSize))
+		return
+	}
+	if expected != "" && digest.FromBytes(b) != expected {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("manifest does not match digest %s", expected))
+		return
+	}
+	mediaType := c.GetHeader("Content-Type")
+	dgst, err := r.push.pusher.PutManifest(c, ref, mediaType, b)
+	if errors.Is(err, oci.ErrBlobUnknown) || errors.Is(err, oci.ErrManifestInvalid) {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	withLogValues(c, "ref", ref, "digest", dgst.String())
+	name := repositoryRegex.FindStringSubmatch(c.Request.URL.Path)[1]
+	c.Header("Location", pushLocation(registry, fmt.Sprintf("/v2/%s/manifests/%s", name, dgst)))
+	c.Header("Docker-Content-Digest", dgst.String())
+	c.Status(http.StatusCreated)
+}
+
+func setUploadAccepted(c *gin.Context, registry, name, id string, size int64) {
+	c.Header("Location", pushLocation(registry, fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id)))
+	c.Header("Docker-Upload-UUID", id)
+	end := size - 1
+	if end < 0 {
+		end = 0
+	}
+	c.Header("Range", fmt.Sprintf("0-%d", end))
+	c.Header("Content-Length", "0")
+	c.Status(http.StatusAccepted)
+}
+
+func setBlobCreated(c *gin.Context, registry, name string, dgst digest.Digest) {
+	c.Header("Location", pushLocation(registry, fmt.Sprintf("/v2/%s/blobs/%s", name, dgst)))
+	c.Header("Docker-Content-Digest", dgst.String())
+	c.Header("Content-Length", "0")
+	c.Status(http.StatusCreated)
+}
+
+// pushLocation keeps the registry parameter in locations, so that following requests are made for the same registry.
+func pushLocation(registry, p string) string {
+	return fmt.Sprintf("%s?%s", p, url.Values{"ns": []string{registry}}.Encode())
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
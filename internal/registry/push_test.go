@@ -0,0 +1,187 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+type memoryPusher struct {
+	mx        sync.Mutex
+	uploads   map[string][]byte
+	blobs     map[digest.Digest][]byte
+	manifests map[string]digest.Digest
+}
+
+func newMemoryPusher() *memoryPusher {
+	return &memoryPusher{
+		uploads:   map[string][]byte{},
+		blobs:     map[digest.Digest][]byte{},
+		manifests: map[string]digest.Digest{},
+	}
+}
+
+func (m *memoryPusher) WriteUpload(ctx context.Context, id string, r io.Reader) (int64, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.uploads[id] = append(m.uploads[id], b...)
+	return int64(len(m.uploads[id])), nil
+}
+
+func (m *memoryPusher) CommitUpload(ctx context.Context, id string, r io.Reader, dgst digest.Digest) error {
+	_, err := m.WriteUpload(ctx, id, r)
+	if err != nil {
+		return err
+	}
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	b := m.uploads[id]
+	if digest.FromBytes(b) != dgst {
+		return fmt.Errorf("unexpected commit digest: %w", errdefs.ErrFailedPrecondition)
+	}
+	delete(m.uploads, id)
+	m.blobs[dgst] = b
+	return nil
+}
+
+func (m *memoryPusher) PutManifest(ctx context.Context, name, mediaType string, b []byte) (digest.Digest, error) {
+	if mediaType != ocispec.MediaTypeImageManifest {
+		return "", oci.ErrManifestInvalid
+	}
+	if bytes.Contains(b, []byte("missing")) {
+		return "", oci.ErrBlobUnknown
+	}
+	dgst := digest.FromBytes(b)
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.blobs[dgst] = b
+	if name != "" {
+		m.manifests[name] = dgst
+	}
+	return dgst, nil
+}
+
+func TestPush(t *testing.T) {
+	pusher := newMemoryPusher()
+	reg := NewRegistry(oci.NewMockClient(nil), routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, WithPush(pusher, "secret", "push.local"))
+	srv := httptest.NewServer(reg.Server("", logr.Discard()).Handler)
+	t.Cleanup(srv.Close)
+
+	do := func(method, p string, body []byte, header http.Header) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+p, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// Requests without the token are asked to authenticate with basic auth.
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/v2/foo/blobs/uploads/", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, `Basic realm="spegel"`, resp.Header.Get("WWW-Authenticate"))
+	req.SetBasicAuth("ci", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// Chunked upload.
+	blob := []byte("hello world")
+	blobDgst := digest.FromBytes(blob)
+	resp = do(http.MethodPost, "/v2/foo/bar/blobs/uploads/", nil, nil)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	location := resp.Header.Get("Location")
+	require.True(t, strings.HasPrefix(location, "/v2/foo/bar/blobs/uploads/"))
+	require.True(t, strings.HasSuffix(location, "?ns=push.local"))
+	require.NotEmpty(t, resp.Header.Get("Docker-Upload-UUID"))
+	require.Equal(t, "0-0", resp.Header.Get("Range"))
+	resp = do(http.MethodPatch, location, blob[:5], nil)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.Equal(t, "0-4", resp.Header.Get("Range"))
+	location = resp.Header.Get("Location")
+	resp = do(http.MethodPut, location+"&digest="+blobDgst.String(), blob[5:], nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "/v2/foo/bar/blobs/"+blobDgst.String()+"?ns=push.local", resp.Header.Get("Location"))
+	require.Equal(t, blobDgst.String(), resp.Header.Get("Docker-Content-Digest"))
+	require.Equal(t, blob, pusher.blobs[blobDgst])
+
+	// Monolithic upload with a mismatching digest.
+	resp = do(http.MethodPost, "/v2/foo/bar/blobs/uploads/?digest="+blobDgst.String(), []byte("foo"), nil)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = do(http.MethodPost, "/v2/foo/bar/blobs/uploads/?digest=foo", blob, nil)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Existing blobs are mounted.
+	resp = do(http.MethodPost, "/v2/foo/bar/blobs/uploads/?mount="+blobDgst.String()+"&from=baz", nil, nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, blobDgst.String(), resp.Header.Get("Docker-Content-Digest"))
+
+	// Manifests pushed by tag are named with the push registry, other registries are rejected.
+	manifest := []byte(`{"schemaVersion":2}`)
+	manifestDgst := digest.FromBytes(manifest)
+	header := http.Header{"Content-Type": []string{ocispec.MediaTypeImageManifest}}
+	resp = do(http.MethodPut, "/v2/foo/bar/manifests/v1", manifest, header)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "/v2/foo/bar/manifests/"+manifestDgst.String()+"?ns=push.local", resp.Header.Get("Location"))
+	require.Equal(t, manifestDgst.String(), resp.Header.Get("Docker-Content-Digest"))
+	require.Equal(t, manifestDgst, pusher.manifests["push.local/foo/bar:v1"])
+	resp = do(http.MethodPut, "/v2/foo/bar/manifests/v2?ns=push.local", manifest, header)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, manifestDgst, pusher.manifests["push.local/foo/bar:v2"])
+	resp = do(http.MethodPut, "/v2/library/nginx/manifests/latest?ns=docker.io", manifest, header)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NotContains(t, pusher.manifests, "docker.io/library/nginx:latest")
+	resp = do(http.MethodPost, "/v2/library/nginx/blobs/uploads/?ns=docker.io", nil, nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = do(http.MethodPut, "/v2/foo/bar/manifests/"+manifestDgst.String(), manifest, header)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = do(http.MethodPut, "/v2/foo/bar/manifests/"+blobDgst.String(), manifest, header)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = do(http.MethodPut, "/v2/foo/bar/manifests/v1", manifest, http.Header{"Content-Type": []string{"text/plain"}})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = do(http.MethodPut, "/v2/foo/bar/manifests/v1", []byte(`{"missing":true}`), header)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(http.MethodDelete, "/v2/foo/bar/manifests/v1", nil, nil)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp = do(http.MethodPut, "/v2/foo/bar/blobs/uploads/", nil, nil)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestPushDisabled(t *testing.T) {
+	reg := NewRegistry(oci.NewMockClient(nil), routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false)
+	srv := reg.Server("", logr.Discard())
+	rw := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "http://example.com/v2/foo/blobs/uploads/", nil))
+	require.Equal(t, http.StatusNotFound, rw.Code)
+}
@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var serveQuotaBytesTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "spegel_serve_quota_bytes_total",
+		Help: "Total number of bytes served for registries with a serving quota.",
+	},
+	[]string{"registry"},
+)
+
+var serveQuotaRejectedTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "spegel_serve_quota_rejected_requests_total",
+		Help: "Total number of requests rejected because the serving quota of the registry was exceeded.",
+	},
+	[]string{"registry"},
+)
+
+// quota tracks the bytes served per registry within fixed intervals.
+// Requests are rejected once the limit has been reached until the next interval starts.
+type quota struct {
+	mx          sync.Mutex
+	limits      map[string]int64
+	interval    time.Duration
+	windowStart time.Time
+	used        map[string]int64
+}
+
+func newQuota(limits map[string]int64, interval time.Duration) *quota {
+	return &quota{
+		limits:      limits,
+		interval:    interval,
+		windowStart: time.Now(),
+		used:        map[string]int64{},
+	}
+}
+
+// exceeded returns true and the time until the next interval if the registry has used its quota.
+func (q *quota) exceeded(registry string) (bool, time.Duration) {
+	limit, ok := q.limits[registry]
+	if !ok {
+		return false, 0
+	}
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	q.reset()
+	if q.used[registry] < limit {
+		return false, 0
+	}
+	return true, q.interval - time.Since(q.windowStart)
+}
+
+func (q *quota) add(registry string, n int64) {
+	if _, ok := q.limits[registry]; !ok {
+		return
+	}
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	q.reset()
+	q.used[registry] += n
+	serveQuotaBytesTotal.WithLabelValues(registry).Add(float64(n))
+}
+
+func (q *quota) reset() {
+	if time.Since(q.windowStart) < q.interval {
+		return
+	}
+	q.windowStart = time.Now()
+	q.used = map[string]int64{}
+}
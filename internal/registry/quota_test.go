@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestQuota(t *testing.T) {
+	q := newQuota(map[string]int64{"docker.io": 10}, 100*time.Millisecond)
+
+	ok, _ := q.exceeded("docker.io")
+	require.False(t, ok)
+	q.add("docker.io", 10)
+	ok, retryAfter := q.exceeded("docker.io")
+	require.True(t, ok)
+	require.LessOrEqual(t, retryAfter, 100*time.Millisecond)
+
+	// Registries without a limit are never exceeded.
+	q.add("ghcr.io", 100)
+	ok, _ = q.exceeded("ghcr.io")
+	require.False(t, ok)
+
+	time.Sleep(100 * time.Millisecond)
+	ok, _ = q.exceeded("docker.io")
+	require.False(t, ok)
+}
+
+func TestServeQuotaHandler(t *testing.T) {
+	reg := NewRegistry(oci.NewMockClient(nil), routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, WithServeQuota(map[string]int64{"docker.io": 0}, time.Minute))
+	srv := reg.Server("", logr.Discard())
+
+	tests := []struct {
+		name           string
+		ns             string
+		expectedStatus int
+	}{
+		{
+			name:           "quota exceeded",
+			ns:             "docker.io",
+			expectedStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:           "no quota",
+			ns:             "ghcr.io",
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/ubuntu/blobs/sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020?ns="+tt.ns, nil)
+			req.Header.Set(MirroredHeaderKey, "true")
+			srv.Handler.ServeHTTP(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus == http.StatusTooManyRequests {
+				require.Equal(t, "60", resp.Header.Get("Retry-After"))
+			}
+		})
+	}
+}
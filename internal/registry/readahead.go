@@ -0,0 +1,141 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+type readAheadChunk struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// readAheadReadSeeker reads the next chunk from the underlying reader in the background while the current chunk
+// is written to the client, so that latency of the content store does not stall the connection.
+// Two buffers of the chunk size are used, one being written and one being filled. Reading ahead starts with the
+// first read after a seek, which means that seeks done to find the size before serving do not read any content.
+type readAheadReadSeeker struct {
+	rs        io.ReadSeeker
+	offset    int64
+	bufs      [2][]byte
+	chunks    chan readAheadChunk
+	free      chan []byte
+	stop      chan interface{}
+	done      chan interface{}
+	cur       []byte
+	curBuf    []byte
+	err       error
+	chunkSize int
+}
+
+func newReadAheadReadSeeker(rs io.ReadSeeker, chunkSize int) (*readAheadReadSeeker, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("read ahead chunk size has to be larger than zero")
+	}
+	offset, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return &readAheadReadSeeker{
+		rs:        rs,
+		offset:    offset,
+		chunkSize: chunkSize,
+	}, nil
+}
+
+func (r *readAheadReadSeeker) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.chunks == nil {
+			r.start()
+		}
+		if r.curBuf != nil {
+			r.free <- r.curBuf
+			r.curBuf = nil
+		}
+		chunk := <-r.chunks
+		r.cur, r.curBuf, r.err = chunk.buf[:chunk.n], chunk.buf, chunk.err
+		if len(r.cur) == 0 {
+			return 0, r.err
+		}
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *readAheadReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	r.halt()
+	if whence == io.SeekCurrent {
+		offset, whence = r.offset+offset, io.SeekStart
+	}
+	n, err := r.rs.Seek(offset, whence)
+	if err != nil {
+		return n, err
+	}
+	r.offset = n
+	r.cur, r.curBuf, r.err = nil, nil, nil
+	return n, nil
+}
+
+// Close stops reading ahead, the underlying reader is not closed.
+func (r *readAheadReadSeeker) Close() error {
+	r.halt()
+	return nil
+}
+
+func (r *readAheadReadSeeker) start() {
+	if r.bufs[0] == nil {
+		r.bufs = [2][]byte{make([]byte, r.chunkSize), make([]byte, r.chunkSize)}
+	}
+	r.chunks = make(chan readAheadChunk, 1)
+	r.free = make(chan []byte, len(r.bufs))
+	for _, buf := range r.bufs {
+		r.free <- buf
+	}
+	r.stop = make(chan interface{})
+	r.done = make(chan interface{})
+	go r.fill(r.chunks, r.free, r.stop, r.done)
+}
+
+// halt stops the background reads and waits for the current read to complete, as the underlying reader is not safe for concurrent use.
+func (r *readAheadReadSeeker) halt() {
+	if r.chunks == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.chunks = nil
+}
+
+func (r *readAheadReadSeeker) fill(chunks chan<- readAheadChunk, free <-chan []byte, stop, done chan interface{}) {
+	defer close(done)
+	for {
+		var buf []byte
+		select {
+		case <-stop:
+			return
+		case buf = <-free:
+		}
+		n, err := io.ReadFull(r.rs, buf)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
+		select {
+		case <-stop:
+			return
+		case chunks <- readAheadChunk{buf: buf, n: n, err: err}:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
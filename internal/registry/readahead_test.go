@@ -0,0 +1,66 @@
+package registry
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAheadReadSeeker(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+
+	for _, chunkSize := range []int{1, 7, 100, 1000, 4096} {
+		ra, err := newReadAheadReadSeeker(bytes.NewReader(content), chunkSize)
+		require.NoError(t, err)
+		b, err := io.ReadAll(ra)
+		require.NoError(t, err)
+		require.Equal(t, content, b)
+
+		// Seeking discards content that was read ahead.
+		_, err = ra.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		p := make([]byte, 15)
+		_, err = io.ReadFull(ra, p)
+		require.NoError(t, err)
+		require.Equal(t, content[:15], p)
+		n, err := ra.Seek(10, io.SeekCurrent)
+		require.NoError(t, err)
+		require.Equal(t, int64(25), n)
+		_, err = io.ReadFull(ra, p)
+		require.NoError(t, err)
+		require.Equal(t, content[25:40], p)
+		n, err = ra.Seek(-5, io.SeekEnd)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(content)-5), n)
+		b, err = io.ReadAll(ra)
+		require.NoError(t, err)
+		require.Equal(t, content[len(content)-5:], b)
+		require.NoError(t, ra.Close())
+	}
+
+	_, err := newReadAheadReadSeeker(bytes.NewReader(content), 0)
+	require.EqualError(t, err, "read ahead chunk size has to be larger than zero")
+}
+
+func TestReadAheadServeContent(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	ra, err := newReadAheadReadSeeker(bytes.NewReader(content), 64)
+	require.NoError(t, err)
+	defer ra.Close()
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("Range", "bytes=100-299")
+	http.ServeContent(rw, req, "", time.Time{}, ra)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, content[100:300], b)
+}
@@ -0,0 +1,94 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Max duration of a single readiness check, kubelet probes time out after one second by default.
+const readinessCheckTimeout = 900 * time.Millisecond
+
+// ReadinessCheck reports the health of a subsystem, the registry is only ready when all checks pass.
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// ReadinessResult is the outcome of a readiness check.
+type ReadinessResult struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+}
+
+// Readiness is the response body of the readiness endpoint.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks []ReadinessResult `json:"checks"`
+}
+
+// WithReadinessChecks adds checks that have to pass for the registry to be ready, in addition to the router and warm-up checks.
+func WithReadinessChecks(checks ...ReadinessCheck) Option {
+	return func(r *Registry) {
+		r.readinessChecks = append(r.readinessChecks, checks...)
+	}
+}
+
+// readyHandler runs all checks concurrently and reports the result of every check, so that a failing probe tells which subsystem is failing.
+func (r *Registry) readyHandler(c *gin.Context) {
+	checks := append([]ReadinessCheck{
+		{Name: "router", Check: r.checkRouter},
+		{Name: "warm_up", Check: r.checkWarmUp},
+	}, r.readinessChecks...)
+	readiness := Readiness{Ready: true, Checks: make([]ReadinessResult, len(checks))}
+	wg := sync.WaitGroup{}
+	for i, check := range checks {
+		i, check := i, check
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(c.Request.Context(), readinessCheckTimeout)
+			defer cancel()
+			result := ReadinessResult{Name: check.Name, Ready: true}
+			if err := check.Check(ctx); err != nil {
+				result.Ready = false
+				result.Error = err.Error()
+			}
+			readiness.Checks[i] = result
+		}()
+	}
+	wg.Wait()
+	for _, result := range readiness.Checks {
+		if !result.Ready {
+			readiness.Ready = false
+		}
+	}
+	if !readiness.Ready {
+		c.JSON(http.StatusServiceUnavailable, readiness)
+		return
+	}
+	c.JSON(http.StatusOK, readiness)
+}
+
+func (r *Registry) checkRouter(_ context.Context) error {
+	ok, err := r.router.HasMirrors()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("router has no peers")
+	}
+	return nil
+}
+
+func (r *Registry) checkWarmUp(_ context.Context) error {
+	if !r.warmUp.Ready() {
+		return errors.New("warm-up has not advertised enough keys")
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+	"github.com/xenitab/spegel/internal/state"
+)
+
+func TestReadinessChecks(t *testing.T) {
+	router := routing.NewMockRouter(map[string][]string{"foo": {"http://127.0.0.1:5000"}})
+	reg := NewRegistry(oci.NewMockClient(nil), router, "", 3, 5*time.Second, false,
+		WithWarmUp(state.NewWarmUp(0.5, false)),
+		WithReadinessChecks(
+			ReadinessCheck{Name: "containerd", Check: func(_ context.Context) error { return nil }},
+			ReadinessCheck{Name: "mirror_configuration", Check: func(_ context.Context) error { return errors.New("config path not set") }},
+		),
+	)
+	srv := reg.Server("", logr.Discard())
+	rw := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/healthz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rw.Code)
+
+	readiness := Readiness{}
+	err := json.Unmarshal(rw.Body.Bytes(), &readiness)
+	require.NoError(t, err)
+	expected := Readiness{
+		Ready: false,
+		Checks: []ReadinessResult{
+			{Name: "router", Ready: true},
+			{Name: "warm_up", Ready: false, Error: "warm-up has not advertised enough keys"},
+			{Name: "containerd", Ready: true},
+			{Name: "mirror_configuration", Ready: false, Error: "config path not set"},
+		},
+	}
+	require.Equal(t, expected, readiness)
+}
+
+func TestReadinessCheckTimeout(t *testing.T) {
+	router := routing.NewMockRouter(map[string][]string{"foo": {"http://127.0.0.1:5000"}})
+	reg := NewRegistry(oci.NewMockClient(nil), router, "", 3, 5*time.Second, false,
+		WithReadinessChecks(ReadinessCheck{Name: "containerd", Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}}),
+	)
+	srv := reg.Server("", logr.Discard())
+	rw := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/healthz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	require.Contains(t, rw.Body.String(), "context deadline exceeded")
+}
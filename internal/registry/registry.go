@@ -1,15 +1,22 @@
 package registry
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	stdlog "log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -18,13 +25,37 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	pkggin "github.com/xenitab/pkg/gin"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
+	"github.com/xenitab/spegel/internal/allowlist"
+	"github.com/xenitab/spegel/internal/audit"
+	"github.com/xenitab/spegel/internal/cache"
+	"github.com/xenitab/spegel/internal/chargeback"
+	"github.com/xenitab/spegel/internal/diskpressure"
+	"github.com/xenitab/spegel/internal/metrics"
 	"github.com/xenitab/spegel/internal/oci"
 	"github.com/xenitab/spegel/internal/routing"
+	"github.com/xenitab/spegel/internal/state"
 )
 
 const (
 	MirroredHeaderKey = "X-Spegel-Mirrored"
+	// HopsHeaderKey counts the amount of times a request has been proxied between mirrors.
+	HopsHeaderKey = "X-Spegel-Hops"
+	// Context key used to pass the hops of the current request to mirror requests.
+	hopsContextKey = "hops"
+	defaultMaxHops = 3
+)
+
+var repositoryRegex = regexp.MustCompile(`^/v2/(.+)/(?:manifests|blobs|tags)/`)
+
+var cacheRequestsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "spegel_local_cache_requests_total",
+		Help: "Total number of requests served through the in-memory cache.",
+	},
+	[]string{"result"},
 )
 
 var mirrorRequestsTotal = promauto.NewCounterVec(
@@ -35,68 +66,416 @@ var mirrorRequestsTotal = promauto.NewCounterVec(
 	[]string{"registry", "cache", "source"},
 )
 
+var mirrorResolveResultsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "spegel_mirror_resolve_results_total",
+		Help: "Total number of mirror requests by result, miss when no mirror was found, exhausted when all resolved mirrors failed and delegated when redirected to a mirror.",
+	},
+	[]string{"result"},
+)
+
+var mirrorPeerAttempts = promauto.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "spegel_mirror_peer_attempts",
+		Help:    "Number of times the same mirror was resolved per mirror request, mirrors are only attempted the first time.",
+		Buckets: []float64{1, 2, 3, 5, 8},
+	},
+)
+
+var mirrorPeersTried = promauto.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "spegel_mirror_peers_tried",
+		Help:    "Number of mirrors attempted per mirror request.",
+		Buckets: []float64{0, 1, 2, 3, 5, 8},
+	},
+)
+
 type Registry struct {
-	ociClient        oci.Client
-	router           routing.Router
-	resolveRetries   int
-	resolveTimeout   time.Duration
-	resolveLatestTag bool
-	localAddr        string
+	h2cConns            *h2cConns
+	ociClient           oci.Client
+	router              routing.Router
+	mx                  sync.RWMutex
+	resolveRetries      int
+	resolveTimeout      time.Duration
+	resolveLatestTag    bool
+	manifestTimeout     time.Duration
+	blobTimeout         time.Duration
+	attemptTimeout      time.Duration
+	localAddr           string
+	chunkSize           int64
+	chunkParallelism    int
+	cache               *cache.LRU
+	cacheMaxBlobSize    int64
+	allowList           *allowlist.AllowList
+	prefetchToken       string
+	quota               *quota
+	capacity            *capacity
+	throttle            *throttle
+	auditExporter       *audit.OTLPExporter
+	verifyBlobs         bool
+	dialTimeout         time.Duration
+	firstByteTimeout    time.Duration
+	transferTimeout     time.Duration
+	maxIdleConnsPerHost int
+	transport           http.RoundTripper
+	client              *http.Client
+	prewarm             *prewarmer
+	peerScores          *peerScores
+	maxHops             int
+	localCIDRs          []*net.IPNet
+	policies            []Policy
+	http2               bool
+	streamDialer        StreamDialer
+	tokenVerifier       TokenVerifier
+	tokenSource         TokenSource
+	peerSigner          PeerSigner
+	latencyObserver     LatencyObserver
+	delegateExternal    bool
+	readAheadSize       int
+	debugToken          string
+	existsToken         string
+	statsGatherer       StatsGatherer
+	shadow              *shadowSampler
+	chargeback          *chargeback.Ledger
+	diskPressure        *diskpressure.Detector
+	resolveTags         oci.ResolveTags
+	warmUp              *state.WarmUp
+	readinessChecks     []ReadinessCheck
+	accessLogSampleRate float64
+	push                *push
+	routesMx            sync.Mutex
+	extraRoutes         extraRoutes
+}
+
+type Option func(*Registry)
+
+// WithChunkedFetch enables fetching blobs larger than the chunk size as ranges from multiple mirrors in parallel.
+func WithChunkedFetch(chunkSize int64, parallelism int) Option {
+	return func(r *Registry) {
+		r.chunkSize = chunkSize
+		r.chunkParallelism = parallelism
+	}
+}
+
+// WithCache enables an in-memory cache of manifests and blobs with a size not larger than max blob size.
+func WithCache(size, maxBlobSize int64) Option {
+	return func(r *Registry) {
+		r.cache = cache.NewLRU(size)
+		r.cacheMaxBlobSize = maxBlobSize
+	}
+}
+
+// WithAllowList rejects requests for images that are not allowed so that they are pulled from the origin registry.
+func WithAllowList(allowList *allowlist.AllowList) Option {
+	return func(r *Registry) {
+		r.allowList = allowList
+	}
+}
+
+// WithPrefetch enables the endpoint to pull images into the local store, requests have to authenticate with the bearer token.
+func WithPrefetch(token string) Option {
+	return func(r *Registry) {
+		r.prefetchToken = token
+	}
+}
+
+// WithServeQuota limits the bytes served to peers per registry within the interval, requests are rejected with 429 once exceeded.
+// Registries without a limit are not limited.
+func WithServeQuota(limits map[string]int64, interval time.Duration) Option {
+	return func(r *Registry) {
+		r.quota = newQuota(limits, interval)
+	}
+}
+
+// WithServingCapacity limits the blob transfers served to peers concurrently and the bytes per second used to serve them.
+// Blob requests beyond the capacity are rejected with 429 and Retry-After, so that clients back off to other mirrors
+// or the origin instead of piling onto a saturated node. A limit of zero disables it.
+func WithServingCapacity(maxTransfers int, maxBytesPerSecond int64) Option {
+	return func(r *Registry) {
+		r.capacity = newCapacity(maxTransfers, maxBytesPerSecond)
+	}
+}
+
+// WithThrottle limits the bytes per second of blobs served to peers and of responses mirrored from peers,
+// so that traffic between nodes does not starve workload traffic on shared network interfaces.
+func WithThrottle(bytesPerSecond int64) Option {
+	return func(r *Registry) {
+		r.throttle = newThrottle(bytesPerSecond)
+	}
+}
+
+// WithChargeback records the bytes served to peers per repository in the ledger.
+func WithChargeback(ledger *chargeback.Ledger) Option {
+	return func(r *Registry) {
+		r.chargeback = ledger
+	}
+}
+
+// WithDiskPressure rejects requests from peers with 503 while the node is under disk pressure,
+// so that serving content never adds load to an already stressed node.
+func WithDiskPressure(detector *diskpressure.Detector) Option {
+	return func(r *Registry) {
+		r.diskPressure = detector
+	}
+}
+
+// WithResolveTags sets which registries have their tags advertised, used when listing the advertised keys.
+func WithResolveTags(resolveTags oci.ResolveTags) Option {
+	return func(r *Registry) {
+		r.resolveTags = resolveTags
+	}
+}
+
+// WithWarmUp keeps the registry from becoming ready until enough keys have been advertised during the warm-up.
+func WithWarmUp(warmUp *state.WarmUp) Option {
+	return func(r *Registry) {
+		r.warmUp = warmUp
+	}
+}
+
+// WithAuditExporter exports an audit record for every request to the registry.
+func WithAuditExporter(exporter *audit.OTLPExporter) Option {
+	return func(r *Registry) {
+		r.auditExporter = exporter
+	}
+}
+
+// WithBlobVerification verifies served blobs against their digest and withdraws blobs that do not match.
+// Blobs served in full are aborted before the last bytes are written, ranges are not verified.
+func WithBlobVerification() Option {
+	return func(r *Registry) {
+		r.verifyBlobs = true
+	}
+}
+
+// WithConnectionPrewarming keeps idle connections open to the most recently used mirrors, bounded by the pool size.
+// Connections are kept warm by requesting each mirror at the interval which should be shorter than the idle connection timeout.
+func WithConnectionPrewarming(poolSize int, interval time.Duration) Option {
+	return func(r *Registry) {
+		r.prewarm = newPrewarmer(poolSize, interval)
+		r.maxIdleConnsPerHost = 4
+	}
+}
+
+// WithPeerBackoff skips mirrors that have failed the threshold amount of times in a row, so that a broken node does not
+// use up a retry on every request. The backoff doubles with every further failure up to the max backoff.
+func WithPeerBackoff(threshold int, backoff, maxBackoff time.Duration) Option {
+	return func(r *Registry) {
+		r.peerScores = newPeerScores(threshold, backoff, maxBackoff)
+	}
+}
+
+// WithTransferTimeouts bounds establishing a connection to a mirror, waiting for the first byte of the response and the total transfer.
+// Resolving mirrors is bounded separately by the resolve timeout, no limit is set for timeouts that are zero.
+func WithTransferTimeouts(dialTimeout, firstByteTimeout, transferTimeout time.Duration) Option {
+	return func(r *Registry) {
+		r.dialTimeout = dialTimeout
+		r.firstByteTimeout = firstByteTimeout
+		r.transferTimeout = transferTimeout
+	}
+}
+
+// WithMaxHops sets the max amount of times a request can be proxied between mirrors before it is rejected.
+func WithMaxHops(maxHops int) Option {
+	return func(r *Registry) {
+		r.maxHops = maxHops
+	}
+}
+
+// WithLocalCIDRs classifies requests from clients within the CIDRs as internal, instead of comparing the request host with the local address.
+// Loopback addresses are always classified as internal.
+func WithLocalCIDRs(cidrs []*net.IPNet) Option {
+	return func(r *Registry) {
+		r.localCIDRs = cidrs
+	}
+}
+
+// WithResolveTimeouts sets separate resolve timeouts for manifests and blobs, replacing the resolve timeout when not zero.
+// The attempt timeout bounds the wait for every next mirror so that a slow lookup fails fast instead of waiting for the whole resolve timeout.
+func WithResolveTimeouts(manifestTimeout, blobTimeout, attemptTimeout time.Duration) Option {
+	return func(r *Registry) {
+		r.manifestTimeout = manifestTimeout
+		r.blobTimeout = blobTimeout
+		r.attemptTimeout = attemptTimeout
+	}
+}
+
+// WithReadAhead reads the next chunk of the size from the content store while the current chunk is served,
+// which keeps the connection busy when the content store has a high latency. Blobs served from files are not
+// read ahead as the kernel already does so.
+func WithReadAhead(size int) Option {
+	return func(r *Registry) {
+		r.readAheadSize = size
+	}
+}
+
+func NewRegistry(ociClient oci.Client, router routing.Router, localAddr string, resolveRetries int, resolveTimeout time.Duration, resolveLatestTag bool, opts ...Option) *Registry {
+	r := &Registry{
+		h2cConns:            &h2cConns{},
+		ociClient:           ociClient,
+		router:              router,
+		resolveRetries:      resolveRetries,
+		resolveTimeout:      resolveTimeout,
+		resolveLatestTag:    resolveLatestTag,
+		localAddr:           localAddr,
+		maxHops:             defaultMaxHops,
+		dialTimeout:         30 * time.Second,
+		accessLogSampleRate: 1,
+		resolveTags:         oci.ResolveTags{Default: true},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	transport := newTransport(r.dialTimeout, r.firstByteTimeout, r.maxIdleConnsPerHost)
+	if r.streamDialer != nil {
+		transport.DialContext = r.streamDialer.DialContext
+	}
+	r.transport = transport
+	if r.http2 {
+		r.transport = newH2CTransport(r.dialTimeout, r.firstByteTimeout)
+	}
+	if r.peerSigner != nil {
+		r.transport = &identityTransport{RoundTripper: r.transport, signer: r.peerSigner}
+	}
+	if r.tokenSource != nil {
+		r.transport = &authTransport{RoundTripper: r.transport, source: r.tokenSource}
+	}
+	if r.throttle != nil {
+		r.transport = &throttledTransport{RoundTripper: r.transport, throttle: r.throttle}
+	}
+	r.client = &http.Client{Transport: r.transport}
+	return r
+}
+
+func newTransport(dialTimeout, firstByteTimeout time.Duration, maxIdleConnsPerHost int) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport.DialContext = dialer.DialContext
+	transport.ResponseHeaderTimeout = firstByteTimeout
+	if maxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	}
+	return transport
 }
 
-func NewRegistry(ociClient oci.Client, router routing.Router, localAddr string, resolveRetries int, resolveTimeout time.Duration, resolveLatestTag bool) *Registry {
-	return &Registry{
-		ociClient:        ociClient,
-		router:           router,
-		resolveRetries:   resolveRetries,
-		resolveTimeout:   resolveTimeout,
-		resolveLatestTag: resolveLatestTag,
-		localAddr:        localAddr,
+// withTransferTimeout bounds the total duration of a single transfer from a mirror, no limit is set when zero.
+func withTransferTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// SetResolveSettings replaces the resolve settings, requests that are already being handled keep the previous settings.
+func (r *Registry) SetResolveSettings(resolveRetries int, resolveTimeout time.Duration, resolveLatestTag bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.resolveRetries = resolveRetries
+	r.resolveTimeout = resolveTimeout
+	r.resolveLatestTag = resolveLatestTag
+}
+
+func (r *Registry) resolveSettings() (int, time.Duration, bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.resolveRetries, r.resolveTimeout, r.resolveLatestTag
+}
+
+// resolveTimeoutFor returns the resolve timeout of the reference type, falling back to the resolve timeout when no specific timeout is set.
+func (r *Registry) resolveTimeoutFor(refType oci.ReferenceType) time.Duration {
+	_, resolveTimeout, _ := r.resolveSettings()
+	switch {
+	case refType == oci.ReferenceTypeManifest && r.manifestTimeout > 0:
+		return r.manifestTimeout
+	case refType == oci.ReferenceTypeBlob && r.blobTimeout > 0:
+		return r.blobTimeout
+	default:
+		return resolveTimeout
 	}
 }
 
 func (r *Registry) Server(addr string, log logr.Logger) *http.Server {
 	cfg := pkggin.Config{
+		// Requests are logged by the access log handler instead of the engine, which would log every request.
 		LogConfig: pkggin.LogConfig{
-			Logger:          log,
-			PathFilter:      regexp.MustCompile("/healthz"),
-			IncludeLatency:  true,
-			IncludeClientIP: true,
-			IncludeKeys:     []string{"handler"},
+			Logger: logr.Discard(),
 		},
 		MetricsConfig: pkggin.MetricsConfig{
 			HandlerID: "registry",
 		},
 	}
 	engine := pkggin.NewEngine(cfg)
+	engine.Use(loggerHandler(log))
+	engine.Use(r.accessLogHandler(log))
+	if r.auditExporter != nil {
+		engine.Use(r.auditHandler)
+	}
+	if r.peerSigner != nil {
+		engine.Use(r.signResponseHandler)
+	}
+	middleware, routes := r.buildExtraRoutes()
+	engine.Use(middleware...)
 	engine.GET("/healthz", r.readyHandler)
+	engine.GET("/internal/resolve", r.bearerAuthHandler, r.resolveHandler)
+	engine.GET("/internal/images/:digest/config", r.imageConfigHandler)
+	engine.GET("/internal/advertised", r.bearerAuthHandler, r.advertisedHandler)
+	if r.prefetchToken != "" {
+		engine.POST("/internal/prefetch", r.prefetchHandler)
+	}
+	if r.debugToken != "" {
+		engine.GET("/debug/keys", r.debugAuthHandler, r.debugKeysHandler)
+		engine.GET("/debug/resolve", r.debugAuthHandler, r.debugResolveHandler)
+		if r.statsGatherer != nil {
+			engine.GET("/debug/stats", r.debugAuthHandler, r.clusterStatsHandler)
+		}
+	}
+	if r.existsToken != "" {
+		engine.GET("/api/v1/exists", r.existsHandler)
+	}
 	engine.Any("/v2/*params", r.metricsHandler, r.registryHandler)
+	for _, route := range routes {
+		engine.Handle(route.method, route.path, route.handlers...)
+	}
+	// Cleartext HTTP/2 is accepted for peers multiplexing requests, HTTP/1 requests are served as before.
+	h2s := &http2.Server{}
+	r.h2cConns.handler = h2c.NewHandler(engine, h2s)
 	srv := &http.Server{
 		Addr:    addr,
-		Handler: engine,
+		Handler: r.h2cConns,
 	}
+	// Configuring the server sends go away to HTTP/2 connections when the server is shut down.
+	//nolint:errcheck // only fails with an invalid TLS configuration
+	http2.ConfigureServer(srv, h2s)
 	return srv
 }
 
-func (r *Registry) readyHandler(c *gin.Context) {
-	ok, err := r.router.HasMirrors()
-	if err != nil {
-		//nolint:errcheck // ignore
-		c.AbortWithError(http.StatusInternalServerError, err)
+func (r *Registry) registryHandler(c *gin.Context) {
+	// Only deal with GET and HEAD requests, other methods are only used to push content.
+	if !(c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead) {
+		if r.push == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		r.pushHandler(c)
 		return
 	}
-	if !ok {
-		c.Status(http.StatusInternalServerError)
+	// External requests are authenticated before anything else so that policies only see authenticated requests.
+	r.bearerAuthHandler(c)
+	if c.IsAborted() {
 		return
-
 	}
-	c.Status(http.StatusOK)
-}
-
-func (r *Registry) registryHandler(c *gin.Context) {
-	// Only deal with GET and HEAD requests.
-	if !(c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead) {
-		c.Status(http.StatusNotFound)
+	// Policies are evaluated after authentication so that they can also reject the version check.
+	if status, header, err := r.evaluatePolicies(c.Request); err != nil {
+		for k, v := range header {
+			for _, vv := range v {
+				c.Writer.Header().Add(k, vv)
+			}
+		}
+		//nolint:errcheck // ignore
+		c.AbortWithError(status, err)
 		return
 	}
 	// Quickly return 200 for /v2/ to indicate that registry supports v2.
@@ -109,6 +488,24 @@ func (r *Registry) registryHandler(c *gin.Context) {
 		return
 	}
 
+	// Reject requests that have been proxied too many times as they are most likely caught in a mirror loop.
+	hops := 0
+	if v := c.Request.Header.Get(HopsHeaderKey); v != "" {
+		var err error
+		hops, err = strconv.Atoi(v)
+		if err != nil || hops < 0 {
+			//nolint:errcheck // ignore
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid %s header value %s", HopsHeaderKey, v))
+			return
+		}
+	}
+	if hops > r.maxHops {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusLoopDetected, fmt.Errorf("request has been proxied %d times which exceeds the max of %d hops, check for mirror loops between registries", hops, r.maxHops))
+		return
+	}
+	c.Set(hopsContextKey, hops)
+
 	// Parse out path components from request.
 	ref, dgst, refType, err := oci.ParsePathComponents(c.Query("ns"), c.Request.URL.Path)
 	if err != nil {
@@ -116,8 +513,26 @@ func (r *Registry) registryHandler(c *gin.Context) {
 		c.AbortWithError(http.StatusNotFound, err)
 		return
 	}
+	if ref != "" {
+		withLogValues(c, "ref", ref)
+	}
+	if dgst != "" {
+		withLogValues(c, "digest", dgst.String())
+	}
 
-	if !r.resolveLatestTag && ref != "" {
+	if !r.isAllowed(c.Query("ns"), c.Request.URL.Path) {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("image is not in allow list"))
+		return
+	}
+
+	// Tag lists are served from the local image store.
+	if refType == oci.ReferenceTypeTagsList {
+		r.handleTagsList(c, ref)
+		return
+	}
+
+	if _, _, resolveLatestTag := r.resolveSettings(); !resolveLatestTag && ref != "" {
 		_, tag, _ := strings.Cut(ref, ":")
 		if tag == "latest" {
 			c.AbortWithStatus(http.StatusNotFound)
@@ -125,20 +540,65 @@ func (r *Registry) registryHandler(c *gin.Context) {
 		}
 	}
 
-	// Request with mirror header are proxied.
-	if c.Request.Header.Get(MirroredHeaderKey) != "true" {
+	// Request without mirror header are proxied, unless they have been delegated by a peer.
+	if c.Request.Header.Get(MirroredHeaderKey) != "true" && !isDelegatedRequest(c) {
 		// Set mirrored header in request to stop infinite loops
 		c.Request.Header.Set(MirroredHeaderKey, "true")
+		c.Request.Header.Set(HopsHeaderKey, strconv.Itoa(hops+1))
 
 		key := dgst.String()
 		if key == "" {
 			key = ref
 		}
-		r.handleMirror(c, key)
+		// Conditional requests are not chunked so that peers can answer them without transferring the content.
+		if refType == oci.ReferenceTypeBlob && c.Request.Method == http.MethodGet && r.chunkSize > 0 && c.Request.Header.Get("If-None-Match") == "" {
+			r.handleChunkedMirror(c, key)
+			return
+		}
+		r.handleMirror(c, key, refType)
 		return
 	}
 
 	// Serve registry endpoints.
+	if r.diskPressure.Pressured() {
+		c.Header("Retry-After", "60")
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusServiceUnavailable, fmt.Errorf("node is under disk pressure"))
+		return
+	}
+	if r.quota != nil || r.chargeback != nil {
+		registry := c.Query("ns")
+		if r.quota != nil {
+			if ok, retryAfter := r.quota.exceeded(registry); ok {
+				serveQuotaRejectedTotal.WithLabelValues(registry).Inc()
+				c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+				//nolint:errcheck // ignore
+				c.AbortWithError(http.StatusTooManyRequests, fmt.Errorf("serving quota exceeded for registry %s", registry))
+				return
+			}
+		}
+		cw := &countingWriter{ResponseWriter: c.Writer}
+		c.Writer = cw
+		defer func() {
+			if r.quota != nil {
+				r.quota.add(registry, cw.written)
+			}
+			if r.chargeback != nil {
+				r.chargeback.Add(repositoryName(registry, c.Request.URL.Path), cw.written)
+			}
+		}()
+	}
+	if r.capacity != nil && refType == oci.ReferenceTypeBlob && c.Request.Method == http.MethodGet && dgst != canaryDigest {
+		if ok, reason := r.capacity.acquire(); !ok {
+			servingCapacityRejectedTotal.WithLabelValues(reason).Inc()
+			c.Header("Retry-After", strconv.Itoa(int(capacityRetryAfter.Seconds())))
+			//nolint:errcheck // ignore
+			c.AbortWithError(http.StatusTooManyRequests, fmt.Errorf("serving capacity exceeded by %s", reason))
+			return
+		}
+		defer r.capacity.release()
+		c.Writer = &capacityWriter{ResponseWriter: c.Writer, capacity: r.capacity}
+	}
 	if dgst == "" {
 		dgst, err = r.ociClient.Resolve(c, ref)
 		if err != nil {
@@ -152,6 +612,10 @@ func (r *Registry) registryHandler(c *gin.Context) {
 		r.handleManifest(c, dgst)
 		return
 	case oci.ReferenceTypeBlob:
+		if dgst == canaryDigest {
+			r.handleCanary(c)
+			return
+		}
 		r.handleBlob(c, dgst)
 		return
 	}
@@ -160,81 +624,298 @@ func (r *Registry) registryHandler(c *gin.Context) {
 	c.Status(http.StatusNotFound)
 }
 
-func (r *Registry) handleMirror(c *gin.Context, key string) {
+func (r *Registry) handleMirror(c *gin.Context, key string, refType oci.ReferenceType) {
 	c.Set("handler", "mirror")
 
-	log := pkggin.FromContextOrDiscard(c)
+	log := requestLogger(c)
 
 	// Resolve mirror with the requested key
-	resolveCtx, cancel := context.WithTimeout(c, r.resolveTimeout)
+	resolveRetries, _, _ := r.resolveSettings()
+	resolveTimeout := r.resolveTimeoutFor(refType)
+	resolveCtx, cancel := context.WithTimeout(c, resolveTimeout)
 	defer cancel()
 	resolveCtx = logr.NewContext(resolveCtx, log)
 	isExternal := r.isExternalRequest(c)
 	if isExternal {
 		log.Info("handling mirror request from external node", "path", c.Request.URL.Path, "ip", c.RemoteIP())
 	}
-	mirrorCh, err := r.router.Resolve(resolveCtx, key, isExternal, r.resolveRetries)
+	tried := 0
+	attempts := map[string]int{}
+	result := "miss"
+	defer func() {
+		mirrorPeersTried.Observe(float64(tried))
+		for _, n := range attempts {
+			mirrorPeerAttempts.Observe(float64(n))
+		}
+		mirrorResolveResultsTotal.WithLabelValues(result).Inc()
+	}()
+	mirrorCh, err := r.router.Resolve(resolveCtx, key, isExternal, resolveRetries)
 	if err != nil {
 		//nolint:errcheck // ignore
 		c.AbortWithError(http.StatusInternalServerError, err)
 	}
+	if isExternal && r.delegateExternal {
+		result = r.delegateMirror(resolveCtx, c, log, mirrorCh)
+		return
+	}
+	// Bytes written are tracked so that a transfer failing mid-stream can be resumed from another mirror.
+	cw := &countingWriter{ResponseWriter: c.Writer}
+	expectedLength := int64(-1)
+	resuming := false
+	abortExhausted := func() {
+		if tried > 0 {
+			result = "exhausted"
+		}
+		if resuming {
+			log.Error(fmt.Errorf("mirror resolution has been exhausted"), "could not resume mirror transfer", "offset", cw.written)
+			c.Abort()
+			return
+		}
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("mirror resolution has been exhausted"))
+	}
 	for {
-		select {
-		case <-resolveCtx.Done():
+		// Retries are spent on unique mirrors, resolution is exhausted once the amount of distinct mirrors have failed.
+		if tried >= resolveRetries {
+			abortExhausted()
+			return
+		}
+		mirror, ok, err := nextMirror(resolveCtx, mirrorCh, r.attemptTimeout)
+		if err != nil {
+			if tried > 0 {
+				result = "exhausted"
+			}
+			if resuming {
+				log.Error(fmt.Errorf("could not resolve mirror for key: %s", key), "could not resume mirror transfer", "offset", cw.written)
+				c.Abort()
+				return
+			}
 			// Resolving mirror has timed out meaning one could not be found.
 			//nolint:errcheck // ignore
 			c.AbortWithError(http.StatusNotFound, fmt.Errorf("could not resolve mirror for key: %s", key))
 			return
-		case mirror, ok := <-mirrorCh:
-			// Channel closed means no more mirrors will be received and max retries has been reached.
-			if !ok {
-				//nolint:errcheck // ignore
-				c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("mirror resolution has been exhausted"))
-				return
-			}
+		}
+		// Channel closed means no more mirrors will be received and max retries has been reached.
+		if !ok {
+			abortExhausted()
+			return
+		}
+
+		// The same mirror can be returned multiple times, for example when a node has restarted with a new peer identity.
+		// Each mirror is only attempted once so that a flapping peer cannot consume the whole retry budget.
+		attempts[mirror]++
+		if attempts[mirror] > 1 {
+			log.V(5).Info("skipping mirror that has already been attempted", "mirror", mirror)
+			continue
+		}
+		if r.peerScores != nil && r.peerScores.isBackingOff(mirror) {
+			mirrorPeerSkipsTotal.Inc()
+			log.V(5).Info("skipping mirror that is backing off after repeated failures", "mirror", mirror)
+			continue
+		}
+		tried++
+		u, err := url.Parse(mirror)
+		if err != nil {
+			//nolint:errcheck // ignore
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
 
-			// Modify response returns and error on non 200 status code and NOP error handler skips response writing.
-			// If proxy fails no response is written and it is tried again against a different mirror.
-			// If the response writer has been written to it means that the request was properly proxied.
-			succeeded := false
-			u, err := url.Parse(mirror)
+		// Response headers have already been written so the remaining content is requested with a range.
+		if resuming {
+			err := resumeMirror(r.client, c.Request, u, cw, expectedLength, r.transferTimeout)
 			if err != nil {
-				//nolint:errcheck // ignore
-				c.AbortWithError(http.StatusInternalServerError, err)
-				return
+				r.mirrorFailed(mirror)
+				log.Error(err, "resuming mirror failed attempting next", "offset", cw.written)
+				continue
 			}
-			proxy := httputil.NewSingleHostReverseProxy(u)
-			proxy.ErrorHandler = func(http.ResponseWriter, *http.Request, error) {}
-			proxy.ModifyResponse = func(resp *http.Response) error {
-				if resp.StatusCode != http.StatusOK {
-					err := fmt.Errorf("expected mirror to respond with 200 OK but received: %s", resp.Status)
-					log.Error(err, "mirror failed attempting next")
-					return err
-				}
+			r.mirrorSucceeded(mirror)
+			withLogValues(c, "peer", mirror)
+			log.V(5).Info("resumed mirrored request", "path", c.Request.URL.Path, "url", u.String())
+			result = "hit"
+			return
+		}
+
+		// Modify response returns and error on non 200 status code and NOP error handler skips response writing.
+		// If proxy fails no response is written and it is tried again against a different mirror.
+		// If the response writer has been written to it means that the request was properly proxied.
+		succeeded := false
+		notModified := false
+		var mirrorHeader http.Header
+		attemptStart := time.Now()
+		var transferStart time.Time
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		proxy.Director = withMirrorPeerID(proxy.Director, mirror)
+		proxy.Transport = r.transport
+		proxy.ErrorLog = stdlog.New(io.Discard, "", 0)
+		proxy.ErrorHandler = func(http.ResponseWriter, *http.Request, error) {}
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			// Conditional requests are answered by the mirror when the client already has the content.
+			if resp.StatusCode == http.StatusNotModified && c.Request.Header.Get("If-None-Match") != "" {
 				succeeded = true
+				notModified = true
+				expectedLength = 0
 				return nil
 			}
-			proxy.ServeHTTP(c.Writer, c.Request)
-			if !succeeded {
-				break
+			if resp.StatusCode != http.StatusOK {
+				err := fmt.Errorf("expected mirror to respond with 200 OK but received: %s", resp.Status)
+				log.Error(err, "mirror failed attempting next")
+				return err
+			}
+			transferStart = time.Now()
+			observePeerClockSkew(log, mirror, resp.Header, transferStart)
+			if r.latencyObserver != nil {
+				r.latencyObserver.ObserveLatency(mirror, transferStart.Sub(attemptStart))
 			}
+			succeeded = true
+			mirrorHeader = resp.Header
+			expectedLength = resp.ContentLength
+			return nil
+		}
+		// The proxy aborts the whole response when copying the body fails with a server context present.
+		transferCtx, transferCancel := withTransferTimeout(withConnectionTrace(withoutServerContext{c.Request.Context()}), r.transferTimeout)
+		proxy.ServeHTTP(cw, c.Request.WithContext(transferCtx))
+		transferCancel()
+		if !succeeded {
+			r.mirrorFailed(mirror)
+			r.observeFailedAttempt(mirror, attemptStart)
+			continue
+		}
+		if r.prewarm != nil {
+			r.prewarm.touch(mirror)
+		}
+		if c.Request.Method == http.MethodHead || expectedLength < 0 || cw.written >= expectedLength {
+			r.mirrorSucceeded(mirror)
+			if !notModified {
+				r.observeThroughput(mirror, cw.written, transferStart)
+			}
+			withLogValues(c, "peer", mirror)
 			log.V(5).Info("mirrored request", "path", c.Request.URL.Path, "url", u.String())
+			if !notModified {
+				r.shadow.sample(log, c.Request, mirrorHeader, expectedLength)
+			}
+			result = "hit"
 			return
 		}
+		r.mirrorFailed(mirror)
+		r.observeFailedAttempt(mirror, attemptStart)
+		log.Info("mirror failed mid-stream attempting to resume", "path", c.Request.URL.Path, "url", u.String(), "offset", cw.written)
+		resuming = true
+		// Resolving may have timed out while transferring so a new resolve is started.
+		if resolveCtx.Err() != nil {
+			resolveCtx, cancel = context.WithTimeout(c, resolveTimeout)
+			defer cancel()
+			resolveCtx = logr.NewContext(resolveCtx, log)
+			mirrorCh, err = r.router.Resolve(resolveCtx, key, isExternal, resolveRetries)
+			if err != nil {
+				log.Error(err, "could not resume mirror transfer")
+				c.Abort()
+				return
+			}
+		}
 	}
 }
 
+// nextMirror waits for the next mirror, the wait is bounded by the attempt timeout when it is not zero.
+// It returns false if the channel is closed and an error if the wait timed out.
+func nextMirror(ctx context.Context, mirrorCh <-chan string, attemptTimeout time.Duration) (string, bool, error) {
+	if attemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, attemptTimeout)
+		defer cancel()
+	}
+	select {
+	case <-ctx.Done():
+		return "", false, ctx.Err()
+	case mirror, ok := <-mirrorCh:
+		return mirror, ok, nil
+	}
+}
+
+func (r *Registry) mirrorFailed(mirror string) {
+	if r.peerScores == nil {
+		return
+	}
+	r.peerScores.failure(mirror)
+}
+
+func (r *Registry) mirrorSucceeded(mirror string) {
+	if r.peerScores == nil {
+		return
+	}
+	r.peerScores.success(mirror)
+}
+
+// resumeMirror requests the remaining content from the mirror starting at the bytes already written.
+func resumeMirror(client *http.Client, req *http.Request, u *url.URL, cw *countingWriter, expectedLength int64, transferTimeout time.Duration) error {
+	ctx, cancel := withTransferTimeout(req.Context(), transferTimeout)
+	defer cancel()
+	resumeURL := *u
+	resumeURL.Path = req.URL.Path
+	resumeURL.RawQuery = req.URL.RawQuery
+	resumeReq, err := http.NewRequestWithContext(ctx, http.MethodGet, resumeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resumeReq.Header = req.Header.Clone()
+	resumeReq.Header.Set("Range", fmt.Sprintf("bytes=%d-", cw.written))
+	resp, err := client.Do(resumeReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("expected mirror to respond with 206 Partial Content but received: %s", resp.Status)
+	}
+	_, err = io.Copy(cw, resp.Body)
+	if err != nil {
+		return err
+	}
+	if cw.written < expectedLength {
+		return fmt.Errorf("mirror response ended after %d of %d bytes", cw.written, expectedLength)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	gin.ResponseWriter
+	written int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// withoutServerContext hides the server context key from the reverse proxy.
+type withoutServerContext struct {
+	context.Context
+}
+
+func (c withoutServerContext) Value(key any) any {
+	if key == http.ServerContextKey {
+		return nil
+	}
+	return c.Context.Value(key)
+}
+
 func (r *Registry) handleManifest(c *gin.Context, dgst digest.Digest) {
 	c.Set("handler", "manifest")
-	b, mediaType, err := r.ociClient.GetBlob(c, dgst)
+	b, mediaType, err := r.getManifest(c, dgst)
 	if err != nil {
 		//nolint:errcheck // ignore
 		c.AbortWithError(http.StatusNotFound, err)
 		return
 	}
+	c.Header("Docker-Content-Digest", dgst.String())
+	c.Header("ETag", digestETag(dgst))
+	if etagMatches(c.GetHeader("If-None-Match"), dgst) {
+		c.Status(http.StatusNotModified)
+		return
+	}
 	c.Header("Content-Type", mediaType)
 	c.Header("Content-Length", strconv.FormatInt(int64(len(b)), 10))
-	c.Header("Docker-Content-Digest", dgst.String())
 	if c.Request.Method == http.MethodHead {
 		return
 	}
@@ -246,20 +927,240 @@ func (r *Registry) handleManifest(c *gin.Context, dgst digest.Digest) {
 	}
 }
 
+func (r *Registry) getManifest(ctx context.Context, dgst digest.Digest) ([]byte, string, error) {
+	if r.cache != nil {
+		// Entries without media type have been cached through the blob endpoint.
+		if entry, ok := r.cache.Get(dgst.String()); ok && entry.MediaType != "" {
+			cacheRequestsTotal.WithLabelValues("hit").Inc()
+			return entry.Data, entry.MediaType, nil
+		}
+		cacheRequestsTotal.WithLabelValues("miss").Inc()
+	}
+	b, mediaType, err := r.ociClient.GetBlob(ctx, dgst)
+	if err != nil {
+		return nil, "", err
+	}
+	if r.cache != nil && int64(len(b)) <= r.cacheMaxBlobSize {
+		r.cache.Add(dgst.String(), cache.Entry{Data: b, MediaType: mediaType})
+	}
+	return b, mediaType, nil
+}
+
 func (r *Registry) handleBlob(c *gin.Context, dgst digest.Digest) {
 	c.Set("handler", "blob")
-	size, err := r.ociClient.GetSize(c, dgst)
+	if r.throttle != nil {
+		c.Writer = &throttledWriter{ResponseWriter: c.Writer, ctx: c.Request.Context(), throttle: r.throttle, source: "blob"}
+	}
+	// Serving content handles range requests which allows mirrors to resume failed transfers.
+	// Conditional requests are answered with 304 by serving content as the ETag is set.
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Docker-Content-Digest", dgst.String())
+	c.Header("ETag", digestETag(dgst))
+	if r.cache != nil {
+		if entry, ok := r.cache.Get(dgst.String()); ok {
+			cacheRequestsTotal.WithLabelValues("hit").Inc()
+			http.ServeContent(c.Writer, c.Request, "", time.Time{}, bytes.NewReader(entry.Data))
+			return
+		}
+		cacheRequestsTotal.WithLabelValues("miss").Inc()
+	}
+	rc, err := r.ociClient.GetBlobReader(c, dgst)
 	if err != nil {
 		//nolint:errcheck // ignore
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
-	c.Header("Content-Length", strconv.FormatInt(size, 10))
-	c.Header("Docker-Content-Digest", dgst.String())
+	defer rc.Close()
+	var rs io.ReadSeeker = rc
+	if r.cache != nil {
+		b, ok, err := readSmallBlob(rc, r.cacheMaxBlobSize)
+		if err != nil {
+			//nolint:errcheck // ignore
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if ok {
+			if r.verifyBlobs && digest.FromBytes(b) != dgst {
+				r.withdrawCorruptBlob(c, dgst)
+				//nolint:errcheck // ignore
+				c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("blob content does not match digest %s", dgst))
+				return
+			}
+			r.cache.Add(dgst.String(), cache.Entry{Data: b})
+			rs = bytes.NewReader(b)
+		}
+	}
+	switch rs.(type) {
+	case *os.File, *bytes.Reader:
+	default:
+		if r.readAheadSize > 0 {
+			ra, err := newReadAheadReadSeeker(rs, r.readAheadSize)
+			if err != nil {
+				//nolint:errcheck // ignore
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			defer ra.Close()
+			rs = ra
+		}
+	}
+	if !r.verifyBlobs {
+		if _, ok := rs.(*os.File); ok {
+			c.Writer = &sendfileWriter{ResponseWriter: c.Writer}
+		}
+		http.ServeContent(c.Writer, c.Request, "", time.Time{}, rs)
+		return
+	}
+	vrs, err := newVerifyingReadSeeker(rs, dgst)
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	http.ServeContent(c.Writer, c.Request, "", time.Time{}, vrs)
+	if vrs.failed() {
+		r.withdrawCorruptBlob(c, dgst)
+		c.Abort()
+	}
+}
+
+// withdrawCorruptBlob stops advertising a blob that does not match its digest so that peers stop requesting it.
+func (r *Registry) withdrawCorruptBlob(c *gin.Context, dgst digest.Digest) {
+	log := requestLogger(c)
+	blobVerificationFailuresTotal.Inc()
+	log.Error(fmt.Errorf("blob content does not match digest %s", dgst), "withdrawing corrupt blob")
+	err := r.router.Withdraw(c, []string{dgst.String()})
+	if err != nil {
+		log.Error(err, "could not withdraw corrupt blob")
+	}
+}
+
+// digestETag returns the strong ETag of content, which is the digest as content is addressed by it.
+func digestETag(dgst digest.Digest) string {
+	return fmt.Sprintf("%q", dgst.String())
+}
+
+// etagMatches returns true if the If-None-Match header value matches the ETag of the digest.
+func etagMatches(ifNoneMatch string, dgst digest.Digest) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag := digestETag(dgst)
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// readSmallBlob reads the full content if it is not larger than max size, otherwise the reader is left at the start.
+func readSmallBlob(rs io.ReadSeeker, maxSize int64) ([]byte, bool, error) {
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = rs.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, false, err
+	}
+	if size > maxSize {
+		return nil, false, nil
+	}
+	b, err := io.ReadAll(rs)
+	if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+type tagsList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+func (r *Registry) handleTagsList(c *gin.Context, name string) {
+	c.Set("handler", "tags")
+	if c.Request.Method != http.MethodGet {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	n := -1
+	if v := c.Query("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 {
+			//nolint:errcheck // ignore
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid pagination number %s", v))
+			return
+		}
+	}
+	tags, err := r.ociClient.ListTags(c, name)
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	tags, more := paginate(tags, n, c.Query("last"))
+	if more {
+		// The next link keeps the other query parameters, like the registry namespace, so that it can be followed as is.
+		query := c.Request.URL.Query()
+		query.Set("n", strconv.Itoa(n))
+		query.Set("last", tags[len(tags)-1])
+		c.Header("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, c.Request.URL.Path, query.Encode()))
+	}
+	_, repository, _ := strings.Cut(name, "/")
+	c.JSON(http.StatusOK, tagsList{Name: repository, Tags: tags})
+}
+
+// paginate sorts the items lexically and returns at most n items following last, a negative n does not limit the amount of items.
+// It returns true if there are more items after the returned page.
+func paginate(items []string, n int, last string) ([]string, bool) {
+	sorted := make([]string, len(items))
+	copy(sorted, items)
+	sort.Strings(sorted)
+	if last != "" {
+		i := sort.Search(len(sorted), func(i int) bool {
+			return sorted[i] > last
+		})
+		sorted = sorted[i:]
+	}
+	if n < 0 || len(sorted) <= n {
+		return sorted, false
+	}
+	if n == 0 {
+		return []string{}, false
+	}
+	return sorted[:n], true
+}
+
+// imageConfigHandler serves the image config from the local store so that it can be inspected without pulling from the origin registry.
+func (r *Registry) imageConfigHandler(c *gin.Context) {
+	c.Set("handler", "image-config")
+	dgst, err := digest.Parse(c.Param("digest"))
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	b, mediaType, err := r.ociClient.GetImageConfig(c, dgst)
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	c.Data(http.StatusOK, mediaType, b)
+}
+
+func (r *Registry) handleCanary(c *gin.Context) {
+	c.Set("handler", "canary")
+	c.Header("Content-Length", strconv.FormatInt(int64(len(canaryBlob)), 10))
+	c.Header("Docker-Content-Digest", canaryDigest.String())
 	if c.Request.Method == http.MethodHead {
 		return
 	}
-	err = r.ociClient.WriteBlob(c, c.Writer, dgst)
+	_, err := c.Writer.Write(canaryBlob)
 	if err != nil {
 		//nolint:errcheck // ignore
 		c.AbortWithError(http.StatusInternalServerError, err)
@@ -267,12 +1168,44 @@ func (r *Registry) handleBlob(c *gin.Context, dgst digest.Digest) {
 	}
 }
 
+func (r *Registry) auditHandler(c *gin.Context) {
+	if c.Request.URL.Path == "/healthz" {
+		c.Next()
+		return
+	}
+	start := time.Now()
+	// The path is read before the request is rewritten by policies, so that the record contains the requested path.
+	path := c.Request.URL.Path
+	c.Next()
+	handler, _ := c.Get("handler")
+	handlerName, _ := handler.(string)
+	size := c.Writer.Size()
+	if size < 0 {
+		size = 0
+	}
+	r.auditExporter.Export(audit.Record{
+		Time:     start,
+		Handler:  handlerName,
+		Method:   c.Request.Method,
+		Path:     path,
+		Registry: c.Query("ns"),
+		Status:   c.Writer.Status(),
+		Bytes:    size,
+		ClientIP: c.ClientIP(),
+		Duration: time.Since(start),
+	})
+}
+
 func (r *Registry) metricsHandler(c *gin.Context) {
 	c.Next()
 	handler, ok := c.Get("handler")
 	if !ok {
 		return
 	}
+	handlerName, _ := handler.(string)
+	if size := c.Writer.Size(); size > 0 {
+		metrics.ServedBytesTotal.WithLabelValues(c.Query("ns"), handlerName).Add(float64(size))
+	}
 	if handler != "mirror" {
 		return
 	}
@@ -287,6 +1220,70 @@ func (r *Registry) metricsHandler(c *gin.Context) {
 	mirrorRequestsTotal.WithLabelValues(c.Query("ns"), cacheType, sourceType).Inc()
 }
 
+// isAllowed checks the image name of the request against the allow list, for both tag and digest references.
+// Requests without the registry parameter are expected to include the registry in the repository path.
+func (r *Registry) isAllowed(registry, p string) bool {
+	if r.allowList == nil || !repositoryRegex.MatchString(p) {
+		return true
+	}
+	return r.allowList.Allowed(repositoryName(registry, p))
+}
+
+// repositoryName returns the registry and repository of the request path.
+func repositoryName(registry, p string) string {
+	comps := repositoryRegex.FindStringSubmatch(p)
+	if len(comps) != 2 {
+		return registry
+	}
+	if registry == "" {
+		return comps[1]
+	}
+	return fmt.Sprintf("%s/%s", registry, comps[1])
+}
+
 func (r *Registry) isExternalRequest(c *gin.Context) bool {
-	return c.Request.Host != r.localAddr
+	if len(r.localCIDRs) == 0 {
+		return c.Request.Host != r.localAddr
+	}
+	return !r.isLocalClient(c)
+}
+
+// isLocalClient returns true if the client address is a loopback address or within the local CIDRs.
+// Unlike the request host the client address can not be set by the client, so it is used for authentication.
+func (r *Registry) isLocalClient(c *gin.Context) bool {
+	ip := net.ParseIP(c.RemoteIP())
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, cidr := range r.localCIDRs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses the CIDRs, addresses without a prefix length are parsed as a single address.
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	cidrs := []*net.IPNet{}
+	for _, v := range values {
+		if ip := net.ParseIP(v); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse cidr %s: %w", v, err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
 }
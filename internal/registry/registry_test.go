@@ -1,16 +1,35 @@
 package registry
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/allowlist"
+	"github.com/xenitab/spegel/internal/cache"
+	"github.com/xenitab/spegel/internal/chargeback"
+	"github.com/xenitab/spegel/internal/diskpressure"
+	"github.com/xenitab/spegel/internal/metrics"
+	"github.com/xenitab/spegel/internal/oci"
 	"github.com/xenitab/spegel/internal/routing"
+	"github.com/xenitab/spegel/internal/state"
 )
 
 type TestResponseRecorder struct {
@@ -68,6 +87,7 @@ func TestMirrorHandler(t *testing.T) {
 		expectedStatus  int
 		expectedBody    string
 		expectedHeaders map[string][]string
+		expectedResult  string
 	}{
 		{
 			name:            "request should timeout when no peers exists",
@@ -75,6 +95,7 @@ func TestMirrorHandler(t *testing.T) {
 			expectedStatus:  http.StatusNotFound,
 			expectedBody:    "",
 			expectedHeaders: nil,
+			expectedResult:  "miss",
 		},
 		{
 			name:            "request should not timeout and give 500 if all peers fail",
@@ -82,6 +103,7 @@ func TestMirrorHandler(t *testing.T) {
 			expectedStatus:  http.StatusInternalServerError,
 			expectedBody:    "",
 			expectedHeaders: nil,
+			expectedResult:  "exhausted",
 		},
 		{
 			name:            "request should work when first peer responds",
@@ -89,6 +111,7 @@ func TestMirrorHandler(t *testing.T) {
 			expectedStatus:  http.StatusOK,
 			expectedBody:    "hello world",
 			expectedHeaders: map[string][]string{"foo": {"bar"}},
+			expectedResult:  "hit",
 		},
 		{
 			name:            "second peer should respond when first gives error",
@@ -96,6 +119,7 @@ func TestMirrorHandler(t *testing.T) {
 			expectedStatus:  http.StatusOK,
 			expectedBody:    "hello world",
 			expectedHeaders: map[string][]string{"foo": {"bar"}},
+			expectedResult:  "hit",
 		},
 		{
 			name:            "last peer should respond when two first fail",
@@ -103,6 +127,7 @@ func TestMirrorHandler(t *testing.T) {
 			expectedStatus:  http.StatusOK,
 			expectedBody:    "hello world",
 			expectedHeaders: map[string][]string{"foo": {"bar"}},
+			expectedResult:  "hit",
 		},
 	}
 	for _, tt := range tests {
@@ -112,7 +137,9 @@ func TestMirrorHandler(t *testing.T) {
 				c, _ := gin.CreateTestContext(rw)
 				target := fmt.Sprintf("http://example.com/%s", tt.key)
 				c.Request = httptest.NewRequest(method, target, nil)
-				reg.handleMirror(c, tt.key)
+				before := testutil.ToFloat64(mirrorResolveResultsTotal.WithLabelValues(tt.expectedResult))
+				reg.handleMirror(c, tt.key, oci.ReferenceTypeBlob)
+				require.Equal(t, before+1, testutil.ToFloat64(mirrorResolveResultsTotal.WithLabelValues(tt.expectedResult)))
 
 				resp := rw.Result()
 				defer resp.Body.Close()
@@ -137,3 +164,939 @@ func TestMirrorHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveTimeouts(t *testing.T) {
+	reg := NewRegistry(nil, routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, WithResolveTimeouts(time.Second, 2*time.Second, 0))
+	require.Equal(t, time.Second, reg.resolveTimeoutFor(oci.ReferenceTypeManifest))
+	require.Equal(t, 2*time.Second, reg.resolveTimeoutFor(oci.ReferenceTypeBlob))
+	reg.SetResolveSettings(3, 10*time.Second, false)
+	require.Equal(t, time.Second, reg.resolveTimeoutFor(oci.ReferenceTypeManifest))
+
+	reg = NewRegistry(nil, routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false)
+	require.Equal(t, 5*time.Second, reg.resolveTimeoutFor(oci.ReferenceTypeManifest))
+	require.Equal(t, 5*time.Second, reg.resolveTimeoutFor(oci.ReferenceTypeBlob))
+
+	// Keys that are not found are resolved until the timeout of the reference type or the attempt timeout.
+	for _, opt := range []Option{
+		WithResolveTimeouts(50*time.Millisecond, 0, 0),
+		WithResolveTimeouts(0, 0, 50*time.Millisecond),
+	} {
+		reg := NewRegistry(nil, routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, opt)
+		rw := CreateTestResponseRecorder()
+		c, _ := gin.CreateTestContext(rw)
+		c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/not-found", nil)
+		start := time.Now()
+		reg.handleMirror(c, "not-found", oci.ReferenceTypeManifest)
+		require.Less(t, time.Since(start), time.Second)
+		resp := rw.Result()
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestNextMirror(t *testing.T) {
+	mirrorCh := make(chan string, 1)
+	mirrorCh <- "http://10.0.0.1:5000"
+	mirror, ok, err := nextMirror(context.Background(), mirrorCh, 50*time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "http://10.0.0.1:5000", mirror)
+
+	_, _, err = nextMirror(context.Background(), mirrorCh, 50*time.Millisecond)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(mirrorCh)
+	_, ok, err = nextMirror(context.Background(), mirrorCh, 0)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestMirrorHandlerResume(t *testing.T) {
+	content := []byte("hello world")
+	brokenSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		//nolint:errcheck // ignore
+		w.Write(content[:5])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer brokenSvr.Close()
+	rangeSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer rangeSvr.Close()
+
+	router := routing.NewMockRouter(map[string][]string{"broken-peer": {brokenSvr.URL, rangeSvr.URL}})
+	reg := NewRegistry(nil, router, "", 3, 5*time.Second, false)
+	rw := CreateTestResponseRecorder()
+	c, _ := gin.CreateTestContext(rw)
+	c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/broken-peer", nil)
+	reg.handleMirror(c, "broken-peer", oci.ReferenceTypeBlob)
+
+	resp := rw.Result()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, string(content), string(b))
+}
+
+func TestTagsListHandler(t *testing.T) {
+	imgRefs := []string{
+		"docker.io/library/ubuntu:latest@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+		"docker.io/library/ubuntu:22.04@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+		"ghcr.io/library/ubuntu:20.04@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+	}
+	imgs := []oci.Image{}
+	for _, imgRef := range imgRefs {
+		img, err := oci.Parse(imgRef, "")
+		require.NoError(t, err)
+		imgs = append(imgs, img)
+	}
+	reg := NewRegistry(oci.NewMockClient(imgs), routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false)
+	srv := reg.Server("", logr.Discard())
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/ubuntu/tags/list?ns=docker.io", nil)
+	srv.Handler.ServeHTTP(rw, req)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.JSONEq(t, `{"name":"library/ubuntu","tags":["22.04","latest"]}`, string(b))
+	require.Empty(t, resp.Header.Get("Link"))
+}
+
+func TestTagsListHandlerPagination(t *testing.T) {
+	imgs := []oci.Image{}
+	for _, tag := range []string{"1.2", "1.0", "latest", "1.1", "2.0"} {
+		img, err := oci.Parse("docker.io/library/ubuntu:"+tag+"@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020", "")
+		require.NoError(t, err)
+		imgs = append(imgs, img)
+	}
+	reg := NewRegistry(oci.NewMockClient(imgs), routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false)
+	srv := reg.Server("", logr.Discard())
+
+	// Following the next links has to return every tag exactly once in lexical order.
+	pages := [][]string{}
+	next := "/v2/library/ubuntu/tags/list?ns=docker.io&n=2"
+	for next != "" {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+next, nil)
+		srv.Handler.ServeHTTP(rw, req)
+		require.Equal(t, http.StatusOK, rw.Code)
+		list := tagsList{}
+		err := json.Unmarshal(rw.Body.Bytes(), &list)
+		require.NoError(t, err)
+		require.Equal(t, "library/ubuntu", list.Name)
+		pages = append(pages, list.Tags)
+		next = ""
+		link := rw.Header().Get("Link")
+		if link == "" {
+			continue
+		}
+		require.True(t, strings.HasSuffix(link, `>; rel="next"`))
+		next = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		u, err := url.Parse(next)
+		require.NoError(t, err)
+		require.Equal(t, "docker.io", u.Query().Get("ns"))
+		require.Equal(t, "2", u.Query().Get("n"))
+	}
+	require.Equal(t, [][]string{{"1.0", "1.1"}, {"1.2", "2.0"}, {"latest"}}, pages)
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedBody   string
+		expectedLink   string
+	}{
+		{
+			name:           "last without n",
+			query:          "last=1.1",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"library/ubuntu","tags":["1.2","2.0","latest"]}`,
+		},
+		{
+			name:           "last not in list",
+			query:          "n=1&last=1.15",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"library/ubuntu","tags":["1.2"]}`,
+			expectedLink:   `</v2/library/ubuntu/tags/list?last=1.2&n=1&ns=docker.io>; rel="next"`,
+		},
+		{
+			name:           "last after all tags",
+			query:          "n=2&last=zzz",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"library/ubuntu","tags":[]}`,
+		},
+		{
+			name:           "zero n",
+			query:          "n=0",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"library/ubuntu","tags":[]}`,
+		},
+		{
+			name:           "n larger than list",
+			query:          "n=100",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"library/ubuntu","tags":["1.0","1.1","1.2","2.0","latest"]}`,
+		},
+		{
+			name:           "negative n",
+			query:          "n=-1",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid n",
+			query:          "n=foo",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/ubuntu/tags/list?ns=docker.io&"+tt.query, nil)
+			srv.Handler.ServeHTTP(rw, req)
+			require.Equal(t, tt.expectedStatus, rw.Code)
+			if tt.expectedBody == "" {
+				return
+			}
+			require.JSONEq(t, tt.expectedBody, rw.Body.String())
+			require.Equal(t, tt.expectedLink, rw.Header().Get("Link"))
+		})
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	img, err := oci.Parse("docker.io/library/ubuntu:22.04@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020", "")
+	require.NoError(t, err)
+	allowList := allowlist.NewAllowList()
+	patterns, err := allowlist.Parse(`ghcr\.io/.+`)
+	require.NoError(t, err)
+	allowList.Set(patterns)
+	reg := NewRegistry(oci.NewMockClient([]oci.Image{img}), routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, WithAllowList(allowList))
+	srv := reg.Server("", logr.Discard())
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+	}{
+		{
+			name:           "tags list not allowed",
+			path:           "/v2/library/ubuntu/tags/list?ns=docker.io",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "blob not allowed",
+			path:           "/v2/library/ubuntu/blobs/sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020?ns=docker.io",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "tags list allowed",
+			path:           "/v2/library/ubuntu/tags/list?ns=ghcr.io",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "manifest digest without registry parameter not allowed",
+			path:           "/v2/docker.io/library/ubuntu/manifests/sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+			srv.Handler.ServeHTTP(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+		})
+	}
+
+	allowedTests := []struct {
+		name     string
+		registry string
+		path     string
+		expected bool
+	}{
+		{
+			name:     "blob digest",
+			registry: "docker.io",
+			path:     "/v2/library/ubuntu/blobs/sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+			expected: false,
+		},
+		{
+			name:     "manifest digest",
+			registry: "ghcr.io",
+			path:     "/v2/xenitab/spegel/manifests/sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+			expected: true,
+		},
+		{
+			name:     "registry from path",
+			path:     "/v2/ghcr.io/xenitab/spegel/blobs/sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+			expected: true,
+		},
+		{
+			name:     "registry from path not allowed",
+			path:     "/v2/docker.io/library/ubuntu/manifests/latest",
+			expected: false,
+		},
+		{
+			name:     "missing registry",
+			path:     "/v2/library/ubuntu/manifests/latest",
+			expected: false,
+		},
+		{
+			name:     "not a repository path",
+			path:     "/v2/",
+			expected: true,
+		},
+	}
+	for _, tt := range allowedTests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, reg.isAllowed(tt.registry, tt.path))
+		})
+	}
+}
+
+func TestBlobHandlerCache(t *testing.T) {
+	reg := NewRegistry(nil, routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, WithCache(1024, 64))
+	dgst := digest.FromString("hello world")
+	reg.cache.Add(dgst.String(), cache.Entry{Data: []byte("hello world")})
+
+	// The OCI client is nil so the content has to be served from the cache.
+	rw := CreateTestResponseRecorder()
+	c, _ := gin.CreateTestContext(rw)
+	c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/v2/foo/blobs/"+dgst.String(), nil)
+	reg.handleBlob(c, dgst)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hello world", string(b))
+	require.Equal(t, dgst.String(), resp.Header.Get("Docker-Content-Digest"))
+}
+
+type manifestClient struct {
+	oci.Client
+	manifests map[digest.Digest][]byte
+}
+
+func (c *manifestClient) GetBlob(ctx context.Context, dgst digest.Digest) ([]byte, string, error) {
+	b, ok := c.manifests[dgst]
+	if !ok {
+		return nil, "", fmt.Errorf("manifest not found %s", dgst)
+	}
+	return b, ocispec.MediaTypeImageManifest, nil
+}
+
+func TestGetManifestCache(t *testing.T) {
+	small := []byte("small")
+	large := []byte("larger than the max blob size")
+	ociClient := &manifestClient{
+		manifests: map[digest.Digest][]byte{
+			digest.FromBytes(small): small,
+			digest.FromBytes(large): large,
+		},
+	}
+	reg := NewRegistry(ociClient, routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, WithCache(1024, 10))
+
+	for _, b := range [][]byte{small, large} {
+		dgst := digest.FromBytes(b)
+		manifest, mediaType, err := reg.getManifest(context.TODO(), dgst)
+		require.NoError(t, err)
+		require.Equal(t, b, manifest)
+		require.Equal(t, ocispec.MediaTypeImageManifest, mediaType)
+	}
+	_, ok := reg.cache.Get(digest.FromBytes(small).String())
+	require.True(t, ok)
+	_, ok = reg.cache.Get(digest.FromBytes(large).String())
+	require.False(t, ok)
+}
+
+func TestReadSmallBlob(t *testing.T) {
+	b, ok, err := readSmallBlob(bytes.NewReader([]byte("hello world")), 11)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "hello world", string(b))
+
+	rs := bytes.NewReader([]byte("hello world"))
+	_, ok, err = readSmallBlob(rs, 10)
+	require.NoError(t, err)
+	require.False(t, ok)
+	b, err = io.ReadAll(rs)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(b))
+}
+
+type imageConfigClient struct {
+	oci.Client
+	configs map[digest.Digest][]byte
+}
+
+func (c *imageConfigClient) GetImageConfig(ctx context.Context, dgst digest.Digest) ([]byte, string, error) {
+	b, ok := c.configs[dgst]
+	if !ok {
+		return nil, "", fmt.Errorf("not found")
+	}
+	return b, "application/vnd.oci.image.config.v1+json", nil
+}
+
+func TestImageConfigHandler(t *testing.T) {
+	dgst := digest.FromString("manifest")
+	ociClient := &imageConfigClient{
+		configs: map[digest.Digest][]byte{
+			dgst: []byte(`{"config":{"User":"nobody","Entrypoint":["/bin/sh"]}}`),
+		},
+	}
+	reg := NewRegistry(ociClient, routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false)
+	srv := reg.Server("", logr.Discard())
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "found",
+			path:           "/internal/images/" + dgst.String() + "/config",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"config":{"User":"nobody","Entrypoint":["/bin/sh"]}}`,
+		},
+		{
+			name:           "not found",
+			path:           "/internal/images/" + digest.FromString("foo").String() + "/config",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "invalid digest",
+			path:           "/internal/images/foo/config",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+			srv.Handler.ServeHTTP(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, "application/vnd.oci.image.config.v1+json", resp.Header.Get("Content-Type"))
+			require.JSONEq(t, tt.expectedBody, string(b))
+		})
+	}
+}
+
+func TestHopsHeader(t *testing.T) {
+	dgst := "sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020"
+	hopsCh := make(chan string, 1)
+	peerSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hopsCh <- r.Header.Get(HopsHeaderKey)
+	}))
+	defer peerSvr.Close()
+	router := routing.NewMockRouter(map[string][]string{dgst: {peerSvr.URL}})
+	reg := NewRegistry(nil, router, "", 3, 5*time.Second, false, WithMaxHops(2))
+	srv := reg.Server("", logr.Discard())
+
+	tests := []struct {
+		name           string
+		hops           string
+		expectedStatus int
+		expectedHops   string
+	}{
+		{
+			name:           "first hop",
+			hops:           "",
+			expectedStatus: http.StatusOK,
+			expectedHops:   "1",
+		},
+		{
+			name:           "below max hops",
+			hops:           "2",
+			expectedStatus: http.StatusOK,
+			expectedHops:   "3",
+		},
+		{
+			name:           "above max hops",
+			hops:           "3",
+			expectedStatus: http.StatusLoopDetected,
+		},
+		{
+			name:           "invalid hops",
+			hops:           "foo",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := CreateTestResponseRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/ubuntu/blobs/"+dgst+"?ns=docker.io", nil)
+			if tt.hops != "" {
+				req.Header.Set(HopsHeaderKey, tt.hops)
+			}
+			srv.Handler.ServeHTTP(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedHops == "" {
+				return
+			}
+			require.Equal(t, tt.expectedHops, <-hopsCh)
+		})
+	}
+}
+
+func TestMirrorHandlerFirstByteTimeout(t *testing.T) {
+	slowSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		//nolint:errcheck // ignore
+		w.Write([]byte("slow"))
+	}))
+	defer slowSvr.Close()
+	goodSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//nolint:errcheck // ignore
+		w.Write([]byte("hello world"))
+	}))
+	defer goodSvr.Close()
+
+	router := routing.NewMockRouter(map[string][]string{"key": {slowSvr.URL, goodSvr.URL}})
+	reg := NewRegistry(nil, router, "", 3, 5*time.Second, false, WithTransferTimeouts(time.Second, 50*time.Millisecond, 0))
+	rw := CreateTestResponseRecorder()
+	c, _ := gin.CreateTestContext(rw)
+	c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/key", nil)
+	reg.handleMirror(c, "key", oci.ReferenceTypeBlob)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hello world", string(b))
+}
+
+func TestMirrorHandlerUniquePeerRetries(t *testing.T) {
+	badHits := 0
+	badSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badHits++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer badSvr.Close()
+	goodSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//nolint:errcheck // ignore
+		w.Write([]byte("hello world"))
+	}))
+	defer goodSvr.Close()
+
+	router := routing.NewMockRouter(map[string][]string{"key": {badSvr.URL, badSvr.URL, badSvr.URL, goodSvr.URL}})
+	reg := NewRegistry(nil, router, "", 2, 5*time.Second, false)
+	rw := CreateTestResponseRecorder()
+	c, _ := gin.CreateTestContext(rw)
+	c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/key", nil)
+	reg.handleMirror(c, "key", oci.ReferenceTypeBlob)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hello world", string(b))
+	require.Equal(t, 1, badHits)
+}
+
+type recordingLatencyObserver struct {
+	latencies   map[string]time.Duration
+	throughputs map[string]float64
+}
+
+func (o recordingLatencyObserver) ObserveLatency(mirror string, d time.Duration) {
+	o.latencies[mirror] = d
+}
+
+func (o recordingLatencyObserver) ObserveThroughput(mirror string, bytesPerSecond float64) {
+	o.throughputs[mirror] = bytesPerSecond
+}
+
+func TestMirrorHandlerLatencyObserver(t *testing.T) {
+	badSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer badSvr.Close()
+	goodSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		//nolint:errcheck // ignore
+		w.Write([]byte("hello world"))
+	}))
+	defer goodSvr.Close()
+	largeSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//nolint:errcheck // ignore
+		w.Write(make([]byte, minThroughputSize))
+	}))
+	defer largeSvr.Close()
+
+	observer := recordingLatencyObserver{latencies: map[string]time.Duration{}, throughputs: map[string]float64{}}
+	router := routing.NewMockRouter(map[string][]string{"key": {badSvr.URL, goodSvr.URL}, "large": {largeSvr.URL}})
+	reg := NewRegistry(nil, router, "", 3, 5*time.Second, false, WithLatencyObserver(observer))
+	rw := CreateTestResponseRecorder()
+	c, _ := gin.CreateTestContext(rw)
+	c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/key", nil)
+	reg.handleMirror(c, "key", oci.ReferenceTypeBlob)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	// Failed attempts are observed with a penalty so that the failing mirror is ranked after the mirror that responds.
+	require.Len(t, observer.latencies, 2)
+	require.Equal(t, failedAttemptLatency, observer.latencies[badSvr.URL])
+	require.GreaterOrEqual(t, observer.latencies[goodSvr.URL], 10*time.Millisecond)
+	require.Less(t, observer.latencies[goodSvr.URL], observer.latencies[badSvr.URL])
+	// Throughput is only observed for transfers large enough to not be dominated by latency.
+	require.Empty(t, observer.throughputs)
+
+	rw = CreateTestResponseRecorder()
+	c, _ = gin.CreateTestContext(rw)
+	c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/large", nil)
+	reg.handleMirror(c, "large", oci.ReferenceTypeBlob)
+	resp = rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Greater(t, observer.throughputs[largeSvr.URL], 0.0)
+}
+
+func TestExternalDelegation(t *testing.T) {
+	dgst := digest.FromString("hello world")
+	router := routing.NewMockRouter(map[string][]string{dgst.String(): {"http://10.0.0.1:5000"}})
+	reg := NewRegistry(oci.NewMockClient(nil), router, "localhost:5000", 3, 5*time.Second, false, WithCache(1024, 64), WithExternalDelegation())
+	reg.cache.Add(dgst.String(), cache.Entry{Data: []byte("hello world")})
+	srv := reg.Server("", logr.Discard())
+
+	// External requests are redirected to the peer.
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/ubuntu/blobs/"+dgst.String()+"?ns=docker.io", nil)
+	srv.Handler.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusTemporaryRedirect, rw.Code)
+	require.Equal(t, "http://10.0.0.1:5000/v2/library/ubuntu/blobs/"+dgst.String()+"?delegated=true&ns=docker.io", rw.Header().Get("Location"))
+
+	// Delegated requests are served from the node instead of being mirrored again.
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/ubuntu/blobs/"+dgst.String()+"?ns=docker.io&delegated=true", nil)
+	srv.Handler.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, "hello world", rw.Body.String())
+
+	// Requests are not redirected when no peer has the content.
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/ubuntu/blobs/"+digest.FromString("foo").String()+"?ns=docker.io", nil)
+	srv.Handler.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func TestConditionalRequests(t *testing.T) {
+	dgst := digest.FromString("hello world")
+	etag := `"` + dgst.String() + `"`
+	reg := NewRegistry(oci.NewMockClient(nil), routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, WithCache(1024, 64))
+	reg.cache.Add(dgst.String(), cache.Entry{Data: []byte("hello world"), MediaType: "application/vnd.oci.image.manifest.v1+json"})
+	srv := reg.Server("", logr.Discard())
+
+	tests := []struct {
+		name         string
+		path         string
+		ifNoneMatch  string
+		expectedCode int
+	}{
+		{
+			name:         "manifest without condition",
+			path:         "/v2/library/ubuntu/manifests/" + dgst.String(),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "manifest matching",
+			path:         "/v2/library/ubuntu/manifests/" + dgst.String(),
+			ifNoneMatch:  `"foo", W/` + etag,
+			expectedCode: http.StatusNotModified,
+		},
+		{
+			name:         "manifest not matching",
+			path:         "/v2/library/ubuntu/manifests/" + dgst.String(),
+			ifNoneMatch:  `"foo"`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "blob matching",
+			path:         "/v2/library/ubuntu/blobs/" + dgst.String(),
+			ifNoneMatch:  etag,
+			expectedCode: http.StatusNotModified,
+		},
+		{
+			name:         "blob not matching",
+			path:         "/v2/library/ubuntu/blobs/" + dgst.String(),
+			ifNoneMatch:  `"foo"`,
+			expectedCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path+"?ns=docker.io", nil)
+			req.Header.Set(MirroredHeaderKey, "true")
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			srv.Handler.ServeHTTP(rw, req)
+			require.Equal(t, tt.expectedCode, rw.Code)
+			require.Equal(t, etag, rw.Header().Get("ETag"))
+			if tt.expectedCode == http.StatusNotModified {
+				require.Empty(t, rw.Body.String())
+				return
+			}
+			require.Equal(t, "hello world", rw.Body.String())
+		})
+	}
+}
+
+func TestMirrorHandlerNotModified(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		//nolint:errcheck // ignore
+		w.Write([]byte("hello world"))
+	}))
+	defer svr.Close()
+
+	router := routing.NewMockRouter(map[string][]string{"key": {svr.URL}})
+	reg := NewRegistry(nil, router, "", 3, 5*time.Second, false)
+	rw := CreateTestResponseRecorder()
+	c, _ := gin.CreateTestContext(rw)
+	c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/key", nil)
+	c.Request.Header.Set("If-None-Match", `"foo"`)
+	reg.handleMirror(c, "key", oci.ReferenceTypeBlob)
+	// Headers without a body are written by the engine after the handler returns.
+	require.Equal(t, http.StatusNotModified, c.Writer.Status())
+	require.False(t, c.Writer.Written())
+}
+
+func TestChargeback(t *testing.T) {
+	ledger, err := chargeback.NewLedger(filepath.Join(t.TempDir(), "chargeback.json"), time.Hour, 10)
+	require.NoError(t, err)
+	reg := NewRegistry(oci.NewMockClient(nil), routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, WithCache(1024, 64), WithChargeback(ledger))
+	dgst := digest.FromString("hello world")
+	reg.cache.Add(dgst.String(), cache.Entry{Data: []byte("hello world")})
+	srv := reg.Server("", logr.Discard())
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/ubuntu/blobs/"+dgst.String()+"?ns=docker.io", nil)
+	req.Header.Set(MirroredHeaderKey, "true")
+	srv.Handler.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, "hello world", rw.Body.String())
+
+	records := ledger.Records(time.Time{}, time.Time{})
+	require.Len(t, records, 1)
+	require.Equal(t, "docker.io/library/ubuntu", records[0].Repository)
+	require.Equal(t, int64(11), records[0].Bytes)
+}
+
+func TestDiskPressure(t *testing.T) {
+	pressure := diskpressure.NewDetector()
+	reg := NewRegistry(oci.NewMockClient(nil), routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, WithDiskPressure(pressure))
+	srv := reg.Server("", logr.Discard())
+
+	for _, pressured := range []bool{true, false} {
+		pressure.Set("usage", pressured)
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/ubuntu/blobs/sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020?ns=docker.io", nil)
+		req.Header.Set(MirroredHeaderKey, "true")
+		srv.Handler.ServeHTTP(rw, req)
+		if pressured {
+			require.Equal(t, http.StatusServiceUnavailable, rw.Code)
+			require.Equal(t, "60", rw.Header().Get("Retry-After"))
+			continue
+		}
+		require.Equal(t, http.StatusOK, rw.Code)
+	}
+}
+
+type blobClient struct {
+	oci.Client
+	blobs map[digest.Digest][]byte
+}
+
+func (c *blobClient) GetBlobReader(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	b, ok := c.blobs[dgst]
+	if !ok {
+		return nil, fmt.Errorf("not found")
+	}
+	return nopReadSeekCloser{bytes.NewReader(b)}, nil
+}
+
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopReadSeekCloser) Close() error {
+	return nil
+}
+
+func TestEncryptedBlobPassthrough(t *testing.T) {
+	// Encrypted layer content starts with a gzip header to detect any attempt to decompress it.
+	b := append([]byte{0x1f, 0x8b, 0x08, 0x00}, []byte("encrypted layer content that is not valid gzip")...)
+	dgst := digest.FromBytes(b)
+	ociClient := &blobClient{Client: oci.NewMockClient(nil), blobs: map[digest.Digest][]byte{dgst: b}}
+
+	for _, opts := range [][]Option{
+		nil,
+		{WithBlobVerification()},
+		{WithCache(1024, 1024)},
+	} {
+		reg := NewRegistry(ociClient, routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false, opts...)
+		srv := reg.Server("", logr.Discard())
+
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/v2/foo/encrypted/blobs/"+dgst.String()+"?ns=ghcr.io", nil)
+		req.Header.Set(MirroredHeaderKey, "true")
+		req.Header.Set("Accept-Encoding", "gzip")
+		srv.Handler.ServeHTTP(rw, req)
+		require.Equal(t, http.StatusOK, rw.Code)
+		require.Equal(t, b, rw.Body.Bytes())
+		require.Equal(t, "application/octet-stream", rw.Header().Get("Content-Type"))
+		require.Empty(t, rw.Header().Get("Content-Encoding"))
+		require.Equal(t, dgst.String(), rw.Header().Get("Docker-Content-Digest"))
+
+		rw = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "http://example.com/v2/foo/encrypted/blobs/"+dgst.String()+"?ns=ghcr.io", nil)
+		req.Header.Set(MirroredHeaderKey, "true")
+		req.Header.Set("Range", "bytes=2-9")
+		srv.Handler.ServeHTTP(rw, req)
+		require.Equal(t, http.StatusPartialContent, rw.Code)
+		require.Equal(t, b[2:10], rw.Body.Bytes())
+	}
+}
+
+func TestRepositoryName(t *testing.T) {
+	require.Equal(t, "docker.io/library/ubuntu", repositoryName("docker.io", "/v2/library/ubuntu/manifests/latest"))
+	require.Equal(t, "library/ubuntu", repositoryName("", "/v2/library/ubuntu/manifests/latest"))
+	require.Equal(t, "docker.io", repositoryName("docker.io", "/v2/"))
+}
+
+func TestIsExternalRequest(t *testing.T) {
+	cidrs, err := ParseCIDRs([]string{"10.0.0.0/24", "192.168.1.10"})
+	require.NoError(t, err)
+	tests := []struct {
+		name       string
+		opts       []Option
+		host       string
+		remoteAddr string
+		expected   bool
+	}{
+		{
+			name:       "host matches local address",
+			host:       "127.0.0.1:30020",
+			remoteAddr: "10.0.1.5:1234",
+			expected:   false,
+		},
+		{
+			name:       "host does not match local address",
+			host:       "10.0.0.5:30020",
+			remoteAddr: "127.0.0.1:1234",
+			expected:   true,
+		},
+		{
+			name:       "client in local cidrs",
+			opts:       []Option{WithLocalCIDRs(cidrs)},
+			host:       "10.0.0.5:30020",
+			remoteAddr: "10.0.0.7:1234",
+			expected:   false,
+		},
+		{
+			name:       "client is node ip",
+			opts:       []Option{WithLocalCIDRs(cidrs)},
+			host:       "10.0.0.5:30020",
+			remoteAddr: "192.168.1.10:1234",
+			expected:   false,
+		},
+		{
+			name:       "loopback client",
+			opts:       []Option{WithLocalCIDRs(cidrs)},
+			host:       "10.0.0.5:30020",
+			remoteAddr: "127.0.0.1:1234",
+			expected:   false,
+		},
+		{
+			name:       "client outside local cidrs",
+			opts:       []Option{WithLocalCIDRs(cidrs)},
+			host:       "127.0.0.1:30020",
+			remoteAddr: "10.0.1.5:1234",
+			expected:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := NewRegistry(nil, routing.NewMockRouter(map[string][]string{}), "127.0.0.1:30020", 3, 5*time.Second, false, tt.opts...)
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/v2/", nil)
+			c.Request.RemoteAddr = tt.remoteAddr
+			require.Equal(t, tt.expected, reg.isExternalRequest(c))
+		})
+	}
+}
+
+func TestParseCIDRsInvalid(t *testing.T) {
+	_, err := ParseCIDRs([]string{"10.0.0.0/33"})
+	require.Error(t, err)
+}
+
+func TestReadyWarmUp(t *testing.T) {
+	router := routing.NewMockRouter(map[string][]string{"foo": {"http://127.0.0.1:5000"}})
+	for _, tt := range []struct {
+		name         string
+		warmUp       *state.WarmUp
+		expectedCode int
+	}{
+		{
+			name:         "without warm up",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "warm up without ready ratio",
+			warmUp:       state.NewWarmUp(0, true),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "warm up not started",
+			warmUp:       state.NewWarmUp(0.5, false),
+			expectedCode: http.StatusServiceUnavailable,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := NewRegistry(oci.NewMockClient(nil), router, "", 3, 5*time.Second, false, WithWarmUp(tt.warmUp))
+			srv := reg.Server("", logr.Discard())
+			rw := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/healthz", nil))
+			require.Equal(t, tt.expectedCode, rw.Code)
+		})
+	}
+}
+
+func TestMetricsHandlerServedBytes(t *testing.T) {
+	reg := NewRegistry(nil, routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false)
+	engine := gin.New()
+	engine.GET("/v2/*params", reg.metricsHandler, func(c *gin.Context) {
+		c.Set("handler", "blob")
+		c.String(http.StatusOK, "hello world")
+	})
+	served := metrics.ServedBytesTotal.WithLabelValues("docker.io", "blob")
+	before := testutil.ToFloat64(served)
+	rw := httptest.NewRecorder()
+	engine.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/foo/blobs/sha256:abc?ns=docker.io", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, before+11, testutil.ToFloat64(served))
+}
@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+// KeyResolution contains the peers found for a key.
+type KeyResolution struct {
+	Key      string   `json:"key"`
+	Peers    []string `json:"peers"`
+	Duration string   `json:"duration"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// ResolveResult contains the peers found for the tag and digest of an image reference.
+type ResolveResult struct {
+	Ref              string         `json:"ref"`
+	Digest           string         `json:"digest,omitempty"`
+	TagResolution    *KeyResolution `json:"tagResolution,omitempty"`
+	DigestResolution *KeyResolution `json:"digestResolution,omitempty"`
+}
+
+// resolveHandler performs the same lookups as a mirrored request for an image reference without proxying any content.
+// Tags are resolved to a digest through the first peer that advertises the tag, a digest without an image name is resolved as is.
+func (r *Registry) resolveHandler(c *gin.Context) {
+	c.Set("handler", "resolve")
+	log := requestLogger(c)
+
+	ref := c.Query("ref")
+	var registry, repository, tag string
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		registry, repository, tag, dgst, err = oci.ParseReference(ref)
+	}
+	if err != nil {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if tag == "" && dgst == "" {
+		//nolint:errcheck // ignore
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("reference needs to contain a tag or digest"))
+		return
+	}
+	ctx := logr.NewContext(c, log)
+
+	_, resolveTimeout, _ := r.resolveSettings()
+	result := ResolveResult{Ref: ref}
+	if dgst == "" {
+		tagRef := fmt.Sprintf("%s/%s:%s", registry, repository, tag)
+		res := r.resolveKey(ctx, tagRef)
+		result.TagResolution = &res
+		for _, peer := range res.Peers {
+			dgst, err = resolveTagFromPeer(ctx, r.client, peer, registry, repository, tag, resolveTimeout)
+			if err != nil {
+				res.Error = err.Error()
+				continue
+			}
+			res.Error = ""
+			break
+		}
+		if dgst == "" {
+			c.JSON(http.StatusNotFound, result)
+			return
+		}
+	}
+	result.Digest = dgst.String()
+	res := r.resolveKey(ctx, dgst.String())
+	result.DigestResolution = &res
+	if len(res.Peers) == 0 {
+		c.JSON(http.StatusNotFound, result)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (r *Registry) resolveKey(ctx context.Context, key string) KeyResolution {
+	resolveRetries, resolveTimeout, _ := r.resolveSettings()
+	resolveCtx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	start := time.Now()
+	peers, err := routing.ResolveMirrors(resolveCtx, r.router, key, true, resolveRetries, resolveTimeout)
+	res := KeyResolution{
+		Key:      key,
+		Peers:    peers,
+		Duration: time.Since(start).String(),
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func resolveTagFromPeer(ctx context.Context, client *http.Client, peer, registry, repository, tag string, timeout time.Duration) (digest.Digest, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	u := &url.URL{
+		Path:     fmt.Sprintf("/v2/%s/manifests/%s", repository, tag),
+		RawQuery: url.Values{"ns": []string{registry}}.Encode(),
+	}
+	req, err := newMirrorRequest(ctx, http.MethodHead, peer, u)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("expected peer %s to respond with 200 OK but received: %s", peer, resp.Status)
+	}
+	dgst, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		return "", err
+	}
+	return dgst, nil
+}
+
+// Resolve looks up the peers of the image reference or digest through the registry running at the address.
+// The result is returned for references that are not found, in which case the peers found for the tag are included.
+func Resolve(ctx context.Context, addr, ref string) (ResolveResult, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return ResolveResult{}, err
+	}
+	u.Path = "/internal/resolve"
+	u.RawQuery = url.Values{"ref": []string{ref}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return ResolveResult{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ResolveResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return ResolveResult{}, fmt.Errorf("expected registry to respond with 200 OK but received: %s", resp.Status)
+	}
+	result := ResolveResult{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return ResolveResult{}, err
+	}
+	return result, nil
+}
@@ -0,0 +1,67 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestResolveHandler(t *testing.T) {
+	dgst := "sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020"
+	peerSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodHead, r.Method)
+		require.Equal(t, "/v2/library/ubuntu/manifests/22.04", r.URL.Path)
+		require.Equal(t, "docker.io", r.URL.Query().Get("ns"))
+		w.Header().Set("Docker-Content-Digest", dgst)
+	}))
+	defer peerSvr.Close()
+
+	router := routing.NewMockRouter(map[string][]string{
+		"docker.io/library/ubuntu:22.04": {peerSvr.URL},
+		dgst:                             {peerSvr.URL, "http://127.0.0.1:1"},
+	})
+	reg := NewRegistry(nil, router, "", 3, time.Second, false)
+	srv := reg.Server("", logr.Discard())
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/internal/resolve?ref=docker.io/library/ubuntu:22.04", nil)
+	srv.Handler.ServeHTTP(rw, req)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	result := ResolveResult{}
+	err := json.NewDecoder(resp.Body).Decode(&result)
+	require.NoError(t, err)
+	require.Equal(t, dgst, result.Digest)
+	require.Equal(t, []string{peerSvr.URL}, result.TagResolution.Peers)
+	require.Equal(t, []string{peerSvr.URL, "http://127.0.0.1:1"}, result.DigestResolution.Peers)
+}
+
+func TestResolve(t *testing.T) {
+	dgst := "sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020"
+	router := routing.NewMockRouter(map[string][]string{
+		dgst: {"http://127.0.0.1:1"},
+	})
+	reg := NewRegistry(nil, router, "", 3, time.Second, false)
+	srv := httptest.NewServer(reg.Server("", logr.Discard()).Handler)
+	defer srv.Close()
+
+	result, err := Resolve(context.Background(), srv.URL, dgst)
+	require.NoError(t, err)
+	require.Equal(t, dgst, result.Digest)
+	require.Nil(t, result.TagResolution)
+	require.Equal(t, []string{"http://127.0.0.1:1"}, result.DigestResolution.Peers)
+
+	result, err = Resolve(context.Background(), srv.URL, "docker.io/library/ubuntu:22.04")
+	require.NoError(t, err)
+	require.Empty(t, result.TagResolution.Peers)
+	require.Nil(t, result.DigestResolution)
+}
@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var rewritePathRegex = regexp.MustCompile(`^/v2/(.+)/((?:manifests|blobs|tags)/.*)$`)
+
+type rewriteRule struct {
+	prefix      string
+	replacement string
+}
+
+// RewritePolicy rewrites the registry and repository of requests so that images referenced by an old name are served from content stored with the new name.
+// Requests are rewritten before tags are resolved, which means that both the local store and peers are queried with the new name.
+type RewritePolicy struct {
+	rules []rewriteRule
+}
+
+// NewRewritePolicy creates a policy rewriting image names starting with any of the prefixes to the replacement.
+// Prefixes contain the registry and optionally a repository path, for example old.registry.corp/foo, and match full path components.
+func NewRewritePolicy(rewrites map[string]string) (*RewritePolicy, error) {
+	rules := []rewriteRule{}
+	for prefix, replacement := range rewrites {
+		prefix = strings.Trim(prefix, "/")
+		replacement = strings.Trim(replacement, "/")
+		if prefix == "" || replacement == "" {
+			return nil, fmt.Errorf("rewrite prefix and replacement cannot be empty")
+		}
+		rules = append(rules, rewriteRule{prefix: prefix, replacement: replacement})
+	}
+	// The longest prefix is matched first so that more specific rules take precedence.
+	sort.Slice(rules, func(i, j int) bool {
+		if len(rules[i].prefix) == len(rules[j].prefix) {
+			return rules[i].prefix < rules[j].prefix
+		}
+		return len(rules[i].prefix) > len(rules[j].prefix)
+	})
+	return &RewritePolicy{rules: rules}, nil
+}
+
+func (p *RewritePolicy) Evaluate(req *http.Request) error {
+	query := req.URL.Query()
+	registry := query.Get("ns")
+	if registry == "" {
+		return nil
+	}
+	comps := rewritePathRegex.FindStringSubmatch(req.URL.Path)
+	if len(comps) != 3 {
+		return nil
+	}
+	name, ok := p.rewrite(fmt.Sprintf("%s/%s", registry, comps[1]))
+	if !ok {
+		return nil
+	}
+	registry, repository, ok := strings.Cut(name, "/")
+	if !ok {
+		return fmt.Errorf("rewritten image name %s does not contain a repository", name)
+	}
+	query.Set("ns", registry)
+	req.URL.RawQuery = query.Encode()
+	req.URL.Path = fmt.Sprintf("/v2/%s/%s", repository, comps[2])
+	req.URL.RawPath = ""
+	return nil
+}
+
+func (p *RewritePolicy) rewrite(name string) (string, bool) {
+	for _, rule := range p.rules {
+		if name != rule.prefix && !strings.HasPrefix(name, rule.prefix+"/") {
+			continue
+		}
+		return rule.replacement + strings.TrimPrefix(name, rule.prefix), true
+	}
+	return "", false
+}
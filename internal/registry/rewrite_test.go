@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestRewritePolicy(t *testing.T) {
+	p, err := NewRewritePolicy(map[string]string{
+		"old.registry.corp":         "new.registry.corp",
+		"old.registry.corp/foo":     "new.registry.corp/bar",
+		"docker.io/library/ubuntu/": "/mirror.corp/ubuntu",
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		url          string
+		expectedNs   string
+		expectedPath string
+	}{
+		{
+			name:         "registry prefix",
+			url:          "http://localhost/v2/baz/manifests/v1?ns=old.registry.corp",
+			expectedNs:   "new.registry.corp",
+			expectedPath: "/v2/baz/manifests/v1",
+		},
+		{
+			name:         "longest prefix",
+			url:          "http://localhost/v2/foo/app/blobs/sha256:abc?ns=old.registry.corp",
+			expectedNs:   "new.registry.corp",
+			expectedPath: "/v2/bar/app/blobs/sha256:abc",
+		},
+		{
+			name:         "trimmed slashes",
+			url:          "http://localhost/v2/library/ubuntu/tags/list?ns=docker.io",
+			expectedNs:   "mirror.corp",
+			expectedPath: "/v2/ubuntu/tags/list",
+		},
+		{
+			name:         "partial path component",
+			url:          "http://localhost/v2/foobar/manifests/v1?ns=old.registry.corp",
+			expectedNs:   "new.registry.corp",
+			expectedPath: "/v2/foobar/manifests/v1",
+		},
+		{
+			name:         "no match",
+			url:          "http://localhost/v2/library/alpine/manifests/3.18?ns=docker.io",
+			expectedNs:   "docker.io",
+			expectedPath: "/v2/library/alpine/manifests/3.18",
+		},
+		{
+			name:         "no registry",
+			url:          "http://localhost/v2/foo/manifests/v1",
+			expectedNs:   "",
+			expectedPath: "/v2/foo/manifests/v1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			err := p.Evaluate(req)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedNs, req.URL.Query().Get("ns"))
+			require.Equal(t, tt.expectedPath, req.URL.Path)
+		})
+	}
+
+	_, err = NewRewritePolicy(map[string]string{"old.registry.corp": ""})
+	require.Error(t, err)
+}
+
+func TestRewritePolicyMirror(t *testing.T) {
+	dgst := "sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020"
+	nsCh := make(chan string, 1)
+	peerSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nsCh <- r.URL.Query().Get("ns")
+		w.Header().Set("Docker-Content-Digest", dgst)
+	}))
+	defer peerSvr.Close()
+	router := routing.NewMockRouter(map[string][]string{"new.registry.corp/foo:v1": {peerSvr.URL}})
+	p, err := NewRewritePolicy(map[string]string{"old.registry.corp": "new.registry.corp"})
+	require.NoError(t, err)
+	reg := NewRegistry(nil, router, "", 3, 5*time.Second, false, WithPolicies(p))
+	srv := reg.Server("", logr.Discard())
+
+	rw := CreateTestResponseRecorder()
+	req := httptest.NewRequest(http.MethodHead, "http://example.com/v2/foo/manifests/v1?ns=old.registry.corp", nil)
+	srv.Handler.ServeHTTP(rw, req)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "new.registry.corp", <-nsCh)
+}
@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Path prefixes served by the registry which extra routes cannot be registered under.
+var reservedPathPrefixes = []string{"/healthz", "/internal/", "/debug/", "/api/", "/v2/"}
+
+type extraRoute struct {
+	method   string
+	path     string
+	handlers []gin.HandlerFunc
+}
+
+// extraRoutes are the routes and middleware registered by embedders, they are added to the engine when the server is created.
+type extraRoutes struct {
+	middleware []gin.HandlerFunc
+	routes     []extraRoute
+	built      bool
+}
+
+// Use registers middleware that is run for every request to the registry server, after the built-in middleware.
+// Middleware has to be registered before Server is called.
+func (r *Registry) Use(middleware ...gin.HandlerFunc) error {
+	r.routesMx.Lock()
+	defer r.routesMx.Unlock()
+	if r.extraRoutes.built {
+		return fmt.Errorf("middleware has to be registered before the server is created")
+	}
+	r.extraRoutes.middleware = append(r.extraRoutes.middleware, middleware...)
+	return nil
+}
+
+// Handle registers an extra route served by the registry server, for example a custom health endpoint.
+// Routes have to be registered before Server is called and cannot overlap with the paths served by the registry.
+// It is safe to register routes concurrently.
+func (r *Registry) Handle(method, path string, handlers ...gin.HandlerFunc) error {
+	if len(handlers) == 0 {
+		return fmt.Errorf("route %s %s has to have at least one handler", method, path)
+	}
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("route path %s has to start with /", path)
+	}
+	if strings.ContainsAny(path, ":*") {
+		return fmt.Errorf("route path %s cannot contain parameters or wildcards", path)
+	}
+	for _, prefix := range reservedPathPrefixes {
+		if path == strings.TrimSuffix(prefix, "/") || strings.HasPrefix(path, prefix) {
+			return fmt.Errorf("route path %s is reserved by the registry", path)
+		}
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		return fmt.Errorf("route method %s is not supported", method)
+	}
+
+	r.routesMx.Lock()
+	defer r.routesMx.Unlock()
+	if r.extraRoutes.built {
+		return fmt.Errorf("routes have to be registered before the server is created")
+	}
+	for _, route := range r.extraRoutes.routes {
+		if route.method == method && route.path == path {
+			return fmt.Errorf("route %s %s is already registered", method, path)
+		}
+	}
+	r.extraRoutes.routes = append(r.extraRoutes.routes, extraRoute{method: method, path: path, handlers: handlers})
+	return nil
+}
+
+// buildExtraRoutes returns the registered middleware and routes, no more can be registered once they have been built.
+func (r *Registry) buildExtraRoutes() ([]gin.HandlerFunc, []extraRoute) {
+	r.routesMx.Lock()
+	defer r.routesMx.Unlock()
+	r.extraRoutes.built = true
+	return r.extraRoutes.middleware, r.extraRoutes.routes
+}
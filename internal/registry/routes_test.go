@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestExtraRoutes(t *testing.T) {
+	reg := NewRegistry(oci.NewMockClient(nil), routing.NewMockRouter(map[string][]string{}), "", 3, 5*time.Second, false)
+
+	err := reg.Use(func(c *gin.Context) {
+		c.Header("X-Company", "foo")
+	})
+	require.NoError(t, err)
+	wg := sync.WaitGroup{}
+	for _, p := range []string{"/company/health", "/company/ready"} {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			err := reg.Handle(http.MethodGet, p, func(c *gin.Context) {
+				c.String(http.StatusOK, p)
+			})
+			require.NoError(t, err)
+		}(p)
+	}
+	wg.Wait()
+
+	err = reg.Handle(http.MethodGet, "/company/health", func(c *gin.Context) {})
+	require.EqualError(t, err, "route GET /company/health is already registered")
+	err = reg.Handle(http.MethodGet, "/healthz", func(c *gin.Context) {})
+	require.EqualError(t, err, "route path /healthz is reserved by the registry")
+	err = reg.Handle(http.MethodGet, "/v2/foo", func(c *gin.Context) {})
+	require.EqualError(t, err, "route path /v2/foo is reserved by the registry")
+	err = reg.Handle(http.MethodGet, "/api/v1/exists", func(c *gin.Context) {})
+	require.EqualError(t, err, "route path /api/v1/exists is reserved by the registry")
+	err = reg.Handle(http.MethodGet, "/company/:id", func(c *gin.Context) {})
+	require.EqualError(t, err, "route path /company/:id cannot contain parameters or wildcards")
+	err = reg.Handle("FOO", "/company/foo", func(c *gin.Context) {})
+	require.EqualError(t, err, "route method FOO is not supported")
+	err = reg.Handle(http.MethodGet, "/company/foo")
+	require.EqualError(t, err, "route GET /company/foo has to have at least one handler")
+
+	srv := reg.Server("", logr.Discard())
+	err = reg.Handle(http.MethodGet, "/company/foo", func(c *gin.Context) {})
+	require.EqualError(t, err, "routes have to be registered before the server is created")
+	err = reg.Use(func(c *gin.Context) {})
+	require.EqualError(t, err, "middleware has to be registered before the server is created")
+
+	for _, p := range []string{"/company/health", "/company/ready"} {
+		rw := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com"+p, nil))
+		require.Equal(t, http.StatusOK, rw.Code)
+		require.Equal(t, p, rw.Body.String())
+		require.Equal(t, "foo", rw.Header().Get("X-Company"))
+	}
+	// Middleware is also run for the built-in routes.
+	rw := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/healthz", nil))
+	require.Equal(t, "foo", rw.Header().Get("X-Company"))
+}
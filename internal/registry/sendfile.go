@@ -0,0 +1,65 @@
+package registry
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sendfileWriter implements io.ReaderFrom by handing the reader to the connection writer of the server.
+// The connection writer uses sendfile when the reader is a file, which skips copying the content through user space.
+type sendfileWriter struct {
+	gin.ResponseWriter
+	written int64
+}
+
+func (w *sendfileWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.WriteHeaderNow()
+	rf, counters := unwrapReaderFrom(w.ResponseWriter)
+	if rf == nil {
+		// Hide the ReadFrom method to not end up calling it again.
+		return io.Copy(struct{ io.Writer }{w.ResponseWriter}, src)
+	}
+	n, err := rf.ReadFrom(src)
+	w.written += n
+	// Counting writers are bypassed when writing to the connection directly.
+	for _, cw := range counters {
+		cw.written += n
+	}
+	return n, err
+}
+
+// Size includes bytes written directly to the connection which are not seen by the wrapped writer.
+func (w *sendfileWriter) Size() int {
+	size := w.ResponseWriter.Size()
+	if w.written == 0 {
+		return size
+	}
+	if size < 0 {
+		size = 0
+	}
+	return size + int(w.written)
+}
+
+// unwrapReaderFrom returns the innermost response writer if it implements io.ReaderFrom together with the counting writers wrapping it.
+func unwrapReaderFrom(w http.ResponseWriter) (io.ReaderFrom, []*countingWriter) {
+	counters := []*countingWriter{}
+	for {
+		switch t := w.(type) {
+		case *countingWriter:
+			counters = append(counters, t)
+			w = t.ResponseWriter
+			continue
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+			continue
+		}
+		break
+	}
+	rf, ok := w.(io.ReaderFrom)
+	if !ok {
+		return nil, nil
+	}
+	return rf, counters
+}
@@ -0,0 +1,64 @@
+package registry
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendfileWriter(t *testing.T) {
+	content := []byte("hello world")
+	p := filepath.Join(t.TempDir(), "blob")
+	err := os.WriteFile(p, content, 0644)
+	require.NoError(t, err)
+
+	var cw *countingWriter
+	size := 0
+	engine := gin.New()
+	engine.GET("/", func(c *gin.Context) {
+		cw = &countingWriter{ResponseWriter: c.Writer}
+		c.Writer = &sendfileWriter{ResponseWriter: cw}
+		f, err := os.Open(p)
+		require.NoError(t, err)
+		defer f.Close()
+		http.ServeContent(c.Writer, c.Request, "", time.Time{}, f)
+		size = c.Writer.Size()
+	})
+	srv := httptest.NewServer(engine)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, content, b)
+	require.Equal(t, len(content), size)
+	require.Equal(t, int64(len(content)), cw.written)
+}
+
+func TestSendfileWriterFallback(t *testing.T) {
+	content := []byte("hello world")
+	p := filepath.Join(t.TempDir(), "blob")
+	err := os.WriteFile(p, content, 0644)
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rw)
+	c.Request = httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	c.Writer = &sendfileWriter{ResponseWriter: c.Writer}
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	defer f.Close()
+	http.ServeContent(c.Writer, c.Request, "", time.Time{}, f)
+	require.Equal(t, content, rw.Body.Bytes())
+	require.Equal(t, len(content), c.Writer.Size())
+}
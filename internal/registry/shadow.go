@@ -0,0 +1,198 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// Max amount of origin requests in flight, samples are dropped when reached so that shadowing never builds up.
+	maxShadowRequests = 8
+	// Max duration of an origin request including fetching an anonymous token.
+	shadowTimeout = 10 * time.Second
+)
+
+var shadowComparisonsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "spegel_shadow_comparisons_total",
+		Help: "Total number of sampled mirror hits compared with the origin registry.",
+	},
+	[]string{"registry", "result"},
+)
+
+var bearerParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+type shadowSample struct {
+	registry string
+	path     string
+	accept   []string
+	digest   string
+	size     int64
+}
+
+type shadowSampler struct {
+	client *http.Client
+	rate   float64
+	sem    chan interface{}
+}
+
+// WithShadowSampling requests the origin registry for the fraction of mirror hits and compares the digest and size with the mirrored response.
+// Mismatches are exported as metrics to catch stale tags or corrupted content, the mirrored response is never affected.
+func WithShadowSampling(rate float64) Option {
+	return func(r *Registry) {
+		r.shadow = &shadowSampler{
+			client: &http.Client{},
+			rate:   rate,
+			sem:    make(chan interface{}, maxShadowRequests),
+		}
+	}
+}
+
+// sample compares the mirrored response with the origin in the background if the request is sampled.
+func (s *shadowSampler) sample(log logr.Logger, req *http.Request, header http.Header, size int64) {
+	//nolint:gosec // sampling does not have to be secure
+	if s == nil || rand.Float64() >= s.rate {
+		return
+	}
+	sample := shadowSample{
+		registry: req.URL.Query().Get("ns"),
+		path:     req.URL.Path,
+		accept:   req.Header.Values("Accept"),
+		digest:   header.Get("Docker-Content-Digest"),
+		size:     size,
+	}
+	if sample.registry == "" {
+		return
+	}
+	select {
+	case s.sem <- nil:
+	default:
+		shadowComparisonsTotal.WithLabelValues(sample.registry, "dropped").Inc()
+		return
+	}
+	go func() {
+		defer func() { <-s.sem }()
+		ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+		defer cancel()
+		result, err := s.compare(ctx, sample)
+		shadowComparisonsTotal.WithLabelValues(sample.registry, result).Inc()
+		if err != nil {
+			log.Error(err, "could not compare mirrored response with origin", "registry", sample.registry, "path", sample.path)
+			return
+		}
+		if result != "match" {
+			log.Info("mirrored response does not match origin", "registry", sample.registry, "path", sample.path, "result", result)
+		}
+	}()
+}
+
+// compare requests the headers of the sample from the origin and returns the result of the comparison.
+// Digests and sizes are only compared when both responses contain them.
+func (s *shadowSampler) compare(ctx context.Context, sample shadowSample) (string, error) {
+	host := sample.registry
+	// Need a special case for Docker Hub as docker.io is just an alias.
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	u := url.URL{Scheme: "https", Host: host, Path: sample.path}
+	resp, err := s.head(ctx, u.String(), sample.accept, "")
+	if err != nil {
+		return "error", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := s.anonymousToken(ctx, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "error", err
+		}
+		resp, err = s.head(ctx, u.String(), sample.accept, token)
+		if err != nil {
+			return "error", err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "error", fmt.Errorf("expected origin to respond with 200 OK but received: %s", resp.Status)
+	}
+	if originDigest := resp.Header.Get("Docker-Content-Digest"); sample.digest != "" && originDigest != "" && sample.digest != originDigest {
+		return "digest_mismatch", nil
+	}
+	if sample.size >= 0 && resp.ContentLength >= 0 && sample.size != resp.ContentLength {
+		return "size_mismatch", nil
+	}
+	return "match", nil
+}
+
+func (s *shadowSampler) head(ctx context.Context, u string, accept []string, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range accept {
+		req.Header.Add("Accept", v)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// anonymousToken fetches a pull token without credentials from the realm of the bearer challenge, which public images on most registries accept.
+func (s *shadowSampler) anonymousToken(ctx context.Context, challenge string) (string, error) {
+	params := map[string]string{}
+	for _, match := range bearerParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("origin responded with unsupported authentication challenge: %s", challenge)
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for _, k := range []string{"service", "scope"} {
+		if v, ok := params[k]; ok {
+			query.Set(k, v)
+		}
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("expected token realm to respond with 200 OK but received: %s", resp.Status)
+	}
+	tokenResp := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if err != nil {
+		return "", err
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	return tokenResp.AccessToken, nil
+}
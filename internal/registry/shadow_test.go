@@ -0,0 +1,104 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShadowCompare(t *testing.T) {
+	dgst := "sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020"
+	var realm string
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			require.Equal(t, "registry.example.com", r.URL.Query().Get("service"))
+			require.Equal(t, "repository:library/ubuntu:pull", r.URL.Query().Get("scope"))
+			//nolint:errcheck // ignore
+			w.Write([]byte(`{"token": "foo"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer foo" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s",service="registry.example.com",scope="repository:library/ubuntu:pull"`, realm))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		require.Equal(t, http.MethodHead, r.Method)
+		require.Equal(t, "application/vnd.oci.image.index.v1+json", r.Header.Get("Accept"))
+		switch r.URL.Path {
+		case "/v2/library/ubuntu/manifests/22.04":
+			w.Header().Set("Docker-Content-Digest", dgst)
+			w.Header().Set("Content-Length", "100")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer origin.Close()
+	realm = origin.URL + "/token"
+	u, err := url.Parse(origin.URL)
+	require.NoError(t, err)
+
+	s := &shadowSampler{client: origin.Client()}
+	tests := []struct {
+		name     string
+		path     string
+		digest   string
+		size     int64
+		expected string
+	}{
+		{
+			name:     "match",
+			path:     "/v2/library/ubuntu/manifests/22.04",
+			digest:   dgst,
+			size:     100,
+			expected: "match",
+		},
+		{
+			name:     "stale tag",
+			path:     "/v2/library/ubuntu/manifests/22.04",
+			digest:   "sha256:c5c5fda71656f28e49ac9c5416b3643eaa6a108a8093151d6d1afc39463be786",
+			size:     100,
+			expected: "digest_mismatch",
+		},
+		{
+			name:     "size mismatch",
+			path:     "/v2/library/ubuntu/manifests/22.04",
+			digest:   dgst,
+			size:     99,
+			expected: "size_mismatch",
+		},
+		{
+			name:     "unknown size",
+			path:     "/v2/library/ubuntu/manifests/22.04",
+			size:     -1,
+			expected: "match",
+		},
+		{
+			name:     "missing at origin",
+			path:     "/v2/library/ubuntu/manifests/20.04",
+			expected: "error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sample := shadowSample{
+				registry: u.Host,
+				path:     tt.path,
+				accept:   []string{"application/vnd.oci.image.index.v1+json"},
+				digest:   tt.digest,
+				size:     tt.size,
+			}
+			result, err := s.compare(context.Background(), sample)
+			if tt.expected == "error" {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.expected, result)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+// StatsGatherer gathers the stats of the node and the peers it is connected to.
+type StatsGatherer interface {
+	GatherStats(ctx context.Context) []routing.Stats
+}
+
+type clusterStats struct {
+	Nodes          int             `json:"nodes"`
+	Unreachable    int             `json:"unreachable"`
+	Versions       map[string]int  `json:"versions"`
+	AdvertisedKeys float64         `json:"advertisedKeys"`
+	MirrorRequests float64         `json:"mirrorRequests"`
+	MirrorHits     float64         `json:"mirrorHits"`
+	HitRate        float64         `json:"hitRate"`
+	Peers          []routing.Stats `json:"peers"`
+}
+
+// WithClusterStats enables the debug endpoint aggregating the stats of the node and its connected peers, it requires the debug endpoints to be enabled.
+func WithClusterStats(gatherer StatsGatherer) Option {
+	return func(r *Registry) {
+		r.statsGatherer = gatherer
+	}
+}
+
+// clusterStatsHandler gathers the stats of the node and the peers it is connected to over the router network and returns the aggregate,
+// so that the health of the cluster can be assessed without scraping every node. Nodes that the node is not connected to are not included,
+// which in large clusters means that the result covers part of the cluster.
+func (r *Registry) clusterStatsHandler(c *gin.Context) {
+	c.Set("handler", "debug_stats")
+	c.JSON(http.StatusOK, aggregateStats(r.statsGatherer.GatherStats(c)))
+}
+
+func aggregateStats(peers []routing.Stats) clusterStats {
+	result := clusterStats{
+		Versions: map[string]int{},
+		Peers:    peers,
+	}
+	for _, stats := range peers {
+		if stats.Error != "" {
+			result.Unreachable++
+			continue
+		}
+		result.Nodes++
+		result.Versions[stats.Version]++
+		result.AdvertisedKeys += stats.AdvertisedKeys
+		result.MirrorRequests += stats.MirrorRequests
+		result.MirrorHits += stats.MirrorHits
+	}
+	if result.MirrorRequests > 0 {
+		result.HitRate = result.MirrorHits / result.MirrorRequests
+	}
+	return result
+}
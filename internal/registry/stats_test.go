@@ -0,0 +1,31 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestAggregateStats(t *testing.T) {
+	peers := []routing.Stats{
+		{Peer: "a", Version: "v0.0.10", AdvertisedKeys: 10, MirrorRequests: 6, MirrorHits: 3},
+		{Peer: "b", Version: "v0.0.10", AdvertisedKeys: 20, MirrorRequests: 2, MirrorHits: 2},
+		{Peer: "c", Version: "v0.0.9", AdvertisedKeys: 5},
+		{Peer: "d", Error: "could not request stats"},
+	}
+	result := aggregateStats(peers)
+	require.Equal(t, 3, result.Nodes)
+	require.Equal(t, 1, result.Unreachable)
+	require.Equal(t, map[string]int{"v0.0.10": 2, "v0.0.9": 1}, result.Versions)
+	require.Equal(t, 35.0, result.AdvertisedKeys)
+	require.Equal(t, 8.0, result.MirrorRequests)
+	require.Equal(t, 5.0, result.MirrorHits)
+	require.Equal(t, 0.625, result.HitRate)
+	require.Equal(t, peers, result.Peers)
+
+	result = aggregateStats(nil)
+	require.Equal(t, 0, result.Nodes)
+	require.Equal(t, 0.0, result.HitRate)
+}
@@ -0,0 +1,19 @@
+package registry
+
+import (
+	"context"
+	"net"
+)
+
+// StreamDialer opens connections to peers over a transport other than the network, like libp2p streams.
+type StreamDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// WithStreamTransport mirrors requests to peers with connections opened by the dialer instead of dialing the network.
+// The router has to resolve mirrors to addresses that the dialer understands.
+func WithStreamTransport(dialer StreamDialer) Option {
+	return func(r *Registry) {
+		r.streamDialer = dialer
+	}
+}
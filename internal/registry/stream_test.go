@@ -0,0 +1,50 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+type testStreamDialer struct {
+	addr  string
+	addrs []string
+}
+
+func (d *testStreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.addrs = append(d.addrs, addr)
+	return (&net.Dialer{}).DialContext(ctx, network, d.addr)
+}
+
+func TestMirrorHandlerStreamTransport(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//nolint:errcheck // ignore
+		w.Write([]byte("hello world"))
+	}))
+	defer svr.Close()
+
+	dialer := &testStreamDialer{addr: svr.Listener.Addr().String()}
+	router := routing.NewMockRouter(map[string][]string{"key": {"http://bafzaajaiaejcaxykhmgsz2mhscluhm6bkliibattya2l2lld7drdsojfgxbbzidg"}})
+	reg := NewRegistry(nil, router, "", 3, 5*time.Second, false, WithStreamTransport(dialer))
+	rw := CreateTestResponseRecorder()
+	c, _ := gin.CreateTestContext(rw)
+	c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/key", nil)
+	reg.handleMirror(c, "key", oci.ReferenceTypeBlob)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hello world", string(b))
+	require.Equal(t, []string{"bafzaajaiaejcaxykhmgsz2mhscluhm6bkliibattya2l2lld7drdsojfgxbbzidg:80"}, dialer.addrs)
+}
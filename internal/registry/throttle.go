@@ -0,0 +1,146 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+var throttleLimitBytes = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "spegel_throttle_limit_bytes_per_second",
+	Help: "Max bytes per second transferred by blobs served and mirrored responses, zero when throttling is disabled.",
+})
+
+var throttleWaitingTransfers = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "spegel_throttle_waiting_transfers",
+		Help: "Number of transfers currently waiting for the throttle.",
+	},
+	[]string{"source"},
+)
+
+var throttleWaitSecondsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "spegel_throttle_wait_seconds_total",
+		Help: "Total time spent by transfers waiting for the throttle.",
+	},
+	[]string{"source"},
+)
+
+// Max bytes transferred at once, smaller bursts keep concurrent transfers interleaved while throttled.
+const maxThrottleBurst = 256 << 10
+
+// throttle is a token bucket shared by all transfers, so that the bandwidth of the node is limited rather than the bandwidth per transfer.
+type throttle struct {
+	limiter *rate.Limiter
+	burst   int
+}
+
+func newThrottle(bytesPerSecond int64) *throttle {
+	burst := maxThrottleBurst
+	if bytesPerSecond < int64(burst) {
+		burst = int(bytesPerSecond)
+	}
+	throttleLimitBytes.Set(float64(bytesPerSecond))
+	return &throttle{
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+		burst:   burst,
+	}
+}
+
+// wait blocks until n bytes can be transferred, n must not be larger than the burst.
+func (t *throttle) wait(ctx context.Context, source string, n int) error {
+	res := t.limiter.ReserveN(time.Now(), n)
+	delay := res.Delay()
+	if delay == 0 {
+		return nil
+	}
+	throttleWaitingTransfers.WithLabelValues(source).Inc()
+	defer throttleWaitingTransfers.WithLabelValues(source).Dec()
+	start := time.Now()
+	defer func() {
+		throttleWaitSecondsTotal.WithLabelValues(source).Add(time.Since(start).Seconds())
+	}()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		res.Cancel()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledWriter throttles writes to the response. Writing to the connection directly with sendfile is
+// skipped as the writer does not unwrap, which means that throttled content is always copied through user space.
+type throttledWriter struct {
+	gin.ResponseWriter
+	ctx      context.Context
+	throttle *throttle
+	source   string
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > w.throttle.burst {
+			n = w.throttle.burst
+		}
+		err := w.throttle.wait(w.ctx, w.source, n)
+		if err != nil {
+			return written, err
+		}
+		m, err := w.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// throttledTransport throttles the response bodies of all requests to mirrors, so that proxied, chunked and resumed transfers share the throttle.
+type throttledTransport struct {
+	http.RoundTripper
+	throttle *throttle
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &throttledReadCloser{ReadCloser: resp.Body, ctx: req.Context(), throttle: t.throttle, source: "mirror"}
+	return resp, nil
+}
+
+// throttledReadCloser throttles reads of a response body after they have been read.
+type throttledReadCloser struct {
+	io.ReadCloser
+	ctx      context.Context
+	throttle *throttle
+	source   string
+}
+
+func (r *throttledReadCloser) Read(p []byte) (int, error) {
+	if len(p) > r.throttle.burst {
+		p = p[:r.throttle.burst]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		waitErr := r.throttle.wait(r.ctx, r.source, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
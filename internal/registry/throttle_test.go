@@ -0,0 +1,71 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottledWriter(t *testing.T) {
+	th := newThrottle(1000)
+	require.Equal(t, 1000, th.burst)
+
+	rw := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rw)
+	w := &throttledWriter{ResponseWriter: c.Writer, ctx: context.Background(), throttle: th, source: "blob"}
+	start := time.Now()
+	n, err := w.Write(make([]byte, 1500))
+	require.NoError(t, err)
+	require.Equal(t, 1500, n)
+	require.Equal(t, 1500, rw.Body.Len())
+	// The first burst is written directly and the remaining bytes have to wait.
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestThrottledReadCloser(t *testing.T) {
+	th := newThrottle(1000)
+
+	r := &throttledReadCloser{ReadCloser: io.NopCloser(bytes.NewReader(make([]byte, 1500))), ctx: context.Background(), throttle: th, source: "mirror"}
+	start := time.Now()
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Len(t, b, 1500)
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestThrottledTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//nolint:errcheck // ignore
+		w.Write(make([]byte, 1500))
+	}))
+	defer srv.Close()
+
+	// Chunked and resumed transfers use the client of the registry instead of the proxy.
+	reg := NewRegistry(nil, nil, "", 3, time.Second, false, WithThrottle(1000))
+	start := time.Now()
+	resp, err := reg.client.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Len(t, b, 1500)
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestThrottleCanceled(t *testing.T) {
+	th := newThrottle(1000)
+	err := th.wait(context.Background(), "blob", 1000)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = th.wait(ctx, "blob", 1000)
+	require.ErrorIs(t, err, context.Canceled)
+}
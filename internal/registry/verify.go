@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var blobVerificationFailuresTotal = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "spegel_blob_verification_failures_total",
+		Help: "Total number of served blobs that did not match the requested digest.",
+	},
+)
+
+// verifyingReadSeeker hashes the content while it is read from the start and fails the read returning the
+// last bytes if the content does not match the digest, which stops a corrupted blob from being completely served.
+// Verification is skipped when reading does not start at the beginning, for example when serving a range.
+type verifyingReadSeeker struct {
+	rs        io.ReadSeeker
+	dgst      digest.Digest
+	digester  digest.Digester
+	size      int64
+	offset    int64
+	verifying bool
+}
+
+func newVerifyingReadSeeker(rs io.ReadSeeker, dgst digest.Digest) (*verifyingReadSeeker, error) {
+	if !dgst.Algorithm().Available() {
+		return nil, fmt.Errorf("digest algorithm %s is not available", dgst.Algorithm())
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rs.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReadSeeker{
+		rs:        rs,
+		dgst:      dgst,
+		digester:  dgst.Algorithm().Digester(),
+		size:      size,
+		verifying: true,
+	}, nil
+}
+
+func (v *verifyingReadSeeker) Read(p []byte) (int, error) {
+	n, err := v.rs.Read(p)
+	if !v.verifying {
+		return n, err
+	}
+	v.digester.Hash().Write(p[:n])
+	v.offset += int64(n)
+	if v.offset == v.size && v.digester.Digest() != v.dgst {
+		v.verifying = false
+		return 0, fmt.Errorf("blob content does not match digest %s", v.dgst)
+	}
+	return n, err
+}
+
+func (v *verifyingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	n, err := v.rs.Seek(offset, whence)
+	if err != nil {
+		return n, err
+	}
+	// Seeking to the end is done to find the size before serving, only reads need to start at the beginning.
+	if n == 0 {
+		v.digester = v.dgst.Algorithm().Digester()
+		v.offset = 0
+		v.verifying = true
+		return n, nil
+	}
+	if n != v.size {
+		v.verifying = false
+	}
+	return n, nil
+}
+
+// failed returns true if the full content was read and did not match the digest.
+func (v *verifyingReadSeeker) failed() bool {
+	return v.offset == v.size && !v.verifying
+}
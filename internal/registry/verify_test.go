@@ -0,0 +1,84 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xenitab/spegel/internal/oci"
+	"github.com/xenitab/spegel/internal/routing"
+)
+
+func TestVerifyingReadSeeker(t *testing.T) {
+	content := []byte("hello world")
+
+	vrs, err := newVerifyingReadSeeker(bytes.NewReader(content), digest.FromBytes(content))
+	require.NoError(t, err)
+	b, err := io.ReadAll(vrs)
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+	require.False(t, vrs.failed())
+
+	vrs, err = newVerifyingReadSeeker(bytes.NewReader(content), digest.FromString("foo"))
+	require.NoError(t, err)
+	b, err = io.ReadAll(vrs)
+	require.Error(t, err)
+	require.Empty(t, b)
+	require.True(t, vrs.failed())
+
+	// Reads that do not start at the beginning are not verified.
+	vrs, err = newVerifyingReadSeeker(bytes.NewReader(content), digest.FromString("foo"))
+	require.NoError(t, err)
+	_, err = vrs.Seek(6, io.SeekStart)
+	require.NoError(t, err)
+	b, err = io.ReadAll(vrs)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(b))
+	require.False(t, vrs.failed())
+}
+
+type blobReaderClient struct {
+	oci.Client
+	content []byte
+}
+
+func (c *blobReaderClient) GetBlobReader(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	return &readSeekCloser{ReadSeeker: bytes.NewReader(c.content), Closer: io.NopCloser(nil)}, nil
+}
+
+type readSeekCloser struct {
+	io.ReadSeeker
+	io.Closer
+}
+
+func TestBlobHandlerVerification(t *testing.T) {
+	for _, cacheEnabled := range []bool{false, true} {
+		dgst := digest.FromString("hello world")
+		router := routing.NewMockRouter(map[string][]string{dgst.String(): {"localhost"}})
+		opts := []Option{WithBlobVerification()}
+		if cacheEnabled {
+			opts = append(opts, WithCache(1024, 64))
+		}
+		reg := NewRegistry(&blobReaderClient{content: []byte("hello wordl")}, router, "", 3, 5*time.Second, false, opts...)
+
+		rw := CreateTestResponseRecorder()
+		c, _ := gin.CreateTestContext(rw)
+		c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/v2/foo/blobs/"+dgst.String(), nil)
+		reg.handleBlob(c, dgst)
+		resp := rw.Result()
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NotEqual(t, "hello wordl", string(b))
+		_, ok := router.LookupKey(dgst.String())
+		require.False(t, ok)
+	}
+}
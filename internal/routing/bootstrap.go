@@ -2,12 +2,24 @@ package routing
 
 import (
 	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/go-logr/logr"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
@@ -90,3 +102,316 @@ func (k *KubernetesBootstrapper) GetAddress() (*peer.AddrInfo, error) {
 	}
 	return addrInfo, err
 }
+
+// DNSBootstrapper discovers peers by resolving a DNS name, which makes it possible
+// to bootstrap without access to the Kubernetes API. When a service is set SRV records
+// are used to find both host and port, otherwise A/AAAA records are used together with
+// the port that the local router listens on.
+// Peer IDs can not be discovered through DNS so returned addresses will not have an ID set, the router learns the ID through a handshake.
+type DNSBootstrapper struct {
+	resolver        dnsResolver
+	name            string
+	service         string
+	proto           string
+	refreshInterval time.Duration
+	initCh          chan interface{}
+	mx              sync.RWMutex
+	self            *peer.AddrInfo
+	addrs           []multiaddr.Multiaddr
+}
+
+// dnsResolver is the subset of net.Resolver used to discover peers.
+type dnsResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func NewDNSBootstrapper(name, service, proto string, refreshInterval time.Duration) Bootstrapper {
+	return &DNSBootstrapper{
+		resolver:        net.DefaultResolver,
+		name:            name,
+		service:         service,
+		proto:           proto,
+		refreshInterval: refreshInterval,
+		initCh:          make(chan interface{}),
+	}
+}
+
+func (d *DNSBootstrapper) Run(ctx context.Context, id string) error {
+	log := logr.FromContextOrDiscard(ctx).WithName("dns-bootstrap")
+
+	addr, err := multiaddr.NewMultiaddr(id)
+	if err != nil {
+		return err
+	}
+	self, err := peer.AddrInfoFromP2pAddr(addr)
+	if err != nil {
+		return err
+	}
+	port, err := addr.ValueForProtocol(multiaddr.P_TCP)
+	if err != nil {
+		return err
+	}
+	d.mx.Lock()
+	d.self = self
+	d.mx.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(d.refreshInterval)
+		defer ticker.Stop()
+		for {
+			addrs, err := d.lookup(ctx, port)
+			if err != nil {
+				log.Error(err, "could not resolve bootstrap peers", "name", d.name)
+			} else {
+				d.mx.Lock()
+				d.addrs = addrs
+				d.mx.Unlock()
+				// Close channel if not already closed
+				select {
+				case <-d.initCh:
+					break
+				default:
+					close(d.initCh)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (d *DNSBootstrapper) GetAddress() (*peer.AddrInfo, error) {
+	<-d.initCh
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+	return selectAddress(d.self, d.addrs), nil
+}
+
+func (d *DNSBootstrapper) lookup(ctx context.Context, port string) ([]multiaddr.Multiaddr, error) {
+	type target struct {
+		host string
+		port string
+	}
+	targets := []target{}
+	if d.service != "" {
+		_, srvs, err := d.resolver.LookupSRV(ctx, d.service, d.proto, d.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			targets = append(targets, target{host: srv.Target, port: strconv.FormatUint(uint64(srv.Port), 10)})
+		}
+	} else {
+		targets = append(targets, target{host: d.name, port: port})
+	}
+
+	addrs := []multiaddr.Multiaddr{}
+	for _, t := range targets {
+		ips, err := d.resolver.LookupIPAddr(ctx, t.host)
+		if err != nil {
+			return nil, err
+		}
+		p, err := strconv.Atoi(t.port)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addr, err := manet.FromNetAddr(&net.TCPAddr{IP: ip.IP, Port: p})
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", d.name)
+	}
+	return addrs, nil
+}
+
+// EndpointSliceBootstrapper discovers peers from the EndpointSlices of a Service selecting the Spegel Pods.
+// The peer set is kept up to date by an informer so that new peers are used without restarting.
+// Not ready endpoints are included as Pods only become ready after they have bootstrapped.
+type EndpointSliceBootstrapper struct {
+	cs          kubernetes.Interface
+	namespace   string
+	serviceName string
+	changedCh   chan interface{}
+	mx          sync.RWMutex
+	self        *peer.AddrInfo
+	addrs       []multiaddr.Multiaddr
+}
+
+func NewEndpointSliceBootstrapper(cs kubernetes.Interface, namespace, serviceName string) Bootstrapper {
+	return &EndpointSliceBootstrapper{
+		cs:          cs,
+		namespace:   namespace,
+		serviceName: serviceName,
+		changedCh:   make(chan interface{}, 1),
+	}
+}
+
+func (e *EndpointSliceBootstrapper) Run(ctx context.Context, id string) error {
+	log := logr.FromContextOrDiscard(ctx).WithName("endpointslice-bootstrap")
+
+	addr, err := multiaddr.NewMultiaddr(id)
+	if err != nil {
+		return err
+	}
+	self, err := peer.AddrInfoFromP2pAddr(addr)
+	if err != nil {
+		return err
+	}
+	port, err := addr.ValueForProtocol(multiaddr.P_TCP)
+	if err != nil {
+		return err
+	}
+	e.mx.Lock()
+	e.self = self
+	e.mx.Unlock()
+
+	factory := informers.NewSharedInformerFactoryWithOptions(e.cs, 0, informers.WithNamespace(e.namespace), informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+		opts.LabelSelector = fmt.Sprintf("%s=%s", discoveryv1.LabelServiceName, e.serviceName)
+	}))
+	informer := factory.Discovery().V1().EndpointSlices()
+	update := func() {
+		slices, err := informer.Lister().EndpointSlices(e.namespace).List(labels.Everything())
+		if err != nil {
+			log.Error(err, "could not list endpoint slices")
+			return
+		}
+		addrs, err := endpointSliceAddrs(slices, port)
+		if err != nil {
+			log.Error(err, "could not get addresses from endpoint slices")
+			return
+		}
+		e.setAddrs(addrs)
+	}
+	_, err = informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { update() },
+		UpdateFunc: func(oldObj, newObj interface{}) { update() },
+		DeleteFunc: func(obj interface{}) { update() },
+	})
+	if err != nil {
+		return err
+	}
+	factory.Start(ctx.Done())
+	// Addresses are read once the cache has synced so that existing peers are known when bootstrapping the first time.
+	for typ, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			return fmt.Errorf("could not sync %s informer cache", typ)
+		}
+	}
+	update()
+	return nil
+}
+
+// GetAddress returns an error while no peers have been discovered, as the EndpointSlices may be empty until the first Pod is scheduled.
+// Discovering peers later signals a change so that the router bootstraps again.
+func (e *EndpointSliceBootstrapper) GetAddress() (*peer.AddrInfo, error) {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	if len(e.addrs) == 0 {
+		return nil, fmt.Errorf("no peers found in endpoint slices of service %s", e.serviceName)
+	}
+	return selectAddress(e.self, e.addrs), nil
+}
+
+// Changed returns a channel that receives a value every time the peer set changes.
+func (e *EndpointSliceBootstrapper) Changed() <-chan interface{} {
+	return e.changedCh
+}
+
+func (e *EndpointSliceBootstrapper) setAddrs(addrs []multiaddr.Multiaddr) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	if len(addrs) == 0 || equalAddrs(e.addrs, addrs) {
+		return
+	}
+	e.addrs = addrs
+	select {
+	case e.changedCh <- nil:
+	default:
+	}
+}
+
+func endpointSliceAddrs(slices []*discoveryv1.EndpointSlice, port string) ([]multiaddr.Multiaddr, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []multiaddr.Multiaddr{}
+	for _, slice := range slices {
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 && slice.AddressType != discoveryv1.AddressTypeIPv6 {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Terminating != nil && *endpoint.Conditions.Terminating {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				ip := net.ParseIP(address)
+				if ip == nil {
+					continue
+				}
+				addr, err := manet.FromNetAddr(&net.TCPAddr{IP: ip, Port: p})
+				if err != nil {
+					return nil, err
+				}
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].String() < addrs[j].String()
+	})
+	return addrs, nil
+}
+
+func equalAddrs(a, b []multiaddr.Multiaddr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectAddress returns a random address that is not self, self is returned if it is the only address.
+// Addresses do not have an ID set as it is not known.
+func selectAddress(self *peer.AddrInfo, addrs []multiaddr.Multiaddr) *peer.AddrInfo {
+	candidates := []multiaddr.Multiaddr{}
+	for _, addr := range addrs {
+		if isSelfAddr(self, addr) {
+			continue
+		}
+		candidates = append(candidates, addr)
+	}
+	// Only finding self means that this is the only instance.
+	if len(candidates) == 0 {
+		return self
+	}
+	//nolint:gosec // weak random is fine for peer selection
+	addr := candidates[rand.Intn(len(candidates))]
+	return &peer.AddrInfo{Addrs: []multiaddr.Multiaddr{addr}}
+}
+
+func isSelfAddr(self *peer.AddrInfo, addr multiaddr.Multiaddr) bool {
+	if self == nil {
+		return false
+	}
+	for _, selfAddr := range self.Addrs {
+		if selfAddr.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
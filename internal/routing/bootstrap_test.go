@@ -0,0 +1,260 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type mockResolver struct {
+	srvs map[string][]*net.SRV
+	ips  map[string][]net.IPAddr
+}
+
+func (m *mockResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	key := fmt.Sprintf("_%s._%s.%s", service, proto, name)
+	srvs, ok := m.srvs[key]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: key, IsNotFound: true}
+	}
+	return key, srvs, nil
+}
+
+func (m *mockResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := m.ips[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func TestDNSBootstrapperLookup(t *testing.T) {
+	resolver := &mockResolver{
+		srvs: map[string][]*net.SRV{
+			"_p2p._tcp.spegel.spegel.svc.cluster.local": {
+				{Target: "a.spegel.spegel.svc.cluster.local", Port: 5001},
+				{Target: "b.spegel.spegel.svc.cluster.local", Port: 5002},
+			},
+		},
+		ips: map[string][]net.IPAddr{
+			"spegel.spegel.svc.cluster.local":   {{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("fd00::2")}},
+			"a.spegel.spegel.svc.cluster.local": {{IP: net.ParseIP("10.0.0.1")}},
+			"b.spegel.spegel.svc.cluster.local": {{IP: net.ParseIP("10.0.0.2")}},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		service       string
+		dnsName       string
+		expectedAddrs []string
+		expectedErr   string
+	}{
+		{
+			name:          "address records use local port",
+			dnsName:       "spegel.spegel.svc.cluster.local",
+			expectedAddrs: []string{"/ip4/10.0.0.1/tcp/5001", "/ip6/fd00::2/tcp/5001"},
+		},
+		{
+			name:          "service records set port",
+			service:       "p2p",
+			dnsName:       "spegel.spegel.svc.cluster.local",
+			expectedAddrs: []string{"/ip4/10.0.0.1/tcp/5001", "/ip4/10.0.0.2/tcp/5002"},
+		},
+		{
+			name:        "missing name",
+			dnsName:     "missing.spegel.svc.cluster.local",
+			expectedErr: "lookup missing.spegel.svc.cluster.local: no such host",
+		},
+		{
+			name:        "missing service",
+			service:     "missing",
+			dnsName:     "spegel.spegel.svc.cluster.local",
+			expectedErr: "lookup _missing._tcp.spegel.spegel.svc.cluster.local: no such host",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DNSBootstrapper{
+				resolver: resolver,
+				name:     tt.dnsName,
+				service:  tt.service,
+				proto:    "tcp",
+			}
+			addrs, err := d.lookup(context.TODO(), "5001")
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			actual := []string{}
+			for _, addr := range addrs {
+				actual = append(actual, addr.String())
+			}
+			require.Equal(t, tt.expectedAddrs, actual)
+		})
+	}
+}
+
+func TestDNSBootstrapperRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver := &mockResolver{
+		ips: map[string][]net.IPAddr{
+			"spegel.spegel.svc.cluster.local": {{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")}},
+		},
+	}
+	d := NewDNSBootstrapper("spegel.spegel.svc.cluster.local", "", "", time.Minute).(*DNSBootstrapper)
+	d.resolver = resolver
+	err := d.Run(ctx, "/ip4/10.0.0.1/tcp/5001/p2p/12D3KooWHAHyxFTsGgXwpjDZz6SPtJLbAS3GYzUf8QXf4qUaTZ3A")
+	require.NoError(t, err)
+	addrInfo, err := d.GetAddress()
+	require.NoError(t, err)
+	require.Empty(t, addrInfo.ID)
+	require.Equal(t, []string{"/ip4/10.0.0.2/tcp/5001"}, []string{addrInfo.Addrs[0].String()})
+
+	err = d.Run(ctx, "/ip4/10.0.0.1/tcp/5001")
+	require.EqualError(t, err, "invalid p2p multiaddr")
+}
+
+func TestDNSBootstrapperGetAddress(t *testing.T) {
+	selfAddr, err := multiaddr.NewMultiaddr("/ip4/10.0.0.1/tcp/5001/p2p/12D3KooWHAHyxFTsGgXwpjDZz6SPtJLbAS3GYzUf8QXf4qUaTZ3A")
+	require.NoError(t, err)
+	self, err := peer.AddrInfoFromP2pAddr(selfAddr)
+	require.NoError(t, err)
+	otherAddr, err := multiaddr.NewMultiaddr("/ip4/10.0.0.2/tcp/5001")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		addrs        []multiaddr.Multiaddr
+		expectedSelf bool
+	}{
+		{
+			name:         "only self",
+			addrs:        []multiaddr.Multiaddr{self.Addrs[0]},
+			expectedSelf: true,
+		},
+		{
+			name:         "self and other",
+			addrs:        []multiaddr.Multiaddr{self.Addrs[0], otherAddr},
+			expectedSelf: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DNSBootstrapper{
+				initCh: make(chan interface{}),
+				self:   self,
+				addrs:  tt.addrs,
+			}
+			close(d.initCh)
+			addrInfo, err := d.GetAddress()
+			require.NoError(t, err)
+			if tt.expectedSelf {
+				require.Equal(t, self.ID, addrInfo.ID)
+				return
+			}
+			require.Empty(t, addrInfo.ID)
+			require.Equal(t, []multiaddr.Multiaddr{otherAddr}, addrInfo.Addrs)
+		})
+	}
+}
+
+func TestEndpointSliceAddrs(t *testing.T) {
+	terminating := true
+	slices := []*discoveryv1.EndpointSlice{
+		{
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.0.0.2"}},
+				{Addresses: []string{"10.0.0.1"}},
+				{Addresses: []string{"10.0.0.3"}, Conditions: discoveryv1.EndpointConditions{Terminating: &terminating}},
+			},
+		},
+		{
+			AddressType: discoveryv1.AddressTypeFQDN,
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"foo.example.com"}},
+			},
+		},
+	}
+	addrs, err := endpointSliceAddrs(slices, "5001")
+	require.NoError(t, err)
+	expected := []string{"/ip4/10.0.0.1/tcp/5001", "/ip4/10.0.0.2/tcp/5001"}
+	actual := []string{}
+	for _, addr := range addrs {
+		actual = append(actual, addr.String())
+	}
+	require.Equal(t, expected, actual)
+}
+
+func TestEndpointSliceBootstrapper(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "spegel-abc",
+			Namespace: "spegel",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "spegel"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}},
+			{Addresses: []string{"10.0.0.2"}},
+		},
+	}
+	cs := fake.NewSimpleClientset(slice)
+	b := NewEndpointSliceBootstrapper(cs, "spegel", "spegel").(*EndpointSliceBootstrapper)
+	err := b.Run(ctx, "/ip4/10.0.0.1/tcp/5001/p2p/12D3KooWHAHyxFTsGgXwpjDZz6SPtJLbAS3GYzUf8QXf4qUaTZ3A")
+	require.NoError(t, err)
+	addrInfo, err := b.GetAddress()
+	require.NoError(t, err)
+	require.Empty(t, addrInfo.ID)
+	require.Equal(t, "/ip4/10.0.0.2/tcp/5001", addrInfo.Addrs[0].String())
+	// Discovering the first peers signals a change.
+	select {
+	case <-b.Changed():
+	default:
+		t.Fatal("expected discovered peers to be signaled")
+	}
+
+	// Other peer is replaced which should signal a change.
+	slice.Endpoints = []discoveryv1.Endpoint{
+		{Addresses: []string{"10.0.0.1"}},
+		{Addresses: []string{"10.0.0.3"}},
+	}
+	_, err = cs.DiscoveryV1().EndpointSlices("spegel").Update(ctx, slice, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	select {
+	case <-b.Changed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected peer change to be signaled")
+	}
+	addrInfo, err = b.GetAddress()
+	require.NoError(t, err)
+	require.Equal(t, "/ip4/10.0.0.3/tcp/5001", addrInfo.Addrs[0].String())
+}
+
+func TestEndpointSliceBootstrapperEmpty(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cs := fake.NewSimpleClientset()
+	b := NewEndpointSliceBootstrapper(cs, "spegel", "spegel")
+	err := b.Run(ctx, "/ip4/10.0.0.1/tcp/5001/p2p/12D3KooWHAHyxFTsGgXwpjDZz6SPtJLbAS3GYzUf8QXf4qUaTZ3A")
+	require.NoError(t, err)
+	_, err = b.GetAddress()
+	require.EqualError(t, err, "no peers found in endpoint slices of service spegel")
+}
@@ -0,0 +1,124 @@
+package routing
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Weight of a new latency observation, older observations decay by the remaining weight.
+	latencyAlpha = 0.3
+	// Duration after which the latency of a mirror is forgotten when it has not been observed again.
+	latencyExpiration = 30 * time.Minute
+	// Amount of bytes that mirrors are ranked by the estimated time to transfer, which weighs throughput against latency.
+	latencyRankSize = 1 << 20
+)
+
+type peerLatency struct {
+	ewma       float64
+	throughput float64
+	observedAt time.Time
+}
+
+// latencies keeps an exponentially weighted moving average of the latency and throughput observed per mirror.
+type latencies struct {
+	mx      sync.Mutex
+	window  time.Duration
+	mirrors map[string]*peerLatency
+	now     func() time.Time
+}
+
+func newLatencies(window time.Duration) *latencies {
+	return &latencies{
+		window:  window,
+		mirrors: map[string]*peerLatency{},
+		now:     time.Now,
+	}
+}
+
+func (l *latencies) observe(mirror string, d time.Duration) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	pl, ok := l.get(mirror)
+	if !ok {
+		pl.ewma = float64(d)
+		return
+	}
+	pl.ewma = latencyAlpha*float64(d) + (1-latencyAlpha)*pl.ewma
+}
+
+func (l *latencies) observeThroughput(mirror string, bytesPerSecond float64) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	pl, _ := l.get(mirror)
+	if pl.throughput == 0 {
+		pl.throughput = bytesPerSecond
+		return
+	}
+	pl.throughput = latencyAlpha*bytesPerSecond + (1-latencyAlpha)*pl.throughput
+}
+
+// get returns the observations of the mirror, and false if the mirror has not been observed before.
+// Observations that have expired are removed and the observation time of the mirror is updated.
+func (l *latencies) get(mirror string) (*peerLatency, bool) {
+	now := l.now()
+	for k, v := range l.mirrors {
+		if now.Sub(v.observedAt) > latencyExpiration {
+			delete(l.mirrors, k)
+		}
+	}
+	pl, ok := l.mirrors[mirror]
+	if !ok {
+		pl = &peerLatency{}
+		l.mirrors[mirror] = pl
+	}
+	pl.observedAt = now
+	return pl, ok
+}
+
+// rank orders the peers by the estimated time to transfer content, which is the average latency and the time to
+// transfer the rank size at the average throughput when it is known. Peers without observations are tried first
+// so that they are measured, the order of peers with the same estimate is kept.
+func (l *latencies) rank(peers []resolvedPeer) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	latency := func(mirror string) float64 {
+		pl, ok := l.mirrors[mirror]
+		if !ok {
+			return 0
+		}
+		if pl.throughput == 0 {
+			return pl.ewma
+		}
+		return pl.ewma + latencyRankSize/pl.throughput*float64(time.Second)
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		return latency(peers[i].mirror) < latency(peers[j].mirror)
+	})
+}
+
+// WithLatencyRanking orders mirrors found within the window after the first mirror by the latency and throughput observed
+// when requesting content from them, so that the historically fastest peer is tried first. Mirrors found after the window
+// are returned in the order they are found.
+func WithLatencyRanking(window time.Duration) P2PRouterOption {
+	return func(r *P2PRouter) {
+		r.latencies = newLatencies(window)
+	}
+}
+
+// ObserveLatency records the latency of a request to a mirror returned by the router.
+func (r *P2PRouter) ObserveLatency(mirror string, d time.Duration) {
+	if r.latencies == nil {
+		return
+	}
+	r.latencies.observe(mirror, d)
+}
+
+// ObserveThroughput records the throughput of a transfer from a mirror returned by the router.
+func (r *P2PRouter) ObserveThroughput(mirror string, bytesPerSecond float64) {
+	if r.latencies == nil {
+		return
+	}
+	r.latencies.observeThroughput(mirror, bytesPerSecond)
+}
@@ -0,0 +1,89 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatenciesRank(t *testing.T) {
+	l := newLatencies(time.Second)
+	l.observe("http://a:5000", 100*time.Millisecond)
+	l.observe("http://b:5000", 10*time.Millisecond)
+	l.observe("http://c:5000", 50*time.Millisecond)
+	// A single slow response does not outweigh the previous observations.
+	l.observe("http://b:5000", 100*time.Millisecond)
+	require.InDelta(t, float64(37*time.Millisecond), l.mirrors["http://b:5000"].ewma, float64(time.Millisecond))
+
+	peers := []resolvedPeer{
+		{mirror: "http://a:5000"},
+		{mirror: "http://b:5000"},
+		{mirror: "http://d:5000"},
+		{mirror: "http://c:5000"},
+		{mirror: "http://e:5000"},
+	}
+	l.rank(peers)
+	mirrors := []string{}
+	for _, p := range peers {
+		mirrors = append(mirrors, p.mirror)
+	}
+	require.Equal(t, []string{"http://d:5000", "http://e:5000", "http://b:5000", "http://c:5000", "http://a:5000"}, mirrors)
+}
+
+func TestLatenciesRankFailing(t *testing.T) {
+	l := newLatencies(time.Second)
+	l.observe("http://a:5000", 10*time.Millisecond)
+	// A mirror that fails is observed with a penalty and ranked after mirrors that respond or have not been tried.
+	l.observe("http://b:5000", 10*time.Second)
+	l.observe("http://c:5000", 100*time.Millisecond)
+
+	peers := []resolvedPeer{
+		{mirror: "http://b:5000"},
+		{mirror: "http://c:5000"},
+		{mirror: "http://d:5000"},
+		{mirror: "http://a:5000"},
+	}
+	l.rank(peers)
+	mirrors := []string{}
+	for _, p := range peers {
+		mirrors = append(mirrors, p.mirror)
+	}
+	require.Equal(t, []string{"http://d:5000", "http://a:5000", "http://c:5000", "http://b:5000"}, mirrors)
+}
+
+func TestLatenciesRankThroughput(t *testing.T) {
+	l := newLatencies(time.Second)
+	l.observe("http://a:5000", 10*time.Millisecond)
+	l.observe("http://b:5000", 20*time.Millisecond)
+	// A mirror with lower latency is ranked after a mirror that transfers content faster.
+	l.observeThroughput("http://a:5000", 1<<20)
+	l.observeThroughput("http://b:5000", 100<<20)
+	l.observeThroughput("http://b:5000", 200<<20)
+	require.InDelta(t, 130<<20, l.mirrors["http://b:5000"].throughput, 1)
+
+	peers := []resolvedPeer{
+		{mirror: "http://a:5000"},
+		{mirror: "http://b:5000"},
+	}
+	l.rank(peers)
+	require.Equal(t, "http://b:5000", peers[0].mirror)
+	require.Equal(t, "http://a:5000", peers[1].mirror)
+}
+
+func TestLatenciesExpiration(t *testing.T) {
+	now := time.Now()
+	l := newLatencies(time.Second)
+	l.now = func() time.Time { return now }
+	l.observe("http://a:5000", time.Second)
+	now = now.Add(latencyExpiration + time.Second)
+	l.observe("http://b:5000", time.Second)
+	require.NotContains(t, l.mirrors, "http://a:5000")
+	require.Contains(t, l.mirrors, "http://b:5000")
+}
+
+func TestObserveLatencyDisabled(t *testing.T) {
+	r := &P2PRouter{}
+	r.ObserveLatency("http://a:5000", time.Second)
+	require.Nil(t, r.latencies)
+}
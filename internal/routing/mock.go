@@ -36,7 +36,16 @@ func (m *MockRouter) Resolve(ctx context.Context, key string, allowSelf bool, co
 	go func() {
 		m.mx.RLock()
 		defer m.mx.RUnlock()
+		// Like the P2P router at most count unique peers are returned.
+		seen := map[string]interface{}{}
 		for _, peer := range peers {
+			if count > 0 && len(seen) >= count {
+				break
+			}
+			if _, ok := seen[peer]; ok {
+				continue
+			}
+			seen[peer] = nil
 			peerCh <- peer
 		}
 		close(peerCh)
@@ -53,6 +62,19 @@ func (m *MockRouter) Advertise(ctx context.Context, keys []string) error {
 	return nil
 }
 
+func (m *MockRouter) Withdraw(ctx context.Context, keys []string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for _, key := range keys {
+		delete(m.resolver, key)
+	}
+	return nil
+}
+
+func (m *MockRouter) Depart(ctx context.Context) error {
+	return nil
+}
+
 func (m *MockRouter) LookupKey(key string) ([]string, bool) {
 	m.mx.RLock()
 	defer m.mx.RUnlock()
@@ -0,0 +1,64 @@
+package routing
+
+import (
+	"sync"
+	"time"
+)
+
+// Max amount of keys kept in the negative cache, new misses are not cached when full.
+const negativeCacheMaxEntries = 10000
+
+// negativeCache remembers keys that could not be resolved so that repeated lookups fail fast until the TTL expires.
+type negativeCache struct {
+	mx      sync.Mutex
+	ttl     time.Duration
+	entries map[string]time.Time
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		entries: map[string]time.Time{},
+	}
+}
+
+func (n *negativeCache) add(key string) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	if len(n.entries) >= negativeCacheMaxEntries {
+		n.prune()
+		if len(n.entries) >= negativeCacheMaxEntries {
+			return
+		}
+	}
+	n.entries[key] = time.Now().Add(n.ttl)
+}
+
+func (n *negativeCache) contains(key string) bool {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	expiry, ok := n.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(n.entries, key)
+		return false
+	}
+	return true
+}
+
+func (n *negativeCache) remove(key string) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	delete(n.entries, key)
+}
+
+func (n *negativeCache) prune() {
+	now := time.Now()
+	for key, expiry := range n.entries {
+		if now.After(expiry) {
+			delete(n.entries, key)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package routing
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegativeCache(t *testing.T) {
+	n := newNegativeCache(50 * time.Millisecond)
+	require.False(t, n.contains("foo"))
+	n.add("foo")
+	require.True(t, n.contains("foo"))
+	n.remove("foo")
+	require.False(t, n.contains("foo"))
+
+	n.add("bar")
+	time.Sleep(50 * time.Millisecond)
+	require.False(t, n.contains("bar"))
+}
+
+func TestNegativeCacheMaxEntries(t *testing.T) {
+	n := newNegativeCache(time.Minute)
+	for i := 0; i < negativeCacheMaxEntries+1; i++ {
+		n.add(fmt.Sprintf("key-%d", i))
+	}
+	require.Len(t, n.entries, negativeCacheMaxEntries)
+	require.False(t, n.contains(fmt.Sprintf("key-%d", negativeCacheMaxEntries)))
+}
@@ -1,74 +1,270 @@
 package routing
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	mrand "math/rand"
 	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	libp2ppnet "github.com/libp2p/go-libp2p/p2p/net/pnet"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
 	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 	mc "github.com/multiformats/go-multicodec"
 	mh "github.com/multiformats/go-multihash"
+	mss "github.com/multiformats/go-multistream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/xenitab/spegel/internal/metrics"
 )
 
+var advertiseBatchesTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "spegel_router_advertise_batches_total",
+	Help: "Total number of batches of keys advertised.",
+})
+
+var provideDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "spegel_router_provide_duration_seconds",
+	Help:    "Duration of providing a single key to the DHT.",
+	Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+})
+
+var lookupFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "spegel_router_lookup_failures_total",
+	Help: "Total number of DHT operations that failed, provides returning an error and resolves where no peer was found.",
+}, []string{"operation"})
+
+var peersConnected = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "spegel_router_peers",
+	Help: "Number of peers the router is connected to.",
+})
+
+var routingTablePeers = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "spegel_router_routing_table_peers",
+	Help: "Number of peers in the DHT routing table.",
+})
+
+var routingTableBucketPeers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "spegel_router_routing_table_bucket_peers",
+	Help: "Number of peers in the DHT routing table by bucket, which is the common prefix length of the peer ID with the local peer ID.",
+}, []string{"bucket"})
+
+// Interval at which the routing table metrics are updated.
+const routingTableMetricsInterval = 15 * time.Second
+
+// Duration that withdrawn keys are not advertised, after which they are advertised again with the next refresh.
+// Content that is still corrupt is withdrawn again the next time it fails verification.
+const withdrawalTTL = time.Hour
+
+// Protocol used to announce to peers that the router is leaving the network.
+const departureProtocol = protocol.ID("/spegel/departure/1.0.0")
+
 type P2PRouter struct {
-	b            Bootstrapper
-	host         host.Host
-	kdht         *dht.IpfsDHT
-	rd           *routing.RoutingDiscovery
-	registryPort string
+	b               Bootstrapper
+	host            host.Host
+	kdht            *dht.IpfsDHT
+	rd              *routing.RoutingDiscovery
+	registryPort    string
+	keySchemas      []KeySchema
+	negative        *negativeCache
+	psk             pnet.PSK
+	dhtConfig       DHTConfig
+	keyTTL          time.Duration
+	sortPeers       bool
+	latencies       *latencies
+	advertise       AdvertiseConfig
+	stats           StatsFunc
+	streamTransport bool
+	signedMirrors   bool
+	identity        crypto.PrivKey
+	mx              sync.RWMutex
+	withdrawn       map[string]time.Time
+	departed        map[peer.ID]time.Time
+	departing       bool
+	advertisedAt    time.Time
+	advertiseErr    error
 }
 
-func NewP2PRouter(ctx context.Context, addr string, b Bootstrapper, registryPort string) (Router, error) {
-	log := logr.FromContextOrDiscard(ctx).WithName("p2p")
+type P2PRouterOption func(*P2PRouter)
 
-	h, p, err := net.SplitHostPort(addr)
+// WithNegativeCache makes lookups of keys that could not be resolved fail fast until the TTL expires.
+func WithNegativeCache(ttl time.Duration) P2PRouterOption {
+	return func(r *P2PRouter) {
+		r.negative = newNegativeCache(ttl)
+	}
+}
+
+// WithPSK restricts the router to a private network where only peers with the same pre-shared key can connect.
+func WithPSK(psk pnet.PSK) P2PRouterOption {
+	return func(r *P2PRouter) {
+		r.psk = psk
+	}
+}
+
+// WithIdentity uses the private key as the peer identity instead of generating a new identity.
+func WithIdentity(priv crypto.PrivKey) P2PRouterOption {
+	return func(r *P2PRouter) {
+		r.identity = priv
+	}
+}
+
+// DHTConfig tunes the Kademlia DHT for the size of the cluster, zero values keep the library defaults.
+type DHTConfig struct {
+	// BucketSize is the replication factor k, the amount of peers provider records are stored on and kept per bucket.
+	BucketSize int
+	// Concurrency is the amount of concurrent requests per lookup path.
+	Concurrency int
+	// Resiliency is the amount of closest peers that have to respond for a lookup to complete.
+	Resiliency int
+	// RefreshInterval is the interval at which the routing table is refreshed.
+	RefreshInterval time.Duration
+	// KeyTTL is the duration provider records are valid for, keys have to be advertised again before it expires.
+	KeyTTL time.Duration
+}
+
+// WithDHTConfig overrides the Kademlia parameters and the TTL of provider records.
+func WithDHTConfig(cfg DHTConfig) P2PRouterOption {
+	return func(r *P2PRouter) {
+		r.dhtConfig = cfg
+		if cfg.KeyTTL > 0 {
+			r.keyTTL = cfg.KeyTTL
+		}
+	}
+}
+
+// AdvertiseConfig limits the rate at which keys are provided, so that nodes advertising all of their keys
+// at the same time, for example when every node starts after a cluster upgrade, do not flood the DHT.
+type AdvertiseConfig struct {
+	// BatchSize is the amount of keys provided before waiting for the interval, batching is disabled when zero.
+	BatchSize int
+	// Interval is the duration waited between batches.
+	Interval time.Duration
+	// Jitter is the max random delay before the first batch, only applied when the keys do not fit in a single batch.
+	Jitter time.Duration
+}
+
+// WithAdvertiseConfig provides keys in batches with an interval between each batch.
+func WithAdvertiseConfig(cfg AdvertiseConfig) P2PRouterOption {
+	return func(r *P2PRouter) {
+		r.advertise = cfg
+	}
+}
+
+// WithDeterministicResolve orders resolved peers by a hash of the key and peer ID instead of the order they were discovered in.
+// Peers are only returned once all lookups have completed which makes resolving slower, it is meant for tests and debugging.
+func WithDeterministicResolve() P2PRouterOption {
+	return func(r *P2PRouter) {
+		r.sortPeers = true
+	}
+}
+
+// LoadPSK reads a pre-shared key in the libp2p swarm key format from the file.
+func LoadPSK(p string) (pnet.PSK, error) {
+	f, err := os.Open(p)
 	if err != nil {
 		return nil, err
 	}
-	if h == "" {
-		h = "0.0.0.0"
+	defer f.Close()
+	psk, err := pnet.DecodeV1PSK(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode pre-shared key: %w", err)
+	}
+	return psk, nil
+}
+
+func NewP2PRouter(ctx context.Context, addr string, b Bootstrapper, registryPort string, keySchemas []KeySchema, opts ...P2PRouterOption) (Router, error) {
+	if len(keySchemas) == 0 {
+		return nil, fmt.Errorf("at least one key schema has to be set")
+	}
+	log := logr.FromContextOrDiscard(ctx).WithName("p2p")
+	r := &P2PRouter{
+		b:            b,
+		registryPort: registryPort,
+		keySchemas:   keySchemas,
+		withdrawn:    map[string]time.Time{},
+		departed:     map[peer.ID]time.Time{},
+		keyTTL:       KeyTTL,
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
-	multiAddr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/%s/tcp/%s", h, p))
+
+	listenAddrs, err := listenMultiaddrs(addr)
 	if err != nil {
-		return nil, fmt.Errorf("could not create host multi address: %w", err)
+		return nil, err
 	}
 	factory := libp2p.AddrsFactory(func(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
-		for _, addr := range addrs {
-			v, err := addr.ValueForProtocol(multiaddr.P_IP4)
-			if err != nil {
-				continue
-			}
-			if v == "" {
-				continue
-			}
-			if v == "127.0.0.1" {
-				continue
-			}
-			return []multiaddr.Multiaddr{addr}
+		addr, ok := advertisedMultiaddr(addrs)
+		if !ok {
+			return nil
 		}
-		return nil
+		return []multiaddr.Multiaddr{addr}
 	})
-	host, err := libp2p.New(libp2p.ListenAddrs(multiAddr), factory)
+	hostOpts := []libp2p.Option{libp2p.ListenAddrs(listenAddrs...), factory}
+	if r.identity != nil {
+		hostOpts = append(hostOpts, libp2p.Identity(r.identity))
+	}
+	if r.psk != nil {
+		log.Info("using private network with pre-shared key")
+		hostOpts = append(hostOpts, libp2p.PrivateNetwork(r.psk))
+	}
+	host, err := libp2p.New(hostOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("could not create host: %w", err)
 	}
 	self := fmt.Sprintf("%s/p2p/%s", host.Addrs()[0].String(), host.ID().Pretty())
 	log.Info("starting p2p router", "id", self)
+	host.SetStreamHandler(departureProtocol, r.departureHandler(log))
+	host.SetStreamHandler(statsProtocol, r.statsHandler(log))
 
 	err = b.Run(ctx, self)
 	if err != nil {
 		return nil, err
 	}
 
-	dhtOpts := []dht.Option{dht.Mode(dht.ModeServer), dht.ProtocolPrefix("/spegel"), dht.DisableValues(), dht.MaxRecordAge(KeyTTL)}
-	bootstrapPeerOpt := dht.BootstrapPeersFunc(func() []peer.AddrInfo {
+	providerManager, err := providers.NewProviderManager(host.ID(), host.Peerstore(), dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		return nil, fmt.Errorf("could not create provider manager: %w", err)
+	}
+	providerStore := newValidityProviderStore(providerManager, r.keyTTL)
+	go providerStore.Run(ctx)
+	dhtOpts := []dht.Option{dht.Mode(dht.ModeServer), dht.ProtocolPrefix("/spegel"), dht.DisableValues(), dht.MaxRecordAge(r.keyTTL), dht.ProviderStore(providerStore)}
+	if r.dhtConfig.BucketSize > 0 {
+		dhtOpts = append(dhtOpts, dht.BucketSize(r.dhtConfig.BucketSize))
+	}
+	if r.dhtConfig.Concurrency > 0 {
+		dhtOpts = append(dhtOpts, dht.Concurrency(r.dhtConfig.Concurrency))
+	}
+	if r.dhtConfig.Resiliency > 0 {
+		dhtOpts = append(dhtOpts, dht.Resiliency(r.dhtConfig.Resiliency))
+	}
+	if r.dhtConfig.RefreshInterval > 0 {
+		dhtOpts = append(dhtOpts, dht.RoutingTableRefreshPeriod(r.dhtConfig.RefreshInterval))
+	}
+	bootstrapPeers := func() []peer.AddrInfo {
 		addrInfo, err := b.GetAddress()
 		if err != nil {
 			log.Error(err, "could not get bootstrap addresses")
@@ -78,9 +274,17 @@ func NewP2PRouter(ctx context.Context, addr string, b Bootstrapper, registryPort
 			log.Info("leader is self skipping connection to bootstrap node")
 			return nil
 		}
+		if addrInfo.ID == "" {
+			id, err := discoverPeerID(ctx, host, r.psk, addrInfo.Addrs)
+			if err != nil {
+				log.Error(err, "could not discover bootstrap peer id")
+				return nil
+			}
+			addrInfo.ID = id
+		}
 		return []peer.AddrInfo{*addrInfo}
-	})
-	dhtOpts = append(dhtOpts, bootstrapPeerOpt)
+	}
+	dhtOpts = append(dhtOpts, dht.BootstrapPeersFunc(bootstrapPeers))
 	kdht, err := dht.New(ctx, host, dhtOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("could not create distributed hash table: %w", err)
@@ -88,15 +292,70 @@ func NewP2PRouter(ctx context.Context, addr string, b Bootstrapper, registryPort
 	if err = kdht.Bootstrap(ctx); err != nil {
 		return nil, fmt.Errorf("could not boostrap distributed hash table: %w", err)
 	}
+	if n, ok := b.(bootstrapNotifier); ok {
+		go rebootstrap(ctx, host, kdht, n.Changed(), bootstrapPeers)
+	}
 	rd := routing.NewRoutingDiscovery(kdht)
 
-	return &P2PRouter{
-		b:            b,
-		host:         host,
-		kdht:         kdht,
-		rd:           rd,
-		registryPort: registryPort,
-	}, nil
+	r.host = host
+	r.kdht = kdht
+	r.rd = rd
+	go r.observeRoutingTable(ctx)
+	return r, nil
+}
+
+// observeRoutingTable updates the peer and routing table metrics at an interval until the context is cancelled.
+func (r *P2PRouter) observeRoutingTable(ctx context.Context) {
+	ticker := time.NewTicker(routingTableMetricsInterval)
+	defer ticker.Stop()
+	for {
+		peersConnected.Set(float64(len(r.host.Network().Peers())))
+		rt := r.kdht.RoutingTable()
+		size := rt.Size()
+		routingTablePeers.Set(float64(size))
+		// Buckets are counted by common prefix length until all peers in the routing table have been counted.
+		routingTableBucketPeers.Reset()
+		counted := 0
+		for cpl := uint(0); counted < size && cpl <= 256; cpl++ {
+			n := rt.NPeersForCpl(cpl)
+			if n == 0 {
+				continue
+			}
+			counted += n
+			routingTableBucketPeers.WithLabelValues(strconv.Itoa(int(cpl))).Set(float64(n))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// bootstrapNotifier is implemented by bootstrappers that signal when the bootstrap peers change.
+type bootstrapNotifier interface {
+	Changed() <-chan interface{}
+}
+
+// rebootstrap connects to new bootstrap peers and refreshes the routing table every time the bootstrap peers change,
+// so that the router recovers without waiting for the routing table to be empty when all previous peers are gone.
+func rebootstrap(ctx context.Context, h host.Host, kdht *dht.IpfsDHT, changedCh <-chan interface{}, bootstrapPeers func() []peer.AddrInfo) {
+	log := logr.FromContextOrDiscard(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changedCh:
+		}
+		log.Info("bootstrap peers changed, bootstrapping again")
+		for _, addrInfo := range bootstrapPeers() {
+			err := h.Connect(ctx, addrInfo)
+			if err != nil {
+				log.Error(err, "could not connect to bootstrap peer", "id", addrInfo.ID)
+			}
+		}
+		kdht.RefreshRoutingTable()
+	}
 }
 
 func (r *P2PRouter) Close() error {
@@ -104,6 +363,10 @@ func (r *P2PRouter) Close() error {
 }
 
 func (r *P2PRouter) HasMirrors() (bool, error) {
+	// Readiness fails while departing so that the node is removed from endpoints before shutting down.
+	if r.isDeparting() {
+		return false, nil
+	}
 	addrInfo, err := r.b.GetAddress()
 	if err != nil {
 		return false, err
@@ -119,48 +382,545 @@ func (r *P2PRouter) HasMirrors() (bool, error) {
 
 func (r *P2PRouter) Resolve(ctx context.Context, key string, allowSelf bool, count int) (<-chan string, error) {
 	log := logr.FromContextOrDiscard(ctx).WithValues("host", r.host.ID().Pretty(), "key", key)
-	c, err := createCid(key)
-	if err != nil {
-		return nil, err
+	start := time.Now()
+	if r.negative != nil && r.negative.contains(key) {
+		log.V(5).Info("key found in negative cache")
+		metrics.RouterResolveDuration.WithLabelValues("negative_cache").Observe(time.Since(start).Seconds())
+		peerCh := make(chan string)
+		close(peerCh)
+		return peerCh, nil
 	}
-	addrCh := r.rd.FindProvidersAsync(ctx, c, count)
+	cids := []cid.Cid{}
+	for _, schema := range r.keySchemas {
+		c, err := createCid(schema.Encode(key))
+		if err != nil {
+			return nil, err
+		}
+		cids = append(cids, c)
+	}
+	// Providers are not limited per key as duplicate, departed and stale records would use up the count.
+	// Lookups are instead cancelled once the count of unique mirrors has been found.
+	lookupCtx, cancelLookups := context.WithCancel(ctx)
+	addrCh := make(chan peer.AddrInfo, count)
+	wg := sync.WaitGroup{}
+	for _, c := range cids {
+		wg.Add(1)
+		go func(c cid.Cid) {
+			defer wg.Done()
+			for info := range r.rd.FindProvidersAsync(lookupCtx, c, 0) {
+				select {
+				case <-lookupCtx.Done():
+					return
+				case addrCh <- info:
+				}
+			}
+		}(c)
+	}
+	go func() {
+		wg.Wait()
+		close(addrCh)
+	}()
 	peerCh := make(chan string, count)
 	go func() {
-		for info := range addrCh {
+		defer cancelLookups()
+		// The same peer may be found through multiple key schemas during a migration.
+		seen := map[peer.ID]interface{}{}
+		// Peers restarted with a new identity are found multiple times with the same mirror.
+		seenMirrors := map[string]interface{}{}
+		found := false
+		peers := []resolvedPeer{}
+		// Peers found within the ranking window are held back and returned ordered by latency once the window closes.
+		ranking := r.latencies != nil && !r.sortPeers
+		var windowCh <-chan time.Time
+		flush := func() bool {
+			ranking = false
+			windowCh = nil
+			r.latencies.rank(peers)
+			for _, p := range peers {
+				select {
+				case <-ctx.Done():
+					return false
+				case peerCh <- p.mirror:
+				}
+			}
+			peers = nil
+			return true
+		}
+		for {
+			var info peer.AddrInfo
+			var ok bool
+			select {
+			case <-windowCh:
+				if !flush() {
+					return
+				}
+				continue
+			case <-ctx.Done():
+				if !found {
+					metrics.RouterResolveDuration.WithLabelValues("not_found").Observe(time.Since(start).Seconds())
+					lookupFailuresTotal.WithLabelValues("resolve").Inc()
+				}
+				// Only lookups that timed out are cached as cancelled lookups may not have been given enough time.
+				if r.negative != nil && !found && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					r.negative.add(key)
+				}
+				return
+			case info, ok = <-addrCh:
+			}
+			// Lookups have completed, the channel is left open until the context is done as before.
+			if !ok {
+				addrCh = nil
+				if ranking && !flush() {
+					return
+				}
+				if r.sortPeers {
+					sortResolvedPeers(key, peers)
+					for _, p := range peers {
+						select {
+						case <-ctx.Done():
+							return
+						case peerCh <- p.mirror:
+						}
+					}
+				}
+				continue
+			}
+			if _, ok := seen[info.ID]; ok {
+				continue
+			}
+			seen[info.ID] = nil
 			if !allowSelf && info.ID == r.host.ID() {
 				continue
 			}
+			if r.hasDeparted(info.ID) {
+				continue
+			}
 			if len(info.Addrs) != 1 {
 				log.Info("expected address list to only contain a single item")
 				continue
 			}
-			v, err := info.Addrs[0].ValueForProtocol(multiaddr.P_IP4)
+			v, err := multiaddrIP(info.Addrs[0])
 			if err != nil {
-				log.Error(err, "could not get IPV4 address")
+				log.Error(err, "could not get IP address")
 				continue
 			}
+			if !found {
+				metrics.RouterResolveDuration.WithLabelValues("found").Observe(time.Since(start).Seconds())
+			}
+			found = true
 			// Combine peer with registry port to create mirror endpoint.
-			peerCh <- fmt.Sprintf("http://%s:%s", v, r.registryPort)
+			mirror := fmt.Sprintf("http://%s", net.JoinHostPort(v, r.registryPort))
+			if r.streamTransport {
+				mirror = streamMirror(info.ID)
+			} else if r.signedMirrors {
+				mirror = signedMirror(mirror, info.ID)
+			}
+			if _, ok := seenMirrors[mirror]; ok {
+				continue
+			}
+			seenMirrors[mirror] = nil
+			if count > 0 && len(seenMirrors) >= count {
+				cancelLookups()
+			}
+			if r.sortPeers {
+				peers = append(peers, resolvedPeer{id: info.ID, mirror: mirror})
+				continue
+			}
+			if ranking {
+				peers = append(peers, resolvedPeer{id: info.ID, mirror: mirror})
+				if windowCh == nil {
+					timer := time.NewTimer(r.latencies.window)
+					defer timer.Stop()
+					windowCh = timer.C
+				}
+				if len(peers) >= count && !flush() {
+					return
+				}
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case peerCh <- mirror:
+			}
 		}
 	}()
 	return peerCh, nil
 }
 
-func (r *P2PRouter) Advertise(ctx context.Context, keys []string) error {
+type resolvedPeer struct {
+	id     peer.ID
+	mirror string
+}
+
+// sortResolvedPeers orders the peers by the hash of the key and peer ID, so that the order is the same for every lookup
+// of the key while different keys are spread across peers.
+func sortResolvedPeers(key string, peers []resolvedPeer) {
+	hash := func(id peer.ID) []byte {
+		h := sha256.Sum256([]byte(key + string(id)))
+		return h[:]
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		return bytes.Compare(hash(peers[i].id), hash(peers[j].id)) < 0
+	})
+}
+
+// Advertise provides the keys to the network. Keys are provided in batches when the keys do not fit in a single batch,
+// as advertising all keys after listing all images would otherwise flood the DHT.
+func (r *P2PRouter) Advertise(ctx context.Context, keys []string) (err error) {
+	if r.isDeparting() {
+		return nil
+	}
+	defer func() {
+		r.recordAdvertisement(ctx, err)
+	}()
 	logr.FromContextOrDiscard(ctx).V(10).Info("advertising keys", "host", r.host.ID().Pretty(), "keys", keys)
-	for _, key := range keys {
-		c, err := createCid(key)
+	batches := batchKeys(keys, r.advertise.BatchSize)
+	if len(batches) > 1 && r.advertise.Jitter > 0 {
+		//nolint:gosec // jitter only has to spread out nodes
+		jitter := time.Duration(mrand.Int63n(int64(r.advertise.Jitter)))
+		if err := sleepContext(ctx, jitter); err != nil {
+			return err
+		}
+	}
+	// Keys advertised for an added or updated image, as opposed to a refresh, are no longer withdrawn as the content may have been pulled again.
+	if !isRefresh(ctx) {
+		r.clearWithdrawn(keys)
+	}
+	// A key that fails to be provided does not stop the remaining keys from being advertised.
+	errs := []error{}
+	for i, batch := range batches {
+		if i > 0 {
+			if err := sleepContext(ctx, r.advertise.Interval); err != nil {
+				return errors.Join(append(errs, err)...)
+			}
+		}
+		for _, key := range batch {
+			if r.isWithdrawn(key) {
+				continue
+			}
+			if r.negative != nil {
+				r.negative.remove(key)
+			}
+			err := r.provide(ctx, key)
+			if err != nil {
+				errs = append(errs, &AdvertiseError{Key: key, Err: err})
+			}
+		}
+		advertiseBatchesTotal.Inc()
+	}
+	return errors.Join(errs...)
+}
+
+// provide provides the key encoded with every key schema.
+func (r *P2PRouter) provide(ctx context.Context, key string) error {
+	for _, schema := range r.keySchemas {
+		c, err := createCid(schema.Encode(key))
 		if err != nil {
 			return err
 		}
+		start := time.Now()
 		err = r.rd.Provide(ctx, c, false)
 		if err != nil {
+			lookupFailuresTotal.WithLabelValues("provide").Inc()
 			return err
 		}
+		provideDuration.Observe(time.Since(start).Seconds())
+	}
+	return nil
+}
+
+// listenMultiaddrs returns the addresses that the host listens on, both IPv4 and IPv6 are listened on when the host is not set
+// so that dual-stack and IPv6 only clusters work. The host only fails to start if it cannot listen on any of the addresses.
+func listenMultiaddrs(addr string) ([]multiaddr.Multiaddr, error) {
+	h, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid router port %s: %w", p, err)
+	}
+	ips := []net.IP{net.IPv4zero, net.IPv6unspecified}
+	if h != "" {
+		ip := net.ParseIP(h)
+		if ip == nil {
+			return nil, fmt.Errorf("router address host %s has to be an IP", h)
+		}
+		ips = []net.IP{ip}
+	}
+	addrs := []multiaddr.Multiaddr{}
+	for _, ip := range ips {
+		multiAddr, err := manet.FromNetAddr(&net.TCPAddr{IP: ip, Port: port})
+		if err != nil {
+			return nil, fmt.Errorf("could not create host multi address: %w", err)
+		}
+		addrs = append(addrs, multiAddr)
+	}
+	return addrs, nil
+}
+
+// advertisedMultiaddr selects the single address advertised to peers. IPv4 addresses are preferred in dual-stack clusters,
+// IPv6 addresses are only advertised when they are globally routable within the cluster, which excludes link-local addresses.
+func advertisedMultiaddr(addrs []multiaddr.Multiaddr) (multiaddr.Multiaddr, bool) {
+	for _, addr := range addrs {
+		v, err := addr.ValueForProtocol(multiaddr.P_IP4)
+		if err != nil || v == "" {
+			continue
+		}
+		if net.ParseIP(v).IsLoopback() {
+			continue
+		}
+		return addr, true
+	}
+	for _, addr := range addrs {
+		v, err := addr.ValueForProtocol(multiaddr.P_IP6)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(v); ip == nil || !ip.IsGlobalUnicast() {
+			continue
+		}
+		return addr, true
+	}
+	return nil, false
+}
+
+// multiaddrIP returns the IPv4 or IPv6 address of the multi address.
+func multiaddrIP(addr multiaddr.Multiaddr) (string, error) {
+	if v, err := addr.ValueForProtocol(multiaddr.P_IP4); err == nil {
+		return v, nil
+	}
+	return addr.ValueForProtocol(multiaddr.P_IP6)
+}
+
+// batchKeys splits the keys into batches of the size, all keys are returned in a single batch when size is zero.
+func batchKeys(keys []string, size int) [][]string {
+	if len(keys) == 0 {
+		return nil
+	}
+	if size <= 0 {
+		return [][]string{keys}
+	}
+	batches := [][]string{}
+	for size < len(keys) {
+		keys, batches = keys[size:], append(batches, keys[:size])
+	}
+	return append(batches, keys)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Withdraw stops advertising the keys until the withdrawal expires, or until the keys are advertised for an added or updated image.
+// The DHT does not support removing provider records, so records already stored by peers remain until they expire with the key TTL.
+func (r *P2PRouter) Withdraw(ctx context.Context, keys []string) error {
+	logr.FromContextOrDiscard(ctx).Info("withdrawing keys", "host", r.host.ID().Pretty(), "keys", keys)
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		r.withdrawn[key] = now
+	}
+	return nil
+}
+
+// isWithdrawn returns true if the key has been withdrawn within the withdrawal TTL, older withdrawals are forgotten.
+func (r *P2PRouter) isWithdrawn(key string) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	t, ok := r.withdrawn[key]
+	if !ok {
+		return false
+	}
+	if time.Since(t) > withdrawalTTL {
+		delete(r.withdrawn, key)
+		return false
+	}
+	return true
+}
+
+func (r *P2PRouter) clearWithdrawn(keys []string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, key := range keys {
+		delete(r.withdrawn, key)
+	}
+}
+
+// Depart stops advertising keys and announces to all connected peers that the router is leaving.
+// Peers skip provider records of departed peers when resolving, as the records themselves cannot be removed before they expire.
+func (r *P2PRouter) Depart(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx)
+	r.mx.Lock()
+	r.departing = true
+	r.mx.Unlock()
+
+	peers := r.host.Network().Peers()
+	log.Info("announcing departure to peers", "host", r.host.ID().Pretty(), "peers", len(peers))
+	errCh := make(chan error, len(peers))
+	for _, p := range peers {
+		go func(p peer.ID) {
+			s, err := r.host.NewStream(ctx, p, departureProtocol)
+			if err != nil {
+				errCh <- fmt.Errorf("could not announce departure to peer %s: %w", p, err)
+				return
+			}
+			errCh <- s.Close()
+		}(p)
+	}
+	errs := []error{}
+	for range peers {
+		if err := <-errCh; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HandOff stops advertising keys like Depart but does not announce departure to peers, as the identity is handed off
+// to the router replacing this router on the same node and peers should keep resolving keys to it.
+// It returns the private key of the identity.
+func (r *P2PRouter) HandOff() (crypto.PrivKey, error) {
+	priv := r.host.Peerstore().PrivKey(r.host.ID())
+	if priv == nil {
+		return nil, fmt.Errorf("could not find private key of host %s", r.host.ID().Pretty())
+	}
+	r.mx.Lock()
+	r.departing = true
+	r.mx.Unlock()
+	return priv, nil
+}
+
+func (r *P2PRouter) departureHandler(log logr.Logger) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+		id := s.Conn().RemotePeer()
+		log.Info("peer announced departure", "peer", id.Pretty())
+		r.mx.Lock()
+		defer r.mx.Unlock()
+		r.departed[id] = time.Now()
+	}
+}
+
+// hasDeparted returns true if the peer has announced departure within the key TTL.
+// Provider records of the peer have expired after the key TTL, so older departures are forgotten.
+func (r *P2PRouter) hasDeparted(id peer.ID) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	t, ok := r.departed[id]
+	if !ok {
+		return false
+	}
+	if time.Since(t) > r.keyTTL {
+		delete(r.departed, id)
+		return false
+	}
+	return true
+}
+
+// recordAdvertisement records the result of advertising all keys of the node again, advertisements of single images are ignored.
+func (r *P2PRouter) recordAdvertisement(ctx context.Context, err error) {
+	if !isRefresh(ctx) {
+		return
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.advertiseErr = err
+	if err == nil {
+		r.advertisedAt = time.Now()
+	}
+}
+
+// VerifyAdvertisement returns an error if the last refresh of all keys failed, or if keys have not been refreshed within the key TTL
+// which means that provider records of the node have expired. It does not fail before the first refresh.
+func (r *P2PRouter) VerifyAdvertisement() error {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	if r.advertiseErr != nil {
+		return fmt.Errorf("last advertisement failed: %w", r.advertiseErr)
+	}
+	if !r.advertisedAt.IsZero() && time.Since(r.advertisedAt) > r.keyTTL {
+		return fmt.Errorf("keys were last advertised %s ago which is longer than the key TTL", time.Since(r.advertisedAt).Truncate(time.Second))
 	}
 	return nil
 }
 
+func (r *P2PRouter) isDeparting() bool {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.departing
+}
+
+// discoverPeerID finds the ID of a peer when only its address is known.
+// Dialing through the host requires a peer ID, so a Noise handshake is run against the address
+// with the peer ID check disabled. The handshake authenticates the remote key which the ID is derived from.
+func discoverPeerID(ctx context.Context, h host.Host, psk pnet.PSK, addrs []multiaddr.Multiaddr) (peer.ID, error) {
+	tpt, err := noise.New(noise.ID, h.Peerstore().PrivKey(h.ID()), nil)
+	if err != nil {
+		return "", err
+	}
+	st, err := tpt.WithSessionOptions(noise.DisablePeerIDCheck())
+	if err != nil {
+		return "", err
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	errs := []error{}
+	for _, addr := range addrs {
+		id, err := handshakePeerID(dialCtx, st, psk, addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return id, nil
+	}
+	return "", fmt.Errorf("could not discover peer id: %w", errors.Join(errs...))
+}
+
+// handshakePeerID returns the ID of the peer listening on the address, the connection is closed after the handshake.
+func handshakePeerID(ctx context.Context, st *noise.SessionTransport, psk pnet.PSK, addr multiaddr.Multiaddr) (peer.ID, error) {
+	var d manet.Dialer
+	maconn, err := d.DialContext(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+	defer maconn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		err := maconn.SetDeadline(deadline)
+		if err != nil {
+			return "", err
+		}
+	}
+	var conn net.Conn = maconn
+	if psk != nil {
+		conn, err = libp2ppnet.NewProtectedConn(psk, conn)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = mss.SelectProtoOrFail(noise.ID, conn)
+	if err != nil {
+		return "", err
+	}
+	sc, err := st.SecureOutbound(ctx, conn, "")
+	if err != nil {
+		return "", err
+	}
+	return sc.RemotePeer(), nil
+}
+
 func createCid(key string) (cid.Cid, error) {
 	pref := cid.Prefix{
 		Version:  1,
@@ -0,0 +1,397 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPSK(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "swarm.key")
+	err := os.WriteFile(p, []byte("/key/swarm/psk/1.0.0/\n/base16/\n0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef\n"), 0600)
+	require.NoError(t, err)
+	psk, err := LoadPSK(p)
+	require.NoError(t, err)
+	require.Len(t, psk, 32)
+
+	// The decoded key can be used to create a host in a private network.
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.PrivateNetwork(psk))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	invalid := filepath.Join(dir, "invalid.key")
+	err = os.WriteFile(invalid, []byte("foo"), 0600)
+	require.NoError(t, err)
+	_, err = LoadPSK(invalid)
+	require.Error(t, err)
+	_, err = LoadPSK(filepath.Join(dir, "missing.key"))
+	require.Error(t, err)
+}
+
+func TestDiscoverPeerID(t *testing.T) {
+	psk := make([]byte, 32)
+	for _, usePSK := range []bool{false, true} {
+		opts := []libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")}
+		if usePSK {
+			opts = append(opts, libp2p.PrivateNetwork(psk))
+		}
+		remote, err := libp2p.New(opts...)
+		require.NoError(t, err)
+		//nolint:errcheck // ignore
+		defer remote.Close()
+		local, err := libp2p.New(opts...)
+		require.NoError(t, err)
+		//nolint:errcheck // ignore
+		defer local.Close()
+
+		var localPSK pnet.PSK
+		if usePSK {
+			localPSK = psk
+		}
+		id, err := discoverPeerID(context.TODO(), local, localPSK, remote.Addrs())
+		require.NoError(t, err)
+		require.Equal(t, remote.ID(), id)
+	}
+
+	// Discovery fails when nothing is listening on the address.
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	addrs := h.Addrs()
+	require.NoError(t, h.Close())
+	local, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	//nolint:errcheck // ignore
+	defer local.Close()
+	_, err = discoverPeerID(context.TODO(), local, nil, addrs)
+	require.ErrorContains(t, err, "could not discover peer id")
+}
+
+func TestDepart(t *testing.T) {
+	newRouter := func() *P2PRouter {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			h.Close()
+		})
+		r := &P2PRouter{
+			host:      h,
+			withdrawn: map[string]time.Time{},
+			departed:  map[peer.ID]time.Time{},
+			keyTTL:    KeyTTL,
+		}
+		h.SetStreamHandler(departureProtocol, r.departureHandler(logr.Discard()))
+		return r
+	}
+	r1 := newRouter()
+	r2 := newRouter()
+	err := r2.host.Connect(context.Background(), peer.AddrInfo{ID: r1.host.ID(), Addrs: r1.host.Addrs()})
+	require.NoError(t, err)
+
+	require.False(t, r1.hasDeparted(r2.host.ID()))
+	err = r2.Depart(context.Background())
+	require.NoError(t, err)
+	require.True(t, r2.isDeparting())
+	require.NoError(t, r2.Advertise(context.Background(), []string{"foo"}))
+	require.Eventually(t, func() bool {
+		return r1.hasDeparted(r2.host.ID())
+	}, 5*time.Second, 10*time.Millisecond)
+	require.False(t, r2.hasDeparted(r1.host.ID()))
+
+	// Departures older than the key TTL are forgotten.
+	r1.mx.Lock()
+	r1.departed[r2.host.ID()] = time.Now().Add(-KeyTTL - time.Second)
+	r1.mx.Unlock()
+	require.False(t, r1.hasDeparted(r2.host.ID()))
+}
+
+func TestWithdraw(t *testing.T) {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		h.Close()
+	})
+	// Keys are not provided without key schemas, so that advertising does not require a DHT.
+	r := &P2PRouter{
+		host:      h,
+		withdrawn: map[string]time.Time{},
+	}
+
+	err = r.Withdraw(context.Background(), []string{"foo", "bar"})
+	require.NoError(t, err)
+	require.True(t, r.isWithdrawn("foo"))
+	require.True(t, r.isWithdrawn("bar"))
+
+	// Refreshing all keys does not advertise withdrawn keys again.
+	err = r.Advertise(WithRefresh(context.Background()), []string{"foo", "bar"})
+	require.NoError(t, err)
+	require.True(t, r.isWithdrawn("foo"))
+
+	// Keys advertised for an added or updated image are advertised again.
+	err = r.Advertise(context.Background(), []string{"foo"})
+	require.NoError(t, err)
+	require.False(t, r.isWithdrawn("foo"))
+	require.True(t, r.isWithdrawn("bar"))
+
+	// Withdrawals older than the withdrawal TTL are forgotten.
+	r.mx.Lock()
+	r.withdrawn["bar"] = time.Now().Add(-withdrawalTTL - time.Second)
+	r.mx.Unlock()
+	require.False(t, r.isWithdrawn("bar"))
+	require.Empty(t, r.withdrawn)
+}
+
+func TestWithDHTConfig(t *testing.T) {
+	r := &P2PRouter{keyTTL: KeyTTL}
+	WithDHTConfig(DHTConfig{BucketSize: 40})(r)
+	require.Equal(t, KeyTTL, r.keyTTL)
+	require.Equal(t, 40, r.dhtConfig.BucketSize)
+	WithDHTConfig(DHTConfig{KeyTTL: time.Hour})(r)
+	require.Equal(t, time.Hour, r.keyTTL)
+}
+
+func TestVerifyAdvertisement(t *testing.T) {
+	r := &P2PRouter{keyTTL: time.Minute}
+	require.NoError(t, r.VerifyAdvertisement())
+
+	r.advertisedAt = time.Now()
+	require.NoError(t, r.VerifyAdvertisement())
+
+	r.advertisedAt = time.Now().Add(-2 * time.Minute)
+	require.ErrorContains(t, r.VerifyAdvertisement(), "which is longer than the key TTL")
+
+	r.advertiseErr = errors.New("no peers")
+	require.EqualError(t, r.VerifyAdvertisement(), "last advertisement failed: no peers")
+
+	// Only refreshes of all keys are recorded, advertising a single image does not change the result.
+	r.recordAdvertisement(context.TODO(), nil)
+	require.EqualError(t, r.VerifyAdvertisement(), "last advertisement failed: no peers")
+	r.recordAdvertisement(WithRefresh(context.TODO()), nil)
+	require.NoError(t, r.VerifyAdvertisement())
+	r.recordAdvertisement(context.TODO(), errors.New("no peers"))
+	require.NoError(t, r.VerifyAdvertisement())
+	r.recordAdvertisement(WithRefresh(context.TODO()), errors.New("no peers"))
+	require.EqualError(t, r.VerifyAdvertisement(), "last advertisement failed: no peers")
+}
+
+func TestSortResolvedPeers(t *testing.T) {
+	peers := []resolvedPeer{
+		{id: peer.ID("a"), mirror: "http://10.0.0.1:5000"},
+		{id: peer.ID("b"), mirror: "http://10.0.0.2:5000"},
+		{id: peer.ID("c"), mirror: "http://10.0.0.3:5000"},
+		{id: peer.ID("d"), mirror: "http://10.0.0.4:5000"},
+	}
+	mirrors := func(peers []resolvedPeer) []string {
+		m := []string{}
+		for _, p := range peers {
+			m = append(m, p.mirror)
+		}
+		return m
+	}
+
+	// Order is independent of discovery order.
+	reversed := []resolvedPeer{peers[3], peers[2], peers[1], peers[0]}
+	sortResolvedPeers("foo", peers)
+	sortResolvedPeers("foo", reversed)
+	require.Equal(t, mirrors(peers), mirrors(reversed))
+
+	// Different keys are ordered differently.
+	other := append([]resolvedPeer{}, peers...)
+	sortResolvedPeers("bar", other)
+	require.NotEqual(t, mirrors(peers), mirrors(other))
+	require.ElementsMatch(t, mirrors(peers), mirrors(other))
+}
+
+func TestBatchKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []string
+		size     int
+		expected [][]string
+	}{
+		{
+			name:     "no keys",
+			keys:     []string{},
+			size:     2,
+			expected: nil,
+		},
+		{
+			name:     "batching disabled",
+			keys:     []string{"a", "b", "c"},
+			size:     0,
+			expected: [][]string{{"a", "b", "c"}},
+		},
+		{
+			name:     "uneven batches",
+			keys:     []string{"a", "b", "c", "d", "e"},
+			size:     2,
+			expected: [][]string{{"a", "b"}, {"c", "d"}, {"e"}},
+		},
+		{
+			name:     "even batches",
+			keys:     []string{"a", "b", "c", "d"},
+			size:     2,
+			expected: [][]string{{"a", "b"}, {"c", "d"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, batchKeys(tt.keys, tt.size))
+		})
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := sleepContext(ctx, time.Hour)
+	require.ErrorIs(t, err, context.Canceled)
+	require.NoError(t, sleepContext(context.Background(), 0))
+}
+
+func TestObserveRoutingTable(t *testing.T) {
+	newRouter := func() *P2PRouter {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		require.NoError(t, err)
+		kdht, err := dht.New(context.Background(), h, dht.Mode(dht.ModeServer), dht.ProtocolPrefix("/spegel"), dht.DisableValues())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			kdht.Close()
+			h.Close()
+		})
+		return &P2PRouter{host: h, kdht: kdht}
+	}
+	r1 := newRouter()
+	r2 := newRouter()
+	err := r1.host.Connect(context.Background(), peer.AddrInfo{ID: r2.host.ID(), Addrs: r2.host.Addrs()})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return r1.kdht.RoutingTable().Size() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r1.observeRoutingTable(ctx)
+	require.Equal(t, 1.0, testutil.ToFloat64(peersConnected))
+	require.Equal(t, 1.0, testutil.ToFloat64(routingTablePeers))
+	require.Equal(t, 1, testutil.CollectAndCount(routingTableBucketPeers))
+}
+
+func TestHandOff(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	r := &P2PRouter{}
+	WithIdentity(priv)(r)
+	h, err := libp2p.New(libp2p.Identity(r.identity), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		h.Close()
+	})
+	r.host = h
+
+	handOff, err := r.HandOff()
+	require.NoError(t, err)
+	require.True(t, handOff.Equals(priv))
+	require.True(t, r.isDeparting())
+}
+
+func TestListenMultiaddrs(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected []string
+	}{
+		{
+			addr:     ":5001",
+			expected: []string{"/ip4/0.0.0.0/tcp/5001", "/ip6/::/tcp/5001"},
+		},
+		{
+			addr:     "10.0.0.1:5001",
+			expected: []string{"/ip4/10.0.0.1/tcp/5001"},
+		},
+		{
+			addr:     "[fd00::1]:5001",
+			expected: []string{"/ip6/fd00::1/tcp/5001"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			addrs, err := listenMultiaddrs(tt.addr)
+			require.NoError(t, err)
+			actual := []string{}
+			for _, addr := range addrs {
+				actual = append(actual, addr.String())
+			}
+			require.Equal(t, tt.expected, actual)
+		})
+	}
+
+	_, err := listenMultiaddrs("localhost:5001")
+	require.EqualError(t, err, "router address host localhost has to be an IP")
+}
+
+func TestAdvertisedMultiaddr(t *testing.T) {
+	tests := []struct {
+		name     string
+		addrs    []string
+		expected string
+	}{
+		{
+			name:     "IPv4 only",
+			addrs:    []string{"/ip4/127.0.0.1/tcp/5001", "/ip4/10.0.0.1/tcp/5001"},
+			expected: "/ip4/10.0.0.1/tcp/5001",
+		},
+		{
+			name:     "dual-stack prefers IPv4",
+			addrs:    []string{"/ip6/::1/tcp/5001", "/ip6/fd00::1/tcp/5001", "/ip4/127.0.0.1/tcp/5001", "/ip4/10.0.0.1/tcp/5001"},
+			expected: "/ip4/10.0.0.1/tcp/5001",
+		},
+		{
+			name:     "IPv6 only skips link-local",
+			addrs:    []string{"/ip6/::1/tcp/5001", "/ip6/fe80::1/tcp/5001", "/ip6/fd00::1/tcp/5001"},
+			expected: "/ip6/fd00::1/tcp/5001",
+		},
+		{
+			name:  "only loopback",
+			addrs: []string{"/ip4/127.0.0.1/tcp/5001", "/ip6/::1/tcp/5001"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs := []multiaddr.Multiaddr{}
+			for _, s := range tt.addrs {
+				addrs = append(addrs, multiaddr.StringCast(s))
+			}
+			addr, ok := advertisedMultiaddr(addrs)
+			if tt.expected == "" {
+				require.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			require.Equal(t, tt.expected, addr.String())
+		})
+	}
+}
+
+func TestMultiaddrIP(t *testing.T) {
+	v, err := multiaddrIP(multiaddr.StringCast("/ip4/10.0.0.1/tcp/5001"))
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1", v)
+	v, err = multiaddrIP(multiaddr.StringCast("/ip6/fd00::1/tcp/5001"))
+	require.NoError(t, err)
+	require.Equal(t, "fd00::1", v)
+	_, err = multiaddrIP(multiaddr.StringCast("/dns4/example.com/tcp/5001"))
+	require.Error(t, err)
+}
@@ -0,0 +1,91 @@
+package routing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// validityProviderStore expires provider records after the validity. The provider manager of the DHT expires records
+// after a package variable which would be shared by all routers in the process, so records are filtered by the time they were added instead.
+type validityProviderStore struct {
+	providers.ProviderStore
+	mx       sync.Mutex
+	validity time.Duration
+	added    map[string]map[peer.ID]time.Time
+	now      func() time.Time
+}
+
+func newValidityProviderStore(store providers.ProviderStore, validity time.Duration) *validityProviderStore {
+	return &validityProviderStore{
+		ProviderStore: store,
+		validity:      validity,
+		added:         map[string]map[peer.ID]time.Time{},
+		now:           time.Now,
+	}
+}
+
+func (s *validityProviderStore) AddProvider(ctx context.Context, key []byte, prov peer.AddrInfo) error {
+	s.mx.Lock()
+	provs, ok := s.added[string(key)]
+	if !ok {
+		provs = map[peer.ID]time.Time{}
+		s.added[string(key)] = provs
+	}
+	provs[prov.ID] = s.now()
+	s.mx.Unlock()
+	return s.ProviderStore.AddProvider(ctx, key, prov)
+}
+
+func (s *validityProviderStore) GetProviders(ctx context.Context, key []byte) ([]peer.AddrInfo, error) {
+	infos, err := s.ProviderStore.GetProviders(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.expire(string(key))
+	provs := s.added[string(key)]
+	valid := []peer.AddrInfo{}
+	for _, info := range infos {
+		if _, ok := provs[info.ID]; !ok {
+			continue
+		}
+		valid = append(valid, info)
+	}
+	return valid, nil
+}
+
+// Run removes expired records at the validity interval until the context is cancelled, so that keys which are never looked up are not kept forever.
+func (s *validityProviderStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.validity)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mx.Lock()
+			for key := range s.added {
+				s.expire(key)
+			}
+			s.mx.Unlock()
+		}
+	}
+}
+
+func (s *validityProviderStore) expire(key string) {
+	now := s.now()
+	provs := s.added[key]
+	for id, t := range provs {
+		if now.Sub(t) > s.validity {
+			delete(provs, id)
+		}
+	}
+	if len(provs) == 0 {
+		delete(s.added, key)
+	}
+}
@@ -0,0 +1,56 @@
+package routing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+type mockProviderStore struct {
+	provs map[string][]peer.AddrInfo
+}
+
+func (m *mockProviderStore) AddProvider(ctx context.Context, key []byte, prov peer.AddrInfo) error {
+	m.provs[string(key)] = append(m.provs[string(key)], prov)
+	return nil
+}
+
+func (m *mockProviderStore) GetProviders(ctx context.Context, key []byte) ([]peer.AddrInfo, error) {
+	return m.provs[string(key)], nil
+}
+
+func (m *mockProviderStore) Close() error {
+	return nil
+}
+
+func TestValidityProviderStore(t *testing.T) {
+	now := time.Now()
+	store := newValidityProviderStore(&mockProviderStore{provs: map[string][]peer.AddrInfo{}}, time.Minute)
+	store.now = func() time.Time {
+		return now
+	}
+
+	err := store.AddProvider(context.TODO(), []byte("foo"), peer.AddrInfo{ID: "a"})
+	require.NoError(t, err)
+	now = now.Add(30 * time.Second)
+	err = store.AddProvider(context.TODO(), []byte("foo"), peer.AddrInfo{ID: "b"})
+	require.NoError(t, err)
+	infos, err := store.GetProviders(context.TODO(), []byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, []peer.AddrInfo{{ID: "a"}, {ID: "b"}}, infos)
+
+	// Records expire after the validity even though the DHT provider store still returns them.
+	now = now.Add(45 * time.Second)
+	infos, err = store.GetProviders(context.TODO(), []byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, []peer.AddrInfo{{ID: "b"}}, infos)
+
+	now = now.Add(time.Minute)
+	infos, err = store.GetProviders(context.TODO(), []byte("foo"))
+	require.NoError(t, err)
+	require.Empty(t, infos)
+	require.Empty(t, store.added)
+}
@@ -2,14 +2,145 @@ package routing
 
 import (
 	"context"
+	"fmt"
 	"time"
 )
 
+// KeyTTL is the default duration that advertised keys are valid for.
 const KeyTTL = 10 * time.Minute
 
+// AdvertiseInterval returns the interval at which keys are advertised again so that they are refreshed before the TTL expires.
+func AdvertiseInterval(keyTTL time.Duration) time.Duration {
+	return keyTTL - keyTTL/10
+}
+
+type refreshContextKey struct{}
+
+// WithRefresh marks advertisements made with the context as part of advertising all keys of the node again,
+// as opposed to advertising the keys of a single image.
+func WithRefresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, refreshContextKey{}, true)
+}
+
+func isRefresh(ctx context.Context) bool {
+	refresh, _ := ctx.Value(refreshContextKey{}).(bool)
+	return refresh
+}
+
+// AdvertiseError is returned for each key that could not be advertised, the remaining keys are still advertised.
+type AdvertiseError struct {
+	Key string
+	Err error
+}
+
+func (e *AdvertiseError) Error() string {
+	return fmt.Sprintf("could not advertise key %s: %v", e.Key, e.Err)
+}
+
+func (e *AdvertiseError) Unwrap() error {
+	return e.Err
+}
+
+// FailedKeys returns the keys of all advertise errors wrapped or joined in the error.
+func FailedKeys(err error) []string {
+	keys := []string{}
+	switch e := err.(type) {
+	case *AdvertiseError:
+		keys = append(keys, e.Key)
+	case interface{ Unwrap() []error }:
+		for _, err := range e.Unwrap() {
+			keys = append(keys, FailedKeys(err)...)
+		}
+	case interface{ Unwrap() error }:
+		keys = append(keys, FailedKeys(e.Unwrap())...)
+	}
+	return keys
+}
+
 type Router interface {
 	Close() error
 	Resolve(ctx context.Context, key string, allowSelf bool, count int) (<-chan string, error)
 	Advertise(ctx context.Context, keys []string) error
+	Withdraw(ctx context.Context, keys []string) error
+	Depart(ctx context.Context) error
 	HasMirrors() (bool, error)
 }
+
+// KeySchema versions the format of keys stored in the routing table.
+// Changing the format of keys would cause cache misses between nodes running different
+// versions, so multiple schemas can be used at the same time during a migration window.
+type KeySchema string
+
+const (
+	// KeySchemaV0 uses the key as is.
+	KeySchemaV0 KeySchema = "v0"
+	// KeySchemaV1 prefixes the key with the schema version.
+	KeySchemaV1 KeySchema = "v1"
+)
+
+// ParseKeySchemas parses and deduplicates key schemas, defaulting to v0 when none are given.
+func ParseKeySchemas(values []string) ([]KeySchema, error) {
+	if len(values) == 0 {
+		return []KeySchema{KeySchemaV0}, nil
+	}
+	schemas := []KeySchema{}
+	seen := map[KeySchema]interface{}{}
+	for _, v := range values {
+		schema := KeySchema(v)
+		switch schema {
+		case KeySchemaV0, KeySchemaV1:
+		default:
+			return nil, fmt.Errorf("unknown key schema %s", v)
+		}
+		if _, ok := seen[schema]; ok {
+			continue
+		}
+		seen[schema] = nil
+		schemas = append(schemas, schema)
+	}
+	return schemas, nil
+}
+
+func (k KeySchema) Encode(key string) string {
+	switch k {
+	case KeySchemaV1:
+		return fmt.Sprintf("spegel/%s/%s", k, key)
+	default:
+		return key
+	}
+}
+
+// ResolveMirrors collects up to count mirrors for the key, ranked in the order they were found.
+// After the first mirror has been found it waits at most window for additional mirrors.
+func ResolveMirrors(ctx context.Context, router Router, key string, allowSelf bool, count int, window time.Duration) ([]string, error) {
+	peerCh, err := router.Resolve(ctx, key, allowSelf, count)
+	if err != nil {
+		return nil, err
+	}
+	mirrors := []string{}
+	seen := map[string]interface{}{}
+	var windowCh <-chan time.Time
+	for len(mirrors) < count {
+		select {
+		case <-ctx.Done():
+			return mirrors, nil
+		case <-windowCh:
+			return mirrors, nil
+		case mirror, ok := <-peerCh:
+			if !ok {
+				return mirrors, nil
+			}
+			if _, ok := seen[mirror]; ok {
+				continue
+			}
+			seen[mirror] = nil
+			mirrors = append(mirrors, mirror)
+			if windowCh == nil {
+				timer := time.NewTimer(window)
+				defer timer.Stop()
+				windowCh = timer.C
+			}
+		}
+	}
+	return mirrors, nil
+}
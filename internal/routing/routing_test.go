@@ -0,0 +1,77 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeySchemas(t *testing.T) {
+	schemas, err := ParseKeySchemas(nil)
+	require.NoError(t, err)
+	require.Equal(t, []KeySchema{KeySchemaV0}, schemas)
+
+	schemas, err = ParseKeySchemas([]string{"v1", "v0", "v1"})
+	require.NoError(t, err)
+	require.Equal(t, []KeySchema{KeySchemaV1, KeySchemaV0}, schemas)
+
+	_, err = ParseKeySchemas([]string{"v2"})
+	require.EqualError(t, err, "unknown key schema v2")
+}
+
+func TestKeySchemaEncode(t *testing.T) {
+	key := "sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020"
+	require.Equal(t, key, KeySchemaV0.Encode(key))
+	require.Equal(t, "spegel/v1/"+key, KeySchemaV1.Encode(key))
+}
+
+func TestAdvertiseInterval(t *testing.T) {
+	require.Equal(t, 9*time.Minute, AdvertiseInterval(KeyTTL))
+	require.Equal(t, 54*time.Minute, AdvertiseInterval(time.Hour))
+}
+
+func TestFailedKeys(t *testing.T) {
+	require.Empty(t, FailedKeys(nil))
+	require.Empty(t, FailedKeys(errors.New("provide failed")))
+	err := errors.Join(&AdvertiseError{Key: "foo", Err: errors.New("provide failed")}, errors.New("other"), &AdvertiseError{Key: "bar", Err: context.Canceled})
+	err = fmt.Errorf("could not advertise images: %w", err)
+	require.Equal(t, []string{"foo", "bar"}, FailedKeys(err))
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestMockRouterResolveCount(t *testing.T) {
+	router := NewMockRouter(map[string][]string{"dup": {"a", "a", "a", "b", "c"}})
+	peerCh, err := router.Resolve(context.TODO(), "dup", false, 2)
+	require.NoError(t, err)
+	peers := []string{}
+	for peer := range peerCh {
+		peers = append(peers, peer)
+	}
+	require.Equal(t, []string{"a", "b"}, peers)
+}
+
+func TestResolveMirrors(t *testing.T) {
+	router := NewMockRouter(map[string][]string{"foo": {"a", "b", "c"}, "dup": {"a", "a", "b"}})
+
+	mirrors, err := ResolveMirrors(context.TODO(), router, "foo", false, 2, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, mirrors)
+
+	mirrors, err = ResolveMirrors(context.TODO(), router, "foo", false, 5, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, mirrors)
+
+	mirrors, err = ResolveMirrors(context.TODO(), router, "dup", false, 2, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, mirrors)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	mirrors, err = ResolveMirrors(ctx, router, "bar", false, 5, time.Second)
+	require.NoError(t, err)
+	require.Empty(t, mirrors)
+}
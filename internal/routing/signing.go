@@ -0,0 +1,69 @@
+package routing
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// WithSignedMirrors resolves peers to mirrors that carry the peer ID of the provider record as the URL fragment,
+// so that responses can be verified to be signed by the peer that advertised the key. Provider records are only
+// accepted by the DHT from the peer they provide for, which means that the peer ID of a record cannot be forged
+// while the address of it can. The fragment is never sent with requests.
+func WithSignedMirrors() P2PRouterOption {
+	return func(r *P2PRouter) {
+		r.signedMirrors = true
+	}
+}
+
+// signedMirror returns the mirror of the peer address with the peer ID as the fragment.
+func signedMirror(mirror string, id peer.ID) string {
+	return fmt.Sprintf("%s#%s", mirror, id.String())
+}
+
+// MirrorPeerID returns the peer ID of a mirror resolved with signed mirrors.
+func MirrorPeerID(mirror string) (string, bool) {
+	u, err := url.Parse(mirror)
+	if err != nil || u.Fragment == "" {
+		return "", false
+	}
+	return u.Fragment, true
+}
+
+// Sign signs the data with the private key of the host and returns the peer ID of the host together with the signature.
+func (r *P2PRouter) Sign(b []byte) (string, []byte, error) {
+	privKey := r.host.Peerstore().PrivKey(r.host.ID())
+	if privKey == nil {
+		return "", nil, fmt.Errorf("private key of host %s not found", r.host.ID())
+	}
+	sig, err := privKey.Sign(b)
+	if err != nil {
+		return "", nil, err
+	}
+	return r.host.ID().String(), sig, nil
+}
+
+// VerifySignature verifies that the data was signed by the peer. The public key is extracted from the peer ID
+// when it is embedded, and is otherwise looked up in the peer store of peers that the host has connected to.
+func (r *P2PRouter) VerifySignature(id string, b, sig []byte) error {
+	pid, err := peer.Decode(id)
+	if err != nil {
+		return fmt.Errorf("could not decode peer ID %s: %w", id, err)
+	}
+	pubKey, err := pid.ExtractPublicKey()
+	if err != nil {
+		pubKey = r.host.Peerstore().PubKey(pid)
+	}
+	if pubKey == nil {
+		return fmt.Errorf("public key of peer %s not found", id)
+	}
+	ok, err := pubKey.Verify(b, sig)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("signature does not match peer %s", id)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	routers := []*P2PRouter{}
+	for i := 0; i < 2; i++ {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			h.Close()
+		})
+		routers = append(routers, &P2PRouter{host: h})
+	}
+
+	id, sig, err := routers[0].Sign([]byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, routers[0].host.ID().String(), id)
+	err = routers[1].VerifySignature(id, []byte("foo"), sig)
+	require.NoError(t, err)
+	err = routers[1].VerifySignature(id, []byte("bar"), sig)
+	require.EqualError(t, err, "signature does not match peer "+id)
+	err = routers[1].VerifySignature(routers[1].host.ID().String(), []byte("foo"), sig)
+	require.Error(t, err)
+	err = routers[1].VerifySignature("foo", []byte("foo"), sig)
+	require.Error(t, err)
+}
+
+func TestMirrorPeerID(t *testing.T) {
+	id, err := peer.Decode("12D3KooWRJ9BrHnCcFJ6KFSvs7y2BJu1kT5M8F4wvJC3B2jbSMyT")
+	require.NoError(t, err)
+	mirror := signedMirror("http://10.0.0.1:5000", id)
+	require.Equal(t, "http://10.0.0.1:5000#12D3KooWRJ9BrHnCcFJ6KFSvs7y2BJu1kT5M8F4wvJC3B2jbSMyT", mirror)
+	peerID, ok := MirrorPeerID(mirror)
+	require.True(t, ok)
+	require.Equal(t, id.String(), peerID)
+
+	_, ok = MirrorPeerID("http://10.0.0.1:5000")
+	require.False(t, ok)
+}
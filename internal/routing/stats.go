@@ -0,0 +1,112 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Protocol used to request the stats of peers.
+const statsProtocol = protocol.ID("/spegel/stats/1.0.0")
+
+// Max duration waited for a peer to respond with its stats.
+const statsTimeout = 5 * time.Second
+
+// Stats is a summary of the state of a node which is shared with peers, so that stats of the cluster can be aggregated from any node.
+type Stats struct {
+	Peer           string  `json:"peer"`
+	Version        string  `json:"version,omitempty"`
+	AdvertisedKeys float64 `json:"advertisedKeys"`
+	MirrorRequests float64 `json:"mirrorRequests"`
+	MirrorHits     float64 `json:"mirrorHits"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// StatsFunc returns the stats of the local node.
+type StatsFunc func() (Stats, error)
+
+// WithStats serves the stats of the node to peers requesting them.
+func WithStats(fn StatsFunc) P2PRouterOption {
+	return func(r *P2PRouter) {
+		r.stats = fn
+	}
+}
+
+func (r *P2PRouter) statsHandler(log logr.Logger) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+		//nolint:errcheck // ignore
+		s.SetWriteDeadline(time.Now().Add(statsTimeout))
+		err := json.NewEncoder(s).Encode(r.localStats(s.Conn().LocalPeer()))
+		if err != nil {
+			log.Error(err, "could not write stats to peer", "peer", s.Conn().RemotePeer().Pretty())
+		}
+	}
+}
+
+func (r *P2PRouter) localStats(id peer.ID) Stats {
+	if r.stats == nil {
+		return Stats{Peer: id.Pretty(), Error: "stats are not enabled"}
+	}
+	stats, err := r.stats()
+	stats.Peer = id.Pretty()
+	if err != nil {
+		stats.Error = err.Error()
+	}
+	return stats
+}
+
+// GatherStats returns the stats of the node and all connected peers, sorted by peer ID.
+// Peers that could not be reached or do not serve stats are included with the error.
+func (r *P2PRouter) GatherStats(ctx context.Context) []Stats {
+	peers := r.host.Network().Peers()
+	mx := sync.Mutex{}
+	result := []Stats{r.localStats(r.host.ID())}
+	wg := sync.WaitGroup{}
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			stats, err := r.requestStats(ctx, p)
+			if err != nil {
+				stats = Stats{Error: err.Error()}
+			}
+			stats.Peer = p.Pretty()
+			mx.Lock()
+			defer mx.Unlock()
+			result = append(result, stats)
+		}(p)
+	}
+	wg.Wait()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Peer < result[j].Peer
+	})
+	return result
+}
+
+func (r *P2PRouter) requestStats(ctx context.Context, p peer.ID) (Stats, error) {
+	ctx, cancel := context.WithTimeout(ctx, statsTimeout)
+	defer cancel()
+	s, err := r.host.NewStream(ctx, p, statsProtocol)
+	if err != nil {
+		return Stats{}, fmt.Errorf("could not request stats: %w", err)
+	}
+	defer s.Close()
+	deadline, _ := ctx.Deadline()
+	//nolint:errcheck // ignore
+	s.SetReadDeadline(deadline)
+	stats := Stats{}
+	err = json.NewDecoder(s).Decode(&stats)
+	if err != nil {
+		return Stats{}, fmt.Errorf("could not read stats: %w", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,51 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGatherStats(t *testing.T) {
+	newRouter := func(fn StatsFunc) *P2PRouter {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			h.Close()
+		})
+		r := &P2PRouter{host: h}
+		WithStats(fn)(r)
+		h.SetStreamHandler(statsProtocol, r.statsHandler(logr.Discard()))
+		return r
+	}
+	r1 := newRouter(func() (Stats, error) {
+		return Stats{Version: "v1", AdvertisedKeys: 10, MirrorRequests: 4, MirrorHits: 3}, nil
+	})
+	r2 := newRouter(func() (Stats, error) {
+		return Stats{Version: "v2", AdvertisedKeys: 5}, nil
+	})
+	r3 := newRouter(func() (Stats, error) {
+		return Stats{}, fmt.Errorf("metrics unavailable")
+	})
+	r4 := newRouter(nil)
+	for _, r := range []*P2PRouter{r2, r3, r4} {
+		err := r1.host.Connect(context.Background(), peer.AddrInfo{ID: r.host.ID(), Addrs: r.host.Addrs()})
+		require.NoError(t, err)
+	}
+
+	stats := r1.GatherStats(context.Background())
+	require.Len(t, stats, 4)
+	byPeer := map[string]Stats{}
+	for _, s := range stats {
+		byPeer[s.Peer] = s
+	}
+	require.Equal(t, Stats{Peer: r1.host.ID().Pretty(), Version: "v1", AdvertisedKeys: 10, MirrorRequests: 4, MirrorHits: 3}, byPeer[r1.host.ID().Pretty()])
+	require.Equal(t, Stats{Peer: r2.host.ID().Pretty(), Version: "v2", AdvertisedKeys: 5}, byPeer[r2.host.ID().Pretty()])
+	require.Equal(t, "metrics unavailable", byPeer[r3.host.ID().Pretty()].Error)
+	require.Equal(t, "stats are not enabled", byPeer[r4.host.ID().Pretty()].Error)
+}
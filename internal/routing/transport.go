@@ -0,0 +1,144 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Protocol used to transfer registry requests and responses over libp2p streams.
+const blobProtocol = protocol.ID("/spegel/blob/1.0.0")
+
+// WithStreamTransport resolves peers to mirrors that are reached over libp2p streams instead of the registry port.
+// Streams are encrypted and authenticated with the peer identity, and are multiplexed over the connection of the host.
+// All peers have to serve the registry on the listener returned by Listen.
+func WithStreamTransport() P2PRouterOption {
+	return func(r *P2PRouter) {
+		r.streamTransport = true
+	}
+}
+
+// streamMirror returns the mirror of the peer when using the stream transport. The peer ID is encoded as a
+// CID as host names are case insensitive, and the URL is only used to route the request to the peer.
+func streamMirror(id peer.ID) string {
+	return fmt.Sprintf("http://%s", peer.ToCid(id).String())
+}
+
+// DialContext opens a stream to the peer of a mirror returned when using the stream transport.
+// It can be used as the dial function of an HTTP transport.
+func (r *P2PRouter) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	id, err := peer.Decode(h)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode peer ID %s: %w", h, err)
+	}
+	s, err := r.host.NewStream(ctx, id, blobProtocol)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamConn(s), nil
+}
+
+// Listen returns a listener accepting streams from peers as connections, so that the registry can be served to peers
+// with an HTTP server. Closing the listener stops accepting streams.
+func (r *P2PRouter) Listen() net.Listener {
+	l := &streamListener{
+		addr:    streamAddr(r.host.ID().String()),
+		connCh:  make(chan net.Conn),
+		closeCh: make(chan interface{}),
+		close: func() {
+			r.host.RemoveStreamHandler(blobProtocol)
+		},
+	}
+	r.host.SetStreamHandler(blobProtocol, l.handleStream)
+	return l
+}
+
+type streamListener struct {
+	addr      net.Addr
+	connCh    chan net.Conn
+	closeCh   chan interface{}
+	closeOnce sync.Once
+	close     func()
+}
+
+func (l *streamListener) handleStream(s network.Stream) {
+	select {
+	case <-l.closeCh:
+		//nolint:errcheck // ignore
+		s.Reset()
+	case l.connCh <- newStreamConn(s):
+	}
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closeCh:
+		return nil, net.ErrClosed
+	case conn := <-l.connCh:
+		return conn, nil
+	}
+}
+
+func (l *streamListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.close()
+		close(l.closeCh)
+	})
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return l.addr
+}
+
+// streamConn is a stream with the network addresses of the underlying connection, so that the IP of the peer
+// is known when serving requests.
+type streamConn struct {
+	network.Stream
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func newStreamConn(s network.Stream) *streamConn {
+	c := &streamConn{
+		Stream:     s,
+		localAddr:  streamAddr(s.Conn().LocalPeer().String()),
+		remoteAddr: streamAddr(s.Conn().RemotePeer().String()),
+	}
+	if addr, err := manet.ToNetAddr(s.Conn().LocalMultiaddr()); err == nil {
+		c.localAddr = addr
+	}
+	if addr, err := manet.ToNetAddr(s.Conn().RemoteMultiaddr()); err == nil {
+		c.remoteAddr = addr
+	}
+	return c
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// streamAddr is the address of a peer that is not reachable through a network address.
+type streamAddr string
+
+func (a streamAddr) Network() string {
+	return "libp2p"
+}
+
+func (a streamAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,77 @@
+package routing
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamTransport(t *testing.T) {
+	newRouter := func() *P2PRouter {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			h.Close()
+		})
+		return &P2PRouter{host: h}
+	}
+	server := newRouter()
+	client := newRouter()
+	err := client.host.Connect(context.Background(), peer.AddrInfo{ID: server.host.ID(), Addrs: server.host.Addrs()})
+	require.NoError(t, err)
+
+	l := server.Listen()
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			host, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			//nolint:errcheck // ignore
+			w.Write([]byte(req.URL.Path + " " + host))
+		}),
+	}
+	//nolint:errcheck // ignore
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		srv.Close()
+	})
+
+	mirror := streamMirror(server.host.ID())
+	u, err := url.Parse(mirror)
+	require.NoError(t, err)
+	id, err := peer.Decode(u.Hostname())
+	require.NoError(t, err)
+	require.Equal(t, server.host.ID(), id)
+
+	httpClient := &http.Client{Transport: &http.Transport{DialContext: client.DialContext}}
+	for i := 0; i < 3; i++ {
+		resp, err := httpClient.Get(mirror + "/v2/library/ubuntu/blobs/sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020")
+		require.NoError(t, err)
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "/v2/library/ubuntu/blobs/sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020 127.0.0.1", string(b))
+	}
+
+	_, err = client.DialContext(context.Background(), "tcp", "foo:80")
+	require.ErrorContains(t, err, "could not decode peer ID foo")
+
+	err = l.Close()
+	require.NoError(t, err)
+	_, err = l.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+	httpClient.CloseIdleConnections()
+	//nolint:bodyclose // response is nil on error
+	_, err = httpClient.Get(mirror + "/v2/")
+	require.Error(t, err)
+}
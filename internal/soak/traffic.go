@@ -0,0 +1,187 @@
+package soak
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/xenitab/spegel/internal/oci"
+)
+
+var soakRequestsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "spegel_soak_requests_total",
+		Help: "Total number of synthetic pull requests made in soak test mode.",
+	},
+	[]string{"result"},
+)
+
+var soakRequestDuration = promauto.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "spegel_soak_request_duration_seconds",
+		Help:    "Duration of successful synthetic pull requests made in soak test mode.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	},
+)
+
+var soakBytesTotal = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "spegel_soak_bytes_total",
+		Help: "Total number of bytes received by synthetic pull requests made in soak test mode.",
+	},
+)
+
+// Summary is the outcome of generated pull traffic.
+type Summary struct {
+	Requests int64
+	Failures int64
+	Bytes    int64
+	Duration time.Duration
+}
+
+func (s Summary) String() string {
+	seconds := s.Duration.Seconds()
+	if seconds == 0 {
+		seconds = 1
+	}
+	return fmt.Sprintf("requests=%d failures=%d bytes=%d duration=%s rps=%.1f throughput=%.0fB/s", s.Requests, s.Failures, s.Bytes, s.Duration, float64(s.Requests)/seconds, float64(s.Bytes)/seconds)
+}
+
+// Traffic pulls random digests of the images through random targets at a fixed rate.
+type Traffic struct {
+	client      *http.Client
+	targets     []url.URL
+	digests     map[digest.Digest]oci.Image
+	rate        float64
+	concurrency int
+}
+
+// NewTraffic creates pull traffic for the workload at the rate of requests per second with at most concurrency requests in flight.
+// Targets are the registry addresses of Spegel instances, requests are made as if they were mirrored by Containerd.
+func NewTraffic(client *http.Client, targets []url.URL, workload *Workload, rate float64, concurrency int) (*Traffic, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("at least one target has to be set")
+	}
+	if rate <= 0 {
+		return nil, fmt.Errorf("rate has to be larger than zero")
+	}
+	if concurrency <= 0 {
+		return nil, fmt.Errorf("concurrency has to be larger than zero")
+	}
+	digests := map[digest.Digest]oci.Image{}
+	for _, img := range workload.Images() {
+		keys, err := workload.GetImageDigests(context.Background(), img)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			digests[digest.Digest(key)] = img
+		}
+	}
+	return &Traffic{
+		client:      client,
+		targets:     targets,
+		digests:     digests,
+		rate:        rate,
+		concurrency: concurrency,
+	}, nil
+}
+
+// Run generates traffic until the context is cancelled, requests are dropped when the concurrency is reached.
+func (t *Traffic) Run(ctx context.Context) Summary {
+	log := logr.FromContextOrDiscard(ctx)
+	//nolint:gosec // requests only have to be spread out
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	dgsts := make([]digest.Digest, 0, len(t.digests))
+	for dgst := range t.digests {
+		dgsts = append(dgsts, dgst)
+	}
+
+	mx := sync.Mutex{}
+	summary := Summary{}
+	sem := make(chan interface{}, t.concurrency)
+	wg := sync.WaitGroup{}
+	start := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / t.rate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			summary.Duration = time.Since(start)
+			return summary
+		case <-ticker.C:
+			target := t.targets[rnd.Intn(len(t.targets))]
+			dgst := dgsts[rnd.Intn(len(dgsts))]
+			select {
+			case sem <- nil:
+			default:
+				log.V(5).Info("dropping request as max concurrency has been reached")
+				soakRequestsTotal.WithLabelValues("dropped").Inc()
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				reqStart := time.Now()
+				n, err := t.pull(ctx, target, t.digests[dgst], dgst)
+				// Requests aborted when traffic stops are not counted.
+				if err != nil && ctx.Err() != nil {
+					return
+				}
+				mx.Lock()
+				defer mx.Unlock()
+				summary.Requests++
+				summary.Bytes += n
+				soakBytesTotal.Add(float64(n))
+				if err != nil {
+					summary.Failures++
+					soakRequestsTotal.WithLabelValues("failure").Inc()
+					log.Error(err, "synthetic pull failed", "target", target.String(), "digest", dgst.String())
+					return
+				}
+				soakRequestsTotal.WithLabelValues("success").Inc()
+				soakRequestDuration.Observe(time.Since(reqStart).Seconds())
+			}()
+		}
+	}
+}
+
+// pull requests the digest as a blob through the target and verifies the received content.
+func (t *Traffic) pull(ctx context.Context, target url.URL, img oci.Image, dgst digest.Digest) (int64, error) {
+	u := target
+	u.Path = fmt.Sprintf("/v2/%s/blobs/%s", img.Repository, dgst)
+	u.RawQuery = url.Values{"ns": []string{img.Registry}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("expected target to respond with 200 OK but received: %s", resp.Status)
+	}
+	verifier := dgst.Verifier()
+	n, err := io.Copy(verifier, resp.Body)
+	if err != nil {
+		return n, err
+	}
+	if !verifier.Verified() {
+		return n, fmt.Errorf("received content does not match digest %s", dgst)
+	}
+	return n, nil
+}
@@ -0,0 +1,44 @@
+package soak
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraffic(t *testing.T) {
+	sizes, err := ParseSizeDistribution(map[int64]int{1000: 1})
+	require.NoError(t, err)
+	w, err := NewWorkload("soak.example.com", 1, 2, 2, sizes)
+	require.NoError(t, err)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rc, err := w.GetBlobReader(r.Context(), digest.Digest(path.Base(r.URL.Path)))
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(rw, r, "", time.Time{}, rc)
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	traffic, err := NewTraffic(srv.Client(), []url.URL{*u}, w, 200, 5)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.TODO(), 200*time.Millisecond)
+	defer cancel()
+	summary := traffic.Run(ctx)
+	require.Greater(t, summary.Requests, int64(0))
+	require.Equal(t, int64(0), summary.Failures)
+	require.Greater(t, summary.Bytes, int64(0))
+
+	_, err = NewTraffic(srv.Client(), nil, w, 200, 5)
+	require.EqualError(t, err, "at least one target has to be set")
+}
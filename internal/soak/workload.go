@@ -0,0 +1,316 @@
+package soak
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/xenitab/spegel/internal/oci"
+)
+
+// Size of blocks that synthetic layer content is generated in.
+const blockSize = 4096
+
+// SizeDistribution samples layer sizes in bytes with a probability proportional to their weight.
+type SizeDistribution struct {
+	sizes   []int64
+	weights []int
+	total   int
+}
+
+// ParseSizeDistribution parses weights keyed by size in bytes, for example 1048576=9 and 104857600=1 generates
+// one in ten layers with a size of 100 MiB and the rest with a size of 1 MiB.
+func ParseSizeDistribution(weights map[int64]int) (SizeDistribution, error) {
+	if len(weights) == 0 {
+		return SizeDistribution{}, fmt.Errorf("size distribution needs to contain at least one size")
+	}
+	d := SizeDistribution{}
+	for size := range weights {
+		d.sizes = append(d.sizes, size)
+	}
+	sort.Slice(d.sizes, func(i, j int) bool { return d.sizes[i] < d.sizes[j] })
+	for _, size := range d.sizes {
+		weight := weights[size]
+		if size <= 0 {
+			return SizeDistribution{}, fmt.Errorf("size %d has to be larger than zero", size)
+		}
+		if weight <= 0 {
+			return SizeDistribution{}, fmt.Errorf("weight of size %d has to be larger than zero", size)
+		}
+		d.weights = append(d.weights, weight)
+		d.total += weight
+	}
+	return d, nil
+}
+
+func (d SizeDistribution) Sample(rnd *rand.Rand) int64 {
+	n := rnd.Intn(d.total)
+	for i, weight := range d.weights {
+		if n < weight {
+			return d.sizes[i]
+		}
+		n -= weight
+	}
+	return d.sizes[len(d.sizes)-1]
+}
+
+func (d SizeDistribution) String() string {
+	parts := []string{}
+	for i, size := range d.sizes {
+		parts = append(parts, fmt.Sprintf("%d=%d", size, d.weights[i]))
+	}
+	return strings.Join(parts, ",")
+}
+
+type blob struct {
+	mediaType string
+	data      []byte
+	seed      int64
+	size      int64
+}
+
+// Workload is a set of synthetic images that is served as an OCI client, so that the images are advertised
+// and served like images pulled by Containerd. Layer content is generated on read and never kept in memory.
+// Workloads generated with the same options contain the same images.
+type Workload struct {
+	images []oci.Image
+	blobs  map[digest.Digest]blob
+	keys   map[digest.Digest][]string
+}
+
+var _ oci.Client = &Workload{}
+
+// NewWorkload generates the amount of images with the amount of layers each, with layer sizes sampled from the distribution.
+func NewWorkload(registry string, seed int64, imageCount, layerCount int, sizes SizeDistribution) (*Workload, error) {
+	w := &Workload{
+		blobs: map[digest.Digest]blob{},
+		keys:  map[digest.Digest][]string{},
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	for i := 0; i < imageCount; i++ {
+		manifest := ocispec.Manifest{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Layers:    []ocispec.Descriptor{},
+		}
+		manifest.SchemaVersion = 2
+		for j := 0; j < layerCount; j++ {
+			layerSeed := rnd.Int63()
+			size := sizes.Sample(rnd)
+			dgst, err := digest.FromReader(newContentReader(layerSeed, size))
+			if err != nil {
+				return nil, err
+			}
+			w.blobs[dgst] = blob{mediaType: ocispec.MediaTypeImageLayerGzip, seed: layerSeed, size: size}
+			manifest.Layers = append(manifest.Layers, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: dgst, Size: size})
+		}
+		configDesc, err := w.addDocument(ocispec.MediaTypeImageConfig, ocispec.Image{
+			Platform: ocispec.Platform{Architecture: "amd64", OS: "linux"},
+			RootFS:   ocispec.RootFS{Type: "layers"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		manifest.Config = configDesc
+		manifestDesc, err := w.addDocument(ocispec.MediaTypeImageManifest, manifest)
+		if err != nil {
+			return nil, err
+		}
+		keys := []string{manifestDesc.Digest.String(), configDesc.Digest.String()}
+		for _, layer := range manifest.Layers {
+			keys = append(keys, layer.Digest.String())
+		}
+		w.keys[manifestDesc.Digest] = keys
+
+		repository := fmt.Sprintf("soak/image-%d", i)
+		tag := strconv.FormatInt(seed, 10)
+		img, err := oci.NewImage(fmt.Sprintf("%s/%s:%s", registry, repository, tag), registry, repository, tag, manifestDesc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		w.images = append(w.images, img)
+	}
+	return w, nil
+}
+
+func (w *Workload) addDocument(mediaType string, v interface{}) (ocispec.Descriptor, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	dgst := digest.FromBytes(b)
+	w.blobs[dgst] = blob{mediaType: mediaType, data: b, size: int64(len(b))}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(b))}, nil
+}
+
+// Digests returns all digests of the images in the workload.
+func (w *Workload) Digests() []digest.Digest {
+	dgsts := []digest.Digest{}
+	for _, img := range w.images {
+		for _, key := range w.keys[img.Digest] {
+			dgsts = append(dgsts, digest.Digest(key))
+		}
+	}
+	return dgsts
+}
+
+// Images returns the images in the workload.
+func (w *Workload) Images() []oci.Image {
+	return w.images
+}
+
+func (w *Workload) Verify(ctx context.Context) error {
+	return nil
+}
+
+func (w *Workload) Subscribe(ctx context.Context) (<-chan oci.ImageEvent, <-chan error) {
+	return nil, nil
+}
+
+func (w *Workload) ListImages(ctx context.Context) ([]oci.Image, error) {
+	return w.images, nil
+}
+
+func (w *Workload) GetImageDigests(ctx context.Context, img oci.Image) ([]string, error) {
+	keys, ok := w.keys[img.Digest]
+	if !ok {
+		return nil, fmt.Errorf("image not found: %s", img.Name)
+	}
+	return keys, nil
+}
+
+func (w *Workload) ListTags(ctx context.Context, name string) ([]string, error) {
+	tags := []string{}
+	for _, img := range w.images {
+		if fmt.Sprintf("%s/%s", img.Registry, img.Repository) != name {
+			continue
+		}
+		tags = append(tags, img.Tag)
+	}
+	return tags, nil
+}
+
+func (w *Workload) Resolve(ctx context.Context, ref string) (digest.Digest, error) {
+	for _, img := range w.images {
+		if img.Name == ref {
+			return img.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("image not found: %s", ref)
+}
+
+func (w *Workload) GetSize(ctx context.Context, dgst digest.Digest) (int64, error) {
+	b, ok := w.blobs[dgst]
+	if !ok {
+		return 0, fmt.Errorf("digest not found: %s", dgst)
+	}
+	return b.size, nil
+}
+
+func (w *Workload) GetBlobReader(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	b, ok := w.blobs[dgst]
+	if !ok {
+		return nil, fmt.Errorf("digest not found: %s", dgst)
+	}
+	if b.data != nil {
+		return nopCloser{bytes.NewReader(b.data)}, nil
+	}
+	return nopCloser{newContentReader(b.seed, b.size)}, nil
+}
+
+func (w *Workload) GetBlob(ctx context.Context, dgst digest.Digest) ([]byte, string, error) {
+	b, ok := w.blobs[dgst]
+	if !ok || b.data == nil {
+		return nil, "", fmt.Errorf("digest not found: %s", dgst)
+	}
+	return b.data, b.mediaType, nil
+}
+
+func (w *Workload) GetImageConfig(ctx context.Context, dgst digest.Digest) ([]byte, string, error) {
+	for _, img := range w.images {
+		if img.Digest != dgst {
+			continue
+		}
+		return w.GetBlob(ctx, digest.Digest(w.keys[dgst][1]))
+	}
+	return nil, "", fmt.Errorf("image not found: %s", dgst)
+}
+
+func (w *Workload) Pull(ctx context.Context, ref string) error {
+	return errors.New("pulling images is not supported by synthetic workloads")
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// contentReader generates pseudo random content of the size, the content at each offset is the same for the same seed.
+type contentReader struct {
+	seed   int64
+	size   int64
+	offset int64
+	block  []byte
+	index  int64
+}
+
+func newContentReader(seed, size int64) *contentReader {
+	return &contentReader{
+		seed:  seed,
+		size:  size,
+		block: make([]byte, blockSize),
+		index: -1,
+	}
+}
+
+func (r *contentReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && r.offset < r.size {
+		index := r.offset / blockSize
+		if index != r.index {
+			//nolint:gosec // content only has to be deterministic
+			rand.New(rand.NewSource(r.seed ^ index)).Read(r.block)
+			r.index = index
+		}
+		end := int64(blockSize)
+		if remaining := r.size - index*blockSize; remaining < end {
+			end = remaining
+		}
+		c := copy(p[n:], r.block[r.offset-index*blockSize:end])
+		n += c
+		r.offset += int64(c)
+	}
+	return n, nil
+}
+
+func (r *contentReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
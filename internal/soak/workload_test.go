@@ -0,0 +1,80 @@
+package soak
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSizeDistribution(t *testing.T) {
+	sizes, err := ParseSizeDistribution(map[int64]int{100: 3, 10: 1})
+	require.NoError(t, err)
+	require.Equal(t, "10=1,100=3", sizes.String())
+	rnd := rand.New(rand.NewSource(1))
+	counts := map[int64]int{}
+	for i := 0; i < 1000; i++ {
+		counts[sizes.Sample(rnd)]++
+	}
+	require.InDelta(t, 250, counts[10], 50)
+	require.InDelta(t, 750, counts[100], 50)
+
+	_, err = ParseSizeDistribution(map[int64]int{})
+	require.EqualError(t, err, "size distribution needs to contain at least one size")
+	_, err = ParseSizeDistribution(map[int64]int{100: 0})
+	require.EqualError(t, err, "weight of size 100 has to be larger than zero")
+	_, err = ParseSizeDistribution(map[int64]int{-1: 1})
+	require.EqualError(t, err, "size -1 has to be larger than zero")
+}
+
+func TestWorkload(t *testing.T) {
+	sizes, err := ParseSizeDistribution(map[int64]int{5000: 1, 20000: 1})
+	require.NoError(t, err)
+	w, err := NewWorkload("soak.example.com", 1, 3, 2, sizes)
+	require.NoError(t, err)
+	require.Len(t, w.Images(), 3)
+	require.Len(t, w.Digests(), 3*4)
+
+	// Workloads with the same seed contain the same images.
+	other, err := NewWorkload("soak.example.com", 1, 3, 2, sizes)
+	require.NoError(t, err)
+	require.Equal(t, w.Digests(), other.Digests())
+
+	for _, dgst := range w.Digests() {
+		rc, err := w.GetBlobReader(context.TODO(), dgst)
+		require.NoError(t, err)
+		b, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.Equal(t, dgst, digest.FromBytes(b))
+		size, err := w.GetSize(context.TODO(), dgst)
+		require.NoError(t, err)
+		require.Equal(t, size, int64(len(b)))
+	}
+
+	img := w.Images()[0]
+	dgst, err := w.Resolve(context.TODO(), img.Name)
+	require.NoError(t, err)
+	require.Equal(t, img.Digest, dgst)
+	_, mediaType, err := w.GetImageConfig(context.TODO(), img.Digest)
+	require.NoError(t, err)
+	require.Equal(t, "application/vnd.oci.image.config.v1+json", mediaType)
+}
+
+func TestContentReaderSeek(t *testing.T) {
+	b, err := io.ReadAll(newContentReader(1, 10000))
+	require.NoError(t, err)
+	require.Len(t, b, 10000)
+
+	r := newContentReader(1, 10000)
+	_, err = r.Seek(5000, io.SeekStart)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, b[5000:], rest)
+	off, err := r.Seek(-100, io.SeekEnd)
+	require.NoError(t, err)
+	require.Equal(t, int64(9900), off)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -11,47 +12,141 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/xenitab/pkg/channels"
 
+	"github.com/xenitab/spegel/internal/allowlist"
+	"github.com/xenitab/spegel/internal/diskpressure"
+	"github.com/xenitab/spegel/internal/metrics"
 	"github.com/xenitab/spegel/internal/oci"
 	"github.com/xenitab/spegel/internal/routing"
 )
 
-var advertisedImages = promauto.NewGaugeVec(prometheus.GaugeOpts{
-	Name: "spegel_advertised_images",
-	Help: "Number of images advertised to be availible.",
-}, []string{"registry"})
+var imageEventQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "spegel_image_event_queue_depth",
+	Help: "Number of image events waiting to be processed.",
+})
 
-var advertisedKeys = promauto.NewGaugeVec(prometheus.GaugeOpts{
-	Name: "spegel_advertised_keys",
-	Help: "Number of keys advertised to be availible.",
-}, []string{"registry"})
+var imageEventLastTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "spegel_image_event_last_timestamp_seconds",
+	Help: "Unix timestamp of the last processed image event.",
+})
 
-// TODO: Update metrics on subscribed events. This will require keeping state in memory to know about key count changes.
-func Track(ctx context.Context, ociClient oci.Client, router routing.Router, resolveLatestTag bool) {
+var clockJumpsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "spegel_clock_jumps_total",
+	Help: "Total number of detected jumps of the local wall clock.",
+})
+
+var reconcileDuration = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "spegel_state_reconcile_duration_seconds",
+	Help: "Duration of the last full reconcile of advertised images.",
+})
+
+const (
+	// Interval at which the wall clock is compared with the monotonic clock.
+	clockCheckInterval = time.Minute
+	// Difference between wall and monotonic clock progress treated as a clock jump.
+	maxClockJump = 5 * time.Second
+)
+
+// Track advertises images and keeps the advertised keys up to date from image events.
+// Keys are advertised again from memory before the key TTL expires, while images are only listed again
+// at the reconcile interval to pick up images that were removed or missed by the event subscription.
+// Images not allowed by the allow list are not advertised, all images are reconciled when the allow list changes.
+// Keys are reference counted across images, so an image event only advertises keys not already advertised for another image.
+// Keys of images that are removed or no longer allowed are not withdrawn and expire with the key TTL once no image references them.
+// Images are still tracked but keys are not advertised while the node is under disk pressure, so that they expire and peers stop
+// requesting content from the node. All keys are advertised again when the pressure clears.
+// Progress of the first advertisement of all keys is reported to the warm-up when set.
+func Track(ctx context.Context, ociClient oci.Client, router routing.Router, keyTTL, reconcileInterval time.Duration, resolveTags oci.ResolveTags, resolveLatestTag bool, allowList *allowlist.AllowList, pressure *diskpressure.Detector, warmUp *WarmUp) {
 	log := logr.FromContextOrDiscard(ctx)
+	t := newTracker(ociClient, router, resolveTags, resolveLatestTag, allowList, pressure, warmUp)
 	eventCh, errCh := ociClient.Subscribe(ctx)
 	immediate := make(chan time.Time, 1)
 	immediate <- time.Now()
-	expirationTicker := time.NewTicker(routing.KeyTTL - time.Minute)
+	reconcileTicker := time.NewTicker(reconcileInterval)
+	defer reconcileTicker.Stop()
+	reconcileCh := channels.Merge(immediate, reconcileTicker.C)
+	expirationTicker := time.NewTicker(routing.AdvertiseInterval(keyTTL))
 	defer expirationTicker.Stop()
-	ticker := channels.Merge(immediate, expirationTicker.C)
+	// Provider records are expired by wall clock timestamps, so a jump of the wall clock can make them expire early.
+	// Tickers use the monotonic clock which means that refreshes are not delayed by the jump itself,
+	// but keys are advertised again so that records written before the jump are replaced.
+	clockTicker := time.NewTicker(clockCheckInterval)
+	defer clockTicker.Stop()
+	lastClockCheck := time.Now()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker:
-			log.Info("running scheduled image state update")
-			err := all(ctx, ociClient, router, resolveLatestTag)
+		case <-reconcileCh:
+			log.Info("running scheduled image state reconcile")
+			err := t.reconcile(ctx)
+			if err != nil {
+				log.Error(err, "received errors when reconciling all images")
+				continue
+			}
+		case <-expirationTicker.C:
+			log.Info("advertising tracked keys before they expire")
+			err := t.refresh(ctx)
+			if err != nil {
+				log.Error(err, "received error when advertising tracked keys")
+				continue
+			}
+		case <-clockTicker.C:
+			now := time.Now()
+			jump := clockJump(lastClockCheck, now)
+			lastClockCheck = now
+			if jump > -maxClockJump && jump < maxClockJump {
+				continue
+			}
+			clockJumpsTotal.Inc()
+			log.Info("wall clock jump detected, advertising tracked keys again", "jump", jump.String())
+			err := t.refresh(ctx)
+			if err != nil {
+				log.Error(err, "received error when advertising tracked keys")
+				continue
+			}
+		case <-pressure.Changed():
+			if pressure.Pressured() {
+				log.Info("disk pressure detected, pausing advertisement of tracked keys")
+				continue
+			}
+			log.Info("disk pressure cleared, advertising tracked keys again")
+			err := t.refresh(ctx)
+			if err != nil {
+				log.Error(err, "received error when advertising tracked keys")
+				continue
+			}
+		case <-allowList.Changed():
+			log.Info("allow list changed reconciling all images")
+			err := t.reconcile(ctx)
 			if err != nil {
-				log.Error(err, "received errors when updating all images")
+				log.Error(err, "received errors when reconciling all images")
+				continue
+			}
+		case event := <-eventCh:
+			imageEventQueueDepth.Set(float64(len(eventCh)))
+			log.Info("received image event", "image", event.Image, "type", event.Type)
+			if event.Type == oci.ResyncEvent {
+				err := t.reconcile(ctx)
+				if err != nil {
+					log.Error(err, "received errors when reconciling all images")
+				}
+				continue
+			}
+			if event.Type == oci.DeleteEvent {
+				t.remove(ctx, event.Image)
+				continue
+			}
+			if !allowList.Allowed(imageName(event.Image)) {
+				log.V(5).Info("skipping image not in allow list", "image", event.Image)
 				continue
 			}
-		case img := <-eventCh:
-			log.Info("received image event", "image", img)
-			_, err := update(ctx, ociClient, router, img, false, resolveLatestTag)
+			err := t.update(ctx, event.Image)
 			if err != nil {
 				log.Error(err, "received error when updating image")
 				continue
 			}
+			metrics.ImageEventLag.Observe(time.Since(event.Timestamp).Seconds())
+			imageEventLastTimestamp.Set(float64(event.Timestamp.Unix()))
 		case err := <-errCh:
 			log.Error(err, "event channel error")
 			continue
@@ -59,46 +154,283 @@ func Track(ctx context.Context, ociClient oci.Client, router routing.Router, res
 	}
 }
 
-func all(ctx context.Context, ociClient oci.Client, router routing.Router, resolveLatestTag bool) error {
-	imgs, err := ociClient.ListImages(ctx)
+// trackedImage is an advertised image and the keys advertised for it.
+type trackedImage struct {
+	registry  string
+	updatedAt time.Time
+	keys      []string
+}
+
+// tracker keeps the keys of advertised images in memory, keyed by the namespace and name of the image.
+// The number of images referencing each key is counted so that shared keys are only advertised once.
+type tracker struct {
+	ociClient        oci.Client
+	router           routing.Router
+	resolveTags      oci.ResolveTags
+	resolveLatestTag bool
+	allowList        *allowlist.AllowList
+	pressure         *diskpressure.Detector
+	warmUp           *WarmUp
+	images           map[string]trackedImage
+	refs             map[string]int
+	advertised       map[string]interface{}
+}
+
+func newTracker(ociClient oci.Client, router routing.Router, resolveTags oci.ResolveTags, resolveLatestTag bool, allowList *allowlist.AllowList, pressure *diskpressure.Detector, warmUp *WarmUp) *tracker {
+	return &tracker{
+		ociClient:        ociClient,
+		router:           router,
+		resolveTags:      resolveTags,
+		resolveLatestTag: resolveLatestTag,
+		allowList:        allowList,
+		pressure:         pressure,
+		warmUp:           warmUp,
+		images:           map[string]trackedImage{},
+		refs:             map[string]int{},
+		advertised:       map[string]interface{}{},
+	}
+}
+
+// reconcile lists all images and replaces the tracked images before advertising all keys in a single call,
+// so that the router can rate limit the full list of keys.
+func (t *tracker) reconcile(ctx context.Context) error {
+	start := time.Now()
+	defer func() {
+		reconcileDuration.Set(time.Since(start).Seconds())
+	}()
+	imgs, err := t.ociClient.ListImages(ctx)
 	if err != nil {
 		return err
 	}
-	advertisedImages.Reset()
-	advertisedKeys.Reset()
 	errs := []error{}
-	targets := map[string]interface{}{}
+	t.images = map[string]trackedImage{}
+	t.refs = map[string]int{}
+	// Images with the same digest reference the same content, which only has to be walked once.
+	digestKeys := map[string][]string{}
 	for _, img := range imgs {
-		_, skipDigests := targets[img.Digest.String()]
-		keyTotal, err := update(ctx, ociClient, router, img, skipDigests, resolveLatestTag)
-		if err != nil {
-			errs = append(errs, err)
+		if !t.allowList.Allowed(imageName(img)) {
 			continue
 		}
-		targets[img.Digest.String()] = nil
-		advertisedImages.WithLabelValues(img.Registry).Add(1)
-		advertisedKeys.WithLabelValues(img.Registry).Add(float64(keyTotal))
+		dgsts, ok := digestKeys[img.Digest.String()]
+		if !ok {
+			dgsts, err = t.ociClient.GetImageDigests(ctx, img)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("could not get digests for image %s: %w", img.String(), err))
+				continue
+			}
+			digestKeys[img.Digest.String()] = dgsts
+		}
+		t.track(img, append(t.tagKeys(img), dgsts...))
+	}
+	for key := range t.advertised {
+		if _, ok := t.refs[key]; !ok {
+			delete(t.advertised, key)
+		}
+	}
+	err = t.refresh(ctx)
+	if err != nil {
+		errs = append(errs, err)
 	}
+	t.updateMetrics()
 	return errors.Join(errs...)
 }
 
-func update(ctx context.Context, ociClient oci.Client, router routing.Router, img oci.Image, skipDigests, resolveLatestTag bool) (int, error) {
-	keys := []string{}
-	if !(!resolveLatestTag && img.IsLatestTag()) {
-		if tagRef, ok := img.TagName(); ok {
-			keys = append(keys, tagRef)
+// update tracks the tag and digests of the image and advertises the keys not already advertised for another image.
+func (t *tracker) update(ctx context.Context, img oci.Image) error {
+	dgsts, err := t.ociClient.GetImageDigests(ctx, img)
+	if err != nil {
+		return fmt.Errorf("could not get digests for image %s: %w", img.String(), err)
+	}
+	added := t.track(img, append(t.tagKeys(img), dgsts...))
+	defer t.updateMetrics()
+	if len(added) == 0 || t.pressure.Pressured() {
+		return nil
+	}
+	err = t.advertise(ctx, added)
+	if err != nil {
+		return fmt.Errorf("could not advertise image %s: %w", img.String(), err)
+	}
+	return nil
+}
+
+// remove stops tracking the image, keys no longer referenced by any image are not advertised again and expire with the key TTL.
+func (t *tracker) remove(ctx context.Context, img oci.Image) {
+	removed := t.untrack(trackedName(img))
+	t.updateMetrics()
+	logr.FromContextOrDiscard(ctx).V(5).Info("stopped tracking removed image", "image", img, "unreferencedKeys", len(removed))
+}
+
+// track replaces the keys of the image and returns the keys which were not referenced by any image before.
+func (t *tracker) track(img oci.Image, keys []string) []string {
+	unique := []string{}
+	seen := map[string]interface{}{}
+	added := []string{}
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = nil
+		unique = append(unique, key)
+		t.refs[key]++
+		if t.refs[key] == 1 {
+			added = append(added, key)
 		}
 	}
-	if !skipDigests {
-		dgsts, err := ociClient.GetImageDigests(ctx, img)
-		if err != nil {
-			return 0, fmt.Errorf("could not get digests for image %s: %w", img.String(), err)
+	// Keys of the previous version of the image are released after the new keys are referenced, so that shared keys are kept.
+	name := trackedName(img)
+	t.untrack(name)
+	t.images[name] = trackedImage{registry: img.Registry, updatedAt: img.UpdatedAt, keys: unique}
+	return added
+}
+
+// untrack removes the image and returns the keys which are no longer referenced by any image.
+func (t *tracker) untrack(name string) []string {
+	img, ok := t.images[name]
+	if !ok {
+		return []string{}
+	}
+	delete(t.images, name)
+	removed := []string{}
+	for _, key := range img.keys {
+		t.refs[key]--
+		if t.refs[key] > 0 {
+			continue
 		}
-		keys = append(keys, dgsts...)
+		delete(t.refs, key)
+		delete(t.advertised, key)
+		removed = append(removed, key)
 	}
-	err := router.Advertise(ctx, keys)
+	return removed
+}
+
+// refresh advertises the keys of all tracked images, nothing is advertised while the node is under disk pressure.
+// A warm-up is completed under disk pressure as the node would otherwise never become ready, keys are advertised once the pressure is relieved.
+func (t *tracker) refresh(ctx context.Context) error {
+	if t.pressure.Pressured() {
+		t.warmUp.complete()
+		return nil
+	}
+	ctx = routing.WithRefresh(ctx)
+	if !t.warmUp.Done() {
+		return t.advertiseWarmUp(ctx, t.keys())
+	}
+	err := t.advertise(ctx, t.keys())
 	if err != nil {
-		return 0, fmt.Errorf("could not advertise image %s: %w", img.String(), err)
+		return fmt.Errorf("could not advertise images: %w", err)
+	}
+	return nil
+}
+
+// advertise advertises the keys and records which of them were advertised.
+// Keys are only recorded as failed when the router reports which keys failed, otherwise none of them are recorded as advertised.
+func (t *tracker) advertise(ctx context.Context, keys []string) error {
+	err := t.router.Advertise(ctx, keys)
+	failed := routing.FailedKeys(err)
+	if err != nil && len(failed) == 0 {
+		return err
+	}
+	for _, key := range keys {
+		t.advertised[key] = nil
+	}
+	for _, key := range failed {
+		delete(t.advertised, key)
 	}
-	return len(keys), nil
+	return err
+}
+
+// advertiseWarmUp advertises the keys in steps so that the progress of the warm-up is updated while advertising.
+// Failed keys do not stop the remaining steps, but the warm-up starts over on the next refresh if any key fails.
+func (t *tracker) advertiseWarmUp(ctx context.Context, keys []string) error {
+	t.warmUp.start(len(keys))
+	stepSize := (len(keys) + warmUpSteps - 1) / warmUpSteps
+	errs := []error{}
+	for start := 0; start < len(keys); start += stepSize {
+		end := start + stepSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err := t.advertise(ctx, keys[start:end])
+		failed := routing.FailedKeys(err)
+		if err != nil && len(failed) == 0 {
+			return errors.Join(append(errs, fmt.Errorf("could not advertise images: %w", err))...)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not advertise images: %w", err))
+		}
+		t.warmUp.progress(end - start - len(failed))
+	}
+	t.warmUp.progress(0)
+	return errors.Join(errs...)
+}
+
+// keys returns the unique keys of all tracked images. Keys of the most recently updated images come first
+// when the warm-up prioritizes recent images, otherwise images are ordered by name.
+func (t *tracker) keys() []string {
+	names := make([]string, 0, len(t.images))
+	for name := range t.images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if t.warmUp != nil && t.warmUp.recentFirst {
+		sort.SliceStable(names, func(i, j int) bool {
+			return t.images[names[i]].updatedAt.After(t.images[names[j]].updatedAt)
+		})
+	}
+	seen := map[string]interface{}{}
+	keys := []string{}
+	for _, name := range names {
+		for _, key := range t.images[name].keys {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = nil
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// tagKeys returns the tag of the image as a key, tags are not advertised when they are not resolved through mirrors.
+func (t *tracker) tagKeys(img oci.Image) []string {
+	if !t.resolveTags.Enabled(img.Registry) || (!t.resolveLatestTag && img.IsLatestTag()) {
+		return []string{}
+	}
+	tagRef, ok := img.TagName()
+	if !ok {
+		return []string{}
+	}
+	return []string{tagRef}
+}
+
+// updateMetrics sets the gauges from the keys that were actually advertised, images are counted once all of their keys have been advertised.
+func (t *tracker) updateMetrics() {
+	metrics.AdvertisedImages.Reset()
+	metrics.AdvertisedKeys.Reset()
+	for _, img := range t.images {
+		count := 0
+		for _, key := range img.keys {
+			if _, ok := t.advertised[key]; ok {
+				count++
+			}
+		}
+		if count > 0 && count == len(img.keys) {
+			metrics.AdvertisedImages.WithLabelValues(img.registry).Add(1)
+		}
+		metrics.AdvertisedKeys.WithLabelValues(img.registry).Add(float64(count))
+	}
+	metrics.AdvertisedUniqueKeys.Set(float64(len(t.advertised)))
+}
+
+func imageName(img oci.Image) string {
+	return fmt.Sprintf("%s/%s", img.Registry, img.Repository)
+}
+
+// trackedName returns the name the image is tracked by, images with the same name in different namespaces are tracked separately.
+func trackedName(img oci.Image) string {
+	return fmt.Sprintf("%s/%s", img.Namespace, img.Name)
+}
+
+// clockJump returns how much more the wall clock has progressed than the monotonic clock between the times.
+func clockJump(prev, now time.Time) time.Duration {
+	return now.Round(0).Sub(prev.Round(0)) - now.Sub(prev)
 }
@@ -2,11 +2,16 @@ package state
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 
+	"github.com/xenitab/spegel/internal/allowlist"
+	"github.com/xenitab/spegel/internal/diskpressure"
+	"github.com/xenitab/spegel/internal/metrics"
 	"github.com/xenitab/spegel/internal/oci"
 	"github.com/xenitab/spegel/internal/routing"
 )
@@ -14,16 +19,31 @@ import (
 func TestBasic(t *testing.T) {
 	tests := []struct {
 		name             string
+		resolveTags      oci.ResolveTags
 		resolveLatestTag bool
+		allowList        string
 	}{
 		{
 			name:             "resolve latest",
+			resolveTags:      oci.ResolveTags{Default: true},
 			resolveLatestTag: true,
 		},
 		{
 			name:             "do not resolve latest",
+			resolveTags:      oci.ResolveTags{Default: true},
 			resolveLatestTag: false,
 		},
+		{
+			name:             "allow list",
+			resolveTags:      oci.ResolveTags{Default: true},
+			resolveLatestTag: true,
+			allowList:        `docker\.io/library/.+`,
+		},
+		{
+			name:             "do not resolve tags for registry",
+			resolveTags:      oci.ResolveTags{Default: true, Overrides: map[string]bool{"docker.io": false}},
+			resolveLatestTag: true,
+		},
 	}
 
 	imgRefs := []string{
@@ -48,9 +68,18 @@ func TestBasic(t *testing.T) {
 				time.Sleep(2 * time.Second)
 				cancel()
 			}()
-			Track(ctx, ociClient, router, tt.resolveLatestTag)
+			allowList := allowlist.NewAllowList()
+			patterns, err := allowlist.Parse(tt.allowList)
+			require.NoError(t, err)
+			allowList.Set(patterns)
+			Track(ctx, ociClient, router, routing.KeyTTL, time.Hour, tt.resolveTags, tt.resolveLatestTag, allowList, nil, nil)
 
 			for _, img := range imgs {
+				if !allowList.Allowed(imageName(img)) {
+					_, ok := router.LookupKey(img.Digest.String())
+					require.False(t, ok)
+					continue
+				}
 				peers, ok := router.LookupKey(img.Digest.String())
 				require.True(t, ok)
 				require.Len(t, peers, 1)
@@ -59,7 +88,7 @@ func TestBasic(t *testing.T) {
 					continue
 				}
 				peers, ok = router.LookupKey(tagName)
-				if img.IsLatestTag() && !tt.resolveLatestTag {
+				if !tt.resolveTags.Enabled(img.Registry) || (img.IsLatestTag() && !tt.resolveLatestTag) {
 					require.False(t, ok)
 					continue
 				}
@@ -69,3 +98,261 @@ func TestBasic(t *testing.T) {
 		})
 	}
 }
+
+func TestTrackerIncremental(t *testing.T) {
+	ubuntu, err := oci.Parse("docker.io/library/ubuntu:22.04@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020", "")
+	require.NoError(t, err)
+	alpine, err := oci.Parse("docker.io/library/alpine:3.18@sha256:25fad2a32ad1f6f510e528448ae1ec69a28ef81916a004d3629874104f8a7f70", "")
+	require.NoError(t, err)
+	spegel, err := oci.Parse("ghcr.io/xenitab/spegel:v0.0.9@sha256:fa32bd3bcd49a45a62cfc1b0fed6a0b63bf8af95db5bad7ec22865aee0a4b795", "")
+	require.NoError(t, err)
+
+	ociClient := oci.NewMockClient([]oci.Image{ubuntu, alpine})
+	router := routing.NewMockRouter(map[string][]string{})
+	tr := newTracker(ociClient, router, oci.ResolveTags{Default: true}, true, allowlist.NewAllowList(), nil, nil)
+
+	err = tr.reconcile(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, []string{"docker.io/library/alpine:3.18", alpine.Digest.String(), "docker.io/library/ubuntu:22.04", ubuntu.Digest.String()}, tr.keys())
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.AdvertisedImages.WithLabelValues("docker.io")))
+
+	// Images from events are tracked without listing images.
+	err = tr.update(context.TODO(), spegel)
+	require.NoError(t, err)
+	_, ok := router.LookupKey(spegel.Digest.String())
+	require.True(t, ok)
+	require.Len(t, tr.keys(), 6)
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.AdvertisedImages.WithLabelValues("ghcr.io")))
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.AdvertisedKeys.WithLabelValues("ghcr.io")))
+
+	// Keys are advertised again from memory.
+	err = router.Withdraw(context.TODO(), []string{spegel.Digest.String()})
+	require.NoError(t, err)
+	err = tr.refresh(context.TODO())
+	require.NoError(t, err)
+	_, ok = router.LookupKey(spegel.Digest.String())
+	require.True(t, ok)
+
+	// Images not listed by a full reconcile are no longer tracked.
+	err = tr.reconcile(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, tr.keys(), 4)
+	require.Equal(t, 0.0, testutil.ToFloat64(metrics.AdvertisedImages.WithLabelValues("ghcr.io")))
+}
+
+func TestTrackerSharedKeys(t *testing.T) {
+	ubuntu, err := oci.Parse("docker.io/library/ubuntu:22.04@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020", "")
+	require.NoError(t, err)
+	jammy, err := oci.Parse("docker.io/library/ubuntu:jammy@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020", "")
+	require.NoError(t, err)
+
+	ociClient := oci.NewMockClient([]oci.Image{})
+	router := routing.NewMockRouter(map[string][]string{})
+	tr := newTracker(ociClient, router, oci.ResolveTags{Default: true}, true, allowlist.NewAllowList(), nil, nil)
+
+	err = tr.update(context.TODO(), ubuntu)
+	require.NoError(t, err)
+	_, ok := router.LookupKey(ubuntu.Digest.String())
+	require.True(t, ok)
+
+	// Keys already advertised for another image are not advertised again.
+	err = router.Withdraw(context.TODO(), []string{ubuntu.Digest.String()})
+	require.NoError(t, err)
+	err = tr.update(context.TODO(), jammy)
+	require.NoError(t, err)
+	_, ok = router.LookupKey(ubuntu.Digest.String())
+	require.False(t, ok)
+	_, ok = router.LookupKey("docker.io/library/ubuntu:jammy")
+	require.True(t, ok)
+	require.Equal(t, 3.0, testutil.ToFloat64(metrics.AdvertisedUniqueKeys))
+
+	// Updating an image with the same keys does not advertise anything.
+	err = router.Withdraw(context.TODO(), []string{"docker.io/library/ubuntu:jammy"})
+	require.NoError(t, err)
+	err = tr.update(context.TODO(), jammy)
+	require.NoError(t, err)
+	_, ok = router.LookupKey("docker.io/library/ubuntu:jammy")
+	require.False(t, ok)
+
+	// Shared keys are tracked until the last image referencing them is removed.
+	tr.remove(context.TODO(), ubuntu)
+	require.Equal(t, []string{"docker.io/library/ubuntu:jammy", ubuntu.Digest.String()}, tr.keys())
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.AdvertisedUniqueKeys))
+	tr.remove(context.TODO(), jammy)
+	require.Empty(t, tr.keys())
+	require.Empty(t, tr.refs)
+	require.Equal(t, 0.0, testutil.ToFloat64(metrics.AdvertisedUniqueKeys))
+}
+
+type failingRouter struct {
+	*routing.MockRouter
+	failed map[string]interface{}
+}
+
+func (r *failingRouter) Advertise(ctx context.Context, keys []string) error {
+	errs := []error{}
+	advertise := []string{}
+	for _, key := range keys {
+		if _, ok := r.failed[key]; ok {
+			errs = append(errs, &routing.AdvertiseError{Key: key, Err: errors.New("provide failed")})
+			continue
+		}
+		advertise = append(advertise, key)
+	}
+	err := r.MockRouter.Advertise(ctx, advertise)
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+func TestTrackerAdvertiseErrors(t *testing.T) {
+	ubuntu, err := oci.Parse("docker.io/library/ubuntu:22.04@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020", "")
+	require.NoError(t, err)
+	alpine, err := oci.Parse("docker.io/library/alpine:3.18@sha256:25fad2a32ad1f6f510e528448ae1ec69a28ef81916a004d3629874104f8a7f70", "")
+	require.NoError(t, err)
+
+	ociClient := oci.NewMockClient([]oci.Image{ubuntu, alpine})
+	router := &failingRouter{
+		MockRouter: routing.NewMockRouter(map[string][]string{}),
+		failed:     map[string]interface{}{"docker.io/library/ubuntu:22.04": nil},
+	}
+	tr := newTracker(ociClient, router, oci.ResolveTags{Default: true}, true, allowlist.NewAllowList(), nil, nil)
+
+	// A failed key does not stop the remaining keys from being advertised.
+	err = tr.reconcile(context.TODO())
+	require.Error(t, err)
+	_, ok := router.LookupKey(ubuntu.Digest.String())
+	require.True(t, ok)
+	_, ok = router.LookupKey("docker.io/library/alpine:3.18")
+	require.True(t, ok)
+	_, ok = router.LookupKey("docker.io/library/ubuntu:22.04")
+	require.False(t, ok)
+
+	// Only the keys that were advertised are counted.
+	require.Equal(t, 3.0, testutil.ToFloat64(metrics.AdvertisedUniqueKeys))
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.AdvertisedImages.WithLabelValues("docker.io")))
+	require.Equal(t, 3.0, testutil.ToFloat64(metrics.AdvertisedKeys.WithLabelValues("docker.io")))
+
+	router.failed = map[string]interface{}{}
+	err = tr.refresh(context.TODO())
+	require.NoError(t, err)
+	tr.updateMetrics()
+	require.Equal(t, 4.0, testutil.ToFloat64(metrics.AdvertisedUniqueKeys))
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.AdvertisedImages.WithLabelValues("docker.io")))
+}
+
+func TestTrackerNamespaces(t *testing.T) {
+	img, err := oci.Parse("docker.io/library/ubuntu:22.04@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020", "")
+	require.NoError(t, err)
+	k8sImg := img
+	k8sImg.Namespace = "k8s.io"
+	mobyImg := img
+	mobyImg.Namespace = "moby"
+
+	ociClient := oci.NewMockClient([]oci.Image{})
+	router := routing.NewMockRouter(map[string][]string{})
+	tr := newTracker(ociClient, router, oci.ResolveTags{Default: true}, true, allowlist.NewAllowList(), nil, nil)
+
+	err = tr.update(context.TODO(), k8sImg)
+	require.NoError(t, err)
+	err = tr.update(context.TODO(), mobyImg)
+	require.NoError(t, err)
+	require.Len(t, tr.images, 2)
+
+	// Removing the image from one namespace keeps the keys of the image in the other namespace.
+	tr.remove(context.TODO(), mobyImg)
+	require.Len(t, tr.images, 1)
+	require.Equal(t, []string{"docker.io/library/ubuntu:22.04", img.Digest.String()}, tr.keys())
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.AdvertisedUniqueKeys))
+	tr.remove(context.TODO(), k8sImg)
+	require.Empty(t, tr.keys())
+	require.Empty(t, tr.refs)
+}
+
+func TestTrackerDiskPressure(t *testing.T) {
+	ubuntu, err := oci.Parse("docker.io/library/ubuntu:22.04@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020", "")
+	require.NoError(t, err)
+
+	pressure := diskpressure.NewDetector()
+	pressure.Set("usage", true)
+	ociClient := oci.NewMockClient([]oci.Image{})
+	router := routing.NewMockRouter(map[string][]string{})
+	warmUp := NewWarmUp(1, false)
+	tr := newTracker(ociClient, router, oci.ResolveTags{Default: true}, true, allowlist.NewAllowList(), pressure, warmUp)
+
+	// Images are tracked but not advertised while under disk pressure.
+	err = tr.update(context.TODO(), ubuntu)
+	require.NoError(t, err)
+	err = tr.refresh(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, tr.keys(), 2)
+	_, ok := router.LookupKey(ubuntu.Digest.String())
+	require.False(t, ok)
+	// The node becomes ready even though nothing could be advertised.
+	require.True(t, warmUp.Ready())
+
+	pressure.Set("usage", false)
+	err = tr.refresh(context.TODO())
+	require.NoError(t, err)
+	_, ok = router.LookupKey(ubuntu.Digest.String())
+	require.True(t, ok)
+}
+
+func TestTrackerWarmUp(t *testing.T) {
+	ubuntu, err := oci.Parse("docker.io/library/ubuntu:22.04@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020", "")
+	require.NoError(t, err)
+	ubuntu.UpdatedAt = time.Now().Add(-time.Hour)
+	alpine, err := oci.Parse("docker.io/library/alpine:3.18@sha256:25fad2a32ad1f6f510e528448ae1ec69a28ef81916a004d3629874104f8a7f70", "")
+	require.NoError(t, err)
+	alpine.UpdatedAt = time.Now().Add(-2 * time.Hour)
+	spegel, err := oci.Parse("ghcr.io/xenitab/spegel:v0.0.9@sha256:fa32bd3bcd49a45a62cfc1b0fed6a0b63bf8af95db5bad7ec22865aee0a4b795", "")
+	require.NoError(t, err)
+	spegel.UpdatedAt = time.Now()
+
+	ociClient := oci.NewMockClient([]oci.Image{ubuntu, alpine, spegel})
+	router := routing.NewMockRouter(map[string][]string{})
+	warmUp := NewWarmUp(0.5, true)
+	tr := newTracker(ociClient, router, oci.ResolveTags{Default: true}, true, allowlist.NewAllowList(), nil, warmUp)
+	require.False(t, warmUp.Ready())
+	require.False(t, warmUp.Done())
+
+	// Keys of the most recently updated images come first.
+	err = tr.reconcile(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"ghcr.io/xenitab/spegel:v0.0.9", spegel.Digest.String(),
+		"docker.io/library/ubuntu:22.04", ubuntu.Digest.String(),
+		"docker.io/library/alpine:3.18", alpine.Digest.String(),
+	}, tr.keys())
+	require.True(t, warmUp.Ready())
+	require.True(t, warmUp.Done())
+	require.Equal(t, 6.0, testutil.ToFloat64(warmUpKeys))
+	require.Equal(t, 6.0, testutil.ToFloat64(warmUpAdvertisedKeys))
+	require.Equal(t, 1.0, testutil.ToFloat64(warmUpReady))
+	_, ok := router.LookupKey(alpine.Digest.String())
+	require.True(t, ok)
+}
+
+func TestWarmUp(t *testing.T) {
+	var nilWarmUp *WarmUp
+	require.True(t, nilWarmUp.Ready())
+	require.True(t, nilWarmUp.Done())
+
+	w := NewWarmUp(0.5, false)
+	w.start(10)
+	w.progress(4)
+	require.False(t, w.Ready())
+	w.progress(1)
+	require.True(t, w.Ready())
+	require.False(t, w.Done())
+	w.progress(5)
+	require.True(t, w.Done())
+
+	// A node without keys is ready once advertising has completed.
+	w = NewWarmUp(0.5, false)
+	w.start(0)
+	require.False(t, w.Ready())
+	w.progress(0)
+	require.True(t, w.Ready())
+}
@@ -0,0 +1,116 @@
+package state
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var warmUpKeys = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "spegel_warm_up_keys",
+	Help: "Number of keys advertised during warm-up after start.",
+})
+
+var warmUpAdvertisedKeys = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "spegel_warm_up_advertised_keys",
+	Help: "Number of keys advertised so far during warm-up after start.",
+})
+
+var warmUpReady = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "spegel_warm_up_ready",
+	Help: "Set to 1 once enough keys have been advertised during warm-up for the node to become ready.",
+})
+
+// Amount of steps that the keys advertised during warm-up are split into, each step updates the progress.
+// Every step is rate limited by the router on its own, so more steps would add more jitter.
+const warmUpSteps = 20
+
+// WarmUp tracks the progress of the first advertisement of all keys after start, which can take minutes for nodes with large image stores.
+// The node becomes ready once the ratio of keys has been advertised, the remaining keys are advertised while the node is ready.
+type WarmUp struct {
+	mx          sync.RWMutex
+	readyRatio  float64
+	recentFirst bool
+	total       int
+	advertised  int
+	done        bool
+}
+
+// NewWarmUp returns a warm-up that is ready once the ratio of keys has been advertised, or immediately when the ratio is zero.
+// Keys of the most recently updated images are advertised first when recent first is true, as they are the most likely to be requested by peers.
+func NewWarmUp(readyRatio float64, recentFirst bool) *WarmUp {
+	return &WarmUp{
+		readyRatio:  readyRatio,
+		recentFirst: recentFirst,
+	}
+}
+
+// Ready returns true once enough keys have been advertised, a nil warm-up is always ready.
+func (w *WarmUp) Ready() bool {
+	if w == nil {
+		return true
+	}
+	w.mx.RLock()
+	defer w.mx.RUnlock()
+	return w.ready()
+}
+
+func (w *WarmUp) ready() bool {
+	if w.done || w.readyRatio <= 0 {
+		return true
+	}
+	if w.total == 0 {
+		return false
+	}
+	return float64(w.advertised)/float64(w.total) >= w.readyRatio
+}
+
+// Done returns true once all keys have been advertised, a nil warm-up is always done.
+func (w *WarmUp) Done() bool {
+	if w == nil {
+		return true
+	}
+	w.mx.RLock()
+	defer w.mx.RUnlock()
+	return w.done
+}
+
+func (w *WarmUp) start(total int) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	w.total = total
+	w.advertised = 0
+	w.updateMetrics()
+}
+
+func (w *WarmUp) progress(advertised int) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	w.advertised += advertised
+	if w.advertised >= w.total {
+		w.done = true
+	}
+	w.updateMetrics()
+}
+
+// complete ends the warm-up without advertising the keys, a nil warm-up does nothing.
+func (w *WarmUp) complete() {
+	if w == nil {
+		return
+	}
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	w.done = true
+	w.updateMetrics()
+}
+
+func (w *WarmUp) updateMetrics() {
+	warmUpKeys.Set(float64(w.total))
+	warmUpAdvertisedKeys.Set(float64(w.advertised))
+	if w.ready() {
+		warmUpReady.Set(1)
+	} else {
+		warmUpReady.Set(0)
+	}
+}
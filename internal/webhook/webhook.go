@@ -0,0 +1,166 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// MirroredImagesAnnotation lists the images of the pod that are expected to be pulled through Spegel.
+	MirroredImagesAnnotation = "spegel.dev/mirrored-images"
+	// UnmirroredImagesAnnotation lists the images of the pod that are pulled from their registry without Spegel.
+	UnmirroredImagesAnnotation = "spegel.dev/unmirrored-images"
+)
+
+var admittedImagesTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "spegel_webhook_admitted_images_total",
+		Help: "Total number of container images of admitted pods, by whether they are expected to be pulled through Spegel.",
+	},
+	[]string{"registry", "mirrored"},
+)
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Webhook is a mutating admission webhook that annotates pods with the images that are expected to be pulled through Spegel.
+// The annotations and metrics can be compared with the mirror metrics to find pulls that should have hit Spegel but did not.
+// Pods are never rejected, requests that cannot be decoded are allowed without changes.
+type Webhook struct {
+	log                 logr.Logger
+	registries          map[string]interface{}
+	mirrorAllRegistries bool
+}
+
+// NewWebhook creates a webhook for nodes where the registries are mirrored, or where all registries are mirrored.
+func NewWebhook(log logr.Logger, registries []url.URL, mirrorAllRegistries bool) *Webhook {
+	hosts := map[string]interface{}{}
+	for _, u := range registries {
+		hosts[u.Host] = nil
+	}
+	return &Webhook{
+		log:                 log,
+		registries:          hosts,
+		mirrorAllRegistries: mirrorAllRegistries,
+	}
+}
+
+func (wh *Webhook) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	review := admissionv1.AdmissionReview{}
+	err := json.NewDecoder(req.Body).Decode(&review)
+	if err != nil {
+		wh.log.Error(err, "could not decode admission review")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	resp := &admissionv1.AdmissionResponse{
+		UID:     review.Request.UID,
+		Allowed: true,
+	}
+	patch, err := wh.admit(review.Request)
+	if err != nil {
+		wh.log.Error(err, "could not annotate pod, allowing without changes", "namespace", review.Request.Namespace, "name", review.Request.Name)
+	}
+	if err == nil && patch != nil {
+		patchType := admissionv1.PatchTypeJSONPatch
+		resp.Patch = patch
+		resp.PatchType = &patchType
+	}
+	review.Response = resp
+	review.Request = nil
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(review)
+	if err != nil {
+		wh.log.Error(err, "could not write admission review response")
+	}
+}
+
+// admit returns a JSON patch setting the annotations of the pod, or nil if the request is not for a pod.
+func (wh *Webhook) admit(req *admissionv1.AdmissionRequest) ([]byte, error) {
+	if req.Kind != (metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}) {
+		return nil, nil
+	}
+	pod := corev1.Pod{}
+	err := json.Unmarshal(req.Object.Raw, &pod)
+	if err != nil {
+		return nil, err
+	}
+	mirrored, unmirrored := wh.classify(pod)
+	annotations := map[string]string{}
+	for k, v := range pod.Annotations {
+		annotations[k] = v
+	}
+	delete(annotations, MirroredImagesAnnotation)
+	delete(annotations, UnmirroredImagesAnnotation)
+	if len(mirrored) > 0 {
+		annotations[MirroredImagesAnnotation] = strings.Join(mirrored, ",")
+	}
+	if len(unmirrored) > 0 {
+		annotations[UnmirroredImagesAnnotation] = strings.Join(unmirrored, ",")
+	}
+	// Adding an object member that already exists replaces it.
+	return json.Marshal([]patchOperation{{Op: "add", Path: "/metadata/annotations", Value: annotations}})
+}
+
+// classify returns the unique images of all containers in the pod split by whether they are pulled through Spegel.
+func (wh *Webhook) classify(pod corev1.Pod) ([]string, []string) {
+	containers := append([]corev1.Container{}, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
+	seen := map[string]interface{}{}
+	mirrored := []string{}
+	unmirrored := []string{}
+	for _, container := range containers {
+		if _, ok := seen[container.Image]; ok {
+			continue
+		}
+		seen[container.Image] = nil
+		registry, ok := wh.isMirrored(container.Image)
+		admittedImagesTotal.WithLabelValues(registry, fmt.Sprint(ok)).Inc()
+		if !ok {
+			unmirrored = append(unmirrored, container.Image)
+			continue
+		}
+		mirrored = append(mirrored, container.Image)
+	}
+	sort.Strings(mirrored)
+	sort.Strings(unmirrored)
+	return mirrored, unmirrored
+}
+
+// isMirrored returns the registry of the image and true if the registry is mirrored.
+// Images without a registry are normalized in the same way as by the container runtime, so nginx is pulled from docker.io.
+func (wh *Webhook) isMirrored(image string) (string, bool) {
+	named, err := docker.ParseDockerRef(image)
+	if err != nil {
+		return "", false
+	}
+	registry := docker.Domain(named)
+	if wh.mirrorAllRegistries {
+		return registry, true
+	}
+	_, ok := wh.registries[registry]
+	return registry, ok
+}
@@ -0,0 +1,125 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestIsMirrored(t *testing.T) {
+	wh := NewWebhook(logr.Discard(), []url.URL{{Scheme: "https", Host: "docker.io"}, {Scheme: "https", Host: "ghcr.io"}}, false)
+	tests := []struct {
+		image            string
+		expectedRegistry string
+		expectedMirrored bool
+	}{
+		{image: "nginx", expectedRegistry: "docker.io", expectedMirrored: true},
+		{image: "library/nginx:1.25", expectedRegistry: "docker.io", expectedMirrored: true},
+		{image: "ghcr.io/xenitab/spegel:v0.0.9", expectedRegistry: "ghcr.io", expectedMirrored: true},
+		{image: "quay.io/prometheus/prometheus@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020", expectedRegistry: "quay.io", expectedMirrored: false},
+		{image: "Invalid:Image", expectedRegistry: "", expectedMirrored: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			registry, mirrored := wh.isMirrored(tt.image)
+			require.Equal(t, tt.expectedRegistry, registry)
+			require.Equal(t, tt.expectedMirrored, mirrored)
+		})
+	}
+
+	wh = NewWebhook(logr.Discard(), nil, true)
+	registry, mirrored := wh.isMirrored("quay.io/prometheus/prometheus:v2.47.0")
+	require.Equal(t, "quay.io", registry)
+	require.True(t, mirrored)
+}
+
+func TestServeHTTP(t *testing.T) {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Annotations: map[string]string{"foo": "bar", UnmirroredImagesAnnotation: "stale"},
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "quay.io/foo/init:v1"}},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "nginx"},
+				{Name: "sidecar", Image: "ghcr.io/xenitab/spegel:v0.0.9"},
+				{Name: "other", Image: "nginx"},
+			},
+		},
+	}
+	raw, err := json.Marshal(pod)
+	require.NoError(t, err)
+	review := admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:    "123",
+			Kind:   metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Object: runtime.RawExtension{Raw: raw},
+		},
+	}
+	b, err := json.Marshal(review)
+	require.NoError(t, err)
+
+	wh := NewWebhook(logr.Discard(), []url.URL{{Scheme: "https", Host: "docker.io"}, {Scheme: "https", Host: "ghcr.io"}}, false)
+	rw := httptest.NewRecorder()
+	wh.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "http://example.com/mutate", bytes.NewReader(b)))
+	resp := rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	result := admissionv1.AdmissionReview{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	require.NoError(t, err)
+	require.Equal(t, "123", string(result.Response.UID))
+	require.True(t, result.Response.Allowed)
+	require.Equal(t, admissionv1.PatchTypeJSONPatch, *result.Response.PatchType)
+	patch := []patchOperation{}
+	err = json.Unmarshal(result.Response.Patch, &patch)
+	require.NoError(t, err)
+	require.Len(t, patch, 1)
+	require.Equal(t, "add", patch[0].Op)
+	require.Equal(t, "/metadata/annotations", patch[0].Path)
+	expected := map[string]interface{}{
+		"foo":                      "bar",
+		MirroredImagesAnnotation:   "ghcr.io/xenitab/spegel:v0.0.9,nginx",
+		UnmirroredImagesAnnotation: "quay.io/foo/init:v1",
+	}
+	require.Equal(t, expected, patch[0].Value)
+}
+
+func TestServeHTTPNotPod(t *testing.T) {
+	review := admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:  "123",
+			Kind: metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		},
+	}
+	b, err := json.Marshal(review)
+	require.NoError(t, err)
+
+	wh := NewWebhook(logr.Discard(), nil, true)
+	rw := httptest.NewRecorder()
+	wh.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "http://example.com/mutate", bytes.NewReader(b)))
+	resp := rw.Result()
+	defer resp.Body.Close()
+	result := admissionv1.AdmissionReview{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	require.NoError(t, err)
+	require.True(t, result.Response.Allowed)
+	require.Nil(t, result.Response.Patch)
+
+	rw = httptest.NewRecorder()
+	wh.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "http://example.com/mutate", bytes.NewReader([]byte("foo"))))
+	resp = rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -9,62 +10,301 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"runtime/debug"
 	"syscall"
 	"time"
 
 	"github.com/alexflint/go-arg"
 	"github.com/go-logr/logr"
-	"github.com/go-logr/zapr"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/afero"
 	pkgkubernetes "github.com/xenitab/pkg/kubernetes"
-	"go.uber.org/zap"
+	"golang.org/x/exp/slog"
 	"golang.org/x/sync/errgroup"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 
+	"github.com/xenitab/spegel/internal/allowlist"
+	"github.com/xenitab/spegel/internal/audit"
+	"github.com/xenitab/spegel/internal/cachevalue"
+	"github.com/xenitab/spegel/internal/chargeback"
+	"github.com/xenitab/spegel/internal/config"
+	"github.com/xenitab/spegel/internal/diskpressure"
+	"github.com/xenitab/spegel/internal/handoff"
+	"github.com/xenitab/spegel/internal/imageprefetch"
+	spegelkubernetes "github.com/xenitab/spegel/internal/kubernetes"
+	"github.com/xenitab/spegel/internal/logging"
 	"github.com/xenitab/spegel/internal/oci"
 	"github.com/xenitab/spegel/internal/registry"
 	"github.com/xenitab/spegel/internal/routing"
+	"github.com/xenitab/spegel/internal/soak"
 	"github.com/xenitab/spegel/internal/state"
+	"github.com/xenitab/spegel/internal/webhook"
 )
 
 type ConfigurationCmd struct {
-	ContainerdRegistryConfigPath string    `arg:"--containerd-registry-config-path" default:"/etc/containerd/certs.d" help:"Directory where mirror configuration is written."`
-	Registries                   []url.URL `arg:"--registries,required" help:"registries that are configured to be mirrored."`
-	MirrorRegistries             []url.URL `arg:"--mirror-registries,required" help:"registries that are configured to act as mirrors."`
-	ResolveTags                  bool      `arg:"--resolve-tags" default:"true" help:"When true Spegel will resolve tags to digests."`
+	RuntimeFlavor                string            `arg:"--runtime-flavor" default:"standard" help:"Distribution running Containerd, either standard, k3s or rke2. Sets the Containerd socket, namespace and registry config path when they are not set."`
+	ContainerdRegistryConfigPath string            `arg:"--containerd-registry-config-path" default:"/etc/containerd/certs.d" help:"Directory where mirror configuration is written."`
+	RegistriesConfPath           string            `arg:"--registries-conf-path" default:"/etc/containers/registries.conf.d" help:"Directory where registries.conf mirror configuration is written."`
+	MirrorConfigFormat           string            `arg:"--mirror-config-format" default:"containerd" help:"Format of the mirror configuration, either containerd or registries-conf for CRI-O and Podman."`
+	ConfigPath                   string            `arg:"--config" help:"Path to YAML configuration file, values set in the file take precedence over flags."`
+	Registries                   []url.URL         `arg:"--registries" help:"registries that are configured to be mirrored."`
+	MirrorRegistries             []url.URL         `arg:"--mirror-registries" help:"registries that are configured to act as mirrors."`
+	ResolveTags                  bool              `arg:"--resolve-tags" default:"true" help:"When true Spegel will resolve tags to digests."`
+	RegistryResolveTags          map[string]bool   `arg:"--registry-resolve-tags" help:"Per registry host overrides of resolve tags, set as registry=bool for example docker.io=false."`
+	RegistryServers              map[string]string `arg:"--registry-servers" help:"Upstream server written to the mirror configuration per registry host, set as registry=url for example registry.corp=https://corp.jfrog.io/artifactory/api/docker/virtual. Docker Hub is mapped to https://registry-1.docker.io unless set."`
+	MirrorAllRegistries          bool              `arg:"--mirror-all-registries" default:"false" help:"When true default mirror configuration is written so that all registries are mirrored."`
+	MirrorHostname               string            `arg:"--mirror-hostname" help:"Stable hostname used in place of the loopback address for mirrors, resolved through a host alias."`
+	HostsFilePath                string            `arg:"--hosts-file-path" default:"/etc/hosts" help:"Path to hosts file where the mirror hostname alias is written."`
+	EventNodeName                string            `arg:"--event-node-name" help:"Name of the node that warning events are emitted on when configuring mirrors fails, no events are emitted on the node when empty."`
+	EventPodNamespace            string            `arg:"--event-pod-namespace" help:"Namespace of the pod that warning events are emitted on."`
+	EventPodName                 string            `arg:"--event-pod-name" help:"Name of the pod that warning events are emitted on when configuring mirrors fails, no events are emitted on the pod when empty."`
+}
+
+type CleanupCmd struct {
+	RuntimeFlavor                string `arg:"--runtime-flavor" default:"standard" help:"Distribution running Containerd, either standard, k3s or rke2. Sets the Containerd socket, namespace and registry config path when they are not set."`
+	ContainerdRegistryConfigPath string `arg:"--containerd-registry-config-path" default:"/etc/containerd/certs.d" help:"Directory where mirror configuration is written."`
+	RegistriesConfPath           string `arg:"--registries-conf-path" default:"/etc/containers/registries.conf.d" help:"Directory where registries.conf mirror configuration is written."`
+	MirrorConfigFormat           string `arg:"--mirror-config-format" default:"containerd" help:"Format of the mirror configuration, either containerd or registries-conf for CRI-O and Podman."`
+}
+
+type WebhookCmd struct {
+	Addr                string    `arg:"--addr" default:":8443" help:"address to serve the admission webhook."`
+	MetricsAddr         string    `arg:"--metrics-addr" default:":9090" help:"address to serve metrics."`
+	TLSCertPath         string    `arg:"--tls-cert-path,required" help:"Path to the TLS certificate served by the admission webhook."`
+	TLSKeyPath          string    `arg:"--tls-key-path,required" help:"Path to the TLS private key of the certificate."`
+	Registries          []url.URL `arg:"--registries" help:"registries that are configured to be mirrored."`
+	MirrorAllRegistries bool      `arg:"--mirror-all-registries" default:"false" help:"When true all registries are expected to be mirrored."`
 }
 
 type RegistryCmd struct {
-	RegistryAddr                 string        `arg:"--registry-addr,required" help:"address to server image registry."`
-	RouterAddr                   string        `arg:"--router-addr,required" help:"address to serve router."`
-	MetricsAddr                  string        `arg:"--metrics-addr,required" help:"address to serve metrics."`
-	Registries                   []url.URL     `arg:"--registries,required" help:"registries that are configured to be mirrored."`
-	ContainerdSock               string        `arg:"--containerd-sock" default:"/run/containerd/containerd.sock" help:"Endpoint of containerd service."`
-	ContainerdNamespace          string        `arg:"--containerd-namespace" default:"k8s.io" help:"Containerd namespace to fetch images from."`
-	ContainerdRegistryConfigPath string        `arg:"--containerd-registry-config-path" default:"/etc/containerd/certs.d" help:"Directory where mirror configuration is written."`
-	MirrorResolveRetries         int           `arg:"--mirror-resolve-retries" default:"3" help:"Max ammount of mirrors to attempt."`
-	MirrorResolveTimeout         time.Duration `arg:"--mirror-resolve-timeout" default:"5s" help:"Max duration spent finding a mirror."`
-	KubeconfigPath               string        `arg:"--kubeconfig-path" help:"Path to the kubeconfig file."`
-	LeaderElectionNamespace      string        `arg:"--leader-election-namespace" default:"spegel" help:"Kubernetes namespace to write leader election data."`
-	LeaderElectionName           string        `arg:"--leader-election-name" default:"spegel-leader-election" help:"Name of leader election."`
-	ResolveLatestTag             bool          `arg:"--resolve-latest-tag" default:"true" help:"When true latest tags will be resolved to digests."`
-	LocalAddr                    string        `arg:"--local-addr,required" help:"Address that the local Spegel instance will be reached at."`
+	RuntimeFlavor                string            `arg:"--runtime-flavor" default:"standard" help:"Distribution running Containerd, either standard, k3s or rke2. Sets the Containerd socket, namespace and registry config path when they are not set."`
+	ConfigPath                   string            `arg:"--config" help:"Path to YAML configuration file, values set in the file take precedence over flags and changes are applied without restarting."`
+	RegistryAddr                 string            `arg:"--registry-addr,required" help:"address to server image registry."`
+	RouterAddr                   string            `arg:"--router-addr,required" help:"address to serve router."`
+	MetricsAddr                  string            `arg:"--metrics-addr,required" help:"address to serve metrics."`
+	Registries                   []url.URL         `arg:"--registries" help:"registries that are configured to be mirrored."`
+	ContainerdSock               string            `arg:"--containerd-sock" default:"/run/containerd/containerd.sock" help:"Endpoint of containerd service."`
+	ContainerdNamespace          string            `arg:"--containerd-namespace" default:"k8s.io" help:"Containerd namespace to fetch images from."`
+	ContainerdImageFilters       []string          `arg:"--containerd-image-filters" help:"Containerd filter selectors of the image name or labels that images have to match to be advertised, for example labels.\"ci.scratch\"!=true."`
+	ContainerdNamespaces         []string          `arg:"--containerd-namespaces" help:"Containerd namespaces to advertise and serve images from, tried in order when looking up content. Overrides the Containerd namespace when set."`
+	ContainerdRegistryConfigPath string            `arg:"--containerd-registry-config-path" default:"/etc/containerd/certs.d" help:"Directory where mirror configuration is written."`
+	RegistriesConfPath           string            `arg:"--registries-conf-path" default:"/etc/containers/registries.conf.d" help:"Directory where registries.conf mirror configuration is written."`
+	MirrorConfigFormat           string            `arg:"--mirror-config-format" default:"containerd" help:"Format of the mirror configuration, either containerd or registries-conf for CRI-O and Podman."`
+	ContainerdContentPath        string            `arg:"--containerd-content-path" help:"Directory of the Containerd content store, when set blobs are served directly from the filesystem."`
+	ContainerdImportPath         string            `arg:"--containerd-import-path" help:"Directory containing an OCI image layout that is imported into Containerd at startup before advertising, disabled when empty."`
+	MirrorResolveRetries         int               `arg:"--mirror-resolve-retries" default:"3" help:"Max ammount of mirrors to attempt."`
+	MirrorResolveTimeout         time.Duration     `arg:"--mirror-resolve-timeout" default:"5s" help:"Max duration spent finding a mirror."`
+	ResolveTimeoutManifest       time.Duration     `arg:"--resolve-timeout-manifest" default:"0s" help:"Max duration spent finding a mirror for manifests, the mirror resolve timeout is used when zero."`
+	ResolveTimeoutBlob           time.Duration     `arg:"--resolve-timeout-blob" default:"0s" help:"Max duration spent finding a mirror for blobs, the mirror resolve timeout is used when zero."`
+	ResolveTimeoutAttempt        time.Duration     `arg:"--resolve-timeout-attempt" default:"0s" help:"Max duration spent waiting for every next mirror, only the resolve timeout applies when zero."`
+	BootstrapKind                string            `arg:"--bootstrap-kind" default:"kubernetes" help:"Kind of bootstrapper to use, either kubernetes, endpointslice or dns."`
+	DNSBootstrapName             string            `arg:"--dns-bootstrap-name" help:"DNS name to resolve when bootstrapping with DNS."`
+	DNSBootstrapService          string            `arg:"--dns-bootstrap-service" help:"SRV service name to look up, A/AAAA records are used when empty."`
+	DNSBootstrapProto            string            `arg:"--dns-bootstrap-proto" default:"tcp" help:"SRV protocol to look up."`
+	DNSBootstrapRefreshInterval  time.Duration     `arg:"--dns-bootstrap-refresh-interval" default:"30s" help:"Interval at which bootstrap DNS records are refreshed."`
+	EndpointSliceNamespace       string            `arg:"--endpoint-slice-namespace" default:"spegel" help:"Kubernetes namespace of the Service used when bootstrapping with endpoint slices."`
+	EndpointSliceServiceName     string            `arg:"--endpoint-slice-service-name" default:"spegel" help:"Name of the Service selecting Spegel Pods used when bootstrapping with endpoint slices."`
+	KubeconfigPath               string            `arg:"--kubeconfig-path" help:"Path to the kubeconfig file."`
+	LeaderElectionNamespace      string            `arg:"--leader-election-namespace" default:"spegel" help:"Kubernetes namespace to write leader election data."`
+	LeaderElectionName           string            `arg:"--leader-election-name" default:"spegel-leader-election" help:"Name of leader election."`
+	ResolveTags                  bool              `arg:"--resolve-tags" default:"true" help:"When true tags are advertised to peers."`
+	RegistryResolveTags          map[string]bool   `arg:"--registry-resolve-tags" help:"Per registry host overrides of resolve tags, set as registry=bool for example docker.io=false."`
+	ResolveLatestTag             bool              `arg:"--resolve-latest-tag" default:"true" help:"When true latest tags will be resolved to digests."`
+	MirrorAllRegistries          bool              `arg:"--mirror-all-registries" default:"false" help:"When true images from all registries are advertised, registries is ignored."`
+	MirrorRegistries             []url.URL         `arg:"--mirror-registries" help:"Registries that act as mirrors, when set mirror configuration is written again every time the configuration is reloaded."`
+	RegistryServers              map[string]string `arg:"--registry-servers" help:"Upstream server written to the mirror configuration per registry host when it is written again, set as registry=url."`
+	MirrorHostname               string            `arg:"--mirror-hostname" help:"Stable hostname used in place of the loopback address of mirrors when mirror configuration is written again."`
+	LocalAddr                    string            `arg:"--local-addr,required" help:"Address that the local Spegel instance will be reached at."`
+	MirrorChunkSize              int64             `arg:"--mirror-chunk-size" default:"0" help:"Size in bytes of ranges fetched in parallel from multiple mirrors for large blobs, disabled when zero."`
+	MirrorChunkParallelism       int               `arg:"--mirror-chunk-parallelism" default:"4" help:"Max amount of mirrors and chunks fetched in parallel."`
+	BlobReadAheadSize            int               `arg:"--blob-read-ahead-size" default:"0" help:"Size in bytes of chunks read ahead from the content store while serving blobs, disabled when zero."`
+	LocalCacheSize               int64             `arg:"--local-cache-size" default:"0" help:"Max size in bytes of the in-memory cache for manifests and small blobs, disabled when zero."`
+	LocalCacheMaxBlobSize        int64             `arg:"--local-cache-max-blob-size" default:"1048576" help:"Max size in bytes of manifests and blobs stored in the in-memory cache."`
+	CanaryInterval               time.Duration     `arg:"--canary-interval" default:"0s" help:"Interval between synthetic canary pulls from peers, disabled when zero."`
+	CacheValueInterval           time.Duration     `arg:"--cache-value-interval" default:"0s" help:"Interval at which the amount of content only provided by this node is measured, disabled when zero."`
+	CacheValueNodeName           string            `arg:"--cache-value-node-name,env:NODE_NAME" help:"Name of the node annotated with the measured cache value, the node is not annotated when empty."`
+	CacheValueScaleDownThreshold int               `arg:"--cache-value-scale-down-threshold" default:"0" help:"Min amount of content only provided by this node at which cluster autoscaler scale down is disabled for the node, disabled when zero."`
+	ImagePrefetchNodeName        string            `arg:"--image-prefetch-node-name" help:"Name of the node that pulls the images of ImagePrefetch resources selecting it, the controller is disabled when empty."`
+	DiskPressureInterval         time.Duration     `arg:"--disk-pressure-interval" default:"0s" help:"Interval at which disk pressure is checked, serving to peers and advertising keys are paused while the node is under disk pressure. Disabled when zero."`
+	DiskPressurePath             string            `arg:"--disk-pressure-path" help:"Path on the volume of the Containerd content store whose usage is compared with the disk pressure threshold, usage is not checked when empty."`
+	DiskPressureThreshold        float64           `arg:"--disk-pressure-threshold" default:"0.9" help:"Ratio of used space of the volume at which the node is under disk pressure."`
+	EventNodeName                string            `arg:"--event-node-name" help:"Name of the node that warning events are emitted on when verifying Containerd fails, no events are emitted on the node when empty."`
+	EventPodNamespace            string            `arg:"--event-pod-namespace" help:"Namespace of the pod that warning events are emitted on."`
+	EventPodName                 string            `arg:"--event-pod-name" help:"Name of the pod that warning events are emitted on when verifying Containerd fails, no events are emitted on the pod when empty."`
+	DiskPressureNodeName         string            `arg:"--disk-pressure-node-name" help:"Name of the node that is under disk pressure while Kubernetes reports the DiskPressure condition, the condition is not checked when empty."`
+	MirrorConfigCleanup          bool              `arg:"--mirror-config-cleanup" default:"false" help:"When true generated mirror configuration is removed and backed up configuration restored on shutdown."`
+	AdvertiseMinLayerSize        int64             `arg:"--advertise-min-layer-size" default:"0" help:"Min size in bytes of layers advertised to peers, manifests and configs are always advertised."`
+	AdvertiseNonDistributable    bool              `arg:"--advertise-non-distributable" default:"true" help:"When false non-distributable and foreign layers, such as Windows base layers, are not advertised to peers."`
+	AdvertiseInclude             []string          `arg:"--advertise-include" help:"Glob patterns, or regular expressions prefixed with regex:, matching registry and repository of images that are advertised and served to other nodes, all images are included when empty."`
+	AdvertiseExclude             []string          `arg:"--advertise-exclude" help:"Glob patterns, or regular expressions prefixed with regex:, matching registry and repository of images that are never advertised or served to other nodes."`
+	AllowListConfigMapName       string            `arg:"--allow-list-configmap-name" help:"Name of ConfigMap containing image allow list patterns, all images are allowed when empty."`
+	AllowListConfigMapNamespace  string            `arg:"--allow-list-configmap-namespace" default:"spegel" help:"Kubernetes namespace of the allow list ConfigMap."`
+	PushToken                    string            `arg:"--push-token,env:SPEGEL_PUSH_TOKEN" help:"Token required to push images, either as a bearer token or as the password of basic auth. Pushing is disabled when empty."`
+	PushRegistry                 string            `arg:"--push-registry" help:"Registry that pushed images are named with, pushes to other registries are rejected. It has to be mirrored for nodes to pull pushed images."`
+	PrefetchToken                string            `arg:"--prefetch-token,env:SPEGEL_PREFETCH_TOKEN" help:"Bearer token required to pull images through the prefetch endpoint, the endpoint is disabled when empty."`
+	ExistsAPIToken               string            `arg:"--exists-api-token,env:SPEGEL_EXISTS_API_TOKEN" help:"Bearer token required to check which peers have digests through the exists API, the endpoint is disabled when empty."`
+	DebugToken                   string            `arg:"--debug-token,env:SPEGEL_DEBUG_TOKEN" help:"Bearer token required to list advertised keys, resolve peers and gather stats of connected peers through the debug endpoints, and to change the log level, the endpoints are disabled when empty."`
+	ServeQuotas                  map[string]int64  `arg:"--serve-quotas" help:"Max bytes served to peers per registry within the quota interval, set as registry=bytes."`
+	ServeQuotaInterval           time.Duration     `arg:"--serve-quota-interval" default:"1m" help:"Interval after which serving quotas are reset."`
+	ServingMaxTransfers          int               `arg:"--serving-max-transfers" help:"Max blob transfers served to peers concurrently, further blob requests are rejected with 429. Disabled when zero."`
+	ServingMaxBytesPerSecond     int64             `arg:"--serving-max-bytes-per-second" help:"Max bytes per second served to peers, blob requests are rejected with 429 while the bandwidth is exceeded. Disabled when zero."`
+	ThrottleBytesPerSecond       int64             `arg:"--throttle-bytes-per-second" help:"Max bytes per second of blobs served to peers and responses mirrored from peers, transfers are slowed down to stay within the limit. Disabled when zero."`
+	ChargebackPath               string            `arg:"--chargeback-path" help:"File that bytes served to peers per repository and hour are persisted to and served from the chargeback metrics endpoint, disabled when empty."`
+	ChargebackRetention          time.Duration     `arg:"--chargeback-retention" default:"720h" help:"Duration that hourly chargeback records are kept for."`
+	ChargebackMaxRepositories    int               `arg:"--chargeback-max-repositories" default:"1000" help:"Max amount of repositories recorded per hour, bytes of further repositories are recorded as _other."`
+	ChargebackTeams              map[string]string `arg:"--chargeback-teams" help:"Teams that bytes served for repositories are attributed to, set as repository=team where the repository can be a prefix of path components for example ghcr.io/xenitab=platform."`
+	RouterNegativeCacheTTL       time.Duration     `arg:"--router-negative-cache-ttl" default:"5s" help:"Duration that keys which could not be resolved fail fast before being looked up again, disabled when zero."`
+	AuditOTLPEndpoint            string            `arg:"--audit-otlp-endpoint" help:"OTLP HTTP endpoint that registry access audit records are exported to as logs, /v1/logs is used when the endpoint has no path. Disabled when empty."`
+	AuditOTLPHeaders             map[string]string `arg:"--audit-otlp-headers" help:"Headers set on OTLP export requests, set as key=value."`
+	AuditOTLPInterval            time.Duration     `arg:"--audit-otlp-interval" default:"5s" help:"Interval at which batched audit records are exported."`
+	RouterPSKPath                string            `arg:"--router-psk-path" help:"Path to pre-shared key file in the libp2p swarm key format, only peers with the same key can join the router network."`
+	HandoffPath                  string            `arg:"--handoff-path" help:"Path on the node that the peer identity and advertised keys are handed off through to the pod replacing this pod, disabled when empty."`
+	HandoffMaxAge                time.Duration     `arg:"--handoff-max-age" default:"5m" help:"Max age of a handoff written by the replaced pod for it to be imported."`
+	HandoffNodeName              string            `arg:"--handoff-node-name" help:"Name of the node checked on shutdown, state is only handed off when the node is not cordoned, deleted or tainted for removal. Required when handoff is enabled."`
+	MirrorAuth                   string            `arg:"--mirror-auth" help:"Authentication required for requests from clients outside of the local CIDRs, either shared-secret or token-review, disabled when empty. Requires local CIDRs to be set."`
+	MirrorAuthSecretPath         string            `arg:"--mirror-auth-secret-path" help:"Path to file with the secret shared by all nodes, used with shared-secret authentication."`
+	MirrorAuthTokenPath          string            `arg:"--mirror-auth-token-path" default:"/var/run/secrets/kubernetes.io/serviceaccount/token" help:"Path to ServiceAccount token presented to peers, used with token-review authentication."`
+	MirrorAuthAudiences          []string          `arg:"--mirror-auth-audiences" help:"Audiences that ServiceAccount tokens are reviewed against, used with token-review authentication."`
+	VerifyBlobs                  bool              `arg:"--verify-blobs" default:"false" help:"When true served blobs are verified against their digest and withdrawn from peers when corrupt, withdrawn blobs are advertised again after an hour or when the image is pulled again."`
+	AccessLogSampleRate          float64           `arg:"--access-log-sample-rate" default:"1" help:"Fraction of successful requests that are logged, failed requests are always logged. All requests are logged while verbosity V(5) is enabled by the log level, so that the level can be lowered while running to debug specific pulls."`
+	MirrorShadowSampleRate       float64           `arg:"--mirror-shadow-sample-rate" default:"0" help:"Fraction of mirror hits that are also requested from the origin registry to compare digest and size, disabled when zero."`
+	MirrorPrewarmPoolSize        int               `arg:"--mirror-prewarm-pool-size" default:"0" help:"Max amount of recently used mirrors that connections are kept warm to, disabled when zero."`
+	MirrorPrewarmInterval        time.Duration     `arg:"--mirror-prewarm-interval" default:"30s" help:"Interval at which connections to recently used mirrors are kept warm."`
+	MirrorBackoffThreshold       int               `arg:"--mirror-backoff-threshold" default:"3" help:"Amount of consecutive failures after which a mirror is temporarily skipped, disabled when zero."`
+	MirrorBackoff                time.Duration     `arg:"--mirror-backoff" default:"10s" help:"Duration a mirror is skipped after reaching the failure threshold, doubled with every further failure."`
+	MirrorMaxBackoff             time.Duration     `arg:"--mirror-max-backoff" default:"5m" help:"Max duration a failing mirror is skipped."`
+	MirrorMaxHops                int               `arg:"--mirror-max-hops" default:"3" help:"Max amount of times a request can be proxied between mirrors before it is rejected."`
+	MirrorDialTimeout            time.Duration     `arg:"--mirror-dial-timeout" default:"5s" help:"Max duration spent establishing a connection to a mirror."`
+	MirrorFirstByteTimeout       time.Duration     `arg:"--mirror-first-byte-timeout" default:"10s" help:"Max duration waiting for a mirror to respond after the request has been sent."`
+	MirrorTransferTimeout        time.Duration     `arg:"--mirror-transfer-timeout" default:"30m" help:"Max duration of a single transfer from a mirror, disabled when zero."`
+	MirrorHTTP2                  bool              `arg:"--mirror-http2" default:"false" help:"When true mirrors requests to peers over cleartext HTTP/2, all peers have to accept HTTP/2."`
+	DataTransport                string            `arg:"--data-transport" default:"http" help:"Transport used to fetch content from peers, either http or p2p. The p2p transport uses encrypted libp2p streams of the router, all peers have to use the same transport."`
+	MirrorVerifyIdentity         bool              `arg:"--mirror-verify-identity" default:"false" help:"When true responses are signed with the router identity, and responses from peers not signed by the peer that advertised the key are rejected. Only applies to the http data transport, all peers have to enable it."`
+	MirrorExternalDelegation     bool              `arg:"--mirror-external-delegation" default:"false" help:"When true external requests are redirected to a peer that has the content instead of being proxied. Peers have to be reachable by external clients, cannot be used with the p2p data transport, identity verification or mirror auth."`
+	LocalCIDRs                   []string          `arg:"--local-cidrs" help:"CIDRs of clients whose requests are classified as internal, the request host is compared with the local address when empty."`
+	NodeIP                       string            `arg:"--node-ip,env:NODE_IP" help:"IP of the node, requests from it are classified as internal when local CIDRs are used."`
+	RegistryRewrites             map[string]string `arg:"--registry-rewrites" help:"Image name prefixes rewritten before requests are resolved, set as old=new for example old.registry.corp/foo=new.registry.corp/foo. The old registry has to be mirrored."`
+	ShutdownDepartTimeout        time.Duration     `arg:"--shutdown-depart-timeout" default:"5s" help:"Max duration spent telling peers that the node is leaving, or handing off state, on shutdown before in-flight requests are drained."`
+	ShutdownDrainTimeout         time.Duration     `arg:"--shutdown-drain-timeout" default:"25s" help:"Max duration spent draining in-flight requests on shutdown after peers have been told that the node is leaving."`
+	StateReconcileInterval       time.Duration     `arg:"--state-reconcile-interval" default:"1h" help:"Interval at which all images are listed to reconcile the advertised keys, which are otherwise kept up to date from image events."`
+	WarmUpReadyRatio             float64           `arg:"--warm-up-ready-ratio" default:"0" help:"Ratio of keys that have to be advertised after start before becoming ready, the remaining keys are advertised while ready. Readiness does not wait for keys to be advertised when zero."`
+	AdvertiseRecentFirst         bool              `arg:"--advertise-recent-first" default:"false" help:"When true keys of the most recently pulled images are advertised first, so that nodes with large image stores serve the most requested images sooner."`
+	RouterKeyTTL                 time.Duration     `arg:"--router-key-ttl" default:"10m" help:"Duration advertised keys are valid for, keys are advertised again before it expires. Should be the same on all nodes."`
+	RouterBucketSize             int               `arg:"--router-bucket-size" default:"0" help:"Kademlia replication factor, the amount of peers keys are stored on. Uses the library default when zero."`
+	RouterConcurrency            int               `arg:"--router-concurrency" default:"0" help:"Kademlia amount of concurrent requests per lookup. Uses the library default when zero."`
+	RouterResiliency             int               `arg:"--router-resiliency" default:"0" help:"Kademlia amount of closest peers that have to respond for a lookup to complete. Uses the library default when zero."`
+	RouterRefreshInterval        time.Duration     `arg:"--router-refresh-interval" default:"0s" help:"Interval at which the routing table is refreshed. Uses the library default when zero."`
+	AdvertiseBatchSize           int               `arg:"--advertise-batch-size" default:"100" help:"Amount of keys advertised before waiting for the advertise interval, batching is disabled when zero."`
+	AdvertiseInterval            time.Duration     `arg:"--advertise-interval" default:"100ms" help:"Duration waited between batches of advertised keys."`
+	AdvertiseJitter              time.Duration     `arg:"--advertise-jitter" default:"5s" help:"Max random delay before advertising keys that do not fit in a single batch, spreads out nodes starting at the same time."`
+	MirrorLatencyRankingWindow   time.Duration     `arg:"--mirror-latency-ranking-window" default:"0s" help:"Duration that mirrors found after the first mirror are collected and ordered by their observed latency and throughput, disabled when zero."`
+	DeterministicResolve         bool              `arg:"--deterministic-resolve" default:"false" help:"When true resolved peers are ordered by a hash of the key and peer ID instead of discovery timing. Slows down resolving, only meant for tests and debugging."`
+	RouterKeySchemas             []string          `arg:"--router-key-schemas" help:"Key schemas used to advertise and resolve keys, set multiple during migrations between schemas. Defaults to v0."`
+
+	// Policies are evaluated for every registry request after the registry rewrites. They cannot be set with flags,
+	// builds embedding Spegel set them before the registry command is run to add request policies.
+	Policies []registry.Policy `arg:"-"`
+}
+
+type CheckCmd struct {
+	RuntimeFlavor                string    `arg:"--runtime-flavor" default:"standard" help:"Distribution running Containerd, either standard, k3s or rke2. Sets the Containerd socket, namespace and registry config path when they are not set."`
+	ContainerdSock               string    `arg:"--containerd-sock" default:"/run/containerd/containerd.sock" help:"Endpoint of containerd service."`
+	ContainerdNamespace          string    `arg:"--containerd-namespace" default:"k8s.io" help:"Containerd namespace to fetch images from."`
+	ContainerdRegistryConfigPath string    `arg:"--containerd-registry-config-path" default:"/etc/containerd/certs.d" help:"Directory where mirror configuration is written."`
+	Registries                   []url.URL `arg:"--registries" help:"registries that mirror configuration is checked for."`
+}
+
+type LsCmd struct {
+	RegistryAddr string `arg:"--registry-addr" default:"http://127.0.0.1:5000" help:"Address of the local Spegel registry."`
+	Images       bool   `arg:"--images" default:"false" help:"Only list advertised images."`
+	Digests      bool   `arg:"--digests" default:"false" help:"Only list advertised digests."`
+	JSON         bool   `arg:"--json" default:"false" help:"Output as JSON."`
+}
+
+type ResolveCmd struct {
+	RegistryAddr string `arg:"--registry-addr" default:"http://127.0.0.1:5000" help:"Address of the local Spegel registry."`
+	JSON         bool   `arg:"--json" default:"false" help:"Output as JSON."`
+	Ref          string `arg:"positional,required" help:"Image reference or digest to resolve."`
+}
+
+// SoakCmd generates synthetic images and pull traffic for capacity testing, it is hidden from the usage.
+// All instances in a soak test should use the same seed so that they advertise and request the same images.
+type SoakCmd struct {
+	RegistryAddr        string        `arg:"--registry-addr" default:":5000" help:"address to serve the synthetic images."`
+	RouterAddr          string        `arg:"--router-addr" default:":5001" help:"address to serve router."`
+	MetricsAddr         string        `arg:"--metrics-addr" default:":9090" help:"address to serve metrics."`
+	DNSBootstrapName    string        `arg:"--dns-bootstrap-name,required" help:"DNS name to resolve when bootstrapping with DNS."`
+	DNSBootstrapService string        `arg:"--dns-bootstrap-service" help:"SRV service name to look up, A/AAAA records are used when empty."`
+	DNSBootstrapProto   string        `arg:"--dns-bootstrap-proto" default:"tcp" help:"SRV protocol to look up."`
+	Registry            string        `arg:"--registry" default:"soak.spegel.dev" help:"Registry name of the synthetic images, has to be mirrored by the targets."`
+	Seed                int64         `arg:"--seed" default:"1" help:"Seed used to generate the synthetic images."`
+	Images              int           `arg:"--images" default:"10" help:"Amount of synthetic images to generate."`
+	Layers              int           `arg:"--layers" default:"5" help:"Amount of layers per synthetic image."`
+	LayerSizes          map[int64]int `arg:"--layer-sizes" help:"Weights of layer sizes in bytes, set as size=weight. Defaults to 1048576=9,33554432=1."`
+	Targets             []url.URL     `arg:"--targets" help:"Registry addresses of Spegel instances that pull traffic is sent to, only images are advertised when empty."`
+	Rate                float64       `arg:"--rate" default:"10" help:"Pull requests per second sent to the targets."`
+	Concurrency         int           `arg:"--concurrency" default:"20" help:"Max amount of pull requests in flight, requests are dropped once reached."`
+	TrafficDelay        time.Duration `arg:"--traffic-delay" default:"30s" help:"Duration waited before sending traffic so that images are advertised."`
+	Duration            time.Duration `arg:"--duration" default:"0s" help:"Duration that traffic is sent for before exiting, runs until stopped when zero."`
+}
+
+// LogArgs are shared by all subcommands.
+type LogArgs struct {
+	LogBackend string `arg:"--log-backend" default:"zap" help:"Backend used to write logs, either zap or slog."`
+	LogFormat  string `arg:"--log-format" default:"json" help:"Format of logs, either json or text."`
+	LogLevel   string `arg:"--log-level" default:"INFO" help:"Minimum slog level of logs, verbosity V(n) is written at the level -n for example DEBUG-1 for V(5)."`
 }
 
 type Arguments struct {
 	Configuration *ConfigurationCmd `arg:"subcommand:configuration"`
 	Registry      *RegistryCmd      `arg:"subcommand:registry"`
+	Cleanup       *CleanupCmd       `arg:"subcommand:cleanup"`
+	Ls            *LsCmd            `arg:"subcommand:ls" help:"List images and digests advertised by the local Spegel instance."`
+	Resolve       *ResolveCmd       `arg:"subcommand:resolve" help:"Resolve the nodes advertising an image reference or digest through the local Spegel instance."`
+	Check         *CheckCmd         `arg:"subcommand:check" help:"Check that Containerd is configured for mirroring."`
+	Webhook       *WebhookCmd       `arg:"subcommand:webhook" help:"Run an admission webhook annotating pods with the images expected to be pulled through Spegel."`
+	Soak          *SoakCmd          `arg:"-"`
+	LogArgs
 }
 
+// logLevel is shared by all loggers and can be changed while running through the metrics server.
+var logLevel = &slog.LevelVar{}
+
 func main() {
 	args := &Arguments{}
-	arg.MustParse(args)
+	// Subcommands cannot be hidden from the usage so the soak subcommand is parsed separately.
+	if len(os.Args) > 1 && os.Args[1] == "soak" {
+		args.Soak = &SoakCmd{}
+		p, err := arg.NewParser(arg.Config{Program: "spegel soak"}, args.Soak, &args.LogArgs)
+		if err != nil {
+			panic(fmt.Sprintf("who watches the watchmen (%v)?", err))
+		}
+		err = p.Parse(os.Args[2:])
+		if errors.Is(err, arg.ErrHelp) {
+			p.WriteHelp(os.Stdout)
+			os.Exit(0)
+		}
+		if err != nil {
+			p.Fail(err.Error())
+		}
+	} else {
+		arg.MustParse(args)
+	}
 
-	zapLog, err := zap.NewProduction()
+	err := logLevel.UnmarshalText([]byte(args.LogLevel))
+	if err != nil {
+		panic(fmt.Sprintf("who watches the watchmen (%v)?", err))
+	}
+	log, err := logging.New(logging.Backend(args.LogBackend), logging.Format(args.LogFormat), os.Stderr, logLevel)
 	if err != nil {
 		panic(fmt.Sprintf("who watches the watchmen (%v)?", err))
 	}
-	log := zapr.NewLogger(zapLog)
+	slog.SetDefault(logging.ToSlog(log))
 	ctx := logr.NewContext(context.Background(), log)
 
 	err = run(ctx, args)
@@ -83,87 +323,812 @@ func run(ctx context.Context, args *Arguments) error {
 		return configurationCommand(ctx, args.Configuration)
 	case args.Registry != nil:
 		return registryCommand(ctx, args.Registry)
+	case args.Cleanup != nil:
+		return cleanupCommand(ctx, args.Cleanup)
+	case args.Ls != nil:
+		return lsCommand(ctx, args.Ls)
+	case args.Resolve != nil:
+		return resolveCommand(ctx, args.Resolve)
+	case args.Check != nil:
+		return checkCommand(ctx, args.Check)
+	case args.Webhook != nil:
+		return webhookCommand(ctx, args.Webhook)
+	case args.Soak != nil:
+		return soakCommand(ctx, args.Soak)
 	default:
 		return fmt.Errorf("unknown subcommand")
 	}
 }
 
-func configurationCommand(ctx context.Context, args *ConfigurationCmd) error {
+func configurationCommand(ctx context.Context, args *ConfigurationCmd) (err error) {
+	recorder, recorderErr := getEventRecorder("", args.EventNodeName, args.EventPodNamespace, args.EventPodName)
+	if recorderErr != nil {
+		logr.FromContextOrDiscard(ctx).Error(recorderErr, "could not create event recorder")
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		eventErr := recorder.Warning(ctx, spegelkubernetes.ReasonMirrorConfigurationFailed, fmt.Sprintf("Could not configure mirrors: %v", err))
+		if eventErr != nil {
+			logr.FromContextOrDiscard(ctx).Error(eventErr, "could not emit mirror configuration failure event")
+		}
+	}()
+
+	_, err = applyRuntimeFlavor(args.RuntimeFlavor, nil, nil, &args.ContainerdRegistryConfigPath)
+	if err != nil {
+		return err
+	}
+	if args.ConfigPath != "" {
+		cfg, err := config.Load(args.ConfigPath)
+		if err != nil {
+			return err
+		}
+		err = applyConfigurationConfig(args, cfg)
+		if err != nil {
+			return err
+		}
+	}
+	if len(args.Registries) == 0 && !args.MirrorAllRegistries {
+		return fmt.Errorf("registries have to be set when not mirroring all registries")
+	}
+	if len(args.MirrorRegistries) == 0 {
+		return fmt.Errorf("mirror registries have to be set")
+	}
+
 	fs := afero.NewOsFs()
-	err := oci.AddMirrorConfiguration(ctx, fs, args.ContainerdRegistryConfigPath, args.Registries, args.MirrorRegistries, args.ResolveTags)
+	mirrorRegistries := args.MirrorRegistries
+	if args.MirrorHostname != "" {
+		err := oci.AddHostAlias(ctx, fs, args.HostsFilePath, args.MirrorHostname, oci.LoopbackIP(mirrorRegistries))
+		if err != nil {
+			return err
+		}
+		mirrorRegistries = oci.ReplaceLoopbackHost(mirrorRegistries, args.MirrorHostname)
+	}
+	resolveTags := oci.ResolveTags{Default: args.ResolveTags, Overrides: args.RegistryResolveTags}
+	return writeMirrorConfiguration(ctx, fs, args.MirrorConfigFormat, args.ContainerdRegistryConfigPath, args.RegistriesConfPath, args.Registries, mirrorRegistries, resolveTags, args.RegistryServers, args.MirrorAllRegistries)
+}
+
+// writeMirrorConfiguration replaces the mirror configuration of the registries in the format, and the default configuration when mirroring all registries.
+func writeMirrorConfiguration(ctx context.Context, fs afero.Fs, format, containerdRegistryConfigPath, registriesConfPath string, registries, mirrorRegistries []url.URL, resolveTags oci.ResolveTags, registryServers map[string]string, mirrorAll bool) error {
+	switch format {
+	case "containerd":
+		err := oci.AddMirrorConfiguration(ctx, fs, containerdRegistryConfigPath, registries, mirrorRegistries, resolveTags, registryServers)
+		if err != nil {
+			return err
+		}
+		if mirrorAll {
+			return oci.AddDefaultMirrorConfiguration(ctx, fs, containerdRegistryConfigPath, mirrorRegistries, resolveTags)
+		}
+		return nil
+	case "registries-conf":
+		if mirrorAll {
+			return fmt.Errorf("mirroring all registries is not supported with registries-conf mirror config format")
+		}
+		return oci.AddRegistriesConfConfiguration(ctx, fs, registriesConfPath, registries, mirrorRegistries, resolveTags, registryServers)
+	default:
+		return fmt.Errorf("unknown mirror config format %s", format)
+	}
+}
+
+func cleanupCommand(ctx context.Context, args *CleanupCmd) error {
+	_, err := applyRuntimeFlavor(args.RuntimeFlavor, nil, nil, &args.ContainerdRegistryConfigPath)
 	if err != nil {
 		return err
 	}
-	return nil
+	return cleanupMirrorConfiguration(ctx, afero.NewOsFs(), args.MirrorConfigFormat, args.ContainerdRegistryConfigPath, args.RegistriesConfPath)
 }
 
-func registryCommand(ctx context.Context, args *RegistryCmd) (err error) {
+// cleanupMirrorConfiguration removes the mirror configuration written in the format from the directory of the format.
+func cleanupMirrorConfiguration(ctx context.Context, fs afero.Fs, format, containerdRegistryConfigPath, registriesConfPath string) error {
+	switch format {
+	case "containerd":
+		return oci.CleanupMirrorConfiguration(ctx, fs, containerdRegistryConfigPath)
+	case "registries-conf":
+		return oci.CleanupMirrorConfiguration(ctx, fs, registriesConfPath)
+	default:
+		return fmt.Errorf("unknown mirror config format %s", format)
+	}
+}
+
+func webhookCommand(ctx context.Context, args *WebhookCmd) error {
 	log := logr.FromContextOrDiscard(ctx)
+	if len(args.Registries) == 0 && !args.MirrorAllRegistries {
+		return fmt.Errorf("registries have to be set when not mirroring all registries")
+	}
 	g, ctx := errgroup.WithContext(ctx)
+	serveMetrics(ctx, g, args.MetricsAddr, http.NewServeMux())
+	whMux := http.NewServeMux()
+	whMux.Handle("/mutate", webhook.NewWebhook(log.WithName("webhook"), args.Registries, args.MirrorAllRegistries))
+	whMux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	whSrv := &http.Server{
+		Addr:              args.Addr,
+		Handler:           whMux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	g.Go(func() error {
+		if err := whSrv.ListenAndServeTLS(args.TLSCertPath, args.TLSKeyPath); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+	g.Go(func() error {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return whSrv.Shutdown(shutdownCtx)
+	})
+	log.Info("running admission webhook", "addr", args.Addr)
+	return g.Wait()
+}
 
-	cs, err := pkgkubernetes.GetKubernetesClientset(args.KubeconfigPath)
+func checkCommand(ctx context.Context, args *CheckCmd) error {
+	paths, err := applyRuntimeFlavor(args.RuntimeFlavor, &args.ContainerdSock, &args.ContainerdNamespace, &args.ContainerdRegistryConfigPath)
 	if err != nil {
 		return err
 	}
-	ociClient, err := oci.NewContainerd(args.ContainerdSock, args.ContainerdNamespace, args.ContainerdRegistryConfigPath, args.Registries)
+	ociClient, err := oci.NewContainerd(args.ContainerdSock, args.ContainerdNamespace, args.ContainerdRegistryConfigPath, nil, oci.WithConfigTemplatePath(paths.ConfigTemplatePath))
 	if err != nil {
 		return err
 	}
-	err = ociClient.Verify(ctx)
+	findings, err := ociClient.Check(ctx, afero.NewOsFs(), args.Registries)
 	if err != nil {
 		return err
 	}
+	errCount := 0
+	for _, finding := range findings {
+		if finding.Severity == oci.FindingSeverityError {
+			errCount++
+		}
+		fmt.Println(finding.String())
+	}
+	if errCount > 0 {
+		return fmt.Errorf("found %d configuration errors", errCount)
+	}
+	fmt.Println("no configuration errors found")
+	return nil
+}
 
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	metricsSrv := &http.Server{
-		Addr:    args.MetricsAddr,
-		Handler: mux,
+func lsCommand(ctx context.Context, args *LsCmd) error {
+	if args.Images && args.Digests {
+		return fmt.Errorf("images and digests cannot both be set")
+	}
+	advertised, err := registry.GetAdvertised(ctx, args.RegistryAddr)
+	if err != nil {
+		return err
+	}
+	if args.Images {
+		advertised.Digests = nil
+	}
+	if args.Digests {
+		advertised.Images = nil
+	}
+	if args.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(advertised)
+	}
+	for _, img := range advertised.Images {
+		fmt.Println(img.String())
+	}
+	for _, dgst := range advertised.Digests {
+		fmt.Println(dgst)
+	}
+	return nil
+}
+
+func resolveCommand(ctx context.Context, args *ResolveCmd) error {
+	result, err := registry.Resolve(ctx, args.RegistryAddr, args.Ref)
+	if err != nil {
+		return err
 	}
+	if args.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+	for _, res := range []*registry.KeyResolution{result.TagResolution, result.DigestResolution} {
+		if res == nil {
+			continue
+		}
+		if res.Error != "" {
+			fmt.Printf("%s: %s\n", res.Key, res.Error)
+			continue
+		}
+		if len(res.Peers) == 0 {
+			fmt.Printf("%s: no peers found\n", res.Key)
+			continue
+		}
+		for _, peer := range res.Peers {
+			fmt.Printf("%s: %s\n", res.Key, peer)
+		}
+	}
+	return nil
+}
+
+func soakCommand(ctx context.Context, args *SoakCmd) error {
+	log := logr.FromContextOrDiscard(ctx)
+	layerSizes := args.LayerSizes
+	if len(layerSizes) == 0 {
+		layerSizes = map[int64]int{1024 * 1024: 9, 32 * 1024 * 1024: 1}
+	}
+	sizes, err := soak.ParseSizeDistribution(layerSizes)
+	if err != nil {
+		return err
+	}
+	log.Info("generating synthetic images", "images", args.Images, "layers", args.Layers, "sizes", sizes.String())
+	workload, err := soak.NewWorkload(args.Registry, args.Seed, args.Images, args.Layers, sizes)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	g, ctx := errgroup.WithContext(ctx)
+	serveMetrics(ctx, g, args.MetricsAddr, http.NewServeMux())
+
+	_, registryPort, err := net.SplitHostPort(args.RegistryAddr)
+	if err != nil {
+		return err
+	}
+	bootstrapper := routing.NewDNSBootstrapper(args.DNSBootstrapName, args.DNSBootstrapService, args.DNSBootstrapProto, 30*time.Second)
+	router, err := routing.NewP2PRouter(ctx, args.RouterAddr, bootstrapper, registryPort, []routing.KeySchema{routing.KeySchemaV0})
+	if err != nil {
+		return err
+	}
+	g.Go(func() error {
+		state.Track(ctx, workload, router, routing.KeyTTL, time.Hour, oci.ResolveTags{Default: true}, true, allowlist.NewAllowList(), nil, nil)
+		return nil
+	})
+	reg := registry.NewRegistry(workload, router, args.RegistryAddr, 3, 5*time.Second, true)
+	regSrv := reg.Server(args.RegistryAddr, log)
 	g.Go(func() error {
-		if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := regSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return err
 		}
 		return nil
 	})
 	g.Go(func() error {
 		<-ctx.Done()
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-		return metricsSrv.Shutdown(shutdownCtx)
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer shutdownCancel()
+		return errors.Join(regSrv.Shutdown(shutdownCtx), reg.Drain(shutdownCtx), router.Close())
 	})
 
+	if len(args.Targets) > 0 {
+		traffic, err := soak.NewTraffic(&http.Client{}, args.Targets, workload, args.Rate, args.Concurrency)
+		if err != nil {
+			return err
+		}
+		g.Go(func() error {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(args.TrafficDelay):
+			}
+			trafficCtx := ctx
+			if args.Duration > 0 {
+				var trafficCancel context.CancelFunc
+				trafficCtx, trafficCancel = context.WithTimeout(ctx, args.Duration)
+				defer trafficCancel()
+			}
+			log.Info("sending synthetic pull traffic", "targets", len(args.Targets), "rate", args.Rate)
+			summary := traffic.Run(trafficCtx)
+			log.Info("synthetic pull traffic completed", "summary", summary.String())
+			if args.Duration > 0 {
+				cancel()
+			}
+			return nil
+		})
+	}
+
+	log.Info("running soak test", "registry", args.Registry, "seed", args.Seed)
+	return g.Wait()
+}
+
+func registryCommand(ctx context.Context, args *RegistryCmd) (err error) {
+	log := logr.FromContextOrDiscard(ctx)
+	paths, err := applyRuntimeFlavor(args.RuntimeFlavor, &args.ContainerdSock, &args.ContainerdNamespace, &args.ContainerdRegistryConfigPath)
+	if err != nil {
+		return err
+	}
+	// Flag values are kept so that fields removed from the configuration file fall back to them on reload.
+	flagArgs := *args
+	if args.ConfigPath != "" {
+		cfg, err := config.Load(args.ConfigPath)
+		if err != nil {
+			return err
+		}
+		err = applyRegistryConfig(args, cfg)
+		if err != nil {
+			return err
+		}
+	}
+	if len(args.Registries) == 0 && !args.MirrorAllRegistries {
+		return fmt.Errorf("registries have to be set when not mirroring all registries")
+	}
+	switch args.DataTransport {
+	case "http":
+	case "p2p":
+		if args.MirrorHTTP2 {
+			return fmt.Errorf("HTTP/2 cannot be used with the p2p data transport")
+		}
+	default:
+		return fmt.Errorf("unknown data transport %s", args.DataTransport)
+	}
+	if args.MirrorConfigFormat != "containerd" && args.MirrorConfigFormat != "registries-conf" {
+		return fmt.Errorf("unknown mirror config format %s", args.MirrorConfigFormat)
+	}
+	if args.MirrorExternalDelegation && (args.DataTransport == "p2p" || args.MirrorVerifyIdentity || args.MirrorAuth != "") {
+		return fmt.Errorf("external delegation cannot be used with the p2p data transport, identity verification or mirror auth")
+	}
+	g, ctx := errgroup.WithContext(ctx)
+
+	filter, err := allowlist.NewFilter(args.AdvertiseInclude, args.AdvertiseExclude)
+	if err != nil {
+		return err
+	}
+	ociOpts := []oci.ContainerdOption{oci.WithMinLayerSize(args.AdvertiseMinLayerSize), oci.WithIncludeFilter(filter.Include()), oci.WithConfigTemplatePath(paths.ConfigTemplatePath)}
+	if !args.AdvertiseNonDistributable {
+		ociOpts = append(ociOpts, oci.WithSkipNonDistributableLayers())
+	}
+	if args.ContainerdContentPath != "" {
+		ociOpts = append(ociOpts, oci.WithContentPath(args.ContainerdContentPath))
+	}
+	if len(args.ContainerdImageFilters) > 0 {
+		for _, imageFilter := range args.ContainerdImageFilters {
+			err := oci.ValidateImageFilter(imageFilter)
+			if err != nil {
+				return err
+			}
+		}
+		ociOpts = append(ociOpts, oci.WithImageFilters(args.ContainerdImageFilters))
+	}
+	// Content pushed or imported is written to the first namespace.
+	if len(args.ContainerdNamespaces) > 0 {
+		args.ContainerdNamespace = args.ContainerdNamespaces[0]
+		ociOpts = append(ociOpts, oci.WithNamespaces(args.ContainerdNamespaces))
+	}
+	ociClient, err := oci.NewContainerd(args.ContainerdSock, args.ContainerdNamespace, args.ContainerdRegistryConfigPath, filterRegistries(args), ociOpts...)
+	if err != nil {
+		return err
+	}
+	err = ociClient.Verify(ctx)
+	if err != nil {
+		recorder, recorderErr := getEventRecorder(args.KubeconfigPath, args.EventNodeName, args.EventPodNamespace, args.EventPodName)
+		if recorderErr != nil {
+			log.Error(recorderErr, "could not create event recorder")
+		}
+		eventErr := recorder.Warning(ctx, spegelkubernetes.ReasonContainerdVerifyFailed, fmt.Sprintf("Containerd configuration could not be verified: %v", err))
+		if eventErr != nil {
+			log.Error(eventErr, "could not emit Containerd verification failure event")
+		}
+		return err
+	}
+	// Images are imported before the state is tracked so that they are advertised with the first full advertisement.
+	if args.ContainerdImportPath != "" {
+		err = ociClient.ImportLayout(ctx, args.ContainerdImportPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	var ledger *chargeback.Ledger
+	if args.ChargebackPath != "" {
+		ledger, err = chargeback.NewLedger(args.ChargebackPath, args.ChargebackRetention, args.ChargebackMaxRepositories)
+		if err != nil {
+			return err
+		}
+		ledger.SetTeams(args.ChargebackTeams)
+		g.Go(func() error {
+			ledger.Run(ctx, time.Minute)
+			return nil
+		})
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/log-level", logging.LevelHandler(logLevel, args.DebugToken))
+	if ledger != nil {
+		mux.Handle("/chargeback", ledger)
+	}
+	serveMetrics(ctx, g, args.MetricsAddr, mux)
+
 	_, registryPort, err := net.SplitHostPort(args.RegistryAddr)
 	if err != nil {
 		return err
 	}
-	bootstrapper := routing.NewKubernetesBootstrapper(cs, args.LeaderElectionNamespace, args.LeaderElectionName)
-	router, err := routing.NewP2PRouter(ctx, args.RouterAddr, bootstrapper, registryPort)
+	bootstrapper, err := getBootstrapper(args)
 	if err != nil {
 		return err
 	}
+	keySchemas, err := routing.ParseKeySchemas(args.RouterKeySchemas)
+	if err != nil {
+		return err
+	}
+	routerOpts := []routing.P2PRouterOption{
+		routing.WithDHTConfig(routing.DHTConfig{
+			BucketSize:      args.RouterBucketSize,
+			Concurrency:     args.RouterConcurrency,
+			Resiliency:      args.RouterResiliency,
+			RefreshInterval: args.RouterRefreshInterval,
+			KeyTTL:          args.RouterKeyTTL,
+		}),
+		routing.WithAdvertiseConfig(routing.AdvertiseConfig{
+			BatchSize: args.AdvertiseBatchSize,
+			Interval:  args.AdvertiseInterval,
+			Jitter:    args.AdvertiseJitter,
+		}),
+		routing.WithStats(nodeStats),
+	}
+	if args.RouterNegativeCacheTTL > 0 {
+		routerOpts = append(routerOpts, routing.WithNegativeCache(args.RouterNegativeCacheTTL))
+	}
+	if args.DeterministicResolve {
+		routerOpts = append(routerOpts, routing.WithDeterministicResolve())
+	}
+	if args.MirrorLatencyRankingWindow > 0 {
+		routerOpts = append(routerOpts, routing.WithLatencyRanking(args.MirrorLatencyRankingWindow))
+	}
+	if args.RouterPSKPath != "" {
+		psk, err := routing.LoadPSK(args.RouterPSKPath)
+		if err != nil {
+			return err
+		}
+		routerOpts = append(routerOpts, routing.WithPSK(psk))
+	}
+	if args.DataTransport == "p2p" {
+		routerOpts = append(routerOpts, routing.WithStreamTransport())
+	} else if args.MirrorVerifyIdentity {
+		routerOpts = append(routerOpts, routing.WithSignedMirrors())
+	}
+	handoffState := handoff.State{}
+	if args.HandoffPath != "" {
+		var ok bool
+		handoffState, ok, err = handoff.Load(args.HandoffPath, args.HandoffMaxAge)
+		if err != nil {
+			log.Error(err, "could not load handoff state")
+		}
+		if ok {
+			priv, err := crypto.UnmarshalPrivateKey(handoffState.PrivateKey)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal handoff peer identity: %w", err)
+			}
+			log.Info("importing handoff state", "keys", len(handoffState.Keys), "age", time.Since(handoffState.Timestamp).String())
+			routerOpts = append(routerOpts, routing.WithIdentity(priv))
+		}
+	}
+	router, err := routing.NewP2PRouter(ctx, args.RouterAddr, bootstrapper, registryPort, keySchemas, routerOpts...)
+	if err != nil {
+		return err
+	}
+	p2pRouter, ok := router.(*routing.P2PRouter)
+	if !ok && (args.DataTransport == "p2p" || args.HandoffPath != "") {
+		return fmt.Errorf("p2p data transport and handoff require the p2p router")
+	}
+	var recorder *handoff.Recorder
+	var handoffCS kubernetes.Interface
+	trackRouter := router
+	if args.HandoffPath != "" {
+		if args.HandoffNodeName == "" {
+			return fmt.Errorf("handoff node name has to be set when handoff is enabled")
+		}
+		handoffCS, err = pkgkubernetes.GetKubernetesClientset(args.KubeconfigPath)
+		if err != nil {
+			return err
+		}
+		recorder = handoff.NewRecorder(router, args.RouterKeyTTL)
+		trackRouter = recorder
+	}
+	if len(handoffState.Keys) > 0 {
+		// Imported keys are advertised before all images have been listed, keys of images removed since expire with the key TTL.
+		g.Go(func() error {
+			err := trackRouter.Advertise(ctx, handoffState.Keys)
+			if err != nil {
+				log.Error(err, "could not advertise handoff keys")
+			}
+			return nil
+		})
+	}
+	allowList := allowlist.NewAllowList(allowlist.WithFilter(filter))
+	if args.AllowListConfigMapName != "" {
+		cs, err := pkgkubernetes.GetKubernetesClientset(args.KubeconfigPath)
+		if err != nil {
+			return err
+		}
+		g.Go(func() error {
+			return allowlist.Watch(ctx, cs, args.AllowListConfigMapNamespace, args.AllowListConfigMapName, allowList)
+		})
+	}
+	var pressure *diskpressure.Detector
+	if args.DiskPressureInterval > 0 {
+		if args.DiskPressureThreshold <= 0 || args.DiskPressureThreshold > 1 {
+			return fmt.Errorf("disk pressure threshold has to be larger than zero and at most one")
+		}
+		var cs kubernetes.Interface
+		if args.DiskPressureNodeName != "" {
+			cs, err = pkgkubernetes.GetKubernetesClientset(args.KubeconfigPath)
+			if err != nil {
+				return err
+			}
+		}
+		pressure = diskpressure.NewDetector()
+		g.Go(func() error {
+			pressure.Run(ctx, args.DiskPressureInterval, args.DiskPressurePath, args.DiskPressureThreshold, cs, args.DiskPressureNodeName)
+			return nil
+		})
+	}
+	if args.WarmUpReadyRatio < 0 || args.WarmUpReadyRatio > 1 {
+		return fmt.Errorf("warm up ready ratio has to be between zero and one")
+	}
+	var warmUp *state.WarmUp
+	if args.WarmUpReadyRatio > 0 || args.AdvertiseRecentFirst {
+		warmUp = state.NewWarmUp(args.WarmUpReadyRatio, args.AdvertiseRecentFirst)
+	}
 	g.Go(func() error {
-		<-ctx.Done()
-		return router.Close()
-	})
-	g.Go(func() error {
-		state.Track(ctx, ociClient, router, args.ResolveLatestTag)
+		state.Track(ctx, ociClient, trackRouter, args.RouterKeyTTL, args.StateReconcileInterval, oci.ResolveTags{Default: args.ResolveTags, Overrides: args.RegistryResolveTags}, args.ResolveLatestTag, allowList, pressure, warmUp)
 		return nil
 	})
 
-	reg := registry.NewRegistry(ociClient, router, args.LocalAddr, args.MirrorResolveRetries, args.MirrorResolveTimeout, args.ResolveLatestTag)
+	if args.ImagePrefetchNodeName != "" {
+		cs, err := pkgkubernetes.GetKubernetesClientset(args.KubeconfigPath)
+		if err != nil {
+			return err
+		}
+		dc, err := getDynamicClient(args.KubeconfigPath)
+		if err != nil {
+			return err
+		}
+		controller := imageprefetch.NewController(dc, cs, ociClient, args.ImagePrefetchNodeName)
+		g.Go(func() error {
+			return controller.Run(ctx)
+		})
+	}
+
+	if args.CacheValueInterval > 0 {
+		var annotator *cachevalue.Annotator
+		if args.CacheValueNodeName != "" {
+			cs, err := pkgkubernetes.GetKubernetesClientset(args.KubeconfigPath)
+			if err != nil {
+				return err
+			}
+			annotator = cachevalue.NewAnnotator(cs, args.CacheValueNodeName, args.CacheValueScaleDownThreshold)
+		}
+		g.Go(func() error {
+			cachevalue.Run(ctx, ociClient, router, allowList, args.CacheValueInterval, args.MirrorResolveTimeout, annotator)
+			return nil
+		})
+	}
+
+	regOpts := []registry.Option{
+		registry.WithAllowList(allowList),
+		registry.WithResolveTags(oci.ResolveTags{Default: args.ResolveTags, Overrides: args.RegistryResolveTags}),
+		registry.WithMaxHops(args.MirrorMaxHops),
+		registry.WithTransferTimeouts(args.MirrorDialTimeout, args.MirrorFirstByteTimeout, args.MirrorTransferTimeout),
+		registry.WithResolveTimeouts(args.ResolveTimeoutManifest, args.ResolveTimeoutBlob, args.ResolveTimeoutAttempt),
+	}
+	if len(args.RegistryRewrites) > 0 {
+		rewritePolicy, err := registry.NewRewritePolicy(args.RegistryRewrites)
+		if err != nil {
+			return err
+		}
+		regOpts = append(regOpts, registry.WithPolicies(rewritePolicy))
+	}
+	if len(args.Policies) > 0 {
+		regOpts = append(regOpts, registry.WithPolicies(args.Policies...))
+	}
+	if args.MirrorChunkSize > 0 {
+		regOpts = append(regOpts, registry.WithChunkedFetch(args.MirrorChunkSize, args.MirrorChunkParallelism))
+	}
+	if len(args.LocalCIDRs) > 0 {
+		values := args.LocalCIDRs
+		if args.NodeIP != "" {
+			values = append(values, args.NodeIP)
+		}
+		cidrs, err := registry.ParseCIDRs(values)
+		if err != nil {
+			return err
+		}
+		regOpts = append(regOpts, registry.WithLocalCIDRs(cidrs))
+	}
+	if args.MirrorExternalDelegation {
+		regOpts = append(regOpts, registry.WithExternalDelegation())
+	}
+	tokenVerifier, tokenSource, err := getBearerAuth(args)
+	if err != nil {
+		return err
+	}
+	if tokenVerifier != nil {
+		regOpts = append(regOpts, registry.WithBearerAuth(tokenVerifier, tokenSource))
+	}
+	if args.PushToken != "" {
+		if args.PushRegistry == "" {
+			return fmt.Errorf("push registry has to be set when pushing is enabled")
+		}
+		regOpts = append(regOpts, registry.WithPush(ociClient, args.PushToken, args.PushRegistry))
+	}
+	if args.PrefetchToken != "" {
+		regOpts = append(regOpts, registry.WithPrefetch(args.PrefetchToken))
+	}
+	if args.ExistsAPIToken != "" {
+		regOpts = append(regOpts, registry.WithExistsAPI(args.ExistsAPIToken))
+	}
+	if args.DebugToken != "" {
+		regOpts = append(regOpts, registry.WithDebug(args.DebugToken))
+		if gatherer, ok := router.(registry.StatsGatherer); ok {
+			regOpts = append(regOpts, registry.WithClusterStats(gatherer))
+		}
+	}
+	if len(args.ServeQuotas) > 0 {
+		regOpts = append(regOpts, registry.WithServeQuota(args.ServeQuotas, args.ServeQuotaInterval))
+	}
+	if args.ServingMaxTransfers > 0 || args.ServingMaxBytesPerSecond > 0 {
+		regOpts = append(regOpts, registry.WithServingCapacity(args.ServingMaxTransfers, args.ServingMaxBytesPerSecond))
+	}
+	if args.ThrottleBytesPerSecond > 0 {
+		regOpts = append(regOpts, registry.WithThrottle(args.ThrottleBytesPerSecond))
+	}
+	if ledger != nil {
+		regOpts = append(regOpts, registry.WithChargeback(ledger))
+	}
+	if warmUp != nil {
+		regOpts = append(regOpts, registry.WithWarmUp(warmUp))
+	}
+	if pressure != nil {
+		regOpts = append(regOpts, registry.WithDiskPressure(pressure))
+	}
+	if args.AuditOTLPEndpoint != "" {
+		exporter, err := audit.NewOTLPExporter(args.AuditOTLPEndpoint, args.AuditOTLPHeaders, args.AuditOTLPInterval)
+		if err != nil {
+			return err
+		}
+		g.Go(func() error {
+			return exporter.Run(ctx)
+		})
+		regOpts = append(regOpts, registry.WithAuditExporter(exporter))
+	}
+	if args.VerifyBlobs {
+		regOpts = append(regOpts, registry.WithBlobVerification())
+	}
+	if args.AccessLogSampleRate < 0 || args.AccessLogSampleRate > 1 {
+		return fmt.Errorf("access log sample rate has to be between zero and one")
+	}
+	if args.AccessLogSampleRate < 1 {
+		regOpts = append(regOpts, registry.WithAccessLogSampling(args.AccessLogSampleRate))
+	}
+	if args.MirrorShadowSampleRate < 0 || args.MirrorShadowSampleRate > 1 {
+		return fmt.Errorf("mirror shadow sample rate has to be between zero and one")
+	}
+	if args.MirrorShadowSampleRate > 0 {
+		regOpts = append(regOpts, registry.WithShadowSampling(args.MirrorShadowSampleRate))
+	}
+	if args.MirrorPrewarmPoolSize > 0 {
+		regOpts = append(regOpts, registry.WithConnectionPrewarming(args.MirrorPrewarmPoolSize, args.MirrorPrewarmInterval))
+	}
+	if args.MirrorBackoffThreshold > 0 {
+		regOpts = append(regOpts, registry.WithPeerBackoff(args.MirrorBackoffThreshold, args.MirrorBackoff, args.MirrorMaxBackoff))
+	}
+	if args.MirrorHTTP2 {
+		regOpts = append(regOpts, registry.WithHTTP2())
+	}
+	if args.DataTransport == "p2p" {
+		regOpts = append(regOpts, registry.WithStreamTransport(p2pRouter))
+	} else if args.MirrorVerifyIdentity {
+		regOpts = append(regOpts, registry.WithPeerIdentity(p2pRouter))
+	}
+	if args.BlobReadAheadSize > 0 {
+		regOpts = append(regOpts, registry.WithReadAhead(args.BlobReadAheadSize))
+	}
+	if args.LocalCacheSize > 0 {
+		regOpts = append(regOpts, registry.WithCache(args.LocalCacheSize, args.LocalCacheMaxBlobSize))
+	}
+	regOpts = append(regOpts, registry.WithReadinessChecks(
+		registry.ReadinessCheck{Name: "containerd", Check: ociClient.Ping},
+		registry.ReadinessCheck{Name: "mirror_configuration", Check: ociClient.Verify},
+	))
+	if p2pRouter != nil && args.MirrorLatencyRankingWindow > 0 {
+		regOpts = append(regOpts, registry.WithLatencyObserver(p2pRouter))
+	}
+	if p2pRouter != nil {
+		regOpts = append(regOpts, registry.WithReadinessChecks(registry.ReadinessCheck{Name: "advertisement", Check: func(_ context.Context) error {
+			// Keys are not advertised on purpose while the node is under disk pressure.
+			if pressure.Pressured() {
+				return nil
+			}
+			return p2pRouter.VerifyAdvertisement()
+		}}))
+	}
+	// Withdrawn keys are removed through the recorder so that they are not handed off.
+	reg := registry.NewRegistry(ociClient, trackRouter, args.LocalAddr, args.MirrorResolveRetries, args.MirrorResolveTimeout, args.ResolveLatestTag, regOpts...)
 	regSrv := reg.Server(args.RegistryAddr, log)
+	if args.MirrorPrewarmPoolSize > 0 {
+		g.Go(func() error {
+			reg.PrewarmConnections(ctx)
+			return nil
+		})
+	}
+	if args.CanaryInterval > 0 {
+		g.Go(func() error {
+			reg.RunCanary(ctx, args.CanaryInterval, args.MirrorResolveTimeout)
+			return nil
+		})
+	}
+	if args.ConfigPath != "" {
+		g.Go(func() error {
+			return config.Watch(ctx, args.ConfigPath, func(cfg config.Config) {
+				reloaded := flagArgs
+				err := applyRegistryConfig(&reloaded, cfg)
+				if err != nil {
+					log.Error(err, "could not apply reloaded configuration")
+					return
+				}
+				if len(reloaded.Registries) == 0 && !reloaded.MirrorAllRegistries {
+					log.Error(errors.New("registries have to be set when not mirroring all registries"), "could not apply reloaded configuration")
+					return
+				}
+				if len(reloaded.MirrorRegistries) > 0 {
+					mirrorRegistries := reloaded.MirrorRegistries
+					if reloaded.MirrorHostname != "" {
+						mirrorRegistries = oci.ReplaceLoopbackHost(mirrorRegistries, reloaded.MirrorHostname)
+					}
+					resolveTags := oci.ResolveTags{Default: reloaded.ResolveTags, Overrides: reloaded.RegistryResolveTags}
+					err := writeMirrorConfiguration(ctx, afero.NewOsFs(), reloaded.MirrorConfigFormat, reloaded.ContainerdRegistryConfigPath, reloaded.RegistriesConfPath, reloaded.Registries, mirrorRegistries, resolveTags, reloaded.RegistryServers, reloaded.MirrorAllRegistries)
+					if err != nil {
+						log.Error(err, "could not write reloaded mirror configuration")
+						return
+					}
+				}
+				ociClient.SetRegistries(filterRegistries(&reloaded))
+				reg.SetResolveSettings(reloaded.MirrorResolveRetries, reloaded.MirrorResolveTimeout, reloaded.ResolveLatestTag)
+				if ledger != nil {
+					ledger.SetTeams(reloaded.ChargebackTeams)
+				}
+			})
+		})
+	}
 	g.Go(func() error {
 		if err := regSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return err
 		}
 		return nil
 	})
+	if args.DataTransport == "p2p" {
+		// Requests from peers are served on streams while Containerd keeps using the registry address.
+		g.Go(func() error {
+			if err := regSrv.Serve(p2pRouter.Listen()); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
 	g.Go(func() error {
 		<-ctx.Done()
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		// Context has been cancelled at this point so new contexts are created for shutdown.
+		// Departing has its own timeout so that a slow departure does not use up the time to drain requests.
+		departCtx, cancelDepart := context.WithTimeout(logr.NewContext(context.Background(), log), args.ShutdownDepartTimeout)
+		defer cancelDepart()
+		// Peers are told to stop resolving to this node before in-flight requests are drained.
+		// When handing off, peers keep resolving to the identity which is imported by the replacing pod.
+		// State is only handed off on restarts, a drained or removed node is not replaced and departs.
+		handedOff := false
+		if args.HandoffPath != "" && !nodeLeaving(departCtx, log, handoffCS, args.HandoffNodeName) {
+			handedOff = handOff(log, p2pRouter, recorder, args.HandoffPath)
+		}
+		if !handedOff {
+			err := router.Depart(departCtx)
+			if err != nil {
+				log.Error(err, "could not announce departure to all peers")
+			}
+		}
+		cancelDepart()
+		shutdownCtx, cancel := context.WithTimeout(logr.NewContext(context.Background(), log), args.ShutdownDrainTimeout)
 		defer cancel()
-		return regSrv.Shutdown(shutdownCtx)
+		err = errors.Join(regSrv.Shutdown(shutdownCtx), reg.Drain(shutdownCtx))
+		if err != nil {
+			return errors.Join(err, router.Close())
+		}
+		return router.Close()
 	})
 
 	log.Info("running registry", "addr", args.RegistryAddr)
@@ -171,5 +1136,286 @@ func registryCommand(ctx context.Context, args *RegistryCmd) (err error) {
 	if err != nil {
 		return err
 	}
+	if args.MirrorConfigCleanup {
+		// Context has been cancelled at this point so a new context is created for cleanup.
+		err := cleanupMirrorConfiguration(logr.NewContext(context.Background(), log), afero.NewOsFs(), args.MirrorConfigFormat, args.ContainerdRegistryConfigPath, args.RegistriesConfPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveMetrics serves metrics together with the handlers of the mux on the metrics address until the context is cancelled.
+// Metrics are served on their own address so that they are never exposed on the registry port.
+func serveMetrics(ctx context.Context, g *errgroup.Group, addr string, mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	g.Go(func() error {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+	g.Go(func() error {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	})
+}
+
+// filterRegistries returns the registries that images are filtered by, no registries matches images from all registries.
+func filterRegistries(args *RegistryCmd) []url.URL {
+	if args.MirrorAllRegistries {
+		return nil
+	}
+	return args.Registries
+}
+
+func getBearerAuth(args *RegistryCmd) (registry.TokenVerifier, registry.TokenSource, error) {
+	if args.MirrorAuth != "" && len(args.LocalCIDRs) == 0 {
+		return nil, nil, fmt.Errorf("local CIDRs have to be set when mirror auth is enabled")
+	}
+	switch args.MirrorAuth {
+	case "":
+		return nil, nil, nil
+	case "shared-secret":
+		if args.MirrorAuthSecretPath == "" {
+			return nil, nil, fmt.Errorf("mirror auth secret path has to be set when using shared secret authentication")
+		}
+		auth, err := registry.LoadSharedSecretAuth(args.MirrorAuthSecretPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return auth, auth, nil
+	case "token-review":
+		cs, err := pkgkubernetes.GetKubernetesClientset(args.KubeconfigPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		verifier, err := registry.NewTokenReviewVerifier(cs, args.MirrorAuthAudiences)
+		if err != nil {
+			return nil, nil, err
+		}
+		return verifier, registry.NewFileTokenSource(args.MirrorAuthTokenPath), nil
+	default:
+		return nil, nil, fmt.Errorf("unknown mirror auth %s", args.MirrorAuth)
+	}
+}
+
+func getBootstrapper(args *RegistryCmd) (routing.Bootstrapper, error) {
+	switch args.BootstrapKind {
+	case "kubernetes":
+		cs, err := pkgkubernetes.GetKubernetesClientset(args.KubeconfigPath)
+		if err != nil {
+			return nil, err
+		}
+		return routing.NewKubernetesBootstrapper(cs, args.LeaderElectionNamespace, args.LeaderElectionName), nil
+	case "endpointslice":
+		cs, err := pkgkubernetes.GetKubernetesClientset(args.KubeconfigPath)
+		if err != nil {
+			return nil, err
+		}
+		return routing.NewEndpointSliceBootstrapper(cs, args.EndpointSliceNamespace, args.EndpointSliceServiceName), nil
+	case "dns":
+		if args.DNSBootstrapName == "" {
+			return nil, fmt.Errorf("dns bootstrap name has to be set when using dns bootstrapper")
+		}
+		return routing.NewDNSBootstrapper(args.DNSBootstrapName, args.DNSBootstrapService, args.DNSBootstrapProto, args.DNSBootstrapRefreshInterval), nil
+	default:
+		return nil, fmt.Errorf("unknown bootstrap kind %s", args.BootstrapKind)
+	}
+}
+
+func applyConfigurationConfig(args *ConfigurationCmd, cfg config.Config) error {
+	if len(cfg.Registries) > 0 {
+		registries, err := config.ParseURLs(cfg.Registries)
+		if err != nil {
+			return err
+		}
+		args.Registries = registries
+	}
+	if len(cfg.MirrorRegistries) > 0 {
+		mirrorRegistries, err := config.ParseURLs(cfg.MirrorRegistries)
+		if err != nil {
+			return err
+		}
+		args.MirrorRegistries = mirrorRegistries
+	}
+	if cfg.ResolveTags != nil {
+		args.ResolveTags = *cfg.ResolveTags
+	}
+	if len(cfg.RegistryResolveTags) > 0 {
+		args.RegistryResolveTags = cfg.RegistryResolveTags
+	}
+	if len(cfg.RegistryServers) > 0 {
+		args.RegistryServers = cfg.RegistryServers
+	}
+	return nil
+}
+
+// nodeStats summarizes the metrics of the node, which are shared with peers to aggregate stats of the cluster.
+func nodeStats() (routing.Stats, error) {
+	stats := routing.Stats{}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		stats.Version = info.Main.Version
+	}
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return stats, err
+	}
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "spegel_advertised_keys":
+			for _, m := range mf.GetMetric() {
+				stats.AdvertisedKeys += m.GetGauge().GetValue()
+			}
+		case "spegel_mirror_requests_total":
+			for _, m := range mf.GetMetric() {
+				stats.MirrorRequests += m.GetCounter().GetValue()
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "cache" && l.GetValue() == "hit" {
+						stats.MirrorHits += m.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+	}
+	return stats, nil
+}
+
+// getEventRecorder returns a recorder emitting events on the node and pod, it returns nil when neither is set.
+func getEventRecorder(kubeconfigPath, nodeName, podNamespace, podName string) (*spegelkubernetes.EventRecorder, error) {
+	if nodeName == "" && podName == "" {
+		return nil, nil
+	}
+	cs, err := pkgkubernetes.GetKubernetesClientset(kubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+	return spegelkubernetes.NewEventRecorder(cs, nodeName, podNamespace, podName), nil
+}
+
+// nodeLeaving returns true if the node is leaving the cluster, or if it can not be determined whether it is.
+func nodeLeaving(ctx context.Context, log logr.Logger, cs kubernetes.Interface, nodeName string) bool {
+	leaving, err := spegelkubernetes.NodeLeaving(ctx, cs, nodeName)
+	if err != nil {
+		log.Error(err, "could not check if node is leaving", "node", nodeName)
+		return true
+	}
+	return leaving
+}
+
+// handOff writes the peer identity and advertised keys for the pod replacing this pod, it returns false if the state could not be written.
+func handOff(log logr.Logger, router *routing.P2PRouter, recorder *handoff.Recorder, path string) bool {
+	priv, err := router.HandOff()
+	if err != nil {
+		log.Error(err, "could not hand off peer identity")
+		return false
+	}
+	b, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		log.Error(err, "could not marshal peer identity")
+		return false
+	}
+	keys := recorder.Keys()
+	err = handoff.Save(path, handoff.State{Timestamp: time.Now(), PrivateKey: b, Keys: keys})
+	if err != nil {
+		log.Error(err, "could not save handoff state")
+		return false
+	}
+	log.Info("handed off state", "path", path, "keys", len(keys))
+	return true
+}
+
+func getDynamicClient(kubeconfigPath string) (dynamic.Interface, error) {
+	if kubeconfigPath != "" {
+		cfg, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+		if err != nil {
+			return nil, err
+		}
+		return dynamic.NewForConfig(cfg)
+	}
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(cfg)
+}
+
+// applyRuntimeFlavor replaces the Containerd flags that are left at their standard defaults with the paths of the runtime flavor.
+func applyRuntimeFlavor(flavor string, sock, namespace, registryConfigPath *string) (oci.RuntimePaths, error) {
+	paths, err := oci.GetRuntimePaths(oci.RuntimeFlavor(flavor))
+	if err != nil {
+		return oci.RuntimePaths{}, err
+	}
+	standard, err := oci.GetRuntimePaths(oci.RuntimeFlavorStandard)
+	if err != nil {
+		return oci.RuntimePaths{}, err
+	}
+	for _, v := range []struct {
+		arg      *string
+		standard string
+		flavor   string
+	}{
+		{sock, standard.Sock, paths.Sock},
+		{namespace, standard.Namespace, paths.Namespace},
+		{registryConfigPath, standard.RegistryConfigPath, paths.RegistryConfigPath},
+	} {
+		if v.arg != nil && *v.arg == v.standard {
+			*v.arg = v.flavor
+		}
+	}
+	return paths, nil
+}
+
+// applyRegistryConfig overrides the arguments with the values set in the configuration.
+// Only registries, mirror configuration, resolve settings and chargeback teams are applied when the configuration is reloaded, other fields require a restart.
+func applyRegistryConfig(args *RegistryCmd, cfg config.Config) error {
+	if len(cfg.Registries) > 0 {
+		registries, err := config.ParseURLs(cfg.Registries)
+		if err != nil {
+			return err
+		}
+		args.Registries = registries
+	}
+	if len(cfg.MirrorRegistries) > 0 {
+		mirrorRegistries, err := config.ParseURLs(cfg.MirrorRegistries)
+		if err != nil {
+			return err
+		}
+		args.MirrorRegistries = mirrorRegistries
+	}
+	if len(cfg.RegistryServers) > 0 {
+		args.RegistryServers = cfg.RegistryServers
+	}
+	if cfg.ResolveTags != nil {
+		args.ResolveTags = *cfg.ResolveTags
+	}
+	if len(cfg.RegistryResolveTags) > 0 {
+		args.RegistryResolveTags = cfg.RegistryResolveTags
+	}
+	if cfg.ResolveLatestTag != nil {
+		args.ResolveLatestTag = *cfg.ResolveLatestTag
+	}
+	if cfg.MirrorResolveRetries != nil {
+		args.MirrorResolveRetries = *cfg.MirrorResolveRetries
+	}
+	if cfg.MirrorResolveTimeout != nil {
+		args.MirrorResolveTimeout = cfg.MirrorResolveTimeout.Duration
+	}
+	if len(cfg.RouterKeySchemas) > 0 {
+		args.RouterKeySchemas = cfg.RouterKeySchemas
+	}
+	if len(cfg.ChargebackTeams) > 0 {
+		args.ChargebackTeams = cfg.ChargebackTeams
+	}
+	if len(cfg.ContainerdImageFilters) > 0 {
+		args.ContainerdImageFilters = cfg.ContainerdImageFilters
+	}
 	return nil
 }